@@ -0,0 +1,164 @@
+package network
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// Addresses
+//==========
+
+type AddressType int
+
+const (
+	P2PKH          AddressType = iota + 1 // pay to public key hash (base58)
+	P2SH                                  // pay to script hash (base58)
+	P2WPKH                                // pay to witness public key hash (bech32)
+	P2WSH                                 // pay to witness script hash (bech32)
+	P2TR                                  // pay to taproot (bech32m)
+	WitnessUnknown                        // future witness versions (bech32m)
+)
+
+func (t AddressType) String() string {
+	switch t {
+	case P2PKH:
+		return "p2pkh"
+	case P2SH:
+		return "p2sh"
+	case P2WPKH:
+		return "p2wpkh"
+	case P2WSH:
+		return "p2wsh"
+	case P2TR:
+		return "p2tr"
+	case WitnessUnknown:
+		return "witness_unknown"
+	}
+	return fmt.Sprintf("AddressType(%d)", int(t))
+}
+
+// Address is the destination of an output. Hash is the key or script hash
+// for base58 addresses and the witness program for segwit addresses.
+type Address struct {
+	Type    AddressType
+	Version byte // witness version (segwit addresses only)
+	Hash    []byte
+}
+
+var ErrInvalidAddress = errors.New("invalid address")
+
+// NewP2PKHAddress creates the address paying to the serialized public key
+func NewP2PKHAddress(pubKey []byte) *Address {
+	return &Address{Type: P2PKH, Hash: Hash160(pubKey)}
+}
+
+// NewP2SHAddress creates the address paying to the redeem script
+func NewP2SHAddress(script []byte) *Address {
+	return &Address{Type: P2SH, Hash: Hash160(script)}
+}
+
+// NewP2WPKHAddress creates the segwit address paying to the compressed
+// public key
+func NewP2WPKHAddress(pubKey []byte) *Address {
+	return &Address{Type: P2WPKH, Hash: Hash160(pubKey)}
+}
+
+// NewP2WSHAddress creates the segwit address paying to the witness script
+func NewP2WSHAddress(script []byte) *Address {
+	hash := sha256.Sum256(script)
+	return &Address{Type: P2WSH, Hash: hash[:]}
+}
+
+// NewP2TRAddress creates the taproot address paying to the output key (see
+// TweakPublicKey)
+func NewP2TRAddress(outputKey *PublicKey) *Address {
+	return &Address{Type: P2TR, Version: 1, Hash: outputKey.SerializeXOnly()}
+}
+
+// DecodeAddress parses a base58 or segwit address for the network
+func DecodeAddress(s string, params *ChainParams) (*Address, error) {
+	hrp, _, _, err := Bech32Decode(s)
+	if err == nil && hrp == params.Bech32HRP {
+		version, program, err := DecodeSegwitAddress(params.Bech32HRP, s)
+		if err != nil {
+			return nil, err
+		}
+		return witnessAddress(version, program), nil
+	}
+
+	version, hash, err := Base58CheckDecode(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(hash) != 20 {
+		return nil, fmt.Errorf("%w: hash length %d", ErrInvalidAddress, len(hash))
+	}
+	switch version {
+	case params.PubKeyHashAddrID:
+		return &Address{Type: P2PKH, Hash: hash}, nil
+	case params.ScriptHashAddrID:
+		return &Address{Type: P2SH, Hash: hash}, nil
+	}
+	return nil, fmt.Errorf("%w: version 0x%02x is not for network '%s'", ErrInvalidAddress, version, params.Name)
+}
+
+func witnessAddress(version byte, program []byte) *Address {
+	a := &Address{Type: WitnessUnknown, Version: version, Hash: program}
+	switch {
+	case version == 0 && len(program) == 20:
+		a.Type = P2WPKH
+	case version == 0 && len(program) == 32:
+		a.Type = P2WSH
+	case version == 1 && len(program) == 32:
+		a.Type = P2TR
+	}
+	return a
+}
+
+// Encode renders the address for the network
+func (a *Address) Encode(params *ChainParams) (string, error) {
+	switch a.Type {
+	case P2PKH:
+		return Base58CheckEncode(params.PubKeyHashAddrID, a.Hash), nil
+	case P2SH:
+		return Base58CheckEncode(params.ScriptHashAddrID, a.Hash), nil
+	}
+	return EncodeSegwitAddress(params.Bech32HRP, a.Version, a.Hash)
+}
+
+// Script returns the scriptPubKey paying to the address
+func (a *Address) Script() []byte {
+	switch a.Type {
+	case P2PKH:
+		// OP_DUP OP_HASH160 <hash> OP_EQUALVERIFY OP_CHECKSIG
+		out := append([]byte{OP_DUP, OP_HASH160, 20}, a.Hash...)
+		return append(out, OP_EQUALVERIFY, OP_CHECKSIG)
+	case P2SH:
+		// OP_HASH160 <hash> OP_EQUAL
+		out := append([]byte{OP_HASH160, 20}, a.Hash...)
+		return append(out, OP_EQUAL)
+	}
+	// OP_n <program>
+	version := a.Version
+	if version > 0 {
+		version += OP_1 - 1
+	}
+	return append([]byte{version, byte(len(a.Hash))}, a.Hash...)
+}
+
+// AddressFromScript returns the address a scriptPubKey pays to. Scripts
+// which have no address (like bare multisig or OP_RETURN) give an error.
+func AddressFromScript(script []byte) (*Address, error) {
+	class, solutions := ClassifyScript(script)
+	switch class {
+	case PubKeyHashTy:
+		return &Address{Type: P2PKH, Hash: solutions[0]}, nil
+	case ScriptHashTy:
+		return &Address{Type: P2SH, Hash: solutions[0]}, nil
+	}
+	if version, program, ok := IsWitnessProgram(script); ok {
+		return witnessAddress(version, program), nil
+	}
+	return nil, fmt.Errorf("%w: script %x has no address", ErrInvalidAddress, script)
+}
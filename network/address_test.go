@@ -0,0 +1,107 @@
+package network
+
+import (
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestAlertKeyAddress(t *testing.T) {
+	key, _ := PublicKeyFromString(ALERT_PUBKEY)
+	addr, err := NewP2PKHAddress(key.SerializeUncompressed()).Encode(&MainNetParams)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if addr != "1AGRxqDa5WjUKBwHB9XYEjmkv1ucoUUy1s" {
+		t.Errorf("Wrong alert key address %s", addr)
+	}
+}
+
+func TestSegwitAddresses(t *testing.T) {
+	// Valid addresses from BIP173 and BIP350 with their scriptPubKey
+	tests := []struct {
+		addr   string
+		params *ChainParams
+		script string
+		typ    AddressType
+	}{
+		{"BC1QW508D6QEJXTDG4Y5R3ZARVARY0C5XW7KV8F3T4", &MainNetParams, "0014751e76e8199196d454941c45d1b3a323f1433bd6", P2WPKH},
+		{"tb1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3q0sl5k7", &TestNet3Params, "00201863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262", P2WSH},
+		{"bc1pw508d6qejxtdg4y5r3zarvary0c5xw7kw508d6qejxtdg4y5r3zarvary0c5xw7kt5nd6y", &MainNetParams, "5128751e76e8199196d454941c45d1b3a323f1433bd6751e76e8199196d454941c45d1b3a323f1433bd6", WitnessUnknown},
+		{"BC1SW50QGDZ25J", &MainNetParams, "6002751e", WitnessUnknown},
+		{"bc1zw508d6qejxtdg4y5r3zarvaryvaxxpcs", &MainNetParams, "5210751e76e8199196d454941c45d1b3a323", WitnessUnknown},
+		{"tb1pqqqqp399et2xygdj5xreqhjjvcmzhxw4aywxecjdzew6hylgvsesf3hn0c", &TestNet3Params, "5120000000c4a5cad46221b2a187905e5266362b99d5e91c6ce24d165dab93e86433", P2TR},
+		{"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqzk5jj0", &MainNetParams, "512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798", P2TR},
+	}
+	for _, test := range tests {
+		addr, err := DecodeAddress(test.addr, test.params)
+		if err != nil {
+			t.Errorf("Unexpected error for %s: %v", test.addr, err)
+			continue
+		}
+		if addr.Type != test.typ || hex.EncodeToString(addr.Script()) != test.script {
+			t.Errorf("Wrong address %v for %s", addr, test.addr)
+		}
+		addr2, err := AddressFromScript(h2b(test.script))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if s, _ := addr2.Encode(test.params); s != strings.ToLower(test.addr) {
+			t.Errorf("Wrong encoding %s for %s", s, test.addr)
+		}
+	}
+
+	invalid := []string{
+		"bc1p0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vqh2y7hd", // version 1 with bech32 checksum
+		"BC1S0XLXVLHEMJA6C4DQV22UAPCTQUPFHLXM9H8Z3K2E72Q4K9HCZ7VQ54WELL", // version 16 with bech32 checksum
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kemeawh",                     // version 0 with bech32m checksum
+		"BC130XLXVLHEMJA6C4DQV22UAPCTQUPFHLXM9H8Z3K2E72Q4K9HCZ7VQ7ZWS8R", // version 17
+		"bc1pw5dgrnzv",                          // program too short
+		"bc1zw508d6qejxtdg4y5r3zarvaryvqyzf3du", // too much padding
+		"bc1gmk9yu",                             // empty data
+		"tb1q0xlxvlhemja6c4dqv22uapctqupfhlxm9h8z3k2e72q4k9hcz7vq47Zagq",      // mixed case
+		"tb1qw508d6qejxtdg4y5r3zarvary0c5xw7kxpjzsx",                          // wrong network
+		"bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t5",                          // bad checksum
+		"bc1qrp33g0q5c5txsp9arysrx4k6zdkfs4nce4xj0gdcccefvpysxf3qxxxxxxxxxxx", // too long for checksum
+	}
+	for _, s := range invalid {
+		if _, err := DecodeAddress(s, &MainNetParams); err == nil {
+			t.Errorf("Expected error for %s", s)
+		}
+	}
+}
+
+func TestBase58Addresses(t *testing.T) {
+	// The P2SH address of the redeem script OP_TRUE on regtest, and the
+	// P2PKH address for private key 1 (compressed)
+	p2sh := NewP2SHAddress([]byte{0x51})
+	s, _ := p2sh.Encode(&RegTestParams)
+	addr, err := DecodeAddress(s, &RegTestParams)
+	if err != nil || addr.Type != P2SH || hex.EncodeToString(addr.Script()) != "a914da1745e9b549bd0bfa1a569971c77eba30cd5a4b87" {
+		t.Errorf("Wrong P2SH address %s: %v (%v)", s, addr, err)
+	}
+	if _, err = DecodeAddress(s, &MainNetParams); !errors.Is(err, ErrInvalidAddress) {
+		t.Errorf("Expected error for wrong network, got %v", err)
+	}
+
+	key, _ := PrivateKeyFromBytes(h2b("0000000000000000000000000000000000000000000000000000000000000001"))
+	s, _ = NewP2PKHAddress(key.SerializePubKey()).Encode(&MainNetParams)
+	if s != "1BgGZ9tcN4rm9KBzDn7KprQz87SZ26SAMH" {
+		t.Errorf("Wrong P2PKH address %s", s)
+	}
+	s, _ = NewP2WPKHAddress(key.SerializePubKey()).Encode(&MainNetParams)
+	if s != "bc1qw508d6qejxtdg4y5r3zarvary0c5xw7kv8f3t4" {
+		t.Errorf("Wrong P2WPKH address %s", s)
+	}
+}
+
+func TestTaprootAddress(t *testing.T) {
+	// First scriptPubKey vector of the BIP341 wallet test vectors
+	internal, _ := ParseXOnlyPublicKey(h2b("d6889cb081036e0faefa3a35157ad71086b123b2b144b649798b494c300a961d"))
+	output, _, _ := TweakPublicKey(internal, nil)
+	s, err := NewP2TRAddress(output).Encode(&MainNetParams)
+	if err != nil || s != "bc1p2wsldez5mud2yam29q22wgfh9439spgduvct83k3pm50fcxa5dps59h4z5" {
+		t.Errorf("Wrong taproot address %s (%v)", s, err)
+	}
+}
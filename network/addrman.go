@@ -0,0 +1,720 @@
+package network
+
+import (
+	crand "crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Network groups
+//===============
+
+// Ranges that are not reachable over the internet: private, local,
+// reserved and documentation addresses
+var unroutableNets = parseCIDRs(
+	"0.0.0.0/8", "10.0.0.0/8", "100.64.0.0/10", "127.0.0.0/8", "169.254.0.0/16",
+	"172.16.0.0/12", "192.0.2.0/24", "192.168.0.0/16", "198.18.0.0/15",
+	"198.51.100.0/24", "203.0.113.0/24", "224.0.0.0/3",
+	"::/128", "::1/128", "2001:10::/28", "2001:20::/28", "2001:db8::/32",
+	"fc00::/7", "fe80::/64",
+)
+
+func parseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, nets[i], _ = net.ParseCIDR(cidr)
+	}
+	return nets
+}
+
+// IsRoutable tells whether ip is a public internet address
+func IsRoutable(ip net.IP) bool {
+	if len(ip) != net.IPv4len && len(ip) != net.IPv6len {
+		return false
+	}
+	for _, n := range unroutableNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// NetGroup returns the group of an address for bucketing: the /16 of IPv4
+// addresses and the /32 of IPv6 addresses. IPv4 addresses embedded in 6to4
+// and Teredo addresses are grouped like IPv4. All unroutable addresses
+// share one group. Nodes in the same group are likely run by the same
+// operator, so an attacker controlling many addresses gets few groups.
+func NetGroup(ip net.IP) []byte {
+	if !IsRoutable(ip) {
+		return []byte{0}
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return []byte{4, ip4[0], ip4[1]}
+	}
+	switch {
+	case ip[0] == 0x20 && ip[1] == 0x02: // 6to4, 2002:AABB:CCDD::/48
+		return []byte{4, ip[2], ip[3]}
+	case ip[0] == 0x20 && ip[1] == 0x01 && ip[2] == 0 && ip[3] == 0: // Teredo, 2001:0000::/32, IPv4 inverted
+		return []byte{4, ^ip[12], ^ip[13]}
+	}
+	return []byte{6, ip[0], ip[1], ip[2], ip[3]}
+}
+
+// netGroupOf returns the group of an address string, "" if it is not an
+// ip:port or not routable
+func netGroupOf(address string) string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return ""
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !IsRoutable(ip) {
+		return ""
+	}
+	return string(NetGroup(ip))
+}
+
+// Address manager
+//================
+
+const (
+	ADDRMAN_TRIED_BUCKET_COUNT           = 256
+	ADDRMAN_NEW_BUCKET_COUNT             = 1024
+	ADDRMAN_BUCKET_SIZE                  = 64
+	ADDRMAN_TRIED_BUCKETS_PER_GROUP      = 8  // tried buckets an address group can use
+	ADDRMAN_NEW_BUCKETS_PER_SOURCE_GROUP = 64 // new buckets the addresses from one source group can use
+
+	ADDRMAN_HORIZON         = 30 * 24 * time.Hour // addresses not seen for longer are terrible
+	ADDRMAN_RETRIES         = 3                   // failed attempts at an address that never worked
+	ADDRMAN_MAX_FAILURES    = 10                  // failed attempts since the last success...
+	ADDRMAN_MIN_FAIL        = 7 * 24 * time.Hour  // ...at least this long ago
+	ADDRMAN_GETADDR_MAX_PCT = 23                  // share of the addresses returned to getaddr
+
+	ADDR_TIME_PENALTY = 2 * time.Hour // set back the time of relayed addresses
+	ADDRMAN_VERSION   = 1             // version of the file format
+)
+
+var ErrAddrManFile = errors.New("corrupt address file")
+
+// lookupIP resolves DNS seeds and manual addresses, replaced in tests
+var lookupIP = net.LookupIP
+
+type addrInfo struct {
+	TimeNetAddr
+	key         string // ip:port
+	source      net.IP // the peer that told us about the address
+	lastTry     time.Time
+	lastSuccess time.Time
+	attempts    int // failed attempts since the last success
+	tried       bool
+}
+
+// AddrMan is an address book of nodes to connect to, modelled after the
+// addrman of Bitcoin Core. Addresses we only heard about are kept in the
+// new table, those we connected to in the tried table. Both are split in
+// buckets selected by a keyed hash of the network group of the address
+// (and, for new, of its source), so no single group can fill the tables.
+// It is safe for concurrent use and implements AddressSource.
+type AddrMan struct {
+	mutex      sync.Mutex
+	params     *ChainParams
+	path       string
+	key        [32]byte
+	infos      map[string]*addrInfo
+	new        [ADDRMAN_NEW_BUCKET_COUNT][ADDRMAN_BUCKET_SIZE]*addrInfo
+	tried      [ADDRMAN_TRIED_BUCKET_COUNT][ADDRMAN_BUCKET_SIZE]*addrInfo
+	newCount   int
+	triedCount int
+	rand       *rand.Rand
+	now        func() time.Time
+
+	// Manual addresses (ip:port) are kept apart from the tables, like the
+	// addnode list of Core, so local nodes are not filtered out
+	manual     []string
+	nextManual int
+	manualTurn bool
+}
+
+// NewAddrMan returns an empty address book that is not saved
+func NewAddrMan(params *ChainParams) *AddrMan {
+	am := &AddrMan{
+		params: params,
+		infos:  make(map[string]*addrInfo),
+		now:    time.Now,
+	}
+	crand.Read(am.key[:])
+	am.rand = rand.New(rand.NewSource(int64(binary.LittleEndian.Uint64(am.key[:8]))))
+	return am
+}
+
+// OpenAddrMan loads the address book saved at path, or returns an empty
+// one if there is no file yet. Save writes it back.
+func OpenAddrMan(path string, params *ChainParams) (*AddrMan, error) {
+	am := NewAddrMan(params)
+	am.path = path
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return am, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = am.unmarshal(data); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return am, nil
+}
+
+func addrKey(addr NetAddr) string {
+	return net.JoinHostPort(addr.IPAddr.String(), strconv.Itoa(int(addr.Port)))
+}
+
+// hash returns a hash of data keyed with the secret key of the address
+// book, so peers can't predict where their addresses end up
+func (am *AddrMan) hash(data ...[]byte) uint64 {
+	buf := append([]byte{}, am.key[:]...)
+	for _, d := range data {
+		buf = append(buf, d...)
+	}
+	digest := doubleHash(buf)
+	return binary.LittleEndian.Uint64(digest[:8])
+}
+
+func (am *AddrMan) triedBucket(info *addrInfo) int {
+	h := am.hash([]byte(info.key)) % ADDRMAN_TRIED_BUCKETS_PER_GROUP
+	return int(am.hash(NetGroup(info.IPAddr), MarshalUint64(nil, h)) % ADDRMAN_TRIED_BUCKET_COUNT)
+}
+
+func (am *AddrMan) newBucket(info *addrInfo) int {
+	sourceGroup := NetGroup(info.source)
+	h := am.hash(NetGroup(info.IPAddr), sourceGroup) % ADDRMAN_NEW_BUCKETS_PER_SOURCE_GROUP
+	return int(am.hash(sourceGroup, MarshalUint64(nil, h)) % ADDRMAN_NEW_BUCKET_COUNT)
+}
+
+func (am *AddrMan) bucketPosition(tried bool, bucket int, info *addrInfo) int {
+	table := []byte{'N'}
+	if tried {
+		table[0] = 'K'
+	}
+	return int(am.hash(table, MarshalUint32(nil, uint32(bucket)), []byte(info.key)) % ADDRMAN_BUCKET_SIZE)
+}
+
+// isTerrible tells whether an address is not worth keeping: too old, from
+// the future, or failing for too long
+func (am *AddrMan) isTerrible(info *addrInfo, now time.Time) bool {
+	switch {
+	case now.Sub(info.lastTry) < time.Minute:
+		return false // just tried, don't evict it while connecting
+	case info.Time.After(now.Add(10 * time.Minute)):
+		return true
+	case now.Sub(info.Time) > ADDRMAN_HORIZON:
+		return true
+	case info.lastSuccess.IsZero() && info.attempts >= ADDRMAN_RETRIES:
+		return true
+	case now.Sub(info.lastSuccess) > ADDRMAN_MIN_FAIL && info.attempts >= ADDRMAN_MAX_FAILURES:
+		return true
+	}
+	return false
+}
+
+// chance returns the relative chance of an address to be selected
+func (am *AddrMan) chance(info *addrInfo, now time.Time) float64 {
+	chance := 1.0
+	if now.Sub(info.lastTry) < 10*time.Minute {
+		chance *= 0.01
+	}
+	attempts := info.attempts
+	if attempts > 8 {
+		attempts = 8
+	}
+	return chance * math.Pow(0.66, float64(attempts))
+}
+
+// Add adds addresses learned from source (the peer that relayed them) to
+// the new table and returns how many were not known yet. Their time is set
+// back by penalty, unless the peer told about itself.
+func (am *AddrMan) Add(addrs []TimeNetAddr, source net.IP, penalty time.Duration) int {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	added := 0
+	for _, addr := range addrs {
+		if am.add(addr, source, penalty) {
+			added++
+		}
+	}
+	return added
+}
+
+func (am *AddrMan) add(addr TimeNetAddr, source net.IP, penalty time.Duration) bool {
+	if !IsRoutable(addr.IPAddr) {
+		return false
+	}
+	now := am.now()
+	if addr.IPAddr.Equal(source) {
+		penalty = 0
+	}
+	if addr.Time.Unix() <= 100000000 || addr.Time.After(now.Add(10*time.Minute)) {
+		addr.Time = now.Add(-5 * 24 * time.Hour)
+	}
+	addr.IPAddr = addr.IPAddr.To16()
+	key := addrKey(addr.NetAddr)
+
+	if info := am.infos[key]; info != nil {
+		// Update the time now and then, more often for nodes that are online
+		interval := 24 * time.Hour
+		if now.Sub(addr.Time) < 24*time.Hour {
+			interval = time.Hour
+		}
+		if info.Time.Before(addr.Time.Add(-interval - penalty)) {
+			info.Time = addr.Time.Add(-penalty)
+		}
+		info.Services |= addr.Services
+		return false
+	}
+
+	addr.Time = addr.Time.Add(-penalty)
+	info := &addrInfo{TimeNetAddr: addr, key: key, source: source}
+	bucket := am.newBucket(info)
+	pos := am.bucketPosition(false, bucket, info)
+	if other := am.new[bucket][pos]; other != nil {
+		if !am.isTerrible(other, now) {
+			return false
+		}
+		am.delete(other)
+	}
+	am.new[bucket][pos] = info
+	am.newCount++
+	am.infos[key] = info
+	return true
+}
+
+// delete removes an address of the new table
+func (am *AddrMan) delete(info *addrInfo) {
+	bucket := am.newBucket(info)
+	pos := am.bucketPosition(false, bucket, info)
+	am.new[bucket][pos] = nil
+	am.newCount--
+	delete(am.infos, info.key)
+}
+
+// Attempt records a connection attempt to address (ip:port)
+func (am *AddrMan) Attempt(address string) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	if info := am.infos[address]; info != nil {
+		info.lastTry = am.now()
+		info.attempts++
+	}
+}
+
+// Good records a successful connection to address (ip:port) and moves it
+// to the tried table. An address occupying its place there goes back to
+// the new table.
+func (am *AddrMan) Good(address string) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	info := am.infos[address]
+	if info == nil {
+		return
+	}
+	now := am.now()
+	info.Time = now
+	info.lastTry = now
+	info.lastSuccess = now
+	info.attempts = 0
+	if info.tried {
+		return
+	}
+
+	bucket := am.newBucket(info)
+	am.new[bucket][am.bucketPosition(false, bucket, info)] = nil
+	am.newCount--
+
+	bucket = am.triedBucket(info)
+	pos := am.bucketPosition(true, bucket, info)
+	if old := am.tried[bucket][pos]; old != nil {
+		am.tried[bucket][pos] = nil
+		am.triedCount--
+		old.tried = false
+		am.placeNew(old)
+	}
+	am.tried[bucket][pos] = info
+	am.triedCount++
+	info.tried = true
+}
+
+// placeNew puts an address known to the book into the new table, replacing
+// whatever is at its place
+func (am *AddrMan) placeNew(info *addrInfo) {
+	bucket := am.newBucket(info)
+	pos := am.bucketPosition(false, bucket, info)
+	if other := am.new[bucket][pos]; other != nil {
+		am.delete(other)
+	}
+	am.new[bucket][pos] = info
+	am.newCount++
+}
+
+// Select picks a random address, preferring those that did not fail
+// recently. With newOnly it picks only from the new table.
+func (am *AddrMan) Select(newOnly bool) (TimeNetAddr, bool) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	if am.newCount == 0 && (newOnly || am.triedCount == 0) {
+		return TimeNetAddr{}, false
+	}
+	tried := am.triedCount > 0 && !newOnly && (am.newCount == 0 || am.rand.Intn(2) == 0)
+	now := am.now()
+	factor := 1.0
+	for {
+		// Take the first address in a random bucket, starting at a random
+		// position
+		var info *addrInfo
+		start := am.rand.Intn(ADDRMAN_BUCKET_SIZE)
+		if tried {
+			bucket := &am.tried[am.rand.Intn(ADDRMAN_TRIED_BUCKET_COUNT)]
+			for i := 0; i < ADDRMAN_BUCKET_SIZE && info == nil; i++ {
+				info = bucket[(start+i)%ADDRMAN_BUCKET_SIZE]
+			}
+		} else {
+			bucket := &am.new[am.rand.Intn(ADDRMAN_NEW_BUCKET_COUNT)]
+			for i := 0; i < ADDRMAN_BUCKET_SIZE && info == nil; i++ {
+				info = bucket[(start+i)%ADDRMAN_BUCKET_SIZE]
+			}
+		}
+		if info == nil {
+			continue
+		}
+		if am.rand.Float64() < factor*am.chance(info, now) {
+			return info.TimeNetAddr, true
+		}
+		factor *= 1.2
+	}
+}
+
+// Candidate returns the ip:port of an address to connect to. Manual
+// addresses take turns with those of the tables, and are handed out alone
+// when the tables are empty.
+func (am *AddrMan) Candidate() (string, bool) {
+	am.mutex.Lock()
+	am.manualTurn = !am.manualTurn
+	manualTurn := am.manualTurn && len(am.manual) > 0
+	am.mutex.Unlock()
+	if !manualTurn {
+		if addr, ok := am.Select(false); ok {
+			return addrKey(addr.NetAddr), true
+		}
+	}
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	if len(am.manual) == 0 {
+		return "", false
+	}
+	address := am.manual[am.nextManual%len(am.manual)]
+	am.nextManual++
+	return address, true
+}
+
+// GetAddr returns up to maxPct percent of the addresses, but no more than
+// maxAddresses, in random order. Terrible addresses are left out.
+func (am *AddrMan) GetAddr(maxAddresses, maxPct int) []TimeNetAddr {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	count := len(am.infos) * maxPct / 100
+	if count > maxAddresses {
+		count = maxAddresses
+	}
+	infos := make([]*addrInfo, 0, len(am.infos))
+	for _, info := range am.infos {
+		infos = append(infos, info)
+	}
+	am.rand.Shuffle(len(infos), func(i, j int) { infos[i], infos[j] = infos[j], infos[i] })
+	now := am.now()
+	addrs := make([]TimeNetAddr, 0, count)
+	for _, info := range infos {
+		if len(addrs) == count {
+			break
+		}
+		if !am.isTerrible(info, now) {
+			addrs = append(addrs, info.TimeNetAddr)
+		}
+	}
+	return addrs
+}
+
+// Size returns the number of addresses in the new and the tried table
+func (am *AddrMan) Size() (int, int) {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	return am.newCount, am.triedCount
+}
+
+// Sources
+//========
+
+// AddSeeds looks up the DNS seeds of the network and adds the addresses
+// found. Like Core, their time is set a few days back, as the seeds don't
+// tell when the nodes were last seen. It returns how many were added. A
+// seed which fails doesn't stop the others, the error of the first one is
+// returned.
+func (am *AddrMan) AddSeeds() (int, error) {
+	added := 0
+	var firstErr error
+	for _, seed := range am.params.DNSSeeds {
+		ips, err := lookupIP(seed)
+		if err == nil && len(ips) == 0 {
+			err = errors.New("no addresses")
+		}
+		if err != nil {
+			if firstErr == nil {
+				firstErr = fmt.Errorf("DNS seed %s: %w", seed, err)
+			}
+			continue
+		}
+		added += am.addSeed(ips)
+	}
+	return added, firstErr
+}
+
+func (am *AddrMan) addSeed(ips []net.IP) int {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	added := 0
+	for _, ip := range ips {
+		age := time.Duration(3*24+am.rand.Intn(4*24)) * time.Hour
+		addr := TimeNetAddr{am.now().Add(-age), NetAddr{NODE_NETWORK | NODE_WITNESS, ip, uint16(am.params.DefaultPort)}}
+		if am.add(addr, ips[0], 0) {
+			added++
+		}
+	}
+	return added
+}
+
+// AddManual adds addresses given as host or host:port, the port defaulting
+// to the one of the network. Host names are resolved. The addresses are
+// handed out by Candidate even if they are not routable, e.g. a node on
+// the local host.
+func (am *AddrMan) AddManual(addresses []string) error {
+	for _, address := range addresses {
+		host, portStr, err := net.SplitHostPort(address)
+		if err != nil {
+			host, portStr = address, strconv.Itoa(am.params.DefaultPort)
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid port in address '%s'", address)
+		}
+		ips := []net.IP{net.ParseIP(host)}
+		if ips[0] == nil {
+			if ips, err = lookupIP(host); err != nil {
+				return err
+			}
+		}
+		am.mutex.Lock()
+		for _, ip := range ips {
+			key := addrKey(NetAddr{NODE_NETWORK, ip, uint16(port)})
+			if !containsString(am.manual, key) {
+				am.manual = append(am.manual, key)
+			}
+		}
+		am.mutex.Unlock()
+	}
+	return nil
+}
+
+// Attach subscribes the address book to the messages of the peer manager:
+// addresses from addr messages are added, getaddr from inbound peers is
+// answered once per connection, and outbound peers are asked for
+// addresses after the handshake. It must be called before Run.
+func (am *AddrMan) Attach(manager *PeerManager) {
+	onConnect := manager.OnConnect
+	manager.OnConnect = func(peer *Peer) {
+		if onConnect != nil {
+			onConnect(peer)
+		}
+		if !peer.Inbound {
+			manager.Send(peer, &GetAddrMessage{})
+		}
+	}
+	manager.Subscribe("", func(peer *Peer, msg Message) {
+		am.HandleMessage(manager, peer, msg)
+	})
+}
+
+// HandleMessage processes addr and getaddr messages. It returns true if
+// msg was one of them.
+func (am *AddrMan) HandleMessage(manager *PeerManager, peer *Peer, msg Message) bool {
+	switch msg := msg.(type) {
+	case *AddrMessage:
+		if len(msg.AddrList) > MAX_ADDR_TO_SEND {
+			return true
+		}
+		am.Add(msg.AddrList, peerIP(peer), ADDR_TIME_PENALTY)
+	case *GetAddrMessage:
+		// Only inbound peers are answered, so a node we connect to can't
+		// learn which addresses we know
+		if !peer.Inbound || peer.getAddrAnswered {
+			return true
+		}
+		peer.getAddrAnswered = true
+		manager.Send(peer, &AddrMessage{AddrList: am.GetAddr(MAX_ADDR_TO_SEND, ADDRMAN_GETADDR_MAX_PCT)})
+	default:
+		return false
+	}
+	return true
+}
+
+func peerIP(peer *Peer) net.IP {
+	if addr, ok := peer.conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
+
+// Persistence
+//============
+
+// Save writes the address book to its file. The file is replaced, so a
+// crash leaves the old or the new version.
+func (am *AddrMan) Save() error {
+	if am.path == "" {
+		return nil
+	}
+	data := am.marshal()
+	tmpPath := am.path + ".tmp"
+	file, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err = file.Write(data); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, am.path); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(am.path))
+}
+
+// The file holds the network magic, the version, the key and the
+// addresses, followed by a checksum
+func (am *AddrMan) marshal() []byte {
+	am.mutex.Lock()
+	defer am.mutex.Unlock()
+	out := MarshalUint32(nil, am.params.Magic)
+	out = MarshalUint32(out, ADDRMAN_VERSION)
+	out = MarshalBytes(out, am.key[:])
+	out = MarshalVarInt(out, uint64(len(am.infos)))
+	for _, info := range am.infos {
+		out = MarshalTimeNetAddr(out, info.TimeNetAddr)
+		source := net.IPv6zero
+		if info.source != nil {
+			source = info.source.To16()
+		}
+		out = MarshalIP(out, source)
+		out = MarshalTimestamp(out, info.lastTry)
+		out = MarshalTimestamp(out, info.lastSuccess)
+		out = MarshalUint32(out, uint32(info.attempts))
+		out = MarshalBool(out, info.tried)
+	}
+	return MarshalUint32(out, checksum(out))
+}
+
+// unmarshal fills an empty address book. Addresses are put back in their
+// buckets; those that collide with another one are dropped.
+func (am *AddrMan) unmarshal(data []byte) error {
+	if len(data) < 4 || checksum(data[:len(data)-4]) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return ErrAddrManFile
+	}
+	data = data[:len(data)-4]
+	magic, data, err := UnmarshalUint32(data)
+	if err != nil {
+		return err
+	}
+	if magic != am.params.Magic {
+		return fmt.Errorf("%w: not for network '%s'", ErrAddrManFile, am.params.Name)
+	}
+	version, data, err := UnmarshalUint32(data)
+	if err != nil {
+		return err
+	}
+	if version != ADDRMAN_VERSION {
+		return fmt.Errorf("%w: unknown version %d", ErrAddrManFile, version)
+	}
+	key, data, err := UnmarshalBytes(data, 32)
+	if err != nil {
+		return err
+	}
+	copy(am.key[:], key)
+	count, data, err := UnmarshalVarInt(data)
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < count; i++ {
+		info := new(addrInfo)
+		if info.TimeNetAddr, data, err = UnmarshalTimeNetAddr(data); err != nil {
+			return err
+		}
+		if info.source, data, err = UnmarshalIP(data); err != nil {
+			return err
+		}
+		if info.lastTry, data, err = UnmarshalTimestamp(data); err != nil {
+			return err
+		}
+		if info.lastSuccess, data, err = UnmarshalTimestamp(data); err != nil {
+			return err
+		}
+		attempts, rest, err := UnmarshalUint32(data)
+		if err != nil {
+			return err
+		}
+		info.attempts = int(attempts)
+		if info.tried, data, err = UnmarshalBool(rest); err != nil {
+			return err
+		}
+		info.key = addrKey(info.NetAddr)
+		if !IsRoutable(info.IPAddr) || am.infos[info.key] != nil {
+			continue
+		}
+
+		if info.tried {
+			bucket := am.triedBucket(info)
+			pos := am.bucketPosition(true, bucket, info)
+			if am.tried[bucket][pos] == nil {
+				am.tried[bucket][pos] = info
+				am.triedCount++
+				am.infos[info.key] = info
+				continue
+			}
+			info.tried = false
+		}
+		bucket := am.newBucket(info)
+		pos := am.bucketPosition(false, bucket, info)
+		if am.new[bucket][pos] == nil {
+			am.new[bucket][pos] = info
+			am.newCount++
+			am.infos[info.key] = info
+		}
+	}
+	if len(data) != 0 {
+		return ErrAddrManFile
+	}
+	return nil
+}
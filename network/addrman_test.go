@@ -0,0 +1,358 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNetGroup(t *testing.T) {
+	tests := []struct {
+		ip       string
+		routable bool
+		group    []byte
+	}{
+		{"1.2.3.4", true, []byte{4, 1, 2}},
+		{"::ffff:1.2.3.4", true, []byte{4, 1, 2}},
+		{"10.1.2.3", false, []byte{0}},
+		{"127.0.0.1", false, []byte{0}},
+		{"192.168.1.1", false, []byte{0}},
+		{"100.64.0.1", false, []byte{0}},
+		{"0.0.0.0", false, []byte{0}},
+		{"2002:102:304::1", true, []byte{4, 1, 2}},                      // 6to4
+		{"2001:0:4136:e378:8000:63bf:fefd:fcfb", true, []byte{4, 1, 2}}, // Teredo of 1.2.3.4
+		{"2a01:4f8:1:2::1", true, []byte{6, 0x2a, 0x01, 0x04, 0xf8}},
+		{"::1", false, []byte{0}},
+		{"fe80::1", false, []byte{0}},
+		{"fd00::1", false, []byte{0}},
+		{"2001:db8::1", false, []byte{0}},
+	}
+	for _, test := range tests {
+		ip := net.ParseIP(test.ip)
+		if IsRoutable(ip) != test.routable {
+			t.Errorf("IsRoutable(%s) = %v, expected %v", test.ip, !test.routable, test.routable)
+		}
+		if group := NetGroup(ip); string(group) != string(test.group) {
+			t.Errorf("NetGroup(%s) = %x, expected %x", test.ip, group, test.group)
+		}
+	}
+}
+
+// newTestAddrMan returns an address book with a fixed key, so addresses
+// always end up in the same buckets
+func newTestAddrMan(params *ChainParams) *AddrMan {
+	am := NewAddrMan(params)
+	am.key = [32]byte{1, 2, 3}
+	return am
+}
+
+// testAddr returns an address seen an hour ago
+func testAddr(ip string, port uint16) TimeNetAddr {
+	return TimeNetAddr{time.Now().Add(-time.Hour).Truncate(time.Second), NetAddr{NODE_NETWORK, net.ParseIP(ip), port}}
+}
+
+func TestAddrManAdd(t *testing.T) {
+	am := newTestAddrMan(&MainNetParams)
+	source := net.ParseIP("5.6.7.8")
+	addrs := []TimeNetAddr{testAddr("1.2.3.4", 8333), testAddr("1.2.3.4", 8334), testAddr("10.0.0.1", 8333)}
+	if added := am.Add(addrs, source, ADDR_TIME_PENALTY); added != 2 {
+		t.Errorf("Added %d addresses, expected 2", added)
+	}
+	info := am.infos["1.2.3.4:8333"]
+	if info == nil || !info.Time.Equal(addrs[0].Time.Add(-ADDR_TIME_PENALTY)) {
+		t.Errorf("Got %v, expected the time set back by the penalty", info)
+	}
+	// Known addresses are not added again, but their time is updated
+	if added := am.Add(addrs[:1], source, 0); added != 0 {
+		t.Errorf("Added known address again")
+	}
+	if !info.Time.Equal(addrs[0].Time) {
+		t.Errorf("Got time %v, expected %v", info.Time, addrs[0].Time)
+	}
+	if newCount, triedCount := am.Size(); newCount != 2 || triedCount != 0 {
+		t.Errorf("Got %d new and %d tried, expected 2 and 0", newCount, triedCount)
+	}
+
+	// A source can fill only a few buckets with the addresses of a group
+	for i := 0; i < 1000; i++ {
+		am.Add([]TimeNetAddr{testAddr(fmt.Sprintf("20.30.%d.%d", i/256, i%256), 8333)}, source, 0)
+	}
+	if newCount, _ := am.Size(); newCount > 2+ADDRMAN_BUCKET_SIZE {
+		t.Errorf("Got %d addresses from one group and source, expected at most one bucket", newCount-2)
+	}
+	// Addresses of many groups are spread out
+	for i := 0; i < 1000; i++ {
+		am.Add([]TimeNetAddr{testAddr(fmt.Sprintf("%d.%d.1.1", 30+i/256, i%256), 8333)}, source, 0)
+	}
+	if newCount, _ := am.Size(); newCount < 900 {
+		t.Errorf("Got %d addresses, expected most of 1000 addresses from different groups", newCount)
+	}
+}
+
+func TestAddrManGood(t *testing.T) {
+	am := newTestAddrMan(&MainNetParams)
+	now := time.Now()
+	am.now = func() time.Time { return now }
+	source := net.ParseIP("5.6.7.8")
+	for i := 0; i < 1000; i++ {
+		am.Add([]TimeNetAddr{testAddr(fmt.Sprintf("20.30.%d.%d", i/256, i%256), 8333)}, net.IPv4(byte(40+i/256), byte(i), 0, 1), 0)
+	}
+	newCount, _ := am.Size()
+	for key := range am.infos {
+		am.Attempt(key)
+		am.Good(key)
+	}
+	// The tried addresses of one group fit in a few buckets, the others go
+	// back to new
+	n, tried := am.Size()
+	if tried > ADDRMAN_TRIED_BUCKETS_PER_GROUP*ADDRMAN_BUCKET_SIZE || tried == 0 || n+tried > newCount {
+		t.Errorf("Got %d new and %d tried from %d, expected at most %d tried", n, tried, newCount, ADDRMAN_TRIED_BUCKETS_PER_GROUP*ADDRMAN_BUCKET_SIZE)
+	}
+	for _, info := range am.infos {
+		if info.tried && (info.attempts != 0 || !info.lastSuccess.Equal(now)) {
+			t.Errorf("Tried address %v not updated", info)
+		}
+	}
+
+	// Addresses failing too often are terrible and not handed out
+	am = newTestAddrMan(&MainNetParams)
+	am.now = func() time.Time { return now }
+	am.Add([]TimeNetAddr{testAddr("1.2.3.4", 8333), testAddr("1.3.3.4", 8333)}, source, 0)
+	for i := 0; i < ADDRMAN_RETRIES; i++ {
+		am.Attempt("1.2.3.4:8333")
+	}
+	now = now.Add(time.Hour)
+	if got := am.GetAddr(MAX_ADDR_TO_SEND, 100); len(got) != 1 || !got[0].IPAddr.Equal(net.ParseIP("1.3.3.4")) {
+		t.Errorf("Got %v, expected only the good address", got)
+	}
+	if !am.isTerrible(am.infos["1.2.3.4:8333"], now) {
+		t.Errorf("Address failing %d times is not terrible", ADDRMAN_RETRIES)
+	}
+}
+
+func TestAddrManSelect(t *testing.T) {
+	am := newTestAddrMan(&MainNetParams)
+	if _, ok := am.Candidate(); ok {
+		t.Errorf("Got a candidate from an empty address book")
+	}
+	source := net.ParseIP("5.6.7.8")
+	am.Add([]TimeNetAddr{testAddr("1.2.3.4", 8333), testAddr("2.2.3.4", 8333)}, source, 0)
+	am.Good("2.2.3.4:8333")
+	seen := make(map[string]bool)
+	for i := 0; i < 200; i++ {
+		address, ok := am.Candidate()
+		if !ok {
+			t.Fatalf("No candidate")
+		}
+		seen[address] = true
+	}
+	if len(seen) != 2 || !seen["1.2.3.4:8333"] || !seen["2.2.3.4:8333"] {
+		t.Errorf("Got candidates %v, expected both addresses", seen)
+	}
+	for i := 0; i < 50; i++ {
+		if addr, _ := am.Select(true); addr.IPAddr.String() != "1.2.3.4" {
+			t.Fatalf("Select from new returned %v", addr)
+		}
+	}
+
+	// Percentage and maximum of getaddr
+	for i := 0; i < 200; i++ {
+		am.Add([]TimeNetAddr{testAddr(fmt.Sprintf("%d.%d.1.1", 30+i/256, i%256), 8333)}, source, 0)
+	}
+	expected := len(am.infos) * ADDRMAN_GETADDR_MAX_PCT / 100
+	if got := am.GetAddr(MAX_ADDR_TO_SEND, ADDRMAN_GETADDR_MAX_PCT); len(got) != expected {
+		t.Errorf("Got %d addresses, expected %d", len(got), expected)
+	}
+	if got := am.GetAddr(10, 100); len(got) != 10 {
+		t.Errorf("Got %d addresses, expected 10", len(got))
+	}
+}
+
+func TestAddrManFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "addrman")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "peers.dat")
+
+	am, err := OpenAddrMan(path, &MainNetParams)
+	if err != nil {
+		t.Fatalf("Opening missing file failed: %v", err)
+	}
+	am.key = [32]byte{1, 2, 3}
+	for i := 0; i < 300; i++ {
+		am.Add([]TimeNetAddr{testAddr(fmt.Sprintf("%d.%d.1.1", 30+i/256, i%256), 8333)}, net.ParseIP("5.6.7.8"), 0)
+	}
+	am.Add([]TimeNetAddr{testAddr("2a01:4f8:1:2::1", 8333)}, nil, 0)
+	am.Attempt("30.1.1.1:8333")
+	am.Good("30.2.1.1:8333")
+	if err = am.Save(); err != nil {
+		t.Fatalf("Save failed: %v", err)
+	}
+
+	loaded, err := OpenAddrMan(path, &MainNetParams)
+	if err != nil {
+		t.Fatalf("Loading failed: %v", err)
+	}
+	newCount, triedCount := am.Size()
+	if n, tried := loaded.Size(); n != newCount || tried != triedCount {
+		t.Errorf("Got %d new and %d tried, expected %d and %d", n, tried, newCount, triedCount)
+	}
+	for key, info := range am.infos {
+		got := loaded.infos[key]
+		// Times are saved in seconds
+		if got == nil || got.Time.Unix() != info.Time.Unix() || got.Services != info.Services || got.tried != info.tried ||
+			got.attempts != info.attempts || got.lastTry.Unix() != info.lastTry.Unix() || got.lastSuccess.Unix() != info.lastSuccess.Unix() {
+			t.Errorf("Got %+v, expected %+v", got, info)
+		}
+	}
+	// Same key, same buckets
+	for b := range am.new {
+		for p, info := range am.new[b] {
+			if got := loaded.new[b][p]; (info == nil) != (got == nil) || info != nil && got.key != info.key {
+				t.Fatalf("Got %v in new bucket %d at %d, expected %v", got, b, p, info)
+			}
+		}
+	}
+	for b := range am.tried {
+		for p, info := range am.tried[b] {
+			if got := loaded.tried[b][p]; (info == nil) != (got == nil) || info != nil && got.key != info.key {
+				t.Fatalf("Got %v in tried bucket %d at %d, expected %v", got, b, p, info)
+			}
+		}
+	}
+
+	if _, err = OpenAddrMan(path, &TestNet3Params); !errors.Is(err, ErrAddrManFile) {
+		t.Errorf("Got %v for file of other network, expected %v", err, ErrAddrManFile)
+	}
+	data, _ := ioutil.ReadFile(path)
+	data[50] ^= 1
+	ioutil.WriteFile(path, data, 0644)
+	if _, err = OpenAddrMan(path, &MainNetParams); !errors.Is(err, ErrAddrManFile) {
+		t.Errorf("Got %v for corrupt file, expected %v", err, ErrAddrManFile)
+	}
+}
+
+func TestAddrManSources(t *testing.T) {
+	defer func(lookup func(string) ([]net.IP, error)) { lookupIP = lookup }(lookupIP)
+	lookupIP = func(host string) ([]net.IP, error) {
+		switch host {
+		case "seed.example.com":
+			return []net.IP{net.ParseIP("1.2.3.4"), net.ParseIP("5.6.7.8")}, nil
+		case "node.example.com":
+			return []net.IP{net.ParseIP("9.9.9.9")}, nil
+		}
+		return nil, fmt.Errorf("no such host %s", host)
+	}
+	params := MainNetParams
+	params.DNSSeeds = []string{"seed.example.com", "bad.example.com"}
+	am := newTestAddrMan(&params)
+	if added, err := am.AddSeeds(); added != 2 || err == nil || !strings.Contains(err.Error(), "bad.example.com") {
+		t.Errorf("Added %d addresses from seeds (%v), expected 2 and an error for the bad seed", added, err)
+	}
+	info := am.infos["1.2.3.4:8333"]
+	if info == nil || info.Services&NODE_WITNESS == 0 || time.Since(info.Time) < 3*24*time.Hour {
+		t.Errorf("Got seed address %+v", info)
+	}
+
+	manual := []string{"9.9.9.9:8333", "7.7.7.7:18333", "[2a01:4f8::1]:8444", "127.0.0.1:18444"}
+	if err := am.AddManual([]string{"node.example.com", "7.7.7.7:18333", "[2a01:4f8::1]:8444", "127.0.0.1:18444", "7.7.7.7:18333"}); err != nil {
+		t.Fatalf("AddManual failed: %v", err)
+	}
+	if len(am.manual) != len(manual) {
+		t.Errorf("Got manual addresses %q, expected %q", am.manual, manual)
+	}
+	// Manual addresses, also local ones, take turns with the tables
+	for i, key := range manual {
+		if address, ok := am.Candidate(); !ok || address != key {
+			t.Errorf("Got candidate %s, expected manual address %s", address, key)
+		}
+		if address, ok := am.Candidate(); !ok || containsString(manual, address) {
+			t.Errorf("Got candidate %s after manual address %d, expected one of the tables", address, i)
+		}
+	}
+	empty := newTestAddrMan(&params)
+	empty.AddManual([]string{"127.0.0.1"})
+	for i := 0; i < 2; i++ {
+		if address, ok := empty.Candidate(); !ok || address != "127.0.0.1:8333" {
+			t.Errorf("Got candidate %s, expected the manual address", address)
+		}
+	}
+	if err := am.AddManual([]string{"bad.example.com"}); err == nil {
+		t.Errorf("AddManual of unresolvable host succeeded")
+	}
+}
+
+func TestAddrManMessages(t *testing.T) {
+	am := newTestAddrMan(&RegTestParams)
+	for i := 0; i < 100; i++ {
+		am.Add([]TimeNetAddr{testAddr(fmt.Sprintf("%d.%d.1.1", 30+i/256, i%256), 18444)}, net.ParseIP("5.6.7.8"), 0)
+	}
+	remotes := make(chan *Peer, 1)
+	listener := listenPeers(t, remotes)
+	defer listener.Close()
+	manager := NewPeerManager(testPeerConfig(PROTOCOL_VERSION, NewNonceSet()), NewAddressList(listener.Addr().String()))
+	manager.MaxOutbound = 1
+	// Handlers run in order, so the address book is done when received
+	am.Attach(manager)
+	received := make(chan string, 10)
+	manager.Subscribe("", func(peer *Peer, msg Message) { received <- msg.GetCommandString() })
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go manager.Run(ctx)
+
+	// Outbound peers are asked for addresses, and what they send is added
+	remote := receiveFrom(t, remotes)
+	defer remote.Close()
+	if _, command, err := remote.ReceiveMessage(); err != nil || command != "getaddr" {
+		t.Fatalf("Got %s %v, expected getaddr", command, err)
+	}
+	remote.SendMessage(&AddrMessage{AddrList: []TimeNetAddr{testAddr("1.2.3.4", 18444)}})
+	remote.SendMessage(&GetAddrMessage{}) // not answered to outbound peers
+	for _, command := range []string{"addr", "getaddr"} {
+		if got := <-received; got != command {
+			t.Errorf("Got %s, expected %s", got, command)
+		}
+	}
+	if am.infos["1.2.3.4:18444"] == nil {
+		t.Errorf("Address from addr message not added")
+	}
+
+	// Inbound peers get an answer to their first getaddr
+	conn, remoteConn := tcpPair(t)
+	other := NewPeer(remoteConn, testPeerConfig(PROTOCOL_VERSION, NewNonceSet()), false)
+	defer other.Close()
+	handshake := make(chan error)
+	go func() { handshake <- other.Handshake() }()
+	if err := manager.AddInbound(ctx, conn); err != nil {
+		t.Fatalf("AddInbound failed: %v", err)
+	}
+	if err := <-handshake; err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	expected := len(am.infos) * ADDRMAN_GETADDR_MAX_PCT / 100
+	other.SendMessage(&GetAddrMessage{})
+	other.SendMessage(&GetAddrMessage{})
+	other.SendMessage(&SendHeadersMessage{})
+	msg, command, err := other.ReceiveMessage()
+	if err != nil || command != "addr" || len((*msg).(*AddrMessage).AddrList) != expected {
+		t.Fatalf("Got %s %v, expected addr with %d addresses", command, err, expected)
+	}
+	for _, command := range []string{"getaddr", "getaddr", "sendheaders"} {
+		if got := <-received; got != command {
+			t.Errorf("Got %s, expected %s", got, command)
+		}
+	}
+	other.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, command, err := other.ReceiveMessage(); err == nil {
+		t.Errorf("Got %s, expected no answer to the second getaddr", command)
+	}
+}
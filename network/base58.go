@@ -0,0 +1,81 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Base58 encoding as used for addresses and WIF keys. Leading zero bytes are
+// encoded as leading '1's.
+
+const base58Alphabet = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// Errors returned when decoding base58 strings
+var (
+	ErrInvalidBase58 = errors.New("invalid base58 character")
+	ErrBadChecksum   = errors.New("bad base58 checksum")
+)
+
+func Base58Encode(data []byte) string {
+	zeros := 0
+	for zeros < len(data) && data[zeros] == 0 {
+		zeros++
+	}
+	n := new(big.Int).SetBytes(data)
+	radix := big.NewInt(58)
+	mod := new(big.Int)
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, base58Alphabet[mod.Int64()])
+	}
+	for i := 0; i < zeros; i++ {
+		out = append(out, base58Alphabet[0])
+	}
+	return string(reverse(out))
+}
+
+func Base58Decode(s string) ([]byte, error) {
+	n := new(big.Int)
+	radix := big.NewInt(58)
+	for i := 0; i < len(s); i++ {
+		digit := bytes.IndexByte([]byte(base58Alphabet), s[i])
+		if digit < 0 {
+			return nil, fmt.Errorf("%w '%c' at position %d", ErrInvalidBase58, s[i], i)
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(digit)))
+	}
+	zeros := 0
+	for zeros < len(s) && s[zeros] == base58Alphabet[0] {
+		zeros++
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
+
+// Base58CheckEncode encodes the version byte and the payload followed by a
+// four byte checksum (the start of the double hash)
+func Base58CheckEncode(version byte, payload []byte) string {
+	data := append([]byte{version}, payload...)
+	hash := doubleHash(data)
+	return Base58Encode(append(data, hash[:4]...))
+}
+
+// Base58CheckDecode decodes s and verifies its checksum. It returns the
+// version byte and the payload.
+func Base58CheckDecode(s string) (byte, []byte, error) {
+	data, err := Base58Decode(s)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(data) < 5 {
+		return 0, nil, fmt.Errorf("%w: too short", ErrBadChecksum)
+	}
+	hash := doubleHash(data[:len(data)-4])
+	if !bytes.Equal(hash[:4], data[len(data)-4:]) {
+		return 0, nil, ErrBadChecksum
+	}
+	return data[0], data[1 : len(data)-4], nil
+}
@@ -0,0 +1,200 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Bech32 (BIP173) and Bech32m (BIP350) encoding, used for segwit addresses.
+// Version 0 witness programs use Bech32, all later versions Bech32m, which
+// differs only in the checksum constant.
+
+type Bech32Encoding int
+
+const (
+	Bech32 Bech32Encoding = iota + 1
+	Bech32m
+)
+
+const bech32Charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+
+const (
+	bech32Const  = 1
+	bech32mConst = 0x2bc830a3
+)
+
+var ErrInvalidBech32 = errors.New("invalid bech32 string")
+
+func bech32Polymod(values []byte) uint32 {
+	gen := []uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	for _, v := range values {
+		b := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ uint32(v)
+		for i := 0; i < 5; i++ {
+			if (b>>uint(i))&1 == 1 {
+				chk ^= gen[i]
+			}
+		}
+	}
+	return chk
+}
+
+func bech32HrpExpand(hrp string) []byte {
+	out := make([]byte, 0, 2*len(hrp)+1)
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]>>5)
+	}
+	out = append(out, 0)
+	for i := 0; i < len(hrp); i++ {
+		out = append(out, hrp[i]&31)
+	}
+	return out
+}
+
+func bech32Checksum(hrp string, data []byte, enc Bech32Encoding) []byte {
+	values := append(bech32HrpExpand(hrp), data...)
+	values = append(values, 0, 0, 0, 0, 0, 0)
+	c := uint32(bech32Const)
+	if enc == Bech32m {
+		c = bech32mConst
+	}
+	mod := bech32Polymod(values) ^ c
+	out := make([]byte, 6)
+	for i := range out {
+		out[i] = byte(mod>>uint(5*(5-i))) & 31
+	}
+	return out
+}
+
+// Bech32Encode encodes the human readable part and the data, given as 5 bit
+// values
+func Bech32Encode(hrp string, data []byte, enc Bech32Encoding) string {
+	combined := append(append([]byte{}, data...), bech32Checksum(hrp, data, enc)...)
+	var sb strings.Builder
+	sb.WriteString(hrp)
+	sb.WriteByte('1')
+	for _, v := range combined {
+		sb.WriteByte(bech32Charset[v])
+	}
+	return sb.String()
+}
+
+// Bech32Decode decodes a Bech32 or Bech32m string into its human readable
+// part (in lower case) and its 5 bit data values, and tells which of the
+// encodings was used
+func Bech32Decode(s string) (string, []byte, Bech32Encoding, error) {
+	if len(s) > 90 {
+		return "", nil, 0, fmt.Errorf("%w: too long", ErrInvalidBech32)
+	}
+	lower, upper := false, false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c < 33 || c > 126 {
+			return "", nil, 0, fmt.Errorf("%w: invalid character 0x%02x", ErrInvalidBech32, c)
+		}
+		lower = lower || (c >= 'a' && c <= 'z')
+		upper = upper || (c >= 'A' && c <= 'Z')
+	}
+	if lower && upper {
+		return "", nil, 0, fmt.Errorf("%w: mixed case", ErrInvalidBech32)
+	}
+	s = strings.ToLower(s)
+	pos := strings.LastIndexByte(s, '1')
+	if pos < 1 || pos+7 > len(s) {
+		return "", nil, 0, fmt.Errorf("%w: bad separator position", ErrInvalidBech32)
+	}
+	hrp := s[:pos]
+	data := make([]byte, 0, len(s)-pos-1)
+	for i := pos + 1; i < len(s); i++ {
+		v := strings.IndexByte(bech32Charset, s[i])
+		if v < 0 {
+			return "", nil, 0, fmt.Errorf("%w: invalid character '%c'", ErrInvalidBech32, s[i])
+		}
+		data = append(data, byte(v))
+	}
+	var enc Bech32Encoding
+	switch bech32Polymod(append(bech32HrpExpand(hrp), data...)) {
+	case bech32Const:
+		enc = Bech32
+	case bech32mConst:
+		enc = Bech32m
+	default:
+		return "", nil, 0, fmt.Errorf("%w: bad checksum", ErrInvalidBech32)
+	}
+	return hrp, data[:len(data)-6], enc, nil
+}
+
+// convertBits regroups the bits of data from groups of fromBits to groups of
+// toBits. With pad, the last group is padded with zeros, otherwise the
+// padding must be shorter than fromBits and all zero.
+func convertBits(data []byte, fromBits, toBits uint, pad bool) ([]byte, error) {
+	acc, bits := uint32(0), uint(0)
+	maxv := uint32(1)<<toBits - 1
+	var out []byte
+	for _, v := range data {
+		if uint32(v)>>fromBits != 0 {
+			return nil, fmt.Errorf("%w: value out of range", ErrInvalidBech32)
+		}
+		acc = acc<<fromBits | uint32(v)
+		bits += fromBits
+		for bits >= toBits {
+			bits -= toBits
+			out = append(out, byte(acc>>bits&maxv))
+		}
+	}
+	if pad {
+		if bits > 0 {
+			out = append(out, byte(acc<<(toBits-bits)&maxv))
+		}
+	} else if bits >= fromBits || acc<<(toBits-bits)&maxv != 0 {
+		return nil, fmt.Errorf("%w: bad padding", ErrInvalidBech32)
+	}
+	return out, nil
+}
+
+// EncodeSegwitAddress encodes a witness program as segwit address
+func EncodeSegwitAddress(hrp string, version byte, program []byte) (string, error) {
+	enc := Bech32
+	if version > 0 {
+		enc = Bech32m
+	}
+	data, _ := convertBits(program, 8, 5, true)
+	s := Bech32Encode(hrp, append([]byte{version}, data...), enc)
+	// Check the result, so that invalid programs can't be encoded
+	if _, _, err := DecodeSegwitAddress(hrp, s); err != nil {
+		return "", err
+	}
+	return s, nil
+}
+
+// DecodeSegwitAddress decodes a segwit address with the human readable part
+// hrp into witness version and program
+func DecodeSegwitAddress(hrp string, s string) (byte, []byte, error) {
+	hrpGot, data, enc, err := Bech32Decode(s)
+	if err != nil {
+		return 0, nil, err
+	}
+	if hrpGot != hrp {
+		return 0, nil, fmt.Errorf("%w: human readable part '%s' instead of '%s'", ErrInvalidBech32, hrpGot, hrp)
+	}
+	if len(data) < 1 || data[0] > 16 {
+		return 0, nil, fmt.Errorf("%w: invalid witness version", ErrInvalidBech32)
+	}
+	version := data[0]
+	program, err := convertBits(data[1:], 5, 8, false)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(program) < 2 || len(program) > 40 {
+		return 0, nil, fmt.Errorf("%w: invalid program length %d", ErrInvalidBech32, len(program))
+	}
+	if version == 0 && len(program) != 20 && len(program) != 32 {
+		return 0, nil, fmt.Errorf("%w: invalid program length %d for version 0", ErrInvalidBech32, len(program))
+	}
+	if (version == 0) != (enc == Bech32) {
+		return 0, nil, fmt.Errorf("%w: wrong checksum variant for version %d", ErrInvalidBech32, version)
+	}
+	return version, program, nil
+}
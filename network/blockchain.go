@@ -1,6 +1,11 @@
 package network
 
-import "time"
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
 
 type Header struct {
 	Version        uint32    // version 			int32_t 	Block version information (note, this is signed)
@@ -12,9 +17,39 @@ type Header struct {
 	// TxnCount       uint64    // txn_count 		var_int 	Number of transaction entries, this value is always 0
 }
 
+// HashHeader computes the block hash, which is the double sha256 hash of
+// the marshalled header
 func HashHeader(h Header) Hash {
-	data := []byte("hello")
-	return doubleHash(data)
+	return doubleHash(MarshalHeader(nil, h))
+}
+
+func (h Header) Hash() Hash {
+	return HashHeader(h)
+}
+
+// Errors returned by CheckProofOfWork
+var (
+	ErrBadBits  = errors.New("bad difficulty bits")
+	ErrHighHash = errors.New("proof of work failed")
+)
+
+// CheckProofOfWork checks that the block hash is not above the target
+// encoded in the bits field of the header
+func (h Header) CheckProofOfWork() error {
+	target := CompactToTarget(h.Bits)
+	if target.Sign() <= 0 || CompactOverflows(h.Bits) {
+		return fmt.Errorf("%w: 0x%08x", ErrBadBits, uint32(h.Bits))
+	}
+	hash := HashToBig(h.Hash())
+	if hash.Cmp(target) > 0 {
+		return fmt.Errorf("%w: hash %064x above target %064x", ErrHighHash, hash, target)
+	}
+	return nil
+}
+
+// Work returns the amount of work represented by this header (see CalcWork)
+func (h Header) Work() *big.Int {
+	return CalcWork(h.Bits)
 }
 
 func MarshalHeader(out []byte, v Header) []byte {
@@ -28,14 +63,65 @@ func MarshalHeader(out []byte, v Header) []byte {
 	return out
 }
 
-func UnmarshalHeader(data []byte) (Header, []byte) {
+func UnmarshalHeader(data []byte) (Header, []byte, error) {
 	var v Header
-	v.Version, data = UnmarshalUint32(data)
-	v.PrevBlockHash, data = UnmarshalHash(data)
-	v.MerkleRootHash, data = UnmarshalHash(data)
-	v.Timestamp, data = UnmarshalTimestamp4(data)
-	v.Bits, data = UnmarshalCompact(data)
-	v.Nonce, data = UnmarshalUint32(data)
-
-	return v, data
+	var err error
+	if v.Version, data, err = UnmarshalUint32(data); err != nil {
+		return v, data, err
+	}
+	if v.PrevBlockHash, data, err = UnmarshalHash(data); err != nil {
+		return v, data, err
+	}
+	if v.MerkleRootHash, data, err = UnmarshalHash(data); err != nil {
+		return v, data, err
+	}
+	if v.Timestamp, data, err = UnmarshalTimestamp4(data); err != nil {
+		return v, data, err
+	}
+	if v.Bits, data, err = UnmarshalCompact(data); err != nil {
+		return v, data, err
+	}
+	if v.Nonce, data, err = UnmarshalUint32(data); err != nil {
+		return v, data, err
+	}
+
+	return v, data, nil
+}
+
+// Block is a full block, a header followed by its transactions
+type Block struct {
+	Header
+	Txs []Tx
+}
+
+func MarshalBlock(out []byte, v Block) []byte {
+	out = MarshalHeader(out, v.Header)
+	out = MarshalVarInt(out, uint64(len(v.Txs)))
+	for _, tx := range v.Txs {
+		out = MarshalTx(out, tx)
+	}
+	return out
+}
+
+func UnmarshalBlock(data []byte) (Block, []byte, error) {
+	var v Block
+	var err error
+	if v.Header, data, err = UnmarshalHeader(data); err != nil {
+		return v, data, err
+	}
+	l, data, err := UnmarshalLength(data)
+	if err != nil {
+		return v, data, err
+	}
+	// smallest possible transaction: version, two counts and locktime
+	if err = checkCount(data, l, 10); err != nil {
+		return v, data, err
+	}
+	v.Txs = make([]Tx, l)
+	for i := range v.Txs {
+		if v.Txs[i], data, err = UnmarshalTx(data); err != nil {
+			return v, data, err
+		}
+	}
+	return v, data, nil
 }
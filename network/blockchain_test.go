@@ -1,6 +1,8 @@
 package network
 
 import (
+	"errors"
+	"math/big"
 	"reflect"
 	"testing"
 	"time"
@@ -28,8 +30,7 @@ func TestHashHeader1(t *testing.T) {
 		Bits:           0x1d00ffff,
 		Nonce:          2573394689,
 	}
-	out := MarshalHeader([]byte{}, h)
-	hash := doubleHash(out)
+	hash := HashHeader(h)
 	hashExpect := rs2h("00000000839a8e6886ab5951d76f411475428afc90947ee320161bbf18eb6048")
 	if !reflect.DeepEqual(hash, hashExpect) {
 		t.Errorf("Hashes did not match (\n%v (actual) != \n%v (expected))", hash, hashExpect)
@@ -48,10 +49,47 @@ func TestHashHeader0(t *testing.T) {
 		Bits:           0x1d00ffff,
 		Nonce:          2083236893,
 	}
-	out := MarshalHeader([]byte{}, h)
-	hash := doubleHash(out)
+	hash := HashHeader(h)
 	hashExpect := rs2h("000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f")
 	if !reflect.DeepEqual(hash, hashExpect) {
 		t.Errorf("Hashes did not match (\n%v (actual) != \n%v (expected))", hash, hashExpect)
 	}
 }
+
+func TestCheckProofOfWork(t *testing.T) {
+	// block height 1 (see above)
+	h := Header{
+		Version:        1,
+		PrevBlockHash:  rs2h("000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f"),
+		MerkleRootHash: rs2h("0e3e2357e806b6cdb1f70b54c3a3a17b6714ee1f0e68bebb44a74b1efd512098"),
+		Timestamp:      time.Unix(1231469665, 0),
+		Bits:           0x1d00ffff,
+		Nonce:          2573394689,
+	}
+	if err := h.CheckProofOfWork(); err != nil {
+		t.Errorf("Proof of work should be valid: %v", err)
+	}
+
+	// Wrong nonce (the chance this still is a valid block is 1:2^32)
+	h.Nonce++
+	if err := h.CheckProofOfWork(); !errors.Is(err, ErrHighHash) {
+		t.Errorf("Proof of work should fail, got '%v'", err)
+	}
+
+	// Invalid bits
+	for _, bits := range []Compact{0x00000000, 0x1d80ffff, 0xff123456} {
+		h.Bits = bits
+		if err := h.CheckProofOfWork(); !errors.Is(err, ErrBadBits) {
+			t.Errorf("Bits 0x%08x should be rejected, got '%v'", uint32(bits), err)
+		}
+	}
+}
+
+func TestHeaderWork(t *testing.T) {
+	// Chain work of the genesis block as reported by getblockheader
+	h := Header{Bits: 0x1d00ffff}
+	e := big.NewInt(0x100010001)
+	if h.Work().Cmp(e) != 0 {
+		t.Errorf("Work did not match (%v!=%v)", h.Work(), e)
+	}
+}
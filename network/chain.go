@@ -0,0 +1,296 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// HeaderNode is a header together with its position in the header tree
+type HeaderNode struct {
+	Header
+	Hash      Hash
+	Height    int
+	ChainWork *big.Int // total work of the chain up to and including this header
+	Parent    *HeaderNode
+}
+
+// Ancestor returns the ancestor of the node at the given height (or nil if
+// the height is out of range)
+func (node *HeaderNode) Ancestor(height int) *HeaderNode {
+	if height < 0 || height > node.Height {
+		return nil
+	}
+	for node != nil && node.Height > height {
+		node = node.Parent
+	}
+	return node
+}
+
+// findFork returns the last common ancestor of the nodes a and b
+func findFork(a, b *HeaderNode) *HeaderNode {
+	if a.Height > b.Height {
+		a = a.Ancestor(b.Height)
+	} else {
+		b = b.Ancestor(a.Height)
+	}
+	for a != b {
+		a, b = a.Parent, b.Parent
+	}
+	return a
+}
+
+// Reorg describes a change of the best chain. Disconnected lists the nodes
+// which are no longer in the best chain (starting from the old tip),
+// Connected the nodes which were added (ending with the new tip). When the
+// chain was just extended, there are no disconnected nodes.
+type Reorg struct {
+	Fork         *HeaderNode
+	Disconnected []*HeaderNode
+	Connected    []*HeaderNode
+}
+
+// Errors returned when adding headers to the chain
+var (
+	ErrNotConnected         = errors.New("header does not connect to chain")
+	ErrCheckpointMismatch   = errors.New("checkpoint mismatch")
+	ErrForkBeforeCheckpoint = errors.New("bad-fork-prior-to-checkpoint")
+)
+
+// HeaderChain holds the tree of all known headers starting from the genesis
+// block and tracks the best chain, i.e. the chain with the most work. It
+// can be backed by a file, so that it survives restarts (see
+// OpenHeaderChain).
+type HeaderChain struct {
+	params *ChainParams
+	nodes  map[Hash]*HeaderNode
+	active []*HeaderNode // the nodes of the best chain indexed by height
+	store  *headerStore
+
+	// Called whenever the best chain changed after adding headers
+	OnReorg func(reorg *Reorg)
+}
+
+// NewHeaderChain returns a header chain that is only kept in memory
+func NewHeaderChain(params *ChainParams) *HeaderChain {
+	genesis := params.GenesisHeader
+	node := &HeaderNode{Header: genesis, Hash: genesis.Hash(), Height: 0, ChainWork: genesis.Work()}
+	return &HeaderChain{
+		params: params,
+		nodes:  map[Hash]*HeaderNode{node.Hash: node},
+		active: []*HeaderNode{node},
+	}
+}
+
+// OpenHeaderChain returns a header chain that is stored in the file at path.
+// Headers already in the file are loaded, new headers are appended to it.
+func OpenHeaderChain(path string, params *ChainParams) (*HeaderChain, error) {
+	chain := NewHeaderChain(params)
+	store, err := openHeaderStore(path)
+	if err != nil {
+		return nil, err
+	}
+	err = store.load(func(header Header, hash Hash, height int, chainWork *big.Int) error {
+		if height == 0 {
+			if hash != chain.active[0].Hash {
+				return fmt.Errorf("genesis block %v in '%s' does not match", hash.RPCString(), path)
+			}
+			return nil
+		}
+		parent := chain.nodes[header.PrevBlockHash]
+		if parent == nil || parent.Height+1 != height {
+			return fmt.Errorf("%w: stored header %v", ErrNotConnected, hash.RPCString())
+		}
+		chain.addNode(&HeaderNode{Header: header, Hash: hash, Height: height, ChainWork: chainWork, Parent: parent})
+		return nil
+	})
+	if err == nil && store.empty() {
+		store.append(chain.active[0])
+		err = store.flush()
+	}
+	if err != nil {
+		store.close()
+		return nil, err
+	}
+	chain.store = store
+	return chain, nil
+}
+
+// Close closes the file backing the chain (if any)
+func (chain *HeaderChain) Close() error {
+	if chain.store == nil {
+		return nil
+	}
+	return chain.store.close()
+}
+
+// Tip returns the last node of the best chain
+func (chain *HeaderChain) Tip() *HeaderNode {
+	return chain.active[len(chain.active)-1]
+}
+
+// Height returns the height of the tip
+func (chain *HeaderChain) Height() int {
+	return chain.Tip().Height
+}
+
+// Lookup returns the node for the given hash or nil if it isn't known. The
+// node may be on a side chain.
+func (chain *HeaderChain) Lookup(hash Hash) *HeaderNode {
+	return chain.nodes[hash]
+}
+
+// NodeAt returns the node of the best chain at the given height or nil if
+// height is out of range
+func (chain *HeaderChain) NodeAt(height int) *HeaderNode {
+	if height < 0 || height >= len(chain.active) {
+		return nil
+	}
+	return chain.active[height]
+}
+
+// Contains returns true if node is part of the best chain
+func (chain *HeaderChain) Contains(node *HeaderNode) bool {
+	return chain.NodeAt(node.Height) == node
+}
+
+// Tips returns the tips of all known chains (including the best chain)
+func (chain *HeaderChain) Tips() []*HeaderNode {
+	hasChildren := map[*HeaderNode]bool{}
+	for _, node := range chain.nodes {
+		hasChildren[node.Parent] = true
+	}
+	tips := []*HeaderNode{}
+	for _, node := range chain.nodes {
+		if !hasChildren[node] {
+			tips = append(tips, node)
+		}
+	}
+	return tips
+}
+
+// BlockLocator returns the hashes to be sent in getheaders and getblocks
+// messages: the last 10 blocks, then going back exponentially, and finally
+// the genesis block. See:
+// https://en.bitcoin.it/wiki/Protocol_documentation#getblocks
+func (chain *HeaderChain) BlockLocator() []Hash {
+	hashes := []Hash{}
+	step := 1
+	for height := chain.Height(); height > 0; height -= step {
+		hashes = append(hashes, chain.active[height].Hash)
+		if len(hashes) >= 10 {
+			step *= 2
+		}
+	}
+	return append(hashes, chain.active[0].Hash)
+}
+
+// AddHeaders adds the headers to the chain. Each header must reference a
+// known header by PrevBlockHash and pass the consensus checks. The header
+// may extend the best chain or any side chain; if a side chain gets more
+// work than the best chain, it becomes the best chain and OnReorg is called.
+// Headers that are already known are skipped. On error, the headers before
+// the failing one remain in the chain.
+func (chain *HeaderChain) AddHeaders(headers []Header) error {
+	oldTip := chain.Tip()
+	err := chain.addHeaders(headers)
+	if chain.store != nil {
+		if flushErr := chain.store.flush(); err == nil {
+			err = flushErr
+		}
+	}
+	if chain.Tip() != oldTip && chain.OnReorg != nil {
+		chain.OnReorg(chain.reorg(oldTip, chain.Tip()))
+	}
+	return err
+}
+
+func (chain *HeaderChain) addHeaders(headers []Header) error {
+	now := time.Now()
+	for _, header := range headers {
+		hash := header.Hash()
+		if chain.nodes[hash] != nil {
+			continue
+		}
+		parent := chain.nodes[header.PrevBlockHash]
+		if parent == nil {
+			return fmt.Errorf("%w: %v (prev %v unknown)", ErrNotConnected,
+				hash.RPCString(), header.PrevBlockHash.RPCString())
+		}
+		if err := CheckHeader(header, &chain.params.Consensus); err != nil {
+			return fmt.Errorf("header %v: %w", hash.RPCString(), err)
+		}
+		if err := chain.checkCheckpoints(hash, parent.Height+1); err != nil {
+			return fmt.Errorf("header %v: %w", hash.RPCString(), err)
+		}
+		if err := ContextualCheckHeader(header, parent, &chain.params.Consensus, now); err != nil {
+			return fmt.Errorf("header %v: %w", hash.RPCString(), err)
+		}
+		node := &HeaderNode{
+			Header:    header,
+			Hash:      hash,
+			Height:    parent.Height + 1,
+			ChainWork: new(big.Int).Add(parent.ChainWork, header.Work()),
+			Parent:    parent,
+		}
+		if chain.store != nil {
+			chain.store.append(node)
+		}
+		chain.addNode(node)
+	}
+	return nil
+}
+
+// checkCheckpoints rejects headers which don't match the checkpoint at their
+// height or fork off the best chain before the last checkpoint it contains
+func (chain *HeaderChain) checkCheckpoints(hash Hash, height int) error {
+	if checkpoint := chain.params.Checkpoint(height); checkpoint != nil && checkpoint.Hash != hash {
+		return fmt.Errorf("%w at height %d", ErrCheckpointMismatch, height)
+	}
+	for i := len(chain.params.Checkpoints) - 1; i >= 0; i-- {
+		checkpoint := chain.params.Checkpoints[i]
+		if node := chain.NodeAt(checkpoint.Height); node != nil && node.Hash == checkpoint.Hash {
+			if height <= checkpoint.Height {
+				return fmt.Errorf("%w at height %d", ErrForkBeforeCheckpoint, height)
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// addNode adds the node to the tree and makes it the tip if it has more work
+// than the current tip (on a tie the first seen chain wins)
+func (chain *HeaderChain) addNode(node *HeaderNode) {
+	chain.nodes[node.Hash] = node
+	if node.ChainWork.Cmp(chain.Tip().ChainWork) <= 0 {
+		return
+	}
+	fork := findFork(chain.Tip(), node)
+	chain.active = chain.active[:fork.Height+1]
+	for n := node; n != fork; n = n.Parent {
+		chain.active = append(chain.active, nil)
+	}
+	for n := node; n != fork; n = n.Parent {
+		chain.active[n.Height] = n
+	}
+}
+
+// reorg returns the changes to the best chain when going from oldTip to
+// newTip
+func (chain *HeaderChain) reorg(oldTip, newTip *HeaderNode) *Reorg {
+	fork := findFork(oldTip, newTip)
+	reorg := &Reorg{Fork: fork, Disconnected: []*HeaderNode{}, Connected: []*HeaderNode{}}
+	for node := oldTip; node != fork; node = node.Parent {
+		reorg.Disconnected = append(reorg.Disconnected, node)
+	}
+	for node := newTip; node != fork; node = node.Parent {
+		reorg.Connected = append(reorg.Connected, node)
+	}
+	reverse := reorg.Connected
+	for i, j := 0, len(reverse)-1; i < j; i, j = i+1, j-1 {
+		reverse[i], reverse[j] = reverse[j], reverse[i]
+	}
+	return reorg
+}
@@ -0,0 +1,240 @@
+package network
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// mineHeader returns a header on top of prev with valid proof of work. With
+// the regtest target, about every other nonce gives a valid header.
+func mineHeader(prev Header, timestamp time.Time) Header {
+	h := Header{
+		Version:       4,
+		PrevBlockHash: prev.Hash(),
+		Timestamp:     timestamp,
+		Bits:          prev.Bits,
+	}
+	for h.CheckProofOfWork() != nil {
+		h.Nonce++
+	}
+	return h
+}
+
+// mineHeaders returns n headers on top of prev, spaced 10 minutes apart
+func mineHeaders(prev Header, n int) []Header {
+	headers := make([]Header, n)
+	for i := range headers {
+		prev = mineHeader(prev, prev.Timestamp.Add(10*time.Minute))
+		headers[i] = prev
+	}
+	return headers
+}
+
+// mineFork returns n headers on top of prev, which differ from the ones
+// returned by mineHeaders
+func mineFork(prev Header, n int) []Header {
+	first := mineHeader(prev, prev.Timestamp.Add(11*time.Minute))
+	return append([]Header{first}, mineHeaders(first, n-1)...)
+}
+
+func TestHeaderChainAddHeaders(t *testing.T) {
+	genesis := RegTestParams.GenesisHeader
+	chain := NewHeaderChain(&RegTestParams)
+	headers := mineHeaders(genesis, 20)
+
+	if err := chain.AddHeaders(headers[:10]); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Overlapping headers are skipped
+	if err := chain.AddHeaders(headers[5:]); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if chain.Height() != 20 || chain.Tip().Hash != headers[19].Hash() {
+		t.Errorf("Wrong tip %v at height %d", chain.Tip().Hash, chain.Height())
+	}
+	if node := chain.Lookup(headers[4].Hash()); node == nil || node.Height != 5 {
+		t.Errorf("Lookup returned wrong node %v", node)
+	}
+	if node := chain.Tip().Ancestor(3); node != chain.NodeAt(3) || node.Hash != headers[2].Hash() {
+		t.Errorf("Ancestor returned wrong node %v", node)
+	}
+
+	// Headers not connecting to any known header
+	more := mineHeaders(headers[19], 2)
+	if err := chain.AddHeaders(more[1:]); !errors.Is(err, ErrNotConnected) {
+		t.Errorf("Expected not connected error, got '%v'", err)
+	}
+
+	// Header with invalid proof of work
+	more[0].Nonce++
+	for more[0].CheckProofOfWork() == nil {
+		more[0].Nonce++
+	}
+	if err := chain.AddHeaders(more[:1]); !errors.Is(err, ErrHighHash) {
+		t.Errorf("Expected proof of work error, got '%v'", err)
+	}
+	if chain.Height() != 20 {
+		t.Errorf("Invalid headers should not change the chain (height %d)", chain.Height())
+	}
+}
+
+func TestBlockLocator(t *testing.T) {
+	genesis := RegTestParams.GenesisHeader
+	chain := NewHeaderChain(&RegTestParams)
+
+	locator := chain.BlockLocator()
+	if len(locator) != 1 || locator[0] != genesis.Hash() {
+		t.Errorf("Locator of empty chain should only contain genesis: %v", locator)
+	}
+
+	if err := chain.AddHeaders(mineHeaders(genesis, 100)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	heights := []int{100, 99, 98, 97, 96, 95, 94, 93, 92, 91, 89, 85, 77, 61, 29, 0}
+	locator = chain.BlockLocator()
+	if len(locator) != len(heights) {
+		t.Fatalf("Locator has wrong length (%d!=%d)", len(locator), len(heights))
+	}
+	for i, height := range heights {
+		if locator[i] != chain.NodeAt(height).Hash {
+			t.Errorf("Locator entry %d should be block at height %d", i, height)
+		}
+	}
+}
+
+func TestHeaderChainReorg(t *testing.T) {
+	genesis := RegTestParams.GenesisHeader
+	chain := NewHeaderChain(&RegTestParams)
+	reorgs := []*Reorg{}
+	chain.OnReorg = func(reorg *Reorg) {
+		reorgs = append(reorgs, reorg)
+	}
+	main := mineHeaders(genesis, 10)
+	if err := chain.AddHeaders(main); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(reorgs) != 1 || len(reorgs[0].Disconnected) != 0 || len(reorgs[0].Connected) != 10 {
+		t.Fatalf("Extending the chain should give one reorg without disconnects: %v", reorgs)
+	}
+
+	// A fork from height 5 with the same work does not change the tip
+	fork := mineFork(main[4], 5)
+	if err := chain.AddHeaders(fork); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if chain.Tip().Hash != main[9].Hash() || len(reorgs) != 1 {
+		t.Errorf("Fork with equal work should not become best chain")
+	}
+	if len(chain.Tips()) != 2 {
+		t.Errorf("There should be two tips (%d)", len(chain.Tips()))
+	}
+
+	// One more header on the fork makes it the best chain
+	fork = append(fork, mineHeaders(fork[4], 1)...)
+	if err := chain.AddHeaders(fork[5:]); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if chain.Tip().Hash != fork[5].Hash() || chain.Height() != 11 {
+		t.Fatalf("Fork with more work should be best chain")
+	}
+	if len(reorgs) != 2 {
+		t.Fatalf("Expected a reorg")
+	}
+	reorg := reorgs[1]
+	if reorg.Fork.Height != 5 || len(reorg.Disconnected) != 5 || len(reorg.Connected) != 6 {
+		t.Fatalf("Wrong reorg (fork at %d, %d disconnected, %d connected)",
+			reorg.Fork.Height, len(reorg.Disconnected), len(reorg.Connected))
+	}
+	if reorg.Disconnected[0].Hash != main[9].Hash() || reorg.Connected[0].Hash != fork[0].Hash() {
+		t.Errorf("Disconnected and connected headers should be in order")
+	}
+	for i, node := range reorg.Connected {
+		if chain.NodeAt(6+i) != node || !chain.Contains(node) {
+			t.Errorf("Connected node %d is not in best chain", i)
+		}
+	}
+	for _, node := range reorg.Disconnected {
+		if chain.Contains(node) {
+			t.Errorf("Disconnected node %v is still in best chain", node.Hash)
+		}
+	}
+}
+
+func TestOpenHeaderChain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "headers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "headers.dat")
+
+	genesis := RegTestParams.GenesisHeader
+	chain, err := OpenHeaderChain(path, &RegTestParams)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	main := mineHeaders(genesis, 10)
+	fork := mineFork(main[2], 3)
+	if err := chain.AddHeaders(main); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := chain.AddHeaders(fork); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tip := chain.Tip()
+	chain.Close()
+
+	// Simulate a crash while writing a record
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.Write(make([]byte, 10))
+	file.Close()
+
+	chain, err = OpenHeaderChain(path, &RegTestParams)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer chain.Close()
+	if chain.Tip().Hash != tip.Hash || chain.Tip().ChainWork.Cmp(tip.ChainWork) != 0 {
+		t.Errorf("Wrong tip after reopening (%v)", chain.Tip().Hash)
+	}
+	if node := chain.Lookup(fork[2].Hash()); node == nil || node.Height != 6 {
+		t.Errorf("Fork not restored after reopening")
+	}
+	if err := chain.AddHeaders(mineHeaders(main[9], 1)); err != nil || chain.Height() != 11 {
+		t.Errorf("Chain should be extendable after reopening (%v)", err)
+	}
+
+	// A store for a different genesis block is rejected
+	if _, err := OpenHeaderChain(path, &TestNet3Params); err == nil {
+		t.Errorf("Opening with a different genesis block should fail")
+	}
+}
+
+func TestHeaderChainCheckpoints(t *testing.T) {
+	genesis := RegTestParams.GenesisHeader
+	main := mineHeaders(genesis, 10)
+	params := RegTestParams
+	params.Checkpoints = []Checkpoint{{5, main[4].Hash()}}
+	chain := NewHeaderChain(&params)
+
+	// A header at the checkpoint height must match
+	fork := append(append([]Header{}, main[:4]...), mineFork(main[3], 2)...)
+	if err := chain.AddHeaders(fork); !errors.Is(err, ErrCheckpointMismatch) {
+		t.Errorf("Expected checkpoint mismatch, got '%v'", err)
+	}
+
+	// Once the checkpoint is in the chain, no forks before it are accepted
+	if err := chain.AddHeaders(main); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := chain.AddHeaders(mineFork(main[2], 10)); !errors.Is(err, ErrForkBeforeCheckpoint) {
+		t.Errorf("Expected fork before checkpoint error, got '%v'", err)
+	}
+	if err := chain.AddHeaders(mineFork(main[6], 10)); err != nil {
+		t.Errorf("Forks after the checkpoint should be accepted: %v", err)
+	}
+}
@@ -0,0 +1,185 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// ConsensusParams holds the consensus rules which differ between the networks
+type ConsensusParams struct {
+	PowLimit                    *big.Int      // easiest allowed target
+	PowTargetTimespan           time.Duration // time between difficulty adjustments
+	PowTargetSpacing            time.Duration // time between blocks
+	PowAllowMinDifficultyBlocks bool          // testnet: allow blocks with PowLimit after 20 minutes
+	PowNoRetargeting            bool          // regtest: never change difficulty
+	EnforceBIP94                bool          // testnet4: timewarp fix and retarget from first block
+
+	// Heights from which on the minimum block versions are enforced
+	BIP34Height int // version 2, height in coinbase
+	BIP66Height int // version 3, strict DER signatures
+	BIP65Height int // version 4, OP_CHECKLOCKTIMEVERIFY
+
+	// Activation heights of soft forks without version requirement
+	CSVHeight    int // BIP68, BIP112 and BIP113
+	SegwitHeight int // BIP141, BIP143 and BIP147
+
+	// Number of blocks after which the block subsidy is halved
+	SubsidyHalvingInterval int
+
+	// Blocks which are validated with other script flags than
+	// GetBlockScriptFlags would return (they violate later soft forks)
+	ScriptFlagExceptions map[Hash]ScriptFlags
+}
+
+// DifficultyAdjustmentInterval returns the number of blocks between
+// difficulty adjustments (2016)
+func (params *ConsensusParams) DifficultyAdjustmentInterval() int {
+	return int(params.PowTargetTimespan / params.PowTargetSpacing)
+}
+
+// Blocks may not be more than two hours ahead of our time
+const MAX_FUTURE_BLOCK_TIME = 2 * time.Hour
+
+// Testnet4 (BIP94): the first block of a difficulty period may not be more
+// than 10 minutes before the previous block
+const MAX_TIMEWARP = 10 * time.Minute
+
+// Number of previous blocks used for the median time past
+const MEDIAN_TIME_SPAN = 11
+
+// Errors returned by the header checks (the strings are the reject reasons
+// used by bitcoin core)
+var (
+	ErrBadDiffBits = errors.New("bad-diffbits")
+	ErrTimeTooOld  = errors.New("time-too-old")
+	ErrTimeTooNew  = errors.New("time-too-new")
+	ErrBadVersion  = errors.New("bad-version")
+	ErrTimewarp    = errors.New("time-timewarp-attack")
+)
+
+// MedianTimePast returns the median of the timestamps of this node and its
+// 10 predecessors. A new block must have a timestamp after that.
+func (node *HeaderNode) MedianTimePast() time.Time {
+	times := make([]int64, 0, MEDIAN_TIME_SPAN)
+	for ; node != nil && len(times) < MEDIAN_TIME_SPAN; node = node.Parent {
+		times = append(times, node.Timestamp.Unix())
+	}
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	return time.Unix(times[len(times)/2], 0)
+}
+
+// CalcNextWorkRequired returns the bits a header following prev must have
+func CalcNextWorkRequired(prev *HeaderNode, header Header, params *ConsensusParams) Compact {
+	powLimit := TargetToCompact(params.PowLimit)
+	if prev == nil {
+		return powLimit
+	}
+
+	// Only change once per difficulty adjustment interval
+	interval := params.DifficultyAdjustmentInterval()
+	if (prev.Height+1)%interval != 0 {
+		if params.PowAllowMinDifficultyBlocks {
+			// Special difficulty rule for testnet: If the new block's
+			// timestamp is more than twice the target spacing after the
+			// previous block, allow mining of a min-difficulty block.
+			if header.Timestamp.After(prev.Timestamp.Add(2 * params.PowTargetSpacing)) {
+				return powLimit
+			}
+			// Otherwise return the bits of the last block which was not
+			// mined with the special rule
+			node := prev
+			for node.Parent != nil && node.Height%interval != 0 && node.Bits == powLimit {
+				node = node.Parent
+			}
+			return node.Bits
+		}
+		return prev.Bits
+	}
+
+	// Go back by what we want to be 14 days worth of blocks
+	first := prev.Ancestor(prev.Height - (interval - 1))
+	return CalculateNextWorkRequired(prev, first.Timestamp, params)
+}
+
+// CalculateNextWorkRequired computes the new target at a difficulty
+// adjustment: the target of the last block scaled by the time the last
+// interval actually took, limited to a factor of 4 in both directions
+func CalculateNextWorkRequired(prev *HeaderNode, firstBlockTime time.Time, params *ConsensusParams) Compact {
+	if params.PowNoRetargeting {
+		return prev.Bits
+	}
+
+	timespan := prev.Timestamp.Unix() - firstBlockTime.Unix()
+	targetTimespan := int64(params.PowTargetTimespan / time.Second)
+	if timespan < targetTimespan/4 {
+		timespan = targetTimespan / 4
+	}
+	if timespan > targetTimespan*4 {
+		timespan = targetTimespan * 4
+	}
+
+	target := CompactToTarget(prev.Bits)
+	if params.EnforceBIP94 {
+		// Use the first block of the period, as the last one may have
+		// been mined with minimum difficulty
+		first := prev.Ancestor(prev.Height - (params.DifficultyAdjustmentInterval() - 1))
+		target = CompactToTarget(first.Bits)
+	}
+	target.Mul(target, big.NewInt(timespan))
+	target.Div(target, big.NewInt(targetTimespan))
+	if target.Cmp(params.PowLimit) > 0 {
+		target = params.PowLimit
+	}
+	return TargetToCompact(target)
+}
+
+// CheckHeader does the context free checks of a header: the proof of work
+// must be valid and the target not above the limit
+func CheckHeader(header Header, params *ConsensusParams) error {
+	if err := header.CheckProofOfWork(); err != nil {
+		return err
+	}
+	if CompactToTarget(header.Bits).Cmp(params.PowLimit) > 0 {
+		return fmt.Errorf("%w: target above limit (bits 0x%08x)", ErrBadBits, uint32(header.Bits))
+	}
+	return nil
+}
+
+// ContextualCheckHeader checks a header against its predecessor prev: the
+// difficulty must follow the retargeting rules, the timestamp must be after
+// the median time past (and the BIP94 timewarp limit) and not too far in the
+// future, and the version must satisfy the BIP34/65/66 minimums.
+func ContextualCheckHeader(header Header, prev *HeaderNode, params *ConsensusParams, now time.Time) error {
+	height := prev.Height + 1
+
+	expectedBits := CalcNextWorkRequired(prev, header, params)
+	if header.Bits != expectedBits {
+		return fmt.Errorf("%w: incorrect proof of work at height %d (difficulty %v, expected %v)",
+			ErrBadDiffBits, height, GetDifficulty(header.Bits), GetDifficulty(expectedBits))
+	}
+
+	if mtp := prev.MedianTimePast(); !header.Timestamp.After(mtp) {
+		return fmt.Errorf("%w: block's timestamp %v is not after median time past %v",
+			ErrTimeTooOld, header.Timestamp, mtp)
+	}
+	if params.EnforceBIP94 && height%params.DifficultyAdjustmentInterval() == 0 &&
+		header.Timestamp.Before(prev.Timestamp.Add(-MAX_TIMEWARP)) {
+		return fmt.Errorf("%w: block's timestamp %v is too early", ErrTimewarp, header.Timestamp)
+	}
+	if header.Timestamp.After(now.Add(MAX_FUTURE_BLOCK_TIME)) {
+		return fmt.Errorf("%w: block timestamp %v too far in the future", ErrTimeTooNew, header.Timestamp)
+	}
+
+	// The version is a signed integer in bitcoin core
+	version := int32(header.Version)
+	if (version < 2 && height >= params.BIP34Height) ||
+		(version < 3 && height >= params.BIP66Height) ||
+		(version < 4 && height >= params.BIP65Height) {
+		return fmt.Errorf("%w(0x%08x): rejected nVersion=0x%08x block at height %d",
+			ErrBadVersion, header.Version, header.Version, height)
+	}
+	return nil
+}
@@ -0,0 +1,164 @@
+package network
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCalculateNextWorkRequired(t *testing.T) {
+	// Test cases from bitcoin core (src/test/pow_tests.cpp)
+	tests := []struct {
+		lastRetargetTime int64
+		height           int
+		time             int64
+		bits             Compact
+		expected         Compact
+	}{
+		{1261130161, 32255, 1262152739, 0x1d00ffff, 0x1d00d86a}, // block 30240 - 32255
+		{1231006505, 2015, 1233061996, 0x1d00ffff, 0x1d00ffff},  // pow limit
+		{1279008237, 68543, 1279297671, 0x1c05a3f4, 0x1c0168fd}, // lower limit actual
+		{1263163443, 46367, 1269211443, 0x1c387f6f, 0x1d00e1fd}, // upper limit actual
+	}
+	for _, test := range tests {
+		prev := &HeaderNode{
+			Header: Header{Timestamp: time.Unix(test.time, 0), Bits: test.bits},
+			Height: test.height,
+		}
+		bits := CalculateNextWorkRequired(prev, time.Unix(test.lastRetargetTime, 0), &MainNetParams.Consensus)
+		if bits != test.expected {
+			t.Errorf("Wrong bits at height %d: 0x%08x!=0x%08x", test.height+1, uint32(bits), uint32(test.expected))
+		}
+	}
+}
+
+// testNodes builds a chain of nodes (without valid proof of work) with the
+// given bits, spaced 10 minutes apart
+func testNodes(bits []Compact) *HeaderNode {
+	var node *HeaderNode
+	timestamp := time.Unix(1296688602, 0)
+	for i, b := range bits {
+		node = &HeaderNode{
+			Header: Header{Timestamp: timestamp, Bits: b},
+			Height: i,
+			Parent: node,
+		}
+		timestamp = timestamp.Add(10 * time.Minute)
+	}
+	return node
+}
+
+func TestCalcNextWorkRequiredMinDifficulty(t *testing.T) {
+	params := &TestNet3Params.Consensus
+	powLimit := TargetToCompact(params.PowLimit)
+	prev := testNodes([]Compact{powLimit, 0x1c0fffff, 0x1c0fffff, powLimit, powLimit})
+
+	// Within 20 minutes, the last regular difficulty is required
+	header := Header{Timestamp: prev.Timestamp.Add(20 * time.Minute)}
+	if bits := CalcNextWorkRequired(prev, header, params); bits != 0x1c0fffff {
+		t.Errorf("Expected last regular difficulty, got 0x%08x", uint32(bits))
+	}
+
+	// After 20 minutes, minimum difficulty is allowed
+	header.Timestamp = header.Timestamp.Add(time.Second)
+	if bits := CalcNextWorkRequired(prev, header, params); bits != powLimit {
+		t.Errorf("Expected minimum difficulty, got 0x%08x", uint32(bits))
+	}
+
+	// But not on mainnet
+	if bits := CalcNextWorkRequired(prev, header, &MainNetParams.Consensus); bits != prev.Bits {
+		t.Errorf("Expected difficulty of previous block, got 0x%08x", uint32(bits))
+	}
+}
+
+func TestMedianTimePast(t *testing.T) {
+	node := testNodes(make([]Compact, 20))
+	// The median of the last 11 blocks is the 6th last block
+	if mtp := node.MedianTimePast(); !mtp.Equal(node.Ancestor(14).Timestamp) {
+		t.Errorf("Wrong median time past %v", mtp)
+	}
+	// Timestamps need not be in order
+	node.Timestamp = time.Unix(0, 0)
+	if mtp := node.MedianTimePast(); !mtp.Equal(node.Ancestor(13).Timestamp) {
+		t.Errorf("Wrong median time past %v", mtp)
+	}
+	// Genesis block only
+	if mtp := node.Ancestor(0).MedianTimePast(); !mtp.Equal(node.Ancestor(0).Timestamp) {
+		t.Errorf("Wrong median time past %v", mtp)
+	}
+}
+
+func TestContextualCheckHeader(t *testing.T) {
+	genesis := RegTestParams.GenesisHeader
+	chain := NewHeaderChain(&RegTestParams)
+	if err := chain.AddHeaders(mineHeaders(genesis, 20)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tip := chain.Tip()
+	now := tip.Timestamp.Add(time.Minute)
+
+	header := mineHeader(tip.Header, tip.Timestamp.Add(time.Minute))
+	if err := ContextualCheckHeader(header, tip, &RegTestParams.Consensus, now); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	header = mineHeader(tip.Header, tip.MedianTimePast())
+	if err := ContextualCheckHeader(header, tip, &RegTestParams.Consensus, now); !errors.Is(err, ErrTimeTooOld) {
+		t.Errorf("Expected time too old error, got '%v'", err)
+	}
+
+	header = mineHeader(tip.Header, now.Add(MAX_FUTURE_BLOCK_TIME+time.Second))
+	if err := ContextualCheckHeader(header, tip, &RegTestParams.Consensus, now); !errors.Is(err, ErrTimeTooNew) {
+		t.Errorf("Expected time too new error, got '%v'", err)
+	}
+
+	header = mineHeader(tip.Header, tip.Timestamp.Add(time.Minute))
+	header.Version = 3
+	if err := ContextualCheckHeader(header, tip, &RegTestParams.Consensus, now); !errors.Is(err, ErrBadVersion) {
+		t.Errorf("Expected bad version error, got '%v'", err)
+	}
+
+	header = mineHeader(tip.Header, tip.Timestamp.Add(time.Minute))
+	header.Bits = 0x1f7fffff
+	if err := ContextualCheckHeader(header, tip, &RegTestParams.Consensus, now); !errors.Is(err, ErrBadDiffBits) {
+		t.Errorf("Expected bad diffbits error, got '%v'", err)
+	}
+}
+
+func TestCheckHeader(t *testing.T) {
+	header := RegTestParams.GenesisHeader
+	if err := CheckHeader(header, &RegTestParams.Consensus); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	// Easier than allowed on mainnet
+	if err := CheckHeader(header, &MainNetParams.Consensus); !errors.Is(err, ErrBadBits) {
+		t.Errorf("Expected bad bits error, got '%v'", err)
+	}
+}
+
+func TestBIP94(t *testing.T) {
+	params := TestNet4Params.Consensus
+	interval := params.DifficultyAdjustmentInterval()
+	bits := make([]Compact, interval)
+	for i := range bits {
+		bits[i] = 0x1c0fffff
+	}
+	// The last block of the period was mined with minimum difficulty
+	bits[interval-1] = TargetToCompact(params.PowLimit)
+	prev := testNodes(bits)
+
+	// The new target is computed from the first block of the period (the
+	// period took 2015 * 10 minutes instead of 2016 * 10 minutes)
+	first := prev.Ancestor(0)
+	if next := CalculateNextWorkRequired(prev, first.Timestamp, &params); next != 0x1c0ffdf6 {
+		t.Errorf("Wrong bits after retarget 0x%08x", uint32(next))
+	}
+
+	// Timewarp protection at the first block of a period
+	header := Header{Version: 4, Bits: CalcNextWorkRequired(prev, Header{}, &params)}
+	header.Timestamp = prev.Timestamp.Add(-MAX_TIMEWARP - time.Second)
+	now := prev.Timestamp
+	if err := ContextualCheckHeader(header, prev, &params, now); !errors.Is(err, ErrTimewarp) {
+		t.Errorf("Expected timewarp error, got '%v'", err)
+	}
+}
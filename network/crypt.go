@@ -1,8 +1,6 @@
 package network
 
 import (
-	"crypto/ecdsa"
-	"crypto/elliptic"
 	"crypto/sha256"
 	"encoding/binary"
 	"encoding/hex"
@@ -10,8 +8,7 @@ import (
 	"math"
 	"math/big"
 
-	"golang.org/x/crypto/cryptobyte"
-	"golang.org/x/crypto/cryptobyte/asn1"
+	"golang.org/x/crypto/ripemd160"
 )
 
 //Hash
@@ -23,6 +20,12 @@ func (h Hash) String() string {
 	return fmt.Sprintf("%x", h[:])
 }
 
+// RPCString returns the hash in reversed byte order, as it is displayed by
+// bitcoin core and block explorers
+func (h Hash) RPCString() string {
+	return fmt.Sprintf("%x", reversed(h[:]))
+}
+
 func StringToHash(s string) (Hash, error) {
 	// https://btcinformation.org/en/glossary/internal-byte-order
 	var h Hash
@@ -39,6 +42,12 @@ func RPCStringToHash(s string) (Hash, error) {
 	return StringToHash(reversedHexString(s))
 }
 
+// HashToBig interprets the hash as little endian 256 bit number (which is how
+// block hashes are compared to the target)
+func HashToBig(h Hash) *big.Int {
+	return new(big.Int).SetBytes(reversed(h[:]))
+}
+
 func doubleHash(data []byte) Hash {
 	digest1 := sha256.Sum256(data)
 	digest2 := sha256.Sum256(digest1[:])
@@ -50,6 +59,30 @@ func checksum(data []byte) uint32 {
 	return binary.LittleEndian.Uint32(digest[:4])
 }
 
+// Hash160 computes ripemd160(sha256(data)), which is used for the hashes in
+// P2PKH, P2SH and P2WPKH scripts
+func Hash160(data []byte) []byte {
+	digest := sha256.Sum256(data)
+	h := ripemd160.New()
+	h.Write(digest[:])
+	return h.Sum(nil)
+}
+
+// TaggedHash computes sha256(sha256(tag) || sha256(tag) || data...) as
+// defined in BIP340, so that hashes for different purposes can't collide
+func TaggedHash(tag string, data ...[]byte) Hash {
+	tagHash := sha256.Sum256([]byte(tag))
+	h := sha256.New()
+	h.Write(tagHash[:])
+	h.Write(tagHash[:])
+	for _, d := range data {
+		h.Write(d)
+	}
+	var out Hash
+	copy(out[:], h.Sum(nil))
+	return out
+}
+
 // Bits
 //=====
 
@@ -62,50 +95,69 @@ func GetDifficulty(b Compact) float64 {
 	return float64(0x0000FFFF) / float64(mant) * math.Pow(2.0, 8*float64(0x1d-exp))
 }
 
-// Public keys
-//============
-
-func PublicKeyFromString(s string) ecdsa.PublicKey {
+// CompactToTarget converts the compact representation of the target (as used
+// in the bits field of the block header) to a big integer. The format is
+// like a floating point number with one byte exponent and three bytes
+// mantissa: target = mantissa * 256^(exponent-3). Bit 24 is a sign bit, so
+// the target may come out negative, which is never valid for a block. See:
+// https://developer.bitcoin.org/reference/block_chain.html#target-nbits
+func CompactToTarget(b Compact) *big.Int {
+	exp := uint(uint32(b) >> 24)
+	mant := int64(uint32(b) & 0x007FFFFF)
+	var target *big.Int
+	if exp <= 3 {
+		target = big.NewInt(mant >> (8 * (3 - exp)))
+	} else {
+		target = new(big.Int).Lsh(big.NewInt(mant), 8*(exp-3))
+	}
+	if uint32(b)&0x00800000 != 0 {
+		target.Neg(target)
+	}
+	return target
+}
 
-	buffer, err := hex.DecodeString(s)
-	if err != nil {
-		panic("Could not decode public key")
+// TargetToCompact converts a target to its compact representation. This is
+// lossy, as only the three most significant bytes are kept.
+func TargetToCompact(target *big.Int) Compact {
+	if target.Sign() == 0 {
+		return 0
 	}
-	if buffer[0] != 0x04 {
-		panic("Public key representation should start with 0x04")
+	abs := new(big.Int).Abs(target)
+	exp := uint((abs.BitLen() + 7) / 8)
+	var mant uint32
+	if exp <= 3 {
+		mant = uint32(abs.Uint64() << (8 * (3 - exp)))
+	} else {
+		mant = uint32(new(big.Int).Rsh(abs, 8*(exp-3)).Uint64())
 	}
-	if len(buffer) != 1+2*32 {
-		panic("Public key reprentation has wrong length")
+	// The mantissa must not have the sign bit set, so shift it one byte
+	// to the right if necessary
+	if mant&0x00800000 != 0 {
+		mant >>= 8
+		exp++
 	}
-	toBigInt := func(n []byte) *big.Int {
-		X := big.NewInt(0)
-		X.SetBytes(n)
-		if !true {
-			X.SetBytes(reverse(n))
-		}
-		return X
+	c := uint32(exp)<<24 | mant
+	if target.Sign() < 0 {
+		c |= 0x00800000
 	}
-	X := toBigInt(buffer[1:33])
-	Y := toBigInt(buffer[33:65])
-	curve := elliptic.P256()
-	pub := ecdsa.PublicKey{Curve: curve, X: X, Y: Y}
-	fmt.Println("pub: ", pub)
-	return pub
+	return Compact(c)
+}
+
+// CompactOverflows returns true if the target encoded in b does not fit into
+// 256 bits
+func CompactOverflows(b Compact) bool {
+	exp := uint32(b) >> 24
+	mant := uint32(b) & 0x007FFFFF
+	return mant != 0 && (exp > 34 || (mant > 0xFF && exp > 33) || (mant > 0xFFFF && exp > 32))
 }
 
-func VerifyASN1(pub *ecdsa.PublicKey, hash, sig []byte) bool {
-	// shamelessly copied from go1.15
-	var (
-		r, s  = &big.Int{}, &big.Int{}
-		inner cryptobyte.String
-	)
-	input := cryptobyte.String(sig)
-	if !input.ReadASN1(&inner, asn1.SEQUENCE) ||
-		!input.Empty() ||
-		!inner.ReadASN1Integer(r) ||
-		!inner.ReadASN1Integer(s) ||
-		!inner.Empty() {
-		return false
+// CalcWork returns the expected number of hashes needed to find a block with
+// the target given by bits, i.e. 2^256 / (target + 1)
+func CalcWork(b Compact) *big.Int {
+	target := CompactToTarget(b)
+	if target.Sign() <= 0 || CompactOverflows(b) {
+		return big.NewInt(0)
 	}
-	return ecdsa.Verify(pub, hash, r, s)
+	numerator := new(big.Int).Lsh(big.NewInt(1), 256)
+	return numerator.Div(numerator, target.Add(target, big.NewInt(1)))
 }
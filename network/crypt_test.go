@@ -1,6 +1,7 @@
 package network
 
 import (
+	"math/big"
 	"reflect"
 	"testing"
 )
@@ -69,3 +70,31 @@ func TestGetDifficulty(t *testing.T) {
 	}
 
 }
+
+func TestCompactToTarget(t *testing.T) {
+	// Examples from https://developer.bitcoin.org/reference/block_chain.html#target-nbits
+	vals := []Compact{0x01003456, 0x01123456, 0x02008000, 0x05009234, 0x04923456, 0x04123456, 0x1d00ffff}
+	targets := []string{"0", "12", "80", "92340000", "-12345600", "12345600", "ffff0000000000000000000000000000000000000000000000000000"}
+	compacts := []Compact{0x00000000, 0x01120000, 0x02008000, 0x05009234, 0x04923456, 0x04123456, 0x1d00ffff}
+	for i, x := range vals {
+		target := CompactToTarget(x)
+		e, _ := new(big.Int).SetString(targets[i], 16)
+		if target.Cmp(e) != 0 {
+			t.Errorf("Targets don't match for 0x%08x: %x!=%x", uint32(x), target, e)
+		}
+		c := TargetToCompact(target)
+		if c != compacts[i] {
+			t.Errorf("Compacts don't match for %x: 0x%08x!=0x%08x", target, uint32(c), uint32(compacts[i]))
+		}
+	}
+}
+
+func TestCompactOverflows(t *testing.T) {
+	vals := []Compact{0x1d00ffff, 0x2100ffff, 0x220000ff, 0x2200ffff, 0xff000000}
+	overflows := []bool{false, false, false, true, false}
+	for i, x := range vals {
+		if CompactOverflows(x) != overflows[i] {
+			t.Errorf("Overflow for 0x%08x should be %v", uint32(x), overflows[i])
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package network
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"os"
+)
+
+// Size of one record in the header store: hash, height, chain work, header
+const headerRecordSize = 32 + 4 + 32 + 80
+
+// headerStore keeps the nodes of a header chain in an append only file.
+// Parents are always written before their children, so the file can be
+// loaded in one pass.
+type headerStore struct {
+	file   *os.File
+	size   int64  // size of the valid part of the file
+	buffer []byte // records not yet written
+}
+
+func openHeaderStore(path string) (*headerStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &headerStore{file: file}, nil
+}
+
+func marshalHeaderRecord(out []byte, node *HeaderNode) []byte {
+	out = MarshalHash(out, node.Hash)
+	out = MarshalUint32(out, uint32(node.Height))
+	work := node.ChainWork.Bytes()
+	out = MarshalBytes(out, make([]byte, 32-len(work)))
+	out = MarshalBytes(out, work)
+	return MarshalHeader(out, node.Header)
+}
+
+// load reads all records from the file and calls fn for each of them. A
+// partially written record at the end of the file (e.g. after a crash) is
+// discarded.
+func (store *headerStore) load(fn func(header Header, hash Hash, height int, chainWork *big.Int) error) error {
+	if _, err := store.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(store.file)
+	if err != nil {
+		return err
+	}
+	count := len(data) / headerRecordSize
+	store.size = int64(count * headerRecordSize)
+	if int64(len(data)) != store.size {
+		if err := store.file.Truncate(store.size); err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < count; i++ {
+		// The length is checked above, so unmarshalling can't fail
+		record := data[i*headerRecordSize : (i+1)*headerRecordSize]
+		hash, record, _ := UnmarshalHash(record)
+		height, record, _ := UnmarshalUint32(record)
+		work, record, _ := UnmarshalBytes(record, 32)
+		header, _, _ := UnmarshalHeader(record)
+		if header.Hash() != hash {
+			return fmt.Errorf("corrupt header store: record %d has wrong hash", i)
+		}
+		if err := fn(header, hash, int(height), new(big.Int).SetBytes(work)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (store *headerStore) empty() bool {
+	return store.size == 0 && len(store.buffer) == 0
+}
+
+// append adds a record for node, which is written on the next flush
+func (store *headerStore) append(node *HeaderNode) {
+	store.buffer = marshalHeaderRecord(store.buffer, node)
+}
+
+// flush writes the buffered records to the file
+func (store *headerStore) flush() error {
+	if len(store.buffer) == 0 {
+		return nil
+	}
+	n, err := store.file.WriteAt(store.buffer, store.size)
+	store.size += int64(n)
+	store.buffer = store.buffer[n:]
+	if err != nil {
+		return err
+	}
+	store.buffer = nil
+	return store.file.Sync()
+}
+
+func (store *headerStore) close() error {
+	err := store.flush()
+	if closeErr := store.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
@@ -0,0 +1,1460 @@
+package network
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/ripemd160"
+)
+
+// Verification flags
+//===================
+
+// ScriptFlags select the rules enforced by the interpreter, with the same
+// meaning as bitcoin core's SCRIPT_VERIFY_* flags
+type ScriptFlags uint32
+
+const (
+	SCRIPT_VERIFY_NONE ScriptFlags = 0
+
+	// Evaluate P2SH subscripts (BIP16)
+	SCRIPT_VERIFY_P2SH ScriptFlags = 1 << 0
+	// Require public keys to be compressed or uncompressed and signatures
+	// to be strict DER with a defined hash type
+	SCRIPT_VERIFY_STRICTENC ScriptFlags = 1 << 1
+	// Require strict DER encoded signatures (BIP66)
+	SCRIPT_VERIFY_DERSIG ScriptFlags = 1 << 2
+	// Require signatures with low S values (BIP146)
+	SCRIPT_VERIFY_LOW_S ScriptFlags = 1 << 3
+	// Require the extra CHECKMULTISIG stack element to be empty (BIP147)
+	SCRIPT_VERIFY_NULLDUMMY ScriptFlags = 1 << 4
+	// Require scriptSigs to be push only
+	SCRIPT_VERIFY_SIGPUSHONLY ScriptFlags = 1 << 5
+	// Require minimal pushes and number encodings
+	SCRIPT_VERIFY_MINIMALDATA ScriptFlags = 1 << 6
+	// Fail on the NOPs reserved for soft forks
+	SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_NOPS ScriptFlags = 1 << 7
+	// Require a single element on the stack after evaluation
+	SCRIPT_VERIFY_CLEANSTACK ScriptFlags = 1 << 8
+	// Enable OP_CHECKLOCKTIMEVERIFY (BIP65)
+	SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY ScriptFlags = 1 << 9
+	// Enable OP_CHECKSEQUENCEVERIFY (BIP112)
+	SCRIPT_VERIFY_CHECKSEQUENCEVERIFY ScriptFlags = 1 << 10
+	// Evaluate segwit programs (BIP141)
+	SCRIPT_VERIFY_WITNESS ScriptFlags = 1 << 11
+	// Fail on witness versions reserved for soft forks
+	SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_WITNESS_PROGRAM ScriptFlags = 1 << 12
+	// Require the argument of OP_IF/NOTIF in segwit v0 to be empty or 1
+	SCRIPT_VERIFY_MINIMALIF ScriptFlags = 1 << 13
+	// Require failing signatures to be empty (BIP146)
+	SCRIPT_VERIFY_NULLFAIL ScriptFlags = 1 << 14
+	// Require compressed public keys in segwit v0
+	SCRIPT_VERIFY_WITNESS_PUBKEYTYPE ScriptFlags = 1 << 15
+	// Fail on OP_CODESEPARATOR and signatures found in legacy script code
+	SCRIPT_VERIFY_CONST_SCRIPTCODE ScriptFlags = 1 << 16
+	// Evaluate taproot (BIP341) and tapscript (BIP342)
+	SCRIPT_VERIFY_TAPROOT ScriptFlags = 1 << 17
+	// Fail on taproot leaf versions reserved for soft forks
+	SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_TAPROOT_VERSION ScriptFlags = 1 << 18
+	// Fail on OP_SUCCESSx opcodes in tapscript
+	SCRIPT_VERIFY_DISCOURAGE_OP_SUCCESS ScriptFlags = 1 << 19
+	// Fail on tapscript public keys with unknown types
+	SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_PUBKEYTYPE ScriptFlags = 1 << 20
+)
+
+var scriptFlagNames = []struct {
+	flag ScriptFlags
+	name string
+}{
+	{SCRIPT_VERIFY_P2SH, "P2SH"},
+	{SCRIPT_VERIFY_STRICTENC, "STRICTENC"},
+	{SCRIPT_VERIFY_DERSIG, "DERSIG"},
+	{SCRIPT_VERIFY_LOW_S, "LOW_S"},
+	{SCRIPT_VERIFY_NULLDUMMY, "NULLDUMMY"},
+	{SCRIPT_VERIFY_SIGPUSHONLY, "SIGPUSHONLY"},
+	{SCRIPT_VERIFY_MINIMALDATA, "MINIMALDATA"},
+	{SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_NOPS, "DISCOURAGE_UPGRADABLE_NOPS"},
+	{SCRIPT_VERIFY_CLEANSTACK, "CLEANSTACK"},
+	{SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY, "CHECKLOCKTIMEVERIFY"},
+	{SCRIPT_VERIFY_CHECKSEQUENCEVERIFY, "CHECKSEQUENCEVERIFY"},
+	{SCRIPT_VERIFY_WITNESS, "WITNESS"},
+	{SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_WITNESS_PROGRAM, "DISCOURAGE_UPGRADABLE_WITNESS_PROGRAM"},
+	{SCRIPT_VERIFY_MINIMALIF, "MINIMALIF"},
+	{SCRIPT_VERIFY_NULLFAIL, "NULLFAIL"},
+	{SCRIPT_VERIFY_WITNESS_PUBKEYTYPE, "WITNESS_PUBKEYTYPE"},
+	{SCRIPT_VERIFY_CONST_SCRIPTCODE, "CONST_SCRIPTCODE"},
+	{SCRIPT_VERIFY_TAPROOT, "TAPROOT"},
+	{SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_TAPROOT_VERSION, "DISCOURAGE_UPGRADABLE_TAPROOT_VERSION"},
+	{SCRIPT_VERIFY_DISCOURAGE_OP_SUCCESS, "DISCOURAGE_OP_SUCCESS"},
+	{SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_PUBKEYTYPE, "DISCOURAGE_UPGRADABLE_PUBKEYTYPE"},
+}
+
+// String returns the flags as comma separated list of names (as used in
+// bitcoin core's test data)
+func (f ScriptFlags) String() string {
+	var names []string
+	for _, n := range scriptFlagNames {
+		if f&n.flag != 0 {
+			names = append(names, n.name)
+		}
+	}
+	if len(names) == 0 {
+		return "NONE"
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseScriptFlags parses a comma separated list of flag names
+func ParseScriptFlags(s string) (ScriptFlags, error) {
+	var flags ScriptFlags
+	for _, name := range strings.Split(s, ",") {
+		if name == "" || name == "NONE" {
+			continue
+		}
+		found := false
+		for _, n := range scriptFlagNames {
+			if n.name == name {
+				flags |= n.flag
+				found = true
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("unknown script flag '%s'", name)
+		}
+	}
+	return flags, nil
+}
+
+// Errors
+//=======
+
+// Script errors, with the messages of bitcoin core's ScriptErrorString
+var (
+	ErrEvalFalse                   = errors.New("Script evaluated without error but finished with a false/empty top stack element")
+	ErrOpReturn                    = errors.New("OP_RETURN was encountered")
+	ErrScriptSize                  = errors.New("Script is too big")
+	ErrPushSize                    = errors.New("Push value size limit exceeded")
+	ErrOpCount                     = errors.New("Operation limit exceeded")
+	ErrStackSize                   = errors.New("Stack size limit exceeded")
+	ErrSigCount                    = errors.New("Signature count negative or greater than pubkey count")
+	ErrPubKeyCount                 = errors.New("Pubkey count negative or limit exceeded")
+	ErrVerify                      = errors.New("Script failed an OP_VERIFY operation")
+	ErrEqualVerify                 = errors.New("Script failed an OP_EQUALVERIFY operation")
+	ErrCheckMultisigVerify         = errors.New("Script failed an OP_CHECKMULTISIGVERIFY operation")
+	ErrCheckSigVerify              = errors.New("Script failed an OP_CHECKSIGVERIFY operation")
+	ErrNumEqualVerify              = errors.New("Script failed an OP_NUMEQUALVERIFY operation")
+	ErrBadOpcode                   = errors.New("Opcode missing or not understood")
+	ErrDisabledOpcode              = errors.New("Attempted to use a disabled opcode")
+	ErrInvalidStackOperation       = errors.New("Operation not valid with the current stack size")
+	ErrInvalidAltstackOperation    = errors.New("Operation not valid with the current altstack size")
+	ErrUnbalancedConditional       = errors.New("Invalid OP_IF construction")
+	ErrNegativeLocktime            = errors.New("Negative locktime")
+	ErrUnsatisfiedLocktime         = errors.New("Locktime requirement not satisfied")
+	ErrSigHashType                 = errors.New("Signature hash type missing or not understood")
+	ErrSigDER                      = errors.New("Non-canonical DER signature")
+	ErrMinimalData                 = errors.New("Data push larger than necessary")
+	ErrSigPushOnly                 = errors.New("Only push operators allowed in signatures")
+	ErrSigHighS                    = errors.New("Non-canonical signature: S value is unnecessarily high")
+	ErrSigNullDummy                = errors.New("Dummy CHECKMULTISIG argument must be zero")
+	ErrPubKeyType                  = errors.New("Public key is neither compressed or uncompressed")
+	ErrCleanStack                  = errors.New("Stack size must be exactly one after execution")
+	ErrMinimalIf                   = errors.New("OP_IF/NOTIF argument must be minimal")
+	ErrSigNullFail                 = errors.New("Signature must be zero for failed CHECK(MULTI)SIG operation")
+	ErrDiscourageUpgradableNops    = errors.New("NOPx reserved for soft-fork upgrades")
+	ErrDiscourageUpgradableWitness = errors.New("Witness version reserved for soft-fork upgrades")
+	ErrDiscourageUpgradableTaproot = errors.New("Taproot version reserved for soft-fork upgrades")
+	ErrDiscourageOpSuccess         = errors.New("OP_SUCCESSx reserved for soft-fork upgrades")
+	ErrDiscourageUpgradablePubKey  = errors.New("Public key version reserved for soft-fork upgrades")
+	ErrWitnessProgramWrongLength   = errors.New("Witness program has incorrect length")
+	ErrWitnessProgramWitnessEmpty  = errors.New("Witness program was passed an empty witness")
+	ErrWitnessProgramMismatch      = errors.New("Witness program hash mismatch")
+	ErrWitnessMalleated            = errors.New("Witness requires empty scriptSig")
+	ErrWitnessMalleatedP2SH        = errors.New("Witness requires only-redeemscript scriptSig")
+	ErrWitnessUnexpected           = errors.New("Witness provided for non-witness script")
+	ErrWitnessPubKeyType           = errors.New("Using non-compressed keys in segwit")
+	ErrSchnorrSigSize              = errors.New("Invalid Schnorr signature size")
+	ErrSchnorrSigHashType          = errors.New("Invalid Schnorr signature hash type")
+	ErrSchnorrSig                  = errors.New("Invalid Schnorr signature")
+	ErrTaprootWrongControlSize     = errors.New("Invalid Taproot control block size")
+	ErrTapscriptValidationWeight   = errors.New("Too much signature validation relative to witness weight")
+	ErrTapscriptCheckMultisig      = errors.New("OP_CHECKMULTISIG(VERIFY) is not available in tapscript")
+	ErrTapscriptMinimalIf          = errors.New("OP_IF/NOTIF argument must be minimal in tapscript")
+	ErrOpCodeSeparator             = errors.New("Using OP_CODESEPARATOR in non-witness script")
+	ErrSigFindAndDelete            = errors.New("Signature is found in scriptCode")
+)
+
+// Signature checking
+//===================
+
+// SignatureChecker checks signatures and lock times against the spending
+// transaction
+type SignatureChecker interface {
+	// CheckECDSASignature checks a legacy or segwit v0 signature (with
+	// the hash type byte)
+	CheckECDSASignature(sig, pubKey, scriptCode []byte, sigVersion SigVersion) bool
+	// CheckSchnorrSignature checks a taproot signature against a 32 byte
+	// public key, returning the script error if it doesn't verify
+	CheckSchnorrSignature(sig, pubKey []byte, sigVersion SigVersion, execData *ScriptExecutionData) error
+	CheckLockTime(lockTime int64) bool
+	CheckSequence(sequence int64) bool
+}
+
+// TxSignatureChecker checks signatures of an input of a transaction
+type TxSignatureChecker struct {
+	Tx     *Tx
+	Index  int   // the input being verified
+	Amount int64 // value of the spent output
+
+	// TxData caches the hashes shared by all inputs. It must contain the
+	// spent outputs for taproot, it may be nil for legacy and segwit v0.
+	TxData *PrecomputedTxData
+}
+
+func (c *TxSignatureChecker) CheckECDSASignature(sig, pubKey, scriptCode []byte, sigVersion SigVersion) bool {
+	key, err := ParsePublicKey(pubKey)
+	if err != nil || len(sig) == 0 {
+		return false
+	}
+	hashType := uint32(sig[len(sig)-1])
+	signature, err := ParseDERSignatureLax(sig[:len(sig)-1])
+	if err != nil {
+		return false
+	}
+	hash := SignatureHash(scriptCode, c.Tx, c.Index, hashType, c.Amount, sigVersion, c.TxData)
+	return key.Verify(hash[:], signature)
+}
+
+func (c *TxSignatureChecker) CheckSchnorrSignature(sig, pubKey []byte, sigVersion SigVersion, execData *ScriptExecutionData) error {
+	if len(sig) != 64 && len(sig) != 65 {
+		return ErrSchnorrSigSize
+	}
+	hashType := byte(SIGHASH_DEFAULT)
+	if len(sig) == 65 {
+		hashType = sig[64]
+		sig = sig[:64]
+		if hashType == SIGHASH_DEFAULT {
+			return ErrSchnorrSigHashType
+		}
+	}
+	hash, err := TaprootSignatureHash(c.Tx, c.Index, hashType, sigVersion, execData, c.TxData)
+	if err != nil {
+		return ErrSchnorrSigHashType
+	}
+	key, err := ParseXOnlyPublicKey(pubKey)
+	if err != nil || !key.VerifySchnorr(hash[:], sig) {
+		return ErrSchnorrSig
+	}
+	return nil
+}
+
+// CheckLockTime implements OP_CHECKLOCKTIMEVERIFY: the lock time of the
+// transaction must be of the same type (height or time) and at least
+// lockTime, and the input must not be final
+func (c *TxSignatureChecker) CheckLockTime(lockTime int64) bool {
+	txLockTime := int64(c.Tx.LockTime)
+	if (txLockTime < LOCKTIME_THRESHOLD) != (lockTime < LOCKTIME_THRESHOLD) {
+		return false
+	}
+	if lockTime > txLockTime {
+		return false
+	}
+	// The lock time is ignored if the input is final, which would make the
+	// opcode ineffective
+	return c.Tx.TxIn[c.Index].Sequence != SEQUENCE_FINAL
+}
+
+// CheckSequence implements OP_CHECKSEQUENCEVERIFY: the relative lock time
+// of the input (BIP68) must be of the same type and at least sequence
+func (c *TxSignatureChecker) CheckSequence(sequence int64) bool {
+	txSequence := int64(c.Tx.TxIn[c.Index].Sequence)
+	// Relative lock times need version 2 transactions and are disabled if
+	// the most significant bit is set
+	if c.Tx.Version < 2 || txSequence&SEQUENCE_LOCKTIME_DISABLE_FLAG != 0 {
+		return false
+	}
+	const mask = SEQUENCE_LOCKTIME_TYPE_FLAG | SEQUENCE_LOCKTIME_MASK
+	txSequence &= mask
+	sequence &= mask
+	if (txSequence < SEQUENCE_LOCKTIME_TYPE_FLAG) != (sequence < SEQUENCE_LOCKTIME_TYPE_FLAG) {
+		return false
+	}
+	return sequence <= txSequence
+}
+
+// checkSignatureEncoding applies the DERSIG, LOW_S and STRICTENC rules. Empty
+// signatures are always allowed, as a compact way to provide an invalid
+// signature.
+func checkSignatureEncoding(sig []byte, flags ScriptFlags) error {
+	if len(sig) == 0 {
+		return nil
+	}
+	if flags&(SCRIPT_VERIFY_DERSIG|SCRIPT_VERIFY_LOW_S|SCRIPT_VERIFY_STRICTENC) != 0 && !isValidSignatureEncoding(sig) {
+		return ErrSigDER
+	}
+	if flags&SCRIPT_VERIFY_LOW_S != 0 {
+		s, err := ParseDERSignature(sig[:len(sig)-1])
+		if err != nil {
+			return ErrSigDER
+		}
+		if !s.IsLowS() {
+			return ErrSigHighS
+		}
+	}
+	if flags&SCRIPT_VERIFY_STRICTENC != 0 {
+		hashType := sig[len(sig)-1] &^ SIGHASH_ANYONECANPAY
+		if hashType < SIGHASH_ALL || hashType > SIGHASH_SINGLE {
+			return ErrSigHashType
+		}
+	}
+	return nil
+}
+
+func checkPubKeyEncoding(pubKey []byte, flags ScriptFlags, sigVersion SigVersion) error {
+	if flags&SCRIPT_VERIFY_STRICTENC != 0 && !isCompressedOrUncompressedPubKey(pubKey) {
+		return ErrPubKeyType
+	}
+	// Only compressed keys are accepted in segwit
+	if flags&SCRIPT_VERIFY_WITNESS_PUBKEYTYPE != 0 && sigVersion == SigVersionWitnessV0 && !isCompressedPubKey(pubKey) {
+		return ErrWitnessPubKeyType
+	}
+	return nil
+}
+
+func isCompressedOrUncompressedPubKey(pubKey []byte) bool {
+	switch {
+	case len(pubKey) == 65:
+		return pubKey[0] == 0x04
+	case len(pubKey) == 33:
+		return pubKey[0] == 0x02 || pubKey[0] == 0x03
+	}
+	return false
+}
+
+func isCompressedPubKey(pubKey []byte) bool {
+	return len(pubKey) == 33 && (pubKey[0] == 0x02 || pubKey[0] == 0x03)
+}
+
+// Interpreter
+//============
+
+// Limits for tapscript signature checks (BIP342)
+const (
+	VALIDATION_WEIGHT_PER_SIGOP_PASSED = 50
+	VALIDATION_WEIGHT_OFFSET           = 50
+)
+
+// castToBool interprets a stack element as boolean: all zeros (including
+// negative zero) are false
+func castToBool(v []byte) bool {
+	for i, b := range v {
+		if b != 0 {
+			return !(i == len(v)-1 && b == 0x80)
+		}
+	}
+	return false
+}
+
+func boolToStack(v bool) []byte {
+	if v {
+		return []byte{1}
+	}
+	return []byte{}
+}
+
+// checkMinimalPush checks that data is pushed with the smallest possible
+// opcode (see ScriptBuilder.AddData)
+func checkMinimalPush(data []byte, op byte) bool {
+	switch n := len(data); {
+	case n == 0:
+		return op == OP_0
+	case n == 1 && data[0] >= 1 && data[0] <= 16:
+		return false
+	case n == 1 && data[0] == 0x81:
+		return false
+	case n <= 75:
+		return int(op) == n
+	case n <= 255:
+		return op == OP_PUSHDATA1
+	case n <= 65535:
+		return op == OP_PUSHDATA2
+	}
+	return true
+}
+
+// pushDataScript returns a script pushing data without replacing small
+// values by OP_1 to OP_16 (like bitcoin core's CScript() << data)
+func pushDataScript(data []byte) []byte {
+	b := NewScriptBuilder()
+	switch n := len(data); {
+	case n == 0:
+		b.AddOp(OP_0)
+	case n < OP_PUSHDATA1:
+		b.script = append(b.script, byte(n))
+		b.script = append(b.script, data...)
+	default:
+		b.AddData(data)
+	}
+	return b.Script()
+}
+
+// findAndDelete removes all pushes of sig from the legacy script code, which
+// prevents signatures from signing themselves. It returns the new script
+// and the number of removed pushes.
+func findAndDelete(script, sig []byte) ([]byte, int) {
+	pattern := pushDataScript(sig)
+	found := 0
+	var result []byte
+	pc, pc2 := 0, 0
+	for {
+		result = append(result, script[pc2:pc]...)
+		for len(script)-pc >= len(pattern) && bytes.Equal(script[pc:pc+len(pattern)], pattern) {
+			pc += len(pattern)
+			found++
+		}
+		pc2 = pc
+		_, _, next, ok := getScriptOp(script, pc)
+		if !ok {
+			break
+		}
+		pc = next
+	}
+	if found == 0 {
+		return script, 0
+	}
+	return append(result, script[pc2:]...), found
+}
+
+func isDisabledOpcode(op byte) bool {
+	switch op {
+	case OP_CAT, OP_SUBSTR, OP_LEFT, OP_RIGHT, OP_INVERT, OP_AND, OP_OR, OP_XOR,
+		OP_2MUL, OP_2DIV, OP_MUL, OP_DIV, OP_MOD, OP_LSHIFT, OP_RSHIFT:
+		return true
+	}
+	return false
+}
+
+// isOpSuccess returns true for the opcodes which make a tapscript succeed
+// unconditionally (reserved for soft forks, BIP342)
+func isOpSuccess(op byte) bool {
+	return op == 80 || op == 98 || (op >= 126 && op <= 129) || (op >= 131 && op <= 134) ||
+		(op >= 137 && op <= 138) || (op >= 141 && op <= 142) || (op >= 149 && op <= 153) ||
+		(op >= 187 && op <= 254)
+}
+
+// interpreter holds the state of a script evaluation
+type interpreter struct {
+	stack      [][]byte
+	altStack   [][]byte
+	flags      ScriptFlags
+	checker    SignatureChecker
+	sigVersion SigVersion
+	execData   *ScriptExecutionData
+}
+
+func (vm *interpreter) push(v []byte) {
+	vm.stack = append(vm.stack, v)
+}
+
+func (vm *interpreter) pop() []byte {
+	v := vm.stack[len(vm.stack)-1]
+	vm.stack = vm.stack[:len(vm.stack)-1]
+	return v
+}
+
+// top returns the i-th element from the top of the stack (-1 is the top)
+func (vm *interpreter) top(i int) []byte {
+	return vm.stack[len(vm.stack)+i]
+}
+
+func (vm *interpreter) swap(i, j int) {
+	n := len(vm.stack)
+	vm.stack[n+i], vm.stack[n+j] = vm.stack[n+j], vm.stack[n+i]
+}
+
+// remove deletes the i-th element from the top
+func (vm *interpreter) remove(i int) {
+	n := len(vm.stack)
+	vm.stack = append(vm.stack[:n+i], vm.stack[n+i+1:]...)
+}
+
+func (vm *interpreter) num(i int, maxLen int) (int64, error) {
+	return decodeScriptNum(vm.top(i), maxLen, vm.flags&SCRIPT_VERIFY_MINIMALDATA != 0)
+}
+
+// EvalScript executes the script on the given stack and returns the
+// resulting stack
+func EvalScript(stack [][]byte, script []byte, flags ScriptFlags, checker SignatureChecker, sigVersion SigVersion, execData *ScriptExecutionData) ([][]byte, error) {
+	vm := &interpreter{stack: stack, flags: flags, checker: checker, sigVersion: sigVersion, execData: execData}
+	if vm.execData == nil {
+		vm.execData = &ScriptExecutionData{}
+	}
+	err := vm.eval(script)
+	return vm.stack, err
+}
+
+func (vm *interpreter) eval(script []byte) error {
+	legacy := vm.sigVersion == SigVersionBase || vm.sigVersion == SigVersionWitnessV0
+	if legacy && len(script) > MAX_SCRIPT_SIZE {
+		return ErrScriptSize
+	}
+	requireMinimal := vm.flags&SCRIPT_VERIFY_MINIMALDATA != 0
+	// The executed script code starts after the last OP_CODESEPARATOR
+	codeHashBegin := 0
+	vm.execData.CodeSeparatorPos = 0xffffffff
+
+	// Execution state of nested IFs, with the number of false entries
+	var exec []bool
+	falseCount := 0
+	opCount := 0
+
+	pc := 0
+	for opcodePos := uint32(0); pc < len(script); opcodePos++ {
+		executing := falseCount == 0
+		op, data, next, ok := getScriptOp(script, pc)
+		if !ok {
+			return ErrBadOpcode
+		}
+		pc = next
+		if len(data) > MAX_SCRIPT_ELEMENT_SIZE {
+			return ErrPushSize
+		}
+		// OP_RESERVED does not count towards the opcode limit
+		if legacy && op > OP_16 {
+			if opCount++; opCount > MAX_OPS_PER_SCRIPT {
+				return ErrOpCount
+			}
+		}
+		// Disabled opcodes fail even in unexecuted branches
+		if isDisabledOpcode(op) {
+			return ErrDisabledOpcode
+		}
+		if op == OP_CODESEPARATOR && vm.sigVersion == SigVersionBase && vm.flags&SCRIPT_VERIFY_CONST_SCRIPTCODE != 0 {
+			return ErrOpCodeSeparator
+		}
+
+		if executing && op <= OP_PUSHDATA4 {
+			if requireMinimal && !checkMinimalPush(data, op) {
+				return ErrMinimalData
+			}
+			vm.push(data)
+		} else if executing || (op >= OP_IF && op <= OP_ENDIF) {
+			switch op {
+			case OP_1NEGATE, OP_1, OP_2, OP_3, OP_4, OP_5, OP_6, OP_7, OP_8,
+				OP_9, OP_10, OP_11, OP_12, OP_13, OP_14, OP_15, OP_16:
+				vm.push(encodeScriptNum(int64(op) - (OP_1 - 1)))
+
+			case OP_NOP:
+
+			case OP_CHECKLOCKTIMEVERIFY:
+				if vm.flags&SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY == 0 {
+					// Not enabled, so it is still a NOP
+					if vm.flags&SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_NOPS != 0 {
+						return ErrDiscourageUpgradableNops
+					}
+					break
+				}
+				if len(vm.stack) < 1 {
+					return ErrInvalidStackOperation
+				}
+				// Lock times need 5 bytes, as they are unsigned 32 bit
+				lockTime, err := vm.num(-1, 5)
+				if err != nil {
+					return err
+				}
+				if lockTime < 0 {
+					return ErrNegativeLocktime
+				}
+				if !vm.checker.CheckLockTime(lockTime) {
+					return ErrUnsatisfiedLocktime
+				}
+
+			case OP_CHECKSEQUENCEVERIFY:
+				if vm.flags&SCRIPT_VERIFY_CHECKSEQUENCEVERIFY == 0 {
+					// Not enabled, so it is still a NOP
+					if vm.flags&SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_NOPS != 0 {
+						return ErrDiscourageUpgradableNops
+					}
+					break
+				}
+				if len(vm.stack) < 1 {
+					return ErrInvalidStackOperation
+				}
+				sequence, err := vm.num(-1, 5)
+				if err != nil {
+					return err
+				}
+				if sequence < 0 {
+					return ErrNegativeLocktime
+				}
+				// With the disable flag set, it is a NOP for future soft
+				// forks
+				if sequence&SEQUENCE_LOCKTIME_DISABLE_FLAG != 0 {
+					break
+				}
+				if !vm.checker.CheckSequence(sequence) {
+					return ErrUnsatisfiedLocktime
+				}
+
+			case OP_NOP1, OP_NOP4, OP_NOP5, OP_NOP6, OP_NOP7, OP_NOP8, OP_NOP9, OP_NOP10:
+				if vm.flags&SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_NOPS != 0 {
+					return ErrDiscourageUpgradableNops
+				}
+
+			case OP_IF, OP_NOTIF:
+				value := false
+				if executing {
+					if len(vm.stack) < 1 {
+						return ErrUnbalancedConditional
+					}
+					v := vm.top(-1)
+					minimal := len(v) == 0 || (len(v) == 1 && v[0] == 1)
+					// Minimal IF arguments are consensus in tapscript and
+					// policy in segwit v0
+					if vm.sigVersion == SigVersionTapscript && !minimal {
+						return ErrTapscriptMinimalIf
+					}
+					if vm.sigVersion == SigVersionWitnessV0 && vm.flags&SCRIPT_VERIFY_MINIMALIF != 0 && !minimal {
+						return ErrMinimalIf
+					}
+					value = castToBool(v)
+					if op == OP_NOTIF {
+						value = !value
+					}
+					vm.pop()
+				}
+				exec = append(exec, value)
+				if !value {
+					falseCount++
+				}
+
+			case OP_ELSE:
+				if len(exec) == 0 {
+					return ErrUnbalancedConditional
+				}
+				last := len(exec) - 1
+				if exec[last] {
+					falseCount++
+				} else {
+					falseCount--
+				}
+				exec[last] = !exec[last]
+
+			case OP_ENDIF:
+				if len(exec) == 0 {
+					return ErrUnbalancedConditional
+				}
+				if !exec[len(exec)-1] {
+					falseCount--
+				}
+				exec = exec[:len(exec)-1]
+
+			case OP_VERIFY:
+				if len(vm.stack) < 1 {
+					return ErrInvalidStackOperation
+				}
+				if !castToBool(vm.top(-1)) {
+					return ErrVerify
+				}
+				vm.pop()
+
+			case OP_RETURN:
+				return ErrOpReturn
+
+			// Stack operations
+
+			case OP_TOALTSTACK:
+				if len(vm.stack) < 1 {
+					return ErrInvalidStackOperation
+				}
+				vm.altStack = append(vm.altStack, vm.pop())
+
+			case OP_FROMALTSTACK:
+				if len(vm.altStack) < 1 {
+					return ErrInvalidAltstackOperation
+				}
+				vm.push(vm.altStack[len(vm.altStack)-1])
+				vm.altStack = vm.altStack[:len(vm.altStack)-1]
+
+			case OP_2DROP:
+				// (x1 x2 -- )
+				if len(vm.stack) < 2 {
+					return ErrInvalidStackOperation
+				}
+				vm.pop()
+				vm.pop()
+
+			case OP_2DUP:
+				// (x1 x2 -- x1 x2 x1 x2)
+				if len(vm.stack) < 2 {
+					return ErrInvalidStackOperation
+				}
+				v1, v2 := vm.top(-2), vm.top(-1)
+				vm.push(v1)
+				vm.push(v2)
+
+			case OP_3DUP:
+				// (x1 x2 x3 -- x1 x2 x3 x1 x2 x3)
+				if len(vm.stack) < 3 {
+					return ErrInvalidStackOperation
+				}
+				v1, v2, v3 := vm.top(-3), vm.top(-2), vm.top(-1)
+				vm.push(v1)
+				vm.push(v2)
+				vm.push(v3)
+
+			case OP_2OVER:
+				// (x1 x2 x3 x4 -- x1 x2 x3 x4 x1 x2)
+				if len(vm.stack) < 4 {
+					return ErrInvalidStackOperation
+				}
+				v1, v2 := vm.top(-4), vm.top(-3)
+				vm.push(v1)
+				vm.push(v2)
+
+			case OP_2ROT:
+				// (x1 x2 x3 x4 x5 x6 -- x3 x4 x5 x6 x1 x2)
+				if len(vm.stack) < 6 {
+					return ErrInvalidStackOperation
+				}
+				v1, v2 := vm.top(-6), vm.top(-5)
+				vm.remove(-6)
+				vm.remove(-5)
+				vm.push(v1)
+				vm.push(v2)
+
+			case OP_2SWAP:
+				// (x1 x2 x3 x4 -- x3 x4 x1 x2)
+				if len(vm.stack) < 4 {
+					return ErrInvalidStackOperation
+				}
+				vm.swap(-4, -2)
+				vm.swap(-3, -1)
+
+			case OP_IFDUP:
+				// (x - 0 | x x)
+				if len(vm.stack) < 1 {
+					return ErrInvalidStackOperation
+				}
+				if castToBool(vm.top(-1)) {
+					vm.push(vm.top(-1))
+				}
+
+			case OP_DEPTH:
+				// -- stacksize
+				vm.push(encodeScriptNum(int64(len(vm.stack))))
+
+			case OP_DROP:
+				// (x -- )
+				if len(vm.stack) < 1 {
+					return ErrInvalidStackOperation
+				}
+				vm.pop()
+
+			case OP_DUP:
+				// (x -- x x)
+				if len(vm.stack) < 1 {
+					return ErrInvalidStackOperation
+				}
+				vm.push(vm.top(-1))
+
+			case OP_NIP:
+				// (x1 x2 -- x2)
+				if len(vm.stack) < 2 {
+					return ErrInvalidStackOperation
+				}
+				vm.remove(-2)
+
+			case OP_OVER:
+				// (x1 x2 -- x1 x2 x1)
+				if len(vm.stack) < 2 {
+					return ErrInvalidStackOperation
+				}
+				vm.push(vm.top(-2))
+
+			case OP_PICK, OP_ROLL:
+				// (xn ... x2 x1 x0 n - xn ... x2 x1 x0 xn)
+				// (xn ... x2 x1 x0 n - ... x2 x1 x0 xn)
+				if len(vm.stack) < 2 {
+					return ErrInvalidStackOperation
+				}
+				n, err := vm.num(-1, 4)
+				if err != nil {
+					return err
+				}
+				vm.pop()
+				if n < 0 || n >= int64(len(vm.stack)) {
+					return ErrInvalidStackOperation
+				}
+				v := vm.top(-int(n) - 1)
+				if op == OP_ROLL {
+					vm.remove(-int(n) - 1)
+				}
+				vm.push(v)
+
+			case OP_ROT:
+				// (x1 x2 x3 -- x2 x3 x1)
+				if len(vm.stack) < 3 {
+					return ErrInvalidStackOperation
+				}
+				vm.swap(-3, -2)
+				vm.swap(-2, -1)
+
+			case OP_SWAP:
+				// (x1 x2 -- x2 x1)
+				if len(vm.stack) < 2 {
+					return ErrInvalidStackOperation
+				}
+				vm.swap(-2, -1)
+
+			case OP_TUCK:
+				// (x1 x2 -- x2 x1 x2)
+				if len(vm.stack) < 2 {
+					return ErrInvalidStackOperation
+				}
+				v1, v2 := vm.top(-2), vm.top(-1)
+				vm.stack[len(vm.stack)-2] = v2
+				vm.stack[len(vm.stack)-1] = v1
+				vm.push(v2)
+
+			case OP_SIZE:
+				// (in -- in size)
+				if len(vm.stack) < 1 {
+					return ErrInvalidStackOperation
+				}
+				vm.push(encodeScriptNum(int64(len(vm.top(-1)))))
+
+			// Bitwise logic
+
+			case OP_EQUAL, OP_EQUALVERIFY:
+				// (x1 x2 - bool)
+				if len(vm.stack) < 2 {
+					return ErrInvalidStackOperation
+				}
+				equal := bytes.Equal(vm.top(-2), vm.top(-1))
+				vm.pop()
+				vm.pop()
+				vm.push(boolToStack(equal))
+				if op == OP_EQUALVERIFY {
+					if !equal {
+						return ErrEqualVerify
+					}
+					vm.pop()
+				}
+
+			// Numeric
+
+			case OP_1ADD, OP_1SUB, OP_NEGATE, OP_ABS, OP_NOT, OP_0NOTEQUAL:
+				// (in -- out)
+				if len(vm.stack) < 1 {
+					return ErrInvalidStackOperation
+				}
+				n, err := vm.num(-1, 4)
+				if err != nil {
+					return err
+				}
+				switch op {
+				case OP_1ADD:
+					n++
+				case OP_1SUB:
+					n--
+				case OP_NEGATE:
+					n = -n
+				case OP_ABS:
+					if n < 0 {
+						n = -n
+					}
+				case OP_NOT:
+					n = boolToInt(n == 0)
+				case OP_0NOTEQUAL:
+					n = boolToInt(n != 0)
+				}
+				vm.pop()
+				vm.push(encodeScriptNum(n))
+
+			case OP_ADD, OP_SUB, OP_BOOLAND, OP_BOOLOR, OP_NUMEQUAL, OP_NUMEQUALVERIFY,
+				OP_NUMNOTEQUAL, OP_LESSTHAN, OP_GREATERTHAN, OP_LESSTHANOREQUAL,
+				OP_GREATERTHANOREQUAL, OP_MIN, OP_MAX:
+				// (x1 x2 -- out)
+				if len(vm.stack) < 2 {
+					return ErrInvalidStackOperation
+				}
+				n1, err := vm.num(-2, 4)
+				if err != nil {
+					return err
+				}
+				n2, err := vm.num(-1, 4)
+				if err != nil {
+					return err
+				}
+				var n int64
+				switch op {
+				case OP_ADD:
+					n = n1 + n2
+				case OP_SUB:
+					n = n1 - n2
+				case OP_BOOLAND:
+					n = boolToInt(n1 != 0 && n2 != 0)
+				case OP_BOOLOR:
+					n = boolToInt(n1 != 0 || n2 != 0)
+				case OP_NUMEQUAL, OP_NUMEQUALVERIFY:
+					n = boolToInt(n1 == n2)
+				case OP_NUMNOTEQUAL:
+					n = boolToInt(n1 != n2)
+				case OP_LESSTHAN:
+					n = boolToInt(n1 < n2)
+				case OP_GREATERTHAN:
+					n = boolToInt(n1 > n2)
+				case OP_LESSTHANOREQUAL:
+					n = boolToInt(n1 <= n2)
+				case OP_GREATERTHANOREQUAL:
+					n = boolToInt(n1 >= n2)
+				case OP_MIN:
+					n = n1
+					if n2 < n1 {
+						n = n2
+					}
+				case OP_MAX:
+					n = n1
+					if n2 > n1 {
+						n = n2
+					}
+				}
+				vm.pop()
+				vm.pop()
+				vm.push(encodeScriptNum(n))
+				if op == OP_NUMEQUALVERIFY {
+					if !castToBool(vm.top(-1)) {
+						return ErrNumEqualVerify
+					}
+					vm.pop()
+				}
+
+			case OP_WITHIN:
+				// (x min max -- out)
+				if len(vm.stack) < 3 {
+					return ErrInvalidStackOperation
+				}
+				var n [3]int64
+				for i := range n {
+					var err error
+					if n[i], err = vm.num(i-3, 4); err != nil {
+						return err
+					}
+				}
+				vm.pop()
+				vm.pop()
+				vm.pop()
+				vm.push(boolToStack(n[1] <= n[0] && n[0] < n[2]))
+
+			// Crypto
+
+			case OP_RIPEMD160, OP_SHA1, OP_SHA256, OP_HASH160, OP_HASH256:
+				// (in -- hash)
+				if len(vm.stack) < 1 {
+					return ErrInvalidStackOperation
+				}
+				v := vm.pop()
+				switch op {
+				case OP_RIPEMD160:
+					h := ripemd160.New()
+					h.Write(v)
+					vm.push(h.Sum(nil))
+				case OP_SHA1:
+					h := sha1.Sum(v)
+					vm.push(h[:])
+				case OP_SHA256:
+					h := sha256.Sum256(v)
+					vm.push(h[:])
+				case OP_HASH160:
+					vm.push(Hash160(v))
+				case OP_HASH256:
+					h := doubleHash(v)
+					vm.push(h[:])
+				}
+
+			case OP_CODESEPARATOR:
+				// Signatures only sign the script after the last
+				// executed OP_CODESEPARATOR
+				codeHashBegin = pc
+				vm.execData.CodeSeparatorPos = opcodePos
+
+			case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+				// (sig pubkey -- bool)
+				if len(vm.stack) < 2 {
+					return ErrInvalidStackOperation
+				}
+				success, err := vm.checkSig(vm.top(-2), vm.top(-1), script[codeHashBegin:])
+				if err != nil {
+					return err
+				}
+				vm.pop()
+				vm.pop()
+				vm.push(boolToStack(success))
+				if op == OP_CHECKSIGVERIFY {
+					if !success {
+						return ErrCheckSigVerify
+					}
+					vm.pop()
+				}
+
+			case OP_CHECKSIGADD:
+				// (sig num pubkey -- num), only available in tapscript
+				if legacy {
+					return ErrBadOpcode
+				}
+				if len(vm.stack) < 3 {
+					return ErrInvalidStackOperation
+				}
+				n, err := vm.num(-2, 4)
+				if err != nil {
+					return err
+				}
+				success, err := vm.checkSig(vm.top(-3), vm.top(-1), script[codeHashBegin:])
+				if err != nil {
+					return err
+				}
+				vm.pop()
+				vm.pop()
+				vm.pop()
+				if success {
+					n++
+				}
+				vm.push(encodeScriptNum(n))
+
+			case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+				// ([sig ...] num_of_signatures [pubkey ...] num_of_pubkeys -- bool)
+				if vm.sigVersion == SigVersionTapscript {
+					return ErrTapscriptCheckMultisig
+				}
+				var err error
+				if opCount, err = vm.checkMultisig(script[codeHashBegin:], op, opCount); err != nil {
+					return err
+				}
+
+			default:
+				return ErrBadOpcode
+			}
+		}
+
+		if len(vm.stack)+len(vm.altStack) > MAX_STACK_SIZE {
+			return ErrStackSize
+		}
+	}
+
+	if len(exec) != 0 {
+		return ErrUnbalancedConditional
+	}
+	return nil
+}
+
+func boolToInt(v bool) int64 {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// checkSig checks a signature for OP_CHECKSIG(VERIFY) and OP_CHECKSIGADD.
+// It returns whether the signature is valid, or an error if the script
+// fails because of it.
+func (vm *interpreter) checkSig(sig, pubKey, scriptCode []byte) (bool, error) {
+	if vm.sigVersion == SigVersionTapscript {
+		return vm.checkSigTapscript(sig, pubKey)
+	}
+	if vm.sigVersion == SigVersionBase {
+		var found int
+		scriptCode, found = findAndDelete(scriptCode, sig)
+		if found > 0 && vm.flags&SCRIPT_VERIFY_CONST_SCRIPTCODE != 0 {
+			return false, ErrSigFindAndDelete
+		}
+	}
+	if err := checkSignatureEncoding(sig, vm.flags); err != nil {
+		return false, err
+	}
+	if err := checkPubKeyEncoding(pubKey, vm.flags, vm.sigVersion); err != nil {
+		return false, err
+	}
+	success := vm.checker.CheckECDSASignature(sig, pubKey, scriptCode, vm.sigVersion)
+	if !success && vm.flags&SCRIPT_VERIFY_NULLFAIL != 0 && len(sig) > 0 {
+		return false, ErrSigNullFail
+	}
+	return success, nil
+}
+
+// checkSigTapscript checks a BIP342 signature. Empty signatures are just
+// false, while invalid non-empty signatures make the script fail. Unknown
+// public key types are valid for any signature, for future soft forks.
+func (vm *interpreter) checkSigTapscript(sig, pubKey []byte) (bool, error) {
+	success := len(sig) > 0
+	if success {
+		// Limit the number of signatures relative to the witness size
+		vm.execData.ValidationWeightLeft -= VALIDATION_WEIGHT_PER_SIGOP_PASSED
+		if vm.execData.ValidationWeightLeft < 0 {
+			return false, ErrTapscriptValidationWeight
+		}
+	}
+	switch len(pubKey) {
+	case 0:
+		return false, ErrPubKeyType
+	case 32:
+		if success {
+			if err := vm.checker.CheckSchnorrSignature(sig, pubKey, vm.sigVersion, vm.execData); err != nil {
+				return false, err
+			}
+		}
+	default:
+		if vm.flags&SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_PUBKEYTYPE != 0 {
+			return false, ErrDiscourageUpgradablePubKey
+		}
+	}
+	return success, nil
+}
+
+// checkMultisig executes OP_CHECKMULTISIG(VERIFY). The public keys count
+// towards the opcode limit, so the new opcode count is returned.
+func (vm *interpreter) checkMultisig(scriptCode []byte, op byte, opCount int) (int, error) {
+	i := 1
+	if len(vm.stack) < i {
+		return opCount, ErrInvalidStackOperation
+	}
+	n, err := vm.num(-i, 4)
+	if err != nil {
+		return opCount, err
+	}
+	keysCount := int(n)
+	if keysCount < 0 || keysCount > MAX_PUBKEYS_PER_MULTISIG {
+		return opCount, ErrPubKeyCount
+	}
+	opCount += keysCount
+	if opCount > MAX_OPS_PER_SCRIPT {
+		return opCount, ErrOpCount
+	}
+	i++
+	ikey := i
+	// ikey2 is the position of the last non-signature item on the stack
+	// (with the top at 1), used for the NULLFAIL check
+	ikey2 := keysCount + 2
+	i += keysCount
+	if len(vm.stack) < i {
+		return opCount, ErrInvalidStackOperation
+	}
+	if n, err = vm.num(-i, 4); err != nil {
+		return opCount, err
+	}
+	sigsCount := int(n)
+	if sigsCount < 0 || sigsCount > keysCount {
+		return opCount, ErrSigCount
+	}
+	i++
+	isig := i
+	i += sigsCount
+	if len(vm.stack) < i {
+		return opCount, ErrInvalidStackOperation
+	}
+
+	// Remove all signatures from the legacy script code
+	if vm.sigVersion == SigVersionBase {
+		for k := 0; k < sigsCount; k++ {
+			var found int
+			scriptCode, found = findAndDelete(scriptCode, vm.top(-isig-k))
+			if found > 0 && vm.flags&SCRIPT_VERIFY_CONST_SCRIPTCODE != 0 {
+				return opCount, ErrSigFindAndDelete
+			}
+		}
+	}
+
+	// The signatures must be in the same order as their keys
+	success := true
+	for success && sigsCount > 0 {
+		sig, pubKey := vm.top(-isig), vm.top(-ikey)
+		if err := checkSignatureEncoding(sig, vm.flags); err != nil {
+			return opCount, err
+		}
+		if err := checkPubKeyEncoding(pubKey, vm.flags, vm.sigVersion); err != nil {
+			return opCount, err
+		}
+		if vm.checker.CheckECDSASignature(sig, pubKey, scriptCode, vm.sigVersion) {
+			isig++
+			sigsCount--
+		}
+		ikey++
+		keysCount--
+		// If there are more signatures left than keys, it fails
+		if sigsCount > keysCount {
+			success = false
+		}
+	}
+
+	// Clean up the stack, with all signatures empty if it failed
+	for ; i > 1; i-- {
+		if !success && vm.flags&SCRIPT_VERIFY_NULLFAIL != 0 && ikey2 == 0 && len(vm.top(-1)) > 0 {
+			return opCount, ErrSigNullFail
+		}
+		if ikey2 > 0 {
+			ikey2--
+		}
+		vm.pop()
+	}
+	// An extra element is removed because of a bug in the original
+	// implementation, which must be empty with NULLDUMMY (BIP147)
+	if len(vm.stack) < 1 {
+		return opCount, ErrInvalidStackOperation
+	}
+	if vm.flags&SCRIPT_VERIFY_NULLDUMMY != 0 && len(vm.top(-1)) > 0 {
+		return opCount, ErrSigNullDummy
+	}
+	vm.pop()
+	vm.push(boolToStack(success))
+	if op == OP_CHECKMULTISIGVERIFY {
+		if !success {
+			return opCount, ErrCheckMultisigVerify
+		}
+		vm.pop()
+	}
+	return opCount, nil
+}
+
+// Verification
+//=============
+
+// Taproot constants (BIP341)
+const (
+	ANNEX_TAG                 = 0x50
+	TAPROOT_LEAF_MASK         = 0xfe
+	TAPROOT_LEAF_TAPSCRIPT    = 0xc0
+	TAPROOT_CONTROL_BASE_SIZE = 33
+	TAPROOT_CONTROL_NODE_SIZE = 32
+	TAPROOT_CONTROL_MAX_SIZE  = TAPROOT_CONTROL_BASE_SIZE + TAPROOT_CONTROL_NODE_SIZE*128
+)
+
+// VerifyScript verifies that scriptSig and witness satisfy scriptPubKey
+func VerifyScript(scriptSig, scriptPubKey []byte, witness [][]byte, flags ScriptFlags, checker SignatureChecker) error {
+	if flags&SCRIPT_VERIFY_SIGPUSHONLY != 0 && !IsPushOnly(scriptSig) {
+		return ErrSigPushOnly
+	}
+
+	// scriptSig and scriptPubKey are evaluated on the same stack, but not
+	// concatenated (CVE-2010-5141)
+	stack, err := EvalScript(nil, scriptSig, flags, checker, SigVersionBase, nil)
+	if err != nil {
+		return err
+	}
+	var stackCopy [][]byte
+	if flags&SCRIPT_VERIFY_P2SH != 0 {
+		stackCopy = append(stackCopy, stack...)
+	}
+	if stack, err = EvalScript(stack, scriptPubKey, flags, checker, SigVersionBase, nil); err != nil {
+		return err
+	}
+	if len(stack) == 0 || !castToBool(stack[len(stack)-1]) {
+		return ErrEvalFalse
+	}
+
+	// Bare witness programs
+	hadWitness := false
+	if flags&SCRIPT_VERIFY_WITNESS != 0 {
+		if version, program, ok := IsWitnessProgram(scriptPubKey); ok {
+			hadWitness = true
+			// Any scriptSig would make the transaction malleable
+			if len(scriptSig) != 0 {
+				return ErrWitnessMalleated
+			}
+			if err = verifyWitnessProgram(witness, version, program, flags, checker, false); err != nil {
+				return err
+			}
+			// The stack is not clean for witness programs
+			stack = stack[:1]
+		}
+	}
+
+	// P2SH (BIP16)
+	if flags&SCRIPT_VERIFY_P2SH != 0 && IsPayToScriptHash(scriptPubKey) {
+		if !IsPushOnly(scriptSig) {
+			return ErrSigPushOnly
+		}
+		// The stack can't be empty, otherwise the scriptPubKey failed
+		stack = stackCopy
+		redeemScript := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if stack, err = EvalScript(stack, redeemScript, flags, checker, SigVersionBase, nil); err != nil {
+			return err
+		}
+		if len(stack) == 0 || !castToBool(stack[len(stack)-1]) {
+			return ErrEvalFalse
+		}
+
+		// P2SH wrapped witness programs
+		if flags&SCRIPT_VERIFY_WITNESS != 0 {
+			if version, program, ok := IsWitnessProgram(redeemScript); ok {
+				hadWitness = true
+				// The scriptSig must be exactly a push of the redeem
+				// script
+				if !bytes.Equal(scriptSig, pushDataScript(redeemScript)) {
+					return ErrWitnessMalleatedP2SH
+				}
+				if err = verifyWitnessProgram(witness, version, program, flags, checker, true); err != nil {
+					return err
+				}
+				stack = stack[:1]
+			}
+		}
+	}
+
+	// Only checked after P2SH and witness evaluation, which don't leave a
+	// clean stack at the first evaluation
+	if flags&SCRIPT_VERIFY_CLEANSTACK != 0 && len(stack) != 1 {
+		return ErrCleanStack
+	}
+	if flags&SCRIPT_VERIFY_WITNESS != 0 && !hadWitness && len(witness) > 0 {
+		return ErrWitnessUnexpected
+	}
+	return nil
+}
+
+func verifyWitnessProgram(witness [][]byte, version byte, program []byte, flags ScriptFlags, checker SignatureChecker, isP2SH bool) error {
+	stack := append([][]byte{}, witness...)
+	execData := &ScriptExecutionData{}
+
+	switch {
+	case version == 0 && len(program) == 32:
+		// P2WSH: the last witness element is the script
+		if len(stack) == 0 {
+			return ErrWitnessProgramWitnessEmpty
+		}
+		script := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if hash := sha256.Sum256(script); !bytes.Equal(hash[:], program) {
+			return ErrWitnessProgramMismatch
+		}
+		return executeWitnessScript(stack, script, flags, SigVersionWitnessV0, checker, execData)
+
+	case version == 0 && len(program) == 20:
+		// P2WPKH: signature and public key for the implied P2PKH script
+		if len(stack) != 2 {
+			return ErrWitnessProgramMismatch
+		}
+		script := NewScriptBuilder().AddOps(OP_DUP, OP_HASH160).AddData(program).
+			AddOps(OP_EQUALVERIFY, OP_CHECKSIG).Script()
+		return executeWitnessScript(stack, script, flags, SigVersionWitnessV0, checker, execData)
+
+	case version == 0:
+		return ErrWitnessProgramWrongLength
+
+	case version == 1 && len(program) == 32 && !isP2SH:
+		// Taproot (BIP341)
+		if flags&SCRIPT_VERIFY_TAPROOT == 0 {
+			return nil
+		}
+		if len(stack) == 0 {
+			return ErrWitnessProgramWitnessEmpty
+		}
+		if last := stack[len(stack)-1]; len(stack) >= 2 && len(last) > 0 && last[0] == ANNEX_TAG {
+			execData.AnnexHash = singleHash(MarshalVarBytes(nil, last))
+			execData.AnnexPresent = true
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 1 {
+			// Key path spend
+			return checker.CheckSchnorrSignature(stack[0], program, SigVersionTaproot, execData)
+		}
+
+		// Script path spend
+		control := stack[len(stack)-1]
+		script := stack[len(stack)-2]
+		stack = stack[:len(stack)-2]
+		if len(control) < TAPROOT_CONTROL_BASE_SIZE || len(control) > TAPROOT_CONTROL_MAX_SIZE ||
+			(len(control)-TAPROOT_CONTROL_BASE_SIZE)%TAPROOT_CONTROL_NODE_SIZE != 0 {
+			return ErrTaprootWrongControlSize
+		}
+		leafVersion := control[0] & TAPROOT_LEAF_MASK
+		execData.TapleafHash = TapLeafHash(leafVersion, script)
+		if !verifyTaprootCommitment(control, program, execData.TapleafHash) {
+			return ErrWitnessProgramMismatch
+		}
+		if leafVersion == TAPROOT_LEAF_TAPSCRIPT {
+			execData.ValidationWeightLeft = int64(len(MarshalWitness(nil, witness))) + VALIDATION_WEIGHT_OFFSET
+			return executeWitnessScript(stack, script, flags, SigVersionTapscript, checker, execData)
+		}
+		if flags&SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_TAPROOT_VERSION != 0 {
+			return ErrDiscourageUpgradableTaproot
+		}
+		return nil
+	}
+
+	// Other versions and sizes are left for future soft forks
+	if flags&SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_WITNESS_PROGRAM != 0 {
+		return ErrDiscourageUpgradableWitness
+	}
+	return nil
+}
+
+func executeWitnessScript(stack [][]byte, script []byte, flags ScriptFlags, sigVersion SigVersion, checker SignatureChecker, execData *ScriptExecutionData) error {
+	if sigVersion == SigVersionTapscript {
+		// OP_SUCCESSx overrides everything, even the size limits
+		t := NewScriptTokenizer(script)
+		for t.Next() {
+			if isOpSuccess(t.Opcode()) {
+				if flags&SCRIPT_VERIFY_DISCOURAGE_OP_SUCCESS != 0 {
+					return ErrDiscourageOpSuccess
+				}
+				return nil
+			}
+		}
+		if t.Err() != nil {
+			return ErrBadOpcode
+		}
+		if len(stack) > MAX_STACK_SIZE {
+			return ErrStackSize
+		}
+	}
+	for _, v := range stack {
+		if len(v) > MAX_SCRIPT_ELEMENT_SIZE {
+			return ErrPushSize
+		}
+	}
+
+	stack, err := EvalScript(stack, script, flags, checker, sigVersion, execData)
+	if err != nil {
+		return err
+	}
+	// Witness scripts must leave exactly one true element on the stack
+	if len(stack) != 1 || !castToBool(stack[0]) {
+		return ErrEvalFalse
+	}
+	return nil
+}
+
+// TapLeafHash computes the hash of a leaf of the taproot script tree
+func TapLeafHash(leafVersion byte, script []byte) Hash {
+	return TaggedHash("TapLeaf", []byte{leafVersion}, MarshalVarBytes(nil, script))
+}
+
+// TapBranchHash computes the hash of an inner node of the script tree from
+// its children, which are sorted first
+func TapBranchHash(a, b Hash) Hash {
+	if bytes.Compare(a[:], b[:]) > 0 {
+		a, b = b, a
+	}
+	return TaggedHash("TapBranch", a[:], b[:])
+}
+
+// verifyTaprootCommitment checks that the output key is the internal key in
+// the control block tweaked with the merkle root computed from the leaf and
+// the path in the control block
+func verifyTaprootCommitment(control, program []byte, leafHash Hash) bool {
+	internal, err := ParseXOnlyPublicKey(control[1:TAPROOT_CONTROL_BASE_SIZE])
+	if err != nil {
+		return false
+	}
+	k := leafHash
+	for pos := TAPROOT_CONTROL_BASE_SIZE; pos < len(control); pos += TAPROOT_CONTROL_NODE_SIZE {
+		var node Hash
+		copy(node[:], control[pos:pos+TAPROOT_CONTROL_NODE_SIZE])
+		k = TapBranchHash(k, node)
+	}
+	return CheckTapTweak(internal, k[:], program, control[0]&1 == 1)
+}
@@ -0,0 +1,331 @@
+package network
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// parseTestScript parses the script notation of bitcoin core's test data
+// (see ParseScript in core_read.cpp): numbers, raw hex bytes (0x...),
+// strings ('...') and opcode names with or without OP_ prefix
+func parseTestScript(s string) ([]byte, error) {
+	b := NewScriptBuilder()
+	for _, w := range strings.Fields(s) {
+		if n, err := strconv.ParseInt(w, 10, 64); err == nil && !strings.HasPrefix(w, "+") {
+			b.AddInt64(n)
+			continue
+		}
+		if strings.HasPrefix(w, "0x") && len(w) > 2 {
+			raw, err := hex.DecodeString(w[2:])
+			if err != nil {
+				return nil, err
+			}
+			b.AddOps(raw...)
+			continue
+		}
+		if len(w) >= 2 && w[0] == '\'' && w[len(w)-1] == '\'' {
+			b.AddOps(pushDataScript([]byte(w[1 : len(w)-1]))...)
+			continue
+		}
+		op, ok := testOpcodes[strings.TrimPrefix(w, "OP_")]
+		if !ok {
+			return nil, fmt.Errorf("unknown opcode '%s'", w)
+		}
+		b.AddOp(op)
+	}
+	return b.Script(), nil
+}
+
+var testOpcodes = func() map[string]byte {
+	m := map[string]byte{"NOP2": OP_NOP2, "NOP3": OP_NOP3}
+	for op := 0; op <= 0xff; op++ {
+		if op < OP_NOP && op != OP_RESERVED {
+			continue
+		}
+		if name := OpcodeName(byte(op)); name != "OP_UNKNOWN" {
+			m[strings.TrimPrefix(name, "OP_")] = byte(op)
+		}
+	}
+	return m
+}()
+
+// The errors of the test data, with bitcoin core's names
+var testScriptErrors = map[string][]error{
+	"OK":                                    nil,
+	"UNKNOWN_ERROR":                         {ErrScriptNumOverflow, ErrScriptNumNotMinimal},
+	"EVAL_FALSE":                            {ErrEvalFalse},
+	"OP_RETURN":                             {ErrOpReturn},
+	"SCRIPT_SIZE":                           {ErrScriptSize},
+	"PUSH_SIZE":                             {ErrPushSize},
+	"OP_COUNT":                              {ErrOpCount},
+	"STACK_SIZE":                            {ErrStackSize},
+	"SIG_COUNT":                             {ErrSigCount},
+	"PUBKEY_COUNT":                          {ErrPubKeyCount},
+	"VERIFY":                                {ErrVerify},
+	"EQUALVERIFY":                           {ErrEqualVerify},
+	"CHECKMULTISIGVERIFY":                   {ErrCheckMultisigVerify},
+	"CHECKSIGVERIFY":                        {ErrCheckSigVerify},
+	"NUMEQUALVERIFY":                        {ErrNumEqualVerify},
+	"BAD_OPCODE":                            {ErrBadOpcode},
+	"DISABLED_OPCODE":                       {ErrDisabledOpcode},
+	"INVALID_STACK_OPERATION":               {ErrInvalidStackOperation},
+	"INVALID_ALTSTACK_OPERATION":            {ErrInvalidAltstackOperation},
+	"UNBALANCED_CONDITIONAL":                {ErrUnbalancedConditional},
+	"NEGATIVE_LOCKTIME":                     {ErrNegativeLocktime},
+	"UNSATISFIED_LOCKTIME":                  {ErrUnsatisfiedLocktime},
+	"SIG_HASHTYPE":                          {ErrSigHashType},
+	"SIG_DER":                               {ErrSigDER},
+	"MINIMALDATA":                           {ErrMinimalData},
+	"SIG_PUSHONLY":                          {ErrSigPushOnly},
+	"SIG_HIGH_S":                            {ErrSigHighS},
+	"SIG_NULLDUMMY":                         {ErrSigNullDummy},
+	"PUBKEYTYPE":                            {ErrPubKeyType},
+	"CLEANSTACK":                            {ErrCleanStack},
+	"MINIMALIF":                             {ErrMinimalIf},
+	"NULLFAIL":                              {ErrSigNullFail},
+	"DISCOURAGE_UPGRADABLE_NOPS":            {ErrDiscourageUpgradableNops},
+	"DISCOURAGE_UPGRADABLE_WITNESS_PROGRAM": {ErrDiscourageUpgradableWitness},
+	"WITNESS_PROGRAM_WRONG_LENGTH":          {ErrWitnessProgramWrongLength},
+	"WITNESS_PROGRAM_WITNESS_EMPTY":         {ErrWitnessProgramWitnessEmpty},
+	"WITNESS_PROGRAM_MISMATCH":              {ErrWitnessProgramMismatch},
+	"WITNESS_MALLEATED":                     {ErrWitnessMalleated},
+	"WITNESS_MALLEATED_P2SH":                {ErrWitnessMalleatedP2SH},
+	"WITNESS_UNEXPECTED":                    {ErrWitnessUnexpected},
+	"WITNESS_PUBKEYTYPE":                    {ErrWitnessPubKeyType},
+}
+
+// buildCreditingTx and buildSpendingTx create the transactions used by
+// bitcoin core's script tests: a coinbase-like transaction with an output
+// paying to scriptPubKey and a transaction spending it
+func buildCreditingTx(scriptPubKey []byte, amount int64) Tx {
+	return Tx{
+		Version: 1,
+		TxIn: []TxIn{{
+			PreviousOutput:  OutPoint{Index: 0xffffffff},
+			SignatureScript: []byte{OP_0, OP_0},
+			Sequence:        SEQUENCE_FINAL,
+		}},
+		TxOut: []TxOut{{Value: amount, PkScript: scriptPubKey}},
+	}
+}
+
+func buildSpendingTx(scriptSig []byte, witness [][]byte, credit *Tx) Tx {
+	return Tx{
+		Version: 1,
+		TxIn: []TxIn{{
+			PreviousOutput:  OutPoint{Hash: credit.TxID()},
+			SignatureScript: scriptSig,
+			Sequence:        SEQUENCE_FINAL,
+			Witness:         witness,
+		}},
+		TxOut: []TxOut{{Value: credit.TxOut[0].Value, PkScript: []byte{}}},
+	}
+}
+
+func loadTestJSON(t *testing.T, name string) [][]interface{} {
+	data, err := ioutil.ReadFile("testdata/" + name)
+	if err != nil {
+		t.Fatalf("Can't read test data: %v", err)
+	}
+	var tests [][]interface{}
+	if err = json.Unmarshal(data, &tests); err != nil {
+		t.Fatalf("Can't parse test data: %v", err)
+	}
+	return tests
+}
+
+func TestScriptTestsJSON(t *testing.T) {
+	for i, test := range loadTestJSON(t, "script_tests.json") {
+		if len(test) < 4 {
+			// comment
+			continue
+		}
+		var witness [][]byte
+		var amount int64
+		if w, ok := test[0].([]interface{}); ok {
+			for _, item := range w[:len(w)-1] {
+				witness = append(witness, h2b(item.(string)))
+			}
+			amount = int64(math.Round(w[len(w)-1].(float64) * COIN))
+			test = test[1:]
+		}
+		name := fmt.Sprintf("test %d %v", i, test)
+		scriptSig, err := parseTestScript(test[0].(string))
+		if err != nil {
+			t.Fatalf("%s: bad scriptSig: %v", name, err)
+		}
+		scriptPubKey, err := parseTestScript(test[1].(string))
+		if err != nil {
+			t.Fatalf("%s: bad scriptPubKey: %v", name, err)
+		}
+		flags, err := ParseScriptFlags(test[2].(string))
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		expected, ok := testScriptErrors[test[3].(string)]
+		if !ok {
+			t.Fatalf("%s: unknown error %s", name, test[3])
+		}
+
+		credit := buildCreditingTx(scriptPubKey, amount)
+		spend := buildSpendingTx(scriptSig, witness, &credit)
+		checker := &TxSignatureChecker{Tx: &spend, Amount: amount, TxData: NewPrecomputedTxData(&spend, credit.TxOut)}
+		err = VerifyScript(scriptSig, scriptPubKey, witness, flags, checker)
+		if expected == nil {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", name, err)
+			}
+			continue
+		}
+		matched := false
+		for _, e := range expected {
+			matched = matched || errors.Is(err, e)
+		}
+		if !matched {
+			t.Errorf("%s: expected %s, got %v", name, test[3], err)
+		}
+	}
+}
+
+// verifyTestTx checks a transaction from tx_valid.json or tx_invalid.json
+func verifyTestTx(test []interface{}) error {
+	prevOuts := make(map[OutPoint]TxOut)
+	for _, input := range test[0].([]interface{}) {
+		in := input.([]interface{})
+		hash, err := RPCStringToHash(in[0].(string))
+		if err != nil {
+			return err
+		}
+		script, err := parseTestScript(in[2].(string))
+		if err != nil {
+			return err
+		}
+		out := TxOut{PkScript: script}
+		if len(in) > 3 {
+			out.Value = int64(in[3].(float64))
+		}
+		prevOuts[OutPoint{hash, uint32(int64(in[1].(float64)))}] = out
+	}
+	tx, err := TxFromHex(test[1].(string))
+	if err != nil {
+		return err
+	}
+	flags, err := ParseScriptFlags(test[2].(string))
+	if err != nil {
+		return err
+	}
+	if err = CheckTransaction(&tx); err != nil {
+		return err
+	}
+
+	spent := make([]TxOut, len(tx.TxIn))
+	for i, in := range tx.TxIn {
+		var ok bool
+		if spent[i], ok = prevOuts[in.PreviousOutput]; !ok {
+			return fmt.Errorf("missing prevout %v", in.PreviousOutput)
+		}
+	}
+	txData := NewPrecomputedTxData(&tx, spent)
+	for i, in := range tx.TxIn {
+		checker := &TxSignatureChecker{Tx: &tx, Index: i, Amount: spent[i].Value, TxData: txData}
+		if err = VerifyScript(in.SignatureScript, spent[i].PkScript, in.Witness, flags, checker); err != nil {
+			return fmt.Errorf("input %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+func TestTxValidJSON(t *testing.T) {
+	for i, test := range loadTestJSON(t, "tx_valid.json") {
+		if _, ok := test[0].([]interface{}); !ok {
+			continue
+		}
+		if err := verifyTestTx(test); err != nil {
+			t.Errorf("test %d (%v): %v", i, test[2], err)
+		}
+	}
+}
+
+func TestTxInvalidJSON(t *testing.T) {
+	for i, test := range loadTestJSON(t, "tx_invalid.json") {
+		if _, ok := test[0].([]interface{}); !ok {
+			continue
+		}
+		if err := verifyTestTx(test); err == nil {
+			t.Errorf("test %d (%v): no error for invalid transaction", i, test[2])
+		}
+	}
+}
+
+// taprootTest is an entry of bitcoin core's script_assets_test.json, from
+// which testdata/taproot_tests.json contains one case of each kind
+type taprootTest struct {
+	Tx       string   `json:"tx"`
+	Prevouts []string `json:"prevouts"`
+	Index    int      `json:"index"`
+	Flags    string   `json:"flags"`
+	Comment  string   `json:"comment"`
+	Success  *struct {
+		ScriptSig string   `json:"scriptSig"`
+		Witness   []string `json:"witness"`
+	} `json:"success"`
+	Failure *struct {
+		ScriptSig string   `json:"scriptSig"`
+		Witness   []string `json:"witness"`
+	} `json:"failure"`
+}
+
+func TestTaprootJSON(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/taproot_tests.json")
+	if err != nil {
+		t.Fatalf("Can't read test data: %v", err)
+	}
+	var tests []taprootTest
+	if err = json.Unmarshal(data, &tests); err != nil {
+		t.Fatalf("Can't parse test data: %v", err)
+	}
+	for _, test := range tests {
+		tx, err := TxFromHex(test.Tx)
+		if err != nil {
+			t.Fatalf("%s: bad tx: %v", test.Comment, err)
+		}
+		prevOuts := make([]TxOut, len(test.Prevouts))
+		for i, s := range test.Prevouts {
+			if prevOuts[i], _, err = UnmarshalTxOut(h2b(s)); err != nil {
+				t.Fatalf("%s: bad prevout: %v", test.Comment, err)
+			}
+		}
+		flags, err := ParseScriptFlags(test.Flags)
+		if err != nil {
+			t.Fatalf("%s: %v", test.Comment, err)
+		}
+
+		verify := func(scriptSig string, witness []string) error {
+			in := &tx.TxIn[test.Index]
+			in.SignatureScript = h2b(scriptSig)
+			in.Witness = nil
+			for _, item := range witness {
+				in.Witness = append(in.Witness, h2b(item))
+			}
+			checker := &TxSignatureChecker{Tx: &tx, Index: test.Index, Amount: prevOuts[test.Index].Value, TxData: NewPrecomputedTxData(&tx, prevOuts)}
+			return VerifyScript(in.SignatureScript, prevOuts[test.Index].PkScript, in.Witness, flags, checker)
+		}
+		if test.Success != nil {
+			if err = verify(test.Success.ScriptSig, test.Success.Witness); err != nil {
+				t.Errorf("%s: unexpected error: %v", test.Comment, err)
+			}
+		}
+		if test.Failure != nil {
+			if err = verify(test.Failure.ScriptSig, test.Failure.Witness); err == nil {
+				t.Errorf("%s: no error for failure case", test.Comment)
+			}
+		}
+	}
+}
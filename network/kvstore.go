@@ -0,0 +1,261 @@
+package network
+
+import (
+	"bufio"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Size of the batch header in the key/value store: payload length and crc32
+const kvBatchHeaderSize = 4 + 4
+
+// Compaction starts when the file is larger than this and has more garbage
+// than live data
+const kvCompactMinSize = 16 << 20
+
+var errCorruptKVStore = errors.New("corrupt key/value store")
+
+// kvLocation is the position of a value in the store file
+type kvLocation struct {
+	offset int64
+	size   int
+}
+
+// kvStore is a simple key/value store in an append only file. Each write is
+// a batch of puts and deletes, which is appended as one record with a
+// checksum, so a batch is either applied completely or (after a crash) not
+// at all. The keys and the positions of their values are kept in memory,
+// the values are read from the file. When the file has grown to more than
+// twice the size of the live data, it is rewritten.
+type kvStore struct {
+	path  string
+	file  *os.File
+	size  int64 // size of the valid part of the file
+	live  int64 // size of the live entries if written in one batch
+	index map[string]kvLocation
+}
+
+// kvEntry is a put, or a delete if value is nil
+type kvEntry struct {
+	key   string
+	value []byte
+}
+
+func openKVStore(path string) (*kvStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	store := &kvStore{path: path, file: file, index: make(map[string]kvLocation)}
+	if err = store.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// load builds the index from the batches in the file. A partially written
+// batch at the end of the file is discarded.
+func (store *kvStore) load() error {
+	reader := bufio.NewReaderSize(store.file, 1<<20)
+	var offset int64
+	for {
+		header := make([]byte, kvBatchHeaderSize)
+		if _, err := io.ReadFull(reader, header); err != nil {
+			break
+		}
+		size, _, _ := UnmarshalUint32(header)
+		checksum, _, _ := UnmarshalUint32(header[4:])
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(reader, payload); err != nil {
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != checksum {
+			break
+		}
+		if err := store.apply(payload, offset+kvBatchHeaderSize); err != nil {
+			return err
+		}
+		offset += kvBatchHeaderSize + int64(size)
+	}
+	store.size = offset
+	if info, err := store.file.Stat(); err != nil {
+		return err
+	} else if info.Size() != offset {
+		return store.file.Truncate(offset)
+	}
+	return nil
+}
+
+// apply updates the index with the entries of a batch, which starts at
+// offset in the file
+func (store *kvStore) apply(payload []byte, offset int64) error {
+	data := payload
+	for len(data) > 0 {
+		op, rest, err := UnmarshalUint8(data)
+		if err != nil {
+			return err
+		}
+		key, rest, err := UnmarshalVarBytes(rest)
+		if err != nil {
+			return errCorruptKVStore
+		}
+		if old, ok := store.index[string(key)]; ok {
+			store.live -= kvEntrySize(len(key), old.size)
+			delete(store.index, string(key))
+		}
+		if op == 0 {
+			data = rest
+			continue
+		}
+		length, rest, err := UnmarshalLength(rest)
+		if err != nil || uint64(len(rest)) < length {
+			return errCorruptKVStore
+		}
+		valueOffset := offset + int64(len(payload)-len(rest))
+		store.index[string(key)] = kvLocation{valueOffset, int(length)}
+		store.live += kvEntrySize(len(key), int(length))
+		data = rest[length:]
+	}
+	return nil
+}
+
+// kvEntrySize returns the size of a marshalled put
+func kvEntrySize(keySize, valueSize int) int64 {
+	return int64(len(MarshalVarInt(nil, uint64(keySize))) + keySize + len(MarshalVarInt(nil, uint64(valueSize))) + valueSize + 1)
+}
+
+// get returns the value for key or nil if there is none
+func (store *kvStore) get(key string) ([]byte, error) {
+	loc, ok := store.index[key]
+	if !ok {
+		return nil, nil
+	}
+	value := make([]byte, loc.size)
+	if _, err := store.file.ReadAt(value, loc.offset); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (store *kvStore) has(key string) bool {
+	_, ok := store.index[key]
+	return ok
+}
+
+// keys returns the sorted keys starting with prefix
+func (store *kvStore) keys(prefix string) []string {
+	var keys []string
+	for key := range store.index {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// diskSize returns the size of the store file
+func (store *kvStore) diskSize() int64 {
+	return store.size
+}
+
+// write appends a batch and syncs the file
+func (store *kvStore) write(batch []kvEntry) error {
+	if len(batch) == 0 {
+		return nil
+	}
+	var payload []byte
+	for _, entry := range batch {
+		if entry.value == nil {
+			payload = MarshalUint8(payload, 0)
+			payload = MarshalVarBytes(payload, []byte(entry.key))
+		} else {
+			payload = MarshalUint8(payload, 1)
+			payload = MarshalVarBytes(payload, []byte(entry.key))
+			payload = MarshalVarBytes(payload, entry.value)
+		}
+	}
+	record := MarshalUint32(nil, uint32(len(payload)))
+	record = MarshalUint32(record, crc32.ChecksumIEEE(payload))
+	record = append(record, payload...)
+	if _, err := store.file.WriteAt(record, store.size); err != nil {
+		// The partially written batch is ignored (and overwritten later)
+		return err
+	}
+	if err := store.file.Sync(); err != nil {
+		return err
+	}
+	if err := store.apply(payload, store.size+kvBatchHeaderSize); err != nil {
+		return err
+	}
+	store.size += int64(len(record))
+
+	if store.size > kvCompactMinSize && store.size > 2*store.live {
+		return store.compact()
+	}
+	return nil
+}
+
+// compact writes all live entries to a new file, which replaces the old one
+func (store *kvStore) compact() error {
+	// A temporary file left by an interrupted compaction holds stale
+	// entries, which must not be loaded
+	tmpPath := store.path + ".tmp"
+	if err := os.Remove(tmpPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	tmp, err := openKVStore(tmpPath)
+	if err != nil {
+		return err
+	}
+	var batch []kvEntry
+	var batchSize int
+	for key := range store.index {
+		value, err := store.get(key)
+		if err != nil {
+			tmp.close()
+			return err
+		}
+		batch = append(batch, kvEntry{key, value})
+		batchSize += len(key) + len(value)
+		if batchSize > 1<<24 {
+			if err = tmp.write(batch); err != nil {
+				tmp.close()
+				return err
+			}
+			batch, batchSize = nil, 0
+		}
+	}
+	if err = tmp.write(batch); err != nil {
+		tmp.close()
+		return err
+	}
+	if err = os.Rename(tmpPath, store.path); err != nil {
+		tmp.close()
+		return err
+	}
+	store.file.Close()
+	tmp.path = store.path
+	*store = *tmp
+	return syncDir(filepath.Dir(store.path))
+}
+
+// syncDir makes a rename in the directory durable
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (store *kvStore) close() error {
+	return store.file.Close()
+}
@@ -0,0 +1,120 @@
+package network
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKVStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.dat")
+
+	store, err := openKVStore(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err = store.write([]kvEntry{{"a", []byte("1")}, {"b", []byte("2")}, {"c", []byte{}}}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err = store.write([]kvEntry{{"a", []byte("3")}, {"b", nil}}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	check := func(key string, expected []byte) {
+		value, err := store.get(key)
+		if err != nil || !bytes.Equal(value, expected) || (value == nil) != (expected == nil) {
+			t.Errorf("Wrong value for %s: %q (%v)", key, value, err)
+		}
+	}
+	check("a", []byte("3"))
+	check("b", nil)
+	check("c", []byte{})
+	store.close()
+
+	// Simulate a crash while writing a batch
+	file, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+	file.Write([]byte{20, 0, 0, 0, 1, 2, 3, 4, 1, 1})
+	file.Close()
+
+	if store, err = openKVStore(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	check("a", []byte("3"))
+	check("b", nil)
+	if keys := store.keys(""); len(keys) != 2 || keys[0] != "a" || keys[1] != "c" {
+		t.Errorf("Wrong keys %q", keys)
+	}
+	if err = store.write([]kvEntry{{"d", []byte("4")}}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// Compaction keeps the live entries only
+	size := store.diskSize()
+	if err = store.compact(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if store.diskSize() >= size {
+		t.Errorf("Store not compacted: %d >= %d", store.diskSize(), size)
+	}
+	check("a", []byte("3"))
+	check("d", []byte("4"))
+	store.close()
+
+	if store, err = openKVStore(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer store.close()
+	check("a", []byte("3"))
+	check("b", nil)
+	check("c", []byte{})
+	check("d", []byte("4"))
+}
+
+func TestKVStoreStaleCompaction(t *testing.T) {
+	dir, err := ioutil.TempDir("", "kvstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.dat")
+
+	// A compaction was interrupted before the rename, when "a" was still
+	// live
+	stale, err := openKVStore(path + ".tmp")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err = stale.write([]kvEntry{{"a", []byte("1")}, {"b", []byte("2")}}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	stale.close()
+
+	store, err := openKVStore(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err = store.write([]kvEntry{{"b", []byte("3")}, {"c", []byte("4")}}); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err = store.compact(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	store.close()
+
+	if store, err = openKVStore(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer store.close()
+	if keys := store.keys(""); len(keys) != 2 || keys[0] != "b" || keys[1] != "c" {
+		t.Errorf("Wrong keys %q after compaction", keys)
+	}
+	if value, err := store.get("b"); err != nil || string(value) != "3" {
+		t.Errorf("Wrong value for b: %q (%v)", value, err)
+	}
+}
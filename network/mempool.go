@@ -0,0 +1,1437 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Policy
+//=======
+
+// FeeRate is a fee rate in satoshis per 1000 virtual bytes
+type FeeRate int64
+
+// NewFeeRate returns the fee rate of paying fee for vsize virtual bytes
+func NewFeeRate(fee int64, vsize int) FeeRate {
+	if vsize <= 0 {
+		return 0
+	}
+	return FeeRate(fee * 1000 / int64(vsize))
+}
+
+// Fee returns the fee for vsize virtual bytes. A non-zero rate results in
+// a fee of at least one satoshi.
+func (rate FeeRate) Fee(vsize int) int64 {
+	fee := int64(rate) * int64(vsize) / 1000
+	if fee == 0 && vsize != 0 {
+		if rate > 0 {
+			fee = 1
+		} else if rate < 0 {
+			fee = -1
+		}
+	}
+	return fee
+}
+
+func (rate FeeRate) String() string {
+	return fmt.Sprintf("%d.%08d BTC/kvB", rate/COIN, rate%COIN)
+}
+
+// Standardness limits, as in bitcoin core's policy.h
+const (
+	MAX_STANDARD_TX_WEIGHT                 = 400000
+	MIN_STANDARD_TX_NONWITNESS_SIZE        = 65
+	MAX_STANDARD_SCRIPTSIG_SIZE            = 1650
+	MAX_P2SH_SIGOPS                        = 15
+	MAX_STANDARD_TX_SIGOPS_COST            = MAX_BLOCK_SIGOPS_COST / 5
+	MAX_STANDARD_P2WSH_STACK_ITEMS         = 100
+	MAX_STANDARD_P2WSH_STACK_ITEM_SIZE     = 80
+	MAX_STANDARD_TAPSCRIPT_STACK_ITEM_SIZE = 80
+	MAX_STANDARD_P2WSH_SCRIPT_SIZE         = 3600
+	MAX_OP_RETURN_RELAY                    = 83 // including OP_RETURN and the push opcodes
+	MAX_STANDARD_MULTISIG_KEYS             = 3
+	TX_MAX_STANDARD_VERSION                = 2
+
+	// Signature operations count as this many virtual bytes at least
+	DEFAULT_BYTES_PER_SIGOP = 20
+)
+
+// Default fee rates
+const (
+	DEFAULT_MIN_RELAY_TX_FEE      FeeRate = 1000
+	DEFAULT_INCREMENTAL_RELAY_FEE FeeRate = 1000
+	DUST_RELAY_TX_FEE             FeeRate = 3000
+)
+
+// Script flags which must pass for a transaction to be valid at all
+const MANDATORY_SCRIPT_VERIFY_FLAGS = SCRIPT_VERIFY_P2SH | SCRIPT_VERIFY_DERSIG | SCRIPT_VERIFY_NULLDUMMY |
+	SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY | SCRIPT_VERIFY_CHECKSEQUENCEVERIFY | SCRIPT_VERIFY_WITNESS | SCRIPT_VERIFY_TAPROOT
+
+// Script flags enforced for transactions entering the mempool
+const STANDARD_SCRIPT_VERIFY_FLAGS = MANDATORY_SCRIPT_VERIFY_FLAGS | SCRIPT_VERIFY_STRICTENC |
+	SCRIPT_VERIFY_MINIMALDATA | SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_NOPS | SCRIPT_VERIFY_CLEANSTACK |
+	SCRIPT_VERIFY_MINIMALIF | SCRIPT_VERIFY_NULLFAIL | SCRIPT_VERIFY_LOW_S |
+	SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_WITNESS_PROGRAM | SCRIPT_VERIFY_WITNESS_PUBKEYTYPE |
+	SCRIPT_VERIFY_CONST_SCRIPTCODE | SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_TAPROOT_VERSION |
+	SCRIPT_VERIFY_DISCOURAGE_OP_SUCCESS | SCRIPT_VERIFY_DISCOURAGE_UPGRADABLE_PUBKEYTYPE
+
+// Errors returned by the standardness checks and the mempool, with bitcoin
+// core's reject reasons
+var (
+	ErrTxVersion                  = errors.New("version")
+	ErrTxWeight                   = errors.New("tx-size")
+	ErrTxSizeSmall                = errors.New("tx-size-small")
+	ErrScriptSigSize              = errors.New("scriptsig-size")
+	ErrScriptSigNotPushOnly       = errors.New("scriptsig-not-pushonly")
+	ErrScriptPubKey               = errors.New("scriptpubkey")
+	ErrDust                       = errors.New("dust")
+	ErrMultiOpReturn              = errors.New("multi-op-return")
+	ErrNonstandardInputs          = errors.New("bad-txns-nonstandard-inputs")
+	ErrNonstandardWitness         = errors.New("bad-witness-nonstandard")
+	ErrTooManySigOps              = errors.New("bad-txns-too-many-sigops")
+	ErrTxCoinbase                 = errors.New("coinbase")
+	ErrTxNotFinal                 = errors.New("non-final")
+	ErrTxNotBIP68Final            = errors.New("non-BIP68-final")
+	ErrTxInMempool                = errors.New("txn-already-in-mempool")
+	ErrTxSameNonWitness           = errors.New("txn-same-nonwitness-data-in-mempool")
+	ErrTxAlreadyKnown             = errors.New("txn-already-known")
+	ErrMempoolConflict            = errors.New("txn-mempool-conflict")
+	ErrSpendsConflicting          = errors.New("bad-txns-spends-conflicting-tx")
+	ErrTooManyReplacements        = errors.New("too many potential replacements")
+	ErrReplacementAddsUnconfirmed = errors.New("replacement-adds-unconfirmed")
+	ErrInsufficientFee            = errors.New("insufficient fee")
+	ErrMinRelayFee                = errors.New("min relay fee not met")
+	ErrMempoolMinFee              = errors.New("mempool min fee not met")
+	ErrTooLongMempoolChain        = errors.New("too-long-mempool-chain")
+	ErrMempoolFull                = errors.New("mempool full")
+	ErrScriptVerifyNonMandatory   = errors.New("non-mandatory-script-verify-flag")
+)
+
+// GetVirtualTransactionSize returns the virtual size of a transaction: its
+// weight divided by four, rounded up, where each signature operation
+// counts as at least DEFAULT_BYTES_PER_SIGOP bytes
+func GetVirtualTransactionSize(weight, sigOpCost int) int {
+	if sigOps := sigOpCost * DEFAULT_BYTES_PER_SIGOP; sigOps > weight {
+		weight = sigOps
+	}
+	return (weight + WITNESS_SCALE_FACTOR - 1) / WITNESS_SCALE_FACTOR
+}
+
+// GetDustThreshold returns the smallest value of out which is worth
+// spending at dustRelayFee: the fee of the output plus the input spending
+// it. Unspendable outputs are never dust.
+func GetDustThreshold(out TxOut, dustRelayFee FeeRate) int64 {
+	if IsUnspendable(out.PkScript) {
+		return 0
+	}
+	size := len(MarshalTxOut(nil, out))
+	if _, _, ok := IsWitnessProgram(out.PkScript); ok {
+		// outpoint, script length, sequence and a witness of a signature
+		// and a public key at a quarter of the weight
+		size += 32 + 4 + 1 + 107/WITNESS_SCALE_FACTOR + 4
+	} else {
+		size += 32 + 4 + 1 + 107 + 4
+	}
+	return dustRelayFee.Fee(size)
+}
+
+// IsDust checks whether the value of out is below the dust threshold
+func IsDust(out TxOut, dustRelayFee FeeRate) bool {
+	return out.Value < GetDustThreshold(out, dustRelayFee)
+}
+
+// isStandardOutput checks the output script against the standard templates
+func isStandardOutput(script []byte) (ScriptClass, bool) {
+	class, solutions := ClassifyScript(script)
+	switch class {
+	case NonStandardTy:
+		return class, false
+	case MultiSigTy:
+		required, keys := solutions[0][0], solutions[len(solutions)-1][0]
+		if keys < 1 || keys > MAX_STANDARD_MULTISIG_KEYS || required < 1 || required > keys {
+			return class, false
+		}
+	case NullDataTy:
+		if len(script) > MAX_OP_RETURN_RELAY {
+			return class, false
+		}
+	}
+	return class, true
+}
+
+// IsStandardTx checks the parts of the standardness rules which don't need
+// the spent outputs (as bitcoin core's IsStandardTx): version, weight,
+// push only input scripts of limited size, standard output scripts, no
+// dust and at most one OP_RETURN output.
+func IsStandardTx(tx *Tx, dustRelayFee FeeRate) error {
+	if version := int32(tx.Version); version < 1 || version > TX_MAX_STANDARD_VERSION {
+		return ErrTxVersion
+	}
+	if tx.Weight() > MAX_STANDARD_TX_WEIGHT {
+		return ErrTxWeight
+	}
+	for i, in := range tx.TxIn {
+		if len(in.SignatureScript) > MAX_STANDARD_SCRIPTSIG_SIZE {
+			return fmt.Errorf("%w: input %d", ErrScriptSigSize, i)
+		}
+		if !IsPushOnly(in.SignatureScript) {
+			return fmt.Errorf("%w: input %d", ErrScriptSigNotPushOnly, i)
+		}
+	}
+	nullData := 0
+	for i, out := range tx.TxOut {
+		class, ok := isStandardOutput(out.PkScript)
+		if !ok {
+			return fmt.Errorf("%w: output %d", ErrScriptPubKey, i)
+		}
+		if class == NullDataTy {
+			nullData++
+		} else if IsDust(out, dustRelayFee) {
+			return fmt.Errorf("%w: output %d", ErrDust, i)
+		}
+	}
+	if nullData > 1 {
+		return ErrMultiOpReturn
+	}
+	return nil
+}
+
+// AreInputsStandard checks that the outputs spent by tx are of a standard
+// type and that P2SH redeem scripts have at most MAX_P2SH_SIGOPS signature
+// operations. The input scripts must be push only (see IsStandardTx).
+func AreInputsStandard(tx *Tx, spent []TxOut) error {
+	for i, in := range tx.TxIn {
+		switch class, _ := ClassifyScript(spent[i].PkScript); class {
+		case NonStandardTy, WitnessUnknownTy:
+			return fmt.Errorf("%w: input %d spends %v output", ErrNonstandardInputs, i, class)
+		case ScriptHashTy:
+			if P2SHSigOpCount(in.SignatureScript, spent[i].PkScript) > MAX_P2SH_SIGOPS {
+				return fmt.Errorf("%w: input %d has too many P2SH sigops", ErrNonstandardInputs, i)
+			}
+		}
+	}
+	return nil
+}
+
+// lastPush returns the data of the last push in a push only script
+func lastPush(script []byte) ([]byte, bool) {
+	var data []byte
+	found := false
+	t := NewScriptTokenizer(script)
+	for t.Next() {
+		if t.Opcode() > OP_16 {
+			return nil, false
+		}
+		data, found = t.Data(), true
+	}
+	return data, found && t.Err() == nil
+}
+
+// IsWitnessStandard checks the witnesses of tx against the limits for
+// P2WSH and tapscript stack items and scripts, rejects witnesses for non
+// witness outputs and taproot annexes
+func IsWitnessStandard(tx *Tx, spent []TxOut) error {
+	for i, in := range tx.TxIn {
+		if len(in.Witness) == 0 {
+			continue
+		}
+		fail := func(reason string) error {
+			return fmt.Errorf("%w: input %d %s", ErrNonstandardWitness, i, reason)
+		}
+		script := spent[i].PkScript
+		p2sh := IsPayToScriptHash(script)
+		if p2sh {
+			redeemScript, ok := lastPush(in.SignatureScript)
+			if !ok {
+				return fail("has no redeem script")
+			}
+			script = redeemScript
+		}
+		version, program, ok := IsWitnessProgram(script)
+		if !ok {
+			return fail("has a witness but spends no witness program")
+		}
+		witness := in.Witness
+		switch {
+		case version == 0 && len(program) == 32:
+			if len(witness)-1 > MAX_STANDARD_P2WSH_STACK_ITEMS {
+				return fail("has too many stack items")
+			}
+			if len(witness[len(witness)-1]) > MAX_STANDARD_P2WSH_SCRIPT_SIZE {
+				return fail("has a too large witness script")
+			}
+			for _, item := range witness[:len(witness)-1] {
+				if len(item) > MAX_STANDARD_P2WSH_STACK_ITEM_SIZE {
+					return fail("has a too large stack item")
+				}
+			}
+		case version == 1 && len(program) == 32 && !p2sh:
+			if last := witness[len(witness)-1]; len(witness) >= 2 && len(last) > 0 && last[0] == ANNEX_TAG {
+				return fail("has an annex")
+			}
+			if len(witness) >= 2 {
+				// Script path spend: the stack items before the script
+				// and the control block are limited for tapscript
+				control := witness[len(witness)-1]
+				if len(control) > 0 && control[0]&TAPROOT_LEAF_MASK == TAPROOT_LEAF_TAPSCRIPT {
+					for _, item := range witness[:len(witness)-2] {
+						if len(item) > MAX_STANDARD_TAPSCRIPT_STACK_ITEM_SIZE {
+							return fail("has a too large tapscript stack item")
+						}
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Mempool
+//========
+
+// Mempool limits
+const (
+	DEFAULT_MAX_MEMPOOL_SIZE        = 300000000 // total virtual size of the transactions
+	DEFAULT_ANCESTOR_LIMIT          = 25        // including the transaction itself
+	DEFAULT_ANCESTOR_SIZE_LIMIT     = 101000    // virtual bytes
+	DEFAULT_DESCENDANT_LIMIT        = 25        // including the transaction itself
+	DEFAULT_DESCENDANT_SIZE_LIMIT   = 101000    // virtual bytes
+	DEFAULT_MAX_ORPHAN_TRANSACTIONS = 100
+
+	// Inputs with a higher sequence number don't signal replaceability
+	MAX_BIP125_RBF_SEQUENCE = 0xfffffffd
+
+	// Maximum number of transactions a replacement may evict
+	MAX_REPLACEMENT_CANDIDATES = 100
+
+	// The minimum fee raised by evictions halves in this time
+	ROLLING_FEE_HALFLIFE = 12 * time.Hour
+
+	// Orphans are forgotten after this time
+	ORPHAN_TX_EXPIRE_TIME = 20 * time.Minute
+)
+
+// MempoolEntry is a transaction in the mempool. The aggregated values of
+// the ancestors and descendants in the mempool are maintained by the
+// mempool and may only be read while it is locked.
+type MempoolEntry struct {
+	Tx        *Tx
+	TxID      Hash
+	WTxID     Hash
+	Fee       int64
+	VSize     int
+	SigOpCost int
+	Time      time.Time // time the transaction entered the mempool
+	Height    int       // height of the tip when it entered
+
+	parents  map[Hash]*MempoolEntry // in-mempool transactions spent
+	children map[Hash]*MempoolEntry // in-mempool transactions spending it
+
+	// Aggregates including the entry itself
+	countWithAncestors   int
+	sizeWithAncestors    int
+	feesWithAncestors    int64
+	countWithDescendants int
+	sizeWithDescendants  int
+	feesWithDescendants  int64
+}
+
+// FeeRate returns the fee rate of the transaction alone
+func (e *MempoolEntry) FeeRate() FeeRate {
+	return NewFeeRate(e.Fee, e.VSize)
+}
+
+// descendantScore is the fee rate used for eviction: the better of the
+// rate of the transaction and that of the package with its descendants
+func (e *MempoolEntry) descendantScore() float64 {
+	score := float64(e.Fee) / float64(e.VSize)
+	if rate := float64(e.feesWithDescendants) / float64(e.sizeWithDescendants); rate > score {
+		score = rate
+	}
+	return score
+}
+
+// signalsRBF checks the inputs of the transaction for BIP125 signaling
+func (e *MempoolEntry) signalsRBF() bool {
+	for _, in := range e.Tx.TxIn {
+		if in.Sequence <= MAX_BIP125_RBF_SEQUENCE {
+			return true
+		}
+	}
+	return false
+}
+
+// Mempool holds the unconfirmed transactions relayed by peers, which spend
+// outputs of the UTXO set or of other transactions in the mempool. It
+// checks the transactions like a block would (see ConnectBlock), the
+// standardness rules and fee rate minimums, limits chains of unconfirmed
+// transactions and allows BIP125 replacements. Transactions with unknown
+// inputs are kept in a bounded orphan pool until their parents arrive. If
+// the mempool is full, the transactions (with their descendants) with the
+// lowest fee rate are evicted and the minimum fee rate is raised.
+//
+// The mempool is safe for concurrent use. It reads the UTXO set while
+// accepting transactions, so blocks must not be connected to the UTXO set
+// concurrently; BlockConnected and BlockDisconnected must be called after
+// each change of the tip.
+type Mempool struct {
+	// Policy settings, which must not be changed once the mempool is in use
+	MinRelayFee         FeeRate
+	IncrementalRelayFee FeeRate // for replacements and evictions
+	DustRelayFee        FeeRate
+	MaxSize             int // maximum total virtual size
+	AncestorLimit       int
+	AncestorSizeLimit   int
+	DescendantLimit     int
+	DescendantSizeLimit int
+	MaxOrphans          int
+	RequireStandard     bool
+
+	// Called for each transaction added to the mempool (including orphans
+	// whose parents arrived), after the mempool has been unlocked
+	OnAccept func(entry *MempoolEntry)
+
+	mutex   sync.Mutex
+	params  *ConsensusParams
+	utxo    *UtxoSet
+	tip     *HeaderNode
+	entries map[Hash]*MempoolEntry     // by txid
+	wtxids  map[Hash]*MempoolEntry     // by wtxid
+	spends  map[OutPoint]*MempoolEntry // the transaction spending each outpoint
+	size    int                        // total virtual size
+	orphans *orphanPool
+
+	rollingMinFee        float64
+	lastRollingFeeUpdate time.Time
+	blockSinceFeeBump    bool
+
+	now func() time.Time
+}
+
+// NewMempool creates an empty mempool on top of the UTXO set, whose best
+// block is tip, with bitcoin core's default policy
+func NewMempool(utxo *UtxoSet, tip *HeaderNode, params *ConsensusParams) *Mempool {
+	mp := &Mempool{
+		MinRelayFee:         DEFAULT_MIN_RELAY_TX_FEE,
+		IncrementalRelayFee: DEFAULT_INCREMENTAL_RELAY_FEE,
+		DustRelayFee:        DUST_RELAY_TX_FEE,
+		MaxSize:             DEFAULT_MAX_MEMPOOL_SIZE,
+		AncestorLimit:       DEFAULT_ANCESTOR_LIMIT,
+		AncestorSizeLimit:   DEFAULT_ANCESTOR_SIZE_LIMIT,
+		DescendantLimit:     DEFAULT_DESCENDANT_LIMIT,
+		DescendantSizeLimit: DEFAULT_DESCENDANT_SIZE_LIMIT,
+		MaxOrphans:          DEFAULT_MAX_ORPHAN_TRANSACTIONS,
+		RequireStandard:     true,
+		params:              params,
+		utxo:                utxo,
+		tip:                 tip,
+		entries:             make(map[Hash]*MempoolEntry),
+		wtxids:              make(map[Hash]*MempoolEntry),
+		spends:              make(map[OutPoint]*MempoolEntry),
+		orphans:             newOrphanPool(),
+		now:                 time.Now,
+	}
+	mp.lastRollingFeeUpdate = mp.now()
+	return mp
+}
+
+// AcceptTx validates tx and adds it to the mempool. peer identifies the
+// peer which relayed it. It returns the accepted transactions: tx and the
+// orphans which could be added because of it. If inputs of tx are
+// missing, it is kept in the orphan pool and the error wraps
+// ErrMissingInputs. Other errors are returned as *RejectError.
+func (mp *Mempool) AcceptTx(tx *Tx, peer string) ([]*MempoolEntry, error) {
+	mp.mutex.Lock()
+	now := mp.now()
+	var accepted []*MempoolEntry
+	entry, err := mp.acceptTx(tx, now)
+	if err == nil {
+		accepted = append(accepted, entry)
+		accepted = append(accepted, mp.processOrphans(entry, now)...)
+	} else if errors.Is(err, ErrMissingInputs) {
+		mp.orphans.add(tx, peer, now, mp.MaxOrphans)
+	}
+	mp.mutex.Unlock()
+
+	if mp.OnAccept != nil {
+		for _, entry := range accepted {
+			mp.OnAccept(entry)
+		}
+	}
+	return accepted, rejectError(err)
+}
+
+// nextBlock returns a node for the block following the tip, for checking
+// lock times
+func (mp *Mempool) nextBlock() *HeaderNode {
+	return &HeaderNode{Height: mp.tip.Height + 1, Parent: mp.tip}
+}
+
+func (mp *Mempool) acceptTx(tx *Tx, now time.Time) (*MempoolEntry, error) {
+	if err := CheckTransaction(tx); err != nil {
+		return nil, err
+	}
+	if tx.IsCoinBase() {
+		return nil, ErrTxCoinbase
+	}
+	if mp.RequireStandard {
+		if err := IsStandardTx(tx, mp.DustRelayFee); err != nil {
+			return nil, err
+		}
+	}
+	if len(MarshalTxNoWitness(nil, *tx)) < MIN_STANDARD_TX_NONWITNESS_SIZE {
+		return nil, ErrTxSizeSmall
+	}
+	next := mp.nextBlock()
+	if !IsFinalTx(tx, next.Height, mp.tip.MedianTimePast().Unix()) {
+		return nil, ErrTxNotFinal
+	}
+	txid, wtxid := tx.TxID(), tx.WTxID()
+	if _, ok := mp.wtxids[wtxid]; ok {
+		return nil, ErrTxInMempool
+	}
+	if _, ok := mp.entries[txid]; ok {
+		return nil, ErrTxSameNonWitness
+	}
+
+	// Transactions spending the same outputs can only be replaced if they
+	// signal it (BIP125)
+	conflicts := make(map[Hash]*MempoolEntry)
+	for _, in := range tx.TxIn {
+		conflict, ok := mp.spends[in.PreviousOutput]
+		if !ok {
+			continue
+		}
+		if !mp.signalsRBF(conflict) {
+			return nil, fmt.Errorf("%w: %v", ErrMempoolConflict, conflict.TxID.RPCString())
+		}
+		conflicts[conflict.TxID] = conflict
+	}
+
+	// Look up the spent outputs in the mempool and the UTXO set
+	spent := make([]TxOut, len(tx.TxIn))
+	heights := make([]int, len(tx.TxIn))
+	parents := make(map[Hash]*MempoolEntry)
+	var valueIn int64
+	for i, in := range tx.TxIn {
+		op := in.PreviousOutput
+		if parent, ok := mp.entries[op.Hash]; ok && int(op.Index) < len(parent.Tx.TxOut) {
+			spent[i] = parent.Tx.TxOut[op.Index]
+			heights[i] = next.Height
+			parents[parent.TxID] = parent
+		} else {
+			coin, ok, err := mp.utxo.Coin(op)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return nil, mp.missingInputs(tx, txid, op)
+			}
+			if coin.CoinBase && next.Height-coin.Height < COINBASE_MATURITY {
+				return nil, fmt.Errorf("%w: tried to spend coinbase at depth %d", ErrPrematureSpend, next.Height-coin.Height)
+			}
+			spent[i] = coin.TxOut
+			heights[i] = coin.Height
+		}
+		valueIn += spent[i].Value
+		if !MoneyRange(spent[i].Value) || !MoneyRange(valueIn) {
+			return nil, ErrInputValuesRange
+		}
+	}
+	var valueOut int64
+	for _, out := range tx.TxOut {
+		valueOut += out.Value
+	}
+	if valueIn < valueOut {
+		return nil, fmt.Errorf("%w: value in (%d) < value out (%d)", ErrInBelowOut, valueIn, valueOut)
+	}
+	if !CheckSequenceLocks(tx, heights, next) {
+		return nil, ErrTxNotBIP68Final
+	}
+	if mp.RequireStandard {
+		if err := AreInputsStandard(tx, spent); err != nil {
+			return nil, err
+		}
+		if err := IsWitnessStandard(tx, spent); err != nil {
+			return nil, err
+		}
+	}
+	sigOpCost := TransactionSigOpCost(tx, spent, STANDARD_SCRIPT_VERIFY_FLAGS)
+	if sigOpCost > MAX_STANDARD_TX_SIGOPS_COST {
+		return nil, fmt.Errorf("%w: %d", ErrTooManySigOps, sigOpCost)
+	}
+
+	entry := &MempoolEntry{
+		Tx:        tx,
+		TxID:      txid,
+		WTxID:     wtxid,
+		Fee:       valueIn - valueOut,
+		VSize:     GetVirtualTransactionSize(tx.Weight(), sigOpCost),
+		SigOpCost: sigOpCost,
+		Time:      now,
+		Height:    mp.tip.Height,
+		parents:   parents,
+		children:  make(map[Hash]*MempoolEntry),
+	}
+	if minFee := mp.MinRelayFee.Fee(entry.VSize); entry.Fee < minFee {
+		return nil, fmt.Errorf("%w, %d < %d", ErrMinRelayFee, entry.Fee, minFee)
+	}
+	if minFee := mp.minFee(now).Fee(entry.VSize); entry.Fee < minFee {
+		return nil, fmt.Errorf("%w, %d < %d", ErrMempoolMinFee, entry.Fee, minFee)
+	}
+	ancestors, err := mp.checkAncestors(entry)
+	if err != nil {
+		return nil, err
+	}
+	if len(conflicts) > 0 {
+		if err := mp.checkReplacement(entry, ancestors, conflicts); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkTxScripts(tx, spent); err != nil {
+		return nil, err
+	}
+
+	for _, conflict := range conflicts {
+		if _, ok := mp.entries[conflict.TxID]; ok {
+			mp.removeEntries(mp.descendants(conflict))
+		}
+	}
+	mp.addEntry(entry, ancestors)
+	mp.trimToSize()
+	if _, ok := mp.entries[txid]; !ok {
+		return nil, ErrMempoolFull
+	}
+	return entry, nil
+}
+
+// missingInputs returns the error for a transaction spending the unknown
+// outpoint op. If outputs of the transaction are in the UTXO set, it is
+// already confirmed.
+func (mp *Mempool) missingInputs(tx *Tx, txid Hash, op OutPoint) error {
+	for i := range tx.TxOut {
+		if _, ok, _ := mp.utxo.Coin(OutPoint{txid, uint32(i)}); ok {
+			return ErrTxAlreadyKnown
+		}
+	}
+	return fmt.Errorf("%w: %v:%d", ErrMissingInputs, op.Hash.RPCString(), op.Index)
+}
+
+// checkTxScripts verifies the input scripts with the standard flags. If
+// they only fail because of the policy flags, the reject code is
+// REJECT_NONSTANDARD.
+func checkTxScripts(tx *Tx, spent []TxOut) error {
+	txData := NewPrecomputedTxData(tx, spent)
+	for i := range tx.TxIn {
+		check := scriptCheck{tx: tx, index: i, spent: spent[i], txData: txData, flags: STANDARD_SCRIPT_VERIFY_FLAGS}
+		err := check.verify()
+		if err == nil {
+			continue
+		}
+		check.flags = MANDATORY_SCRIPT_VERIFY_FLAGS
+		code, reason := uint8(REJECT_INVALID), ErrScriptVerifyFailed
+		if check.verify() == nil {
+			code, reason = REJECT_NONSTANDARD, ErrScriptVerifyNonMandatory
+		}
+		return &RejectError{
+			Code:   code,
+			Reason: fmt.Sprintf("%s (%v)", reason, err),
+			Err:    &scriptCheckError{reason, err, fmt.Sprintf("input %d", i)},
+		}
+	}
+	return nil
+}
+
+// ancestors returns the in-mempool ancestors of entry, which need not be
+// in the mempool itself
+func (mp *Mempool) ancestors(entry *MempoolEntry) map[Hash]*MempoolEntry {
+	result := make(map[Hash]*MempoolEntry)
+	queue := make([]*MempoolEntry, 0, len(entry.parents))
+	for _, parent := range entry.parents {
+		queue = append(queue, parent)
+	}
+	for len(queue) > 0 {
+		e := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if _, ok := result[e.TxID]; ok {
+			continue
+		}
+		result[e.TxID] = e
+		for _, parent := range e.parents {
+			queue = append(queue, parent)
+		}
+	}
+	return result
+}
+
+// descendants returns entry and all its descendants
+func (mp *Mempool) descendants(entry *MempoolEntry) map[Hash]*MempoolEntry {
+	result := make(map[Hash]*MempoolEntry)
+	queue := []*MempoolEntry{entry}
+	for len(queue) > 0 {
+		e := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if _, ok := result[e.TxID]; ok {
+			continue
+		}
+		result[e.TxID] = e
+		for _, child := range e.children {
+			queue = append(queue, child)
+		}
+	}
+	return result
+}
+
+// signalsRBF checks whether entry or one of its ancestors signals
+// replaceability
+func (mp *Mempool) signalsRBF(entry *MempoolEntry) bool {
+	if entry.signalsRBF() {
+		return true
+	}
+	for _, ancestor := range mp.ancestors(entry) {
+		if ancestor.signalsRBF() {
+			return true
+		}
+	}
+	return false
+}
+
+// checkAncestors returns the ancestors of a new entry and checks that the
+// ancestor and descendant limits are kept
+func (mp *Mempool) checkAncestors(entry *MempoolEntry) (map[Hash]*MempoolEntry, error) {
+	ancestors := mp.ancestors(entry)
+	if len(ancestors)+1 > mp.AncestorLimit {
+		return nil, fmt.Errorf("%w: too many unconfirmed ancestors [limit: %d]", ErrTooLongMempoolChain, mp.AncestorLimit)
+	}
+	size := entry.VSize
+	for _, ancestor := range ancestors {
+		size += ancestor.VSize
+		if ancestor.countWithDescendants+1 > mp.DescendantLimit {
+			return nil, fmt.Errorf("%w: too many descendants for tx %v [limit: %d]", ErrTooLongMempoolChain, ancestor.TxID.RPCString(), mp.DescendantLimit)
+		}
+		if ancestor.sizeWithDescendants+entry.VSize > mp.DescendantSizeLimit {
+			return nil, fmt.Errorf("%w: exceeds descendant size limit for tx %v [limit: %d]", ErrTooLongMempoolChain, ancestor.TxID.RPCString(), mp.DescendantSizeLimit)
+		}
+	}
+	if size > mp.AncestorSizeLimit {
+		return nil, fmt.Errorf("%w: exceeds ancestor size limit [limit: %d]", ErrTooLongMempoolChain, mp.AncestorSizeLimit)
+	}
+	return ancestors, nil
+}
+
+// checkReplacement checks the BIP125 rules for entry replacing the
+// conflicting transactions and their descendants: it may not spend them
+// or add unconfirmed inputs, must have a higher fee rate than each
+// conflict and must pay for the replaced transactions and its own relay
+func (mp *Mempool) checkReplacement(entry *MempoolEntry, ancestors, conflicts map[Hash]*MempoolEntry) error {
+	replaced := make(map[Hash]*MempoolEntry)
+	for _, conflict := range conflicts {
+		for hash, e := range mp.descendants(conflict) {
+			replaced[hash] = e
+		}
+		if len(replaced) > MAX_REPLACEMENT_CANDIDATES {
+			return fmt.Errorf("%w: rejecting replacement %v", ErrTooManyReplacements, entry.TxID.RPCString())
+		}
+	}
+	for hash := range ancestors {
+		if _, ok := replaced[hash]; ok {
+			return fmt.Errorf("%w: %v spends conflicting transaction %v", ErrSpendsConflicting, entry.TxID.RPCString(), hash.RPCString())
+		}
+	}
+
+	// Unconfirmed inputs must have been spent by the conflicts already
+	conflictParents := make(map[Hash]bool)
+	for _, conflict := range conflicts {
+		for hash := range conflict.parents {
+			conflictParents[hash] = true
+		}
+	}
+	for hash := range entry.parents {
+		if !conflictParents[hash] {
+			return fmt.Errorf("%w: replacement %v adds unconfirmed input %v", ErrReplacementAddsUnconfirmed, entry.TxID.RPCString(), hash.RPCString())
+		}
+	}
+
+	rate := entry.FeeRate()
+	for _, conflict := range conflicts {
+		if old := conflict.FeeRate(); rate <= old {
+			return fmt.Errorf("%w: rejecting replacement %v; new feerate %v <= old feerate %v", ErrInsufficientFee, entry.TxID.RPCString(), rate, old)
+		}
+	}
+	var replacedFees int64
+	for _, e := range replaced {
+		replacedFees += e.Fee
+	}
+	if entry.Fee < replacedFees {
+		return fmt.Errorf("%w: rejecting replacement %v, less fees than conflicting txs; %d < %d", ErrInsufficientFee, entry.TxID.RPCString(), entry.Fee, replacedFees)
+	}
+	if relayFee := mp.IncrementalRelayFee.Fee(entry.VSize); entry.Fee-replacedFees < relayFee {
+		return fmt.Errorf("%w: rejecting replacement %v, not enough additional fees to relay; %d < %d", ErrInsufficientFee, entry.TxID.RPCString(), entry.Fee-replacedFees, relayFee)
+	}
+	return nil
+}
+
+// addEntry adds a checked entry and updates the aggregates of its
+// ancestors
+func (mp *Mempool) addEntry(entry *MempoolEntry, ancestors map[Hash]*MempoolEntry) {
+	entry.countWithAncestors, entry.sizeWithAncestors, entry.feesWithAncestors = 1, entry.VSize, entry.Fee
+	entry.countWithDescendants, entry.sizeWithDescendants, entry.feesWithDescendants = 1, entry.VSize, entry.Fee
+	for _, ancestor := range ancestors {
+		entry.countWithAncestors++
+		entry.sizeWithAncestors += ancestor.VSize
+		entry.feesWithAncestors += ancestor.Fee
+		ancestor.countWithDescendants++
+		ancestor.sizeWithDescendants += entry.VSize
+		ancestor.feesWithDescendants += entry.Fee
+	}
+	for _, parent := range entry.parents {
+		parent.children[entry.TxID] = entry
+	}
+	mp.entries[entry.TxID] = entry
+	mp.wtxids[entry.WTxID] = entry
+	for _, in := range entry.Tx.TxIn {
+		mp.spends[in.PreviousOutput] = entry
+	}
+	mp.size += entry.VSize
+}
+
+// removeEntries removes a set of entries. The aggregates of the remaining
+// ancestors and descendants are updated.
+func (mp *Mempool) removeEntries(remove map[Hash]*MempoolEntry) {
+	for _, e := range remove {
+		for hash, ancestor := range mp.ancestors(e) {
+			if _, ok := remove[hash]; !ok {
+				ancestor.countWithDescendants--
+				ancestor.sizeWithDescendants -= e.VSize
+				ancestor.feesWithDescendants -= e.Fee
+			}
+		}
+		for hash, descendant := range mp.descendants(e) {
+			if _, ok := remove[hash]; !ok {
+				descendant.countWithAncestors--
+				descendant.sizeWithAncestors -= e.VSize
+				descendant.feesWithAncestors -= e.Fee
+			}
+		}
+	}
+	for hash, e := range remove {
+		for _, parent := range e.parents {
+			delete(parent.children, hash)
+		}
+		for _, child := range e.children {
+			delete(child.parents, hash)
+		}
+		delete(mp.entries, hash)
+		delete(mp.wtxids, e.WTxID)
+		for _, in := range e.Tx.TxIn {
+			delete(mp.spends, in.PreviousOutput)
+		}
+		mp.size -= e.VSize
+	}
+}
+
+// trimToSize evicts the transactions with the lowest descendant fee rate
+// together with their descendants until the mempool fits into MaxSize. The
+// minimum fee rate is raised above the rate of the evicted packages.
+func (mp *Mempool) trimToSize() {
+	for mp.size > mp.MaxSize && len(mp.entries) > 0 {
+		var worst *MempoolEntry
+		for _, e := range mp.entries {
+			if worst == nil || e.descendantScore() < worst.descendantScore() ||
+				(e.descendantScore() == worst.descendantScore() && e.Time.After(worst.Time)) {
+				worst = e
+			}
+		}
+		rate := NewFeeRate(worst.feesWithDescendants, worst.sizeWithDescendants) + mp.IncrementalRelayFee
+		if float64(rate) > mp.rollingMinFee {
+			mp.rollingMinFee = float64(rate)
+			mp.blockSinceFeeBump = false
+		}
+		mp.removeEntries(mp.descendants(worst))
+	}
+}
+
+// minFee returns the fee rate a transaction needs to enter the mempool
+// because of evictions. It decays once blocks have been connected.
+func (mp *Mempool) minFee(now time.Time) FeeRate {
+	if !mp.blockSinceFeeBump || mp.rollingMinFee == 0 {
+		return FeeRate(mp.rollingMinFee)
+	}
+	if elapsed := now.Sub(mp.lastRollingFeeUpdate); elapsed > 10*time.Second {
+		halflife := ROLLING_FEE_HALFLIFE
+		if mp.size < mp.MaxSize/4 {
+			halflife /= 4
+		} else if mp.size < mp.MaxSize/2 {
+			halflife /= 2
+		}
+		mp.rollingMinFee /= math.Pow(2, elapsed.Seconds()/halflife.Seconds())
+		mp.lastRollingFeeUpdate = now
+		if mp.rollingMinFee < float64(mp.IncrementalRelayFee)/2 {
+			mp.rollingMinFee = 0
+			return 0
+		}
+	}
+	if rate := FeeRate(math.Round(mp.rollingMinFee)); rate > mp.IncrementalRelayFee {
+		return rate
+	}
+	return mp.IncrementalRelayFee
+}
+
+// processOrphans accepts the orphans which spend outputs of entry, and
+// then those spending outputs of the accepted orphans
+func (mp *Mempool) processOrphans(entry *MempoolEntry, now time.Time) []*MempoolEntry {
+	var accepted []*MempoolEntry
+	queue := []*MempoolEntry{entry}
+	for len(queue) > 0 {
+		parent := queue[0]
+		queue = queue[1:]
+		for _, orphan := range mp.orphans.children(parent.Tx, parent.TxID) {
+			entry, err := mp.acceptTx(orphan.tx, now)
+			if errors.Is(err, ErrMissingInputs) {
+				continue
+			}
+			mp.orphans.remove(orphan)
+			if err == nil {
+				accepted = append(accepted, entry)
+				queue = append(queue, entry)
+			}
+		}
+	}
+	return accepted
+}
+
+// BlockConnected updates the mempool after block has been connected as the
+// new tip node: the transactions of the block and conflicting ones are
+// removed, also from the orphan pool
+func (mp *Mempool) BlockConnected(block *Block, node *HeaderNode) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.tip = node
+	for i := range block.Txs {
+		tx := &block.Txs[i]
+		if entry, ok := mp.entries[tx.TxID()]; ok {
+			mp.removeEntries(map[Hash]*MempoolEntry{entry.TxID: entry})
+		}
+		if tx.IsCoinBase() {
+			continue
+		}
+		for _, in := range tx.TxIn {
+			if conflict, ok := mp.spends[in.PreviousOutput]; ok {
+				mp.removeEntries(mp.descendants(conflict))
+			}
+		}
+	}
+	mp.orphans.removeForBlock(block)
+	// The minimum fee decays from now on
+	mp.lastRollingFeeUpdate = mp.now()
+	mp.blockSinceFeeBump = true
+}
+
+// BlockDisconnected updates the mempool after block has been disconnected
+// from the tip: its transactions are added to the mempool again, followed
+// by the transactions which spent their outputs
+func (mp *Mempool) BlockDisconnected(block *Block, node *HeaderNode) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.tip = node.Parent
+	now := mp.now()
+
+	removed := make(map[Hash]*MempoolEntry)
+	for i := range block.Txs {
+		txid := block.Txs[i].TxID()
+		for j := range block.Txs[i].TxOut {
+			if spender, ok := mp.spends[OutPoint{txid, uint32(j)}]; ok {
+				for hash, e := range mp.descendants(spender) {
+					removed[hash] = e
+				}
+			}
+		}
+	}
+	// Parents have less ancestors than their children
+	readd := make([]*MempoolEntry, 0, len(removed))
+	for _, e := range removed {
+		readd = append(readd, e)
+	}
+	sort.Slice(readd, func(i, j int) bool { return readd[i].countWithAncestors < readd[j].countWithAncestors })
+	mp.removeEntries(removed)
+
+	for i := range block.Txs {
+		if !block.Txs[i].IsCoinBase() {
+			mp.acceptTx(&block.Txs[i], now)
+		}
+	}
+	for _, e := range readd {
+		mp.acceptTx(e.Tx, now)
+	}
+}
+
+// RemovePeer removes the orphans relayed by peer
+func (mp *Mempool) RemovePeer(peer string) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	mp.orphans.removeForPeer(peer)
+}
+
+// Get returns the entry of the transaction with the given txid
+func (mp *Mempool) Get(txid Hash) (*MempoolEntry, bool) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	entry, ok := mp.entries[txid]
+	return entry, ok
+}
+
+// GetByWTxID returns the entry of the transaction with the given wtxid
+func (mp *Mempool) GetByWTxID(wtxid Hash) (*MempoolEntry, bool) {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	entry, ok := mp.wtxids[wtxid]
+	return entry, ok
+}
+
+// HaveTx checks whether the transaction of a MSG_TX or MSG_WTX inv is in
+// the mempool or (for MSG_TX) in the orphan pool
+func (mp *Mempool) HaveTx(inv Inv) bool {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	if inv.Type&^MSG_WITNESS_FLAG == MSG_WTX {
+		_, ok := mp.wtxids[inv.Hash]
+		return ok
+	}
+	_, ok := mp.entries[inv.Hash]
+	return ok || mp.orphans.has(inv.Hash)
+}
+
+// TxIDs returns the txids of all transactions, parents before children
+func (mp *Mempool) TxIDs() []Hash {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	entries := make([]*MempoolEntry, 0, len(mp.entries))
+	for _, e := range mp.entries {
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].countWithAncestors != entries[j].countWithAncestors {
+			return entries[i].countWithAncestors < entries[j].countWithAncestors
+		}
+		return entries[i].Time.Before(entries[j].Time)
+	})
+	txids := make([]Hash, len(entries))
+	for i, e := range entries {
+		txids[i] = e.TxID
+	}
+	return txids
+}
+
+// Len returns the number of transactions in the mempool
+func (mp *Mempool) Len() int {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	return len(mp.entries)
+}
+
+// Size returns the total virtual size of the transactions
+func (mp *Mempool) Size() int {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	return mp.size
+}
+
+// Orphans returns the number of transactions in the orphan pool
+func (mp *Mempool) Orphans() int {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	return len(mp.orphans.txs)
+}
+
+// MinFee returns the minimum fee rate for new transactions, which is
+// raised when transactions are evicted (in addition to MinRelayFee)
+func (mp *Mempool) MinFee() FeeRate {
+	mp.mutex.Lock()
+	defer mp.mutex.Unlock()
+	return mp.minFee(mp.now())
+}
+
+// Orphan pool
+//============
+
+// orphanTx is a transaction with unknown inputs
+type orphanTx struct {
+	tx     *Tx
+	txid   Hash
+	peer   string // peer which relayed it
+	expire time.Time
+}
+
+// orphanPool keeps a bounded number of orphans by txid and indexes them by
+// the outpoints they spend. When it is full, random orphans are evicted.
+type orphanPool struct {
+	txs       map[Hash]*orphanTx
+	byPrev    map[OutPoint]map[Hash]*orphanTx
+	nextSweep time.Time
+}
+
+func newOrphanPool() *orphanPool {
+	return &orphanPool{
+		txs:    make(map[Hash]*orphanTx),
+		byPrev: make(map[OutPoint]map[Hash]*orphanTx),
+	}
+}
+
+// add adds tx unless it is known or too large and evicts expired and
+// random orphans to keep at most max
+func (pool *orphanPool) add(tx *Tx, peer string, now time.Time, max int) bool {
+	txid := tx.TxID()
+	if _, ok := pool.txs[txid]; ok || tx.Weight() > MAX_STANDARD_TX_WEIGHT {
+		return false
+	}
+	orphan := &orphanTx{tx: tx, txid: txid, peer: peer, expire: now.Add(ORPHAN_TX_EXPIRE_TIME)}
+	pool.txs[txid] = orphan
+	for _, in := range tx.TxIn {
+		if pool.byPrev[in.PreviousOutput] == nil {
+			pool.byPrev[in.PreviousOutput] = make(map[Hash]*orphanTx)
+		}
+		pool.byPrev[in.PreviousOutput][txid] = orphan
+	}
+
+	if !now.Before(pool.nextSweep) {
+		for _, o := range pool.txs {
+			if now.After(o.expire) {
+				pool.remove(o)
+			}
+		}
+		pool.nextSweep = now.Add(ORPHAN_TX_EXPIRE_TIME / 4)
+	}
+	for len(pool.txs) > max {
+		i := rand.Intn(len(pool.txs))
+		for _, o := range pool.txs {
+			if i == 0 {
+				pool.remove(o)
+				break
+			}
+			i--
+		}
+	}
+	_, ok := pool.txs[txid]
+	return ok
+}
+
+func (pool *orphanPool) remove(orphan *orphanTx) {
+	for _, in := range orphan.tx.TxIn {
+		if spenders := pool.byPrev[in.PreviousOutput]; spenders != nil {
+			delete(spenders, orphan.txid)
+			if len(spenders) == 0 {
+				delete(pool.byPrev, in.PreviousOutput)
+			}
+		}
+	}
+	delete(pool.txs, orphan.txid)
+}
+
+func (pool *orphanPool) has(txid Hash) bool {
+	_, ok := pool.txs[txid]
+	return ok
+}
+
+// children returns the orphans spending outputs of tx, ordered by txid
+func (pool *orphanPool) children(tx *Tx, txid Hash) []*orphanTx {
+	found := make(map[Hash]*orphanTx)
+	for i := range tx.TxOut {
+		for hash, orphan := range pool.byPrev[OutPoint{txid, uint32(i)}] {
+			found[hash] = orphan
+		}
+	}
+	children := make([]*orphanTx, 0, len(found))
+	for _, orphan := range found {
+		children = append(children, orphan)
+	}
+	sort.Slice(children, func(i, j int) bool {
+		return children[i].txid.RPCString() < children[j].txid.RPCString()
+	})
+	return children
+}
+
+func (pool *orphanPool) removeForPeer(peer string) {
+	for _, orphan := range pool.txs {
+		if orphan.peer == peer {
+			pool.remove(orphan)
+		}
+	}
+}
+
+// removeForBlock removes the orphans included in block or conflicting
+// with it
+func (pool *orphanPool) removeForBlock(block *Block) {
+	for i := range block.Txs {
+		if orphan, ok := pool.txs[block.Txs[i].TxID()]; ok {
+			pool.remove(orphan)
+		}
+		for _, in := range block.Txs[i].TxIn {
+			for _, orphan := range pool.byPrev[in.PreviousOutput] {
+				pool.remove(orphan)
+			}
+		}
+	}
+}
+
+// Relay
+//======
+
+// Number of txids remembered per peer to avoid announcing transactions it
+// already knows
+const MAX_KNOWN_TXS = 50000
+
+// MessageSender sends messages to one peer, e.g. a client or a peer of a
+// PeerManager
+type MessageSender interface {
+	SendMessage(message Message) error
+}
+
+// managedPeerSender sends through the send queue of a managed peer
+type managedPeerSender struct {
+	manager *PeerManager
+	peer    *Peer
+}
+
+func (s managedPeerSender) SendMessage(message Message) error {
+	return s.manager.Send(s.peer, message)
+}
+
+// MempoolRelay relays transactions between a mempool and a peer: it
+// requests announced transactions and their missing parents, adds received
+// transactions to the mempool (sending reject messages for invalid ones),
+// serves getdata and mempool requests and announces new transactions with
+// inv messages.
+type MempoolRelay struct {
+	sender MessageSender
+	pool   *Mempool
+	peer   string
+
+	mutex sync.Mutex
+	known map[Hash]bool // txids and wtxids the peer knows about
+}
+
+// NewMempoolRelay creates a relay for the peer reached through sender,
+// which is identified by peer in the mempool (e.g. its address)
+func NewMempoolRelay(sender MessageSender, pool *Mempool, peer string) *MempoolRelay {
+	return &MempoolRelay{
+		sender: sender,
+		pool:   pool,
+		peer:   peer,
+		known:  make(map[Hash]bool),
+	}
+}
+
+// AttachMempool relays the transactions of pool to all peers of the peer
+// manager: each peer gets a MempoolRelay handling its messages, and
+// transactions accepted to the pool are announced to the peers which asked
+// for transaction relay in their version message. It must be called
+// before Run.
+func AttachMempool(manager *PeerManager, pool *Mempool) {
+	var mutex sync.Mutex
+	relays := make(map[*Peer]*MempoolRelay)
+
+	onConnect := manager.OnConnect
+	manager.OnConnect = func(peer *Peer) {
+		mutex.Lock()
+		relays[peer] = NewMempoolRelay(managedPeerSender{manager, peer}, pool, peer.Addr())
+		mutex.Unlock()
+		if onConnect != nil {
+			onConnect(peer)
+		}
+	}
+	onDisconnect := manager.OnDisconnect
+	manager.OnDisconnect = func(peer *Peer, err error) {
+		mutex.Lock()
+		delete(relays, peer)
+		mutex.Unlock()
+		pool.RemovePeer(peer.Addr())
+		if onDisconnect != nil {
+			onDisconnect(peer, err)
+		}
+	}
+	manager.Subscribe("", func(peer *Peer, msg Message) {
+		mutex.Lock()
+		relay := relays[peer]
+		mutex.Unlock()
+		if relay != nil {
+			relay.HandleMessage(msg)
+		}
+	})
+
+	onAccept := pool.OnAccept
+	pool.OnAccept = func(entry *MempoolEntry) {
+		if onAccept != nil {
+			onAccept(entry)
+		}
+		mutex.Lock()
+		var announce []*MempoolRelay
+		for peer, relay := range relays {
+			if peer.Relay {
+				announce = append(announce, relay)
+			}
+		}
+		mutex.Unlock()
+		for _, relay := range announce {
+			relay.Announce(entry.TxID)
+		}
+	}
+}
+
+// HandleMessage processes a message received from the peer. It returns
+// false if the message is not related to transaction relay.
+func (r *MempoolRelay) HandleMessage(msg Message) bool {
+	switch msg := msg.(type) {
+	case *TxMessage:
+		r.handleTx(&msg.Tx)
+	case *InvMessage:
+		r.handleInv(msg.Invs)
+	case *GetDataMessage:
+		return r.handleGetData(msg.Invs)
+	case *MempoolMessage:
+		r.handleMempool()
+	default:
+		return false
+	}
+	return true
+}
+
+// Announce sends an inv for the transactions the peer doesn't know yet.
+// They count as known once the inv has been sent, so if sending fails,
+// they are announced again next time.
+func (r *MempoolRelay) Announce(txids ...Hash) error {
+	var invs []Inv
+	r.mutex.Lock()
+	for _, txid := range txids {
+		if !r.known[txid] {
+			invs = append(invs, Inv{Type: MSG_TX, Hash: txid})
+		}
+	}
+	r.mutex.Unlock()
+	return r.sendInvs(invs)
+}
+
+// addKnown marks hash as known to the peer
+func (r *MempoolRelay) addKnown(hash Hash) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if len(r.known) >= MAX_KNOWN_TXS {
+		r.known = make(map[Hash]bool)
+	}
+	r.known[hash] = true
+}
+
+// sendInvs sends the invs in messages of up to MAX_INV_SZ entries and marks
+// the sent ones as known
+func (r *MempoolRelay) sendInvs(invs []Inv) error {
+	for len(invs) > 0 {
+		n := len(invs)
+		if n > MAX_INV_SZ {
+			n = MAX_INV_SZ
+		}
+		if err := r.sender.SendMessage(&InvMessage{Invs: invs[:n]}); err != nil {
+			return err
+		}
+		for _, inv := range invs[:n] {
+			r.addKnown(inv.Hash)
+		}
+		invs = invs[n:]
+	}
+	return nil
+}
+
+func (r *MempoolRelay) handleTx(tx *Tx) {
+	txid := tx.TxID()
+	r.addKnown(txid)
+	_, err := r.pool.AcceptTx(tx, r.peer)
+	if errors.Is(err, ErrMissingInputs) {
+		// Request the parents, the transaction waits in the orphan pool
+		var request []Inv
+		requested := make(map[Hash]bool)
+		for _, in := range tx.TxIn {
+			hash := in.PreviousOutput.Hash
+			if !requested[hash] && !r.pool.HaveTx(Inv{Type: MSG_TX, Hash: hash}) {
+				requested[hash] = true
+				request = append(request, Inv{Type: MSG_WITNESS_TX, Hash: hash})
+			}
+		}
+		if len(request) > 0 {
+			r.sender.SendMessage(&GetDataMessage{Invs: request})
+		}
+		return
+	}
+	var rejectErr *RejectError
+	if errors.As(err, &rejectErr) {
+		r.sender.SendMessage(rejectErr.RejectMessage("tx", txid))
+	}
+}
+
+func (r *MempoolRelay) handleInv(invs []Inv) {
+	var request []Inv
+	for _, inv := range invs {
+		if inv.Type != MSG_TX && inv.Type != MSG_WTX {
+			continue
+		}
+		r.addKnown(inv.Hash)
+		if r.pool.HaveTx(inv) {
+			continue
+		}
+		if inv.Type == MSG_TX {
+			inv.Type = MSG_WITNESS_TX
+		}
+		request = append(request, inv)
+	}
+	if len(request) > 0 {
+		r.sender.SendMessage(&GetDataMessage{Invs: request})
+	}
+}
+
+// handleGetData sends the requested transactions, and a notfound message
+// for the missing ones. It returns false if no transactions were requested.
+func (r *MempoolRelay) handleGetData(invs []Inv) bool {
+	var notFound []Inv
+	handled := false
+	for _, inv := range invs {
+		var entry *MempoolEntry
+		var ok bool
+		switch inv.Type {
+		case MSG_TX, MSG_WITNESS_TX:
+			entry, ok = r.pool.Get(inv.Hash)
+		case MSG_WTX:
+			entry, ok = r.pool.GetByWTxID(inv.Hash)
+		default:
+			continue
+		}
+		handled = true
+		if !ok {
+			notFound = append(notFound, inv)
+			continue
+		}
+		tx := *entry.Tx
+		if inv.Type == MSG_TX {
+			// Without witness data (BIP144)
+			tx.TxIn = append([]TxIn{}, tx.TxIn...)
+			for i := range tx.TxIn {
+				tx.TxIn[i].Witness = nil
+			}
+		}
+		r.sender.SendMessage(&TxMessage{Tx: tx})
+	}
+	if len(notFound) > 0 {
+		r.sender.SendMessage(&NotFoundMessage{Invs: notFound})
+	}
+	return handled
+}
+
+func (r *MempoolRelay) handleMempool() {
+	txids := r.pool.TxIDs()
+	invs := make([]Inv, 0, len(txids))
+	for _, txid := range txids {
+		invs = append(invs, Inv{Type: MSG_TX, Hash: txid})
+	}
+	r.sendInvs(invs)
+}
@@ -0,0 +1,544 @@
+package network
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// p2wshTestScript returns the P2WSH output script for witnessScript
+func p2wshTestScript(witnessScript []byte) []byte {
+	hash := sha256.Sum256(witnessScript)
+	return append([]byte{OP_0, 32}, hash[:]...)
+}
+
+// anyoneCanSpend is a standard output script spent with the witness
+// script OP_TRUE
+var anyoneCanSpend = p2wshTestScript([]byte{OP_TRUE})
+
+// newMempoolTestChain creates a chain with mature coinbases paying to
+// anyoneCanSpend and an empty mempool on top of it
+func newMempoolTestChain(t *testing.T) (*validationTestChain, *Mempool) {
+	c := newValidationTestChain(t, &RegTestParams.Consensus)
+	for i := 0; i < COINBASE_MATURITY+10; i++ {
+		coinbase := c.coinbase(50 * COIN)
+		coinbase.TxOut[0].PkScript = anyoneCanSpend
+		c.mustConnect(c.newBlock(coinbase))
+	}
+	return c, NewMempool(c.utxo, c.tip, c.params)
+}
+
+// mempoolTestTx spends the outputs to anyoneCanSpend outputs with the given
+// values. The inputs signal replaceability.
+func mempoolTestTx(inputs []OutPoint, values ...int64) *Tx {
+	tx := &Tx{Version: 2}
+	for _, op := range inputs {
+		tx.TxIn = append(tx.TxIn, TxIn{PreviousOutput: op, Sequence: MAX_BIP125_RBF_SEQUENCE, Witness: [][]byte{{OP_TRUE}}})
+	}
+	for _, value := range values {
+		tx.TxOut = append(tx.TxOut, TxOut{Value: value, PkScript: anyoneCanSpend})
+	}
+	return tx
+}
+
+// coinbaseOut returns the first output of the coinbase at height
+func coinbaseOut(c *validationTestChain, height int) []OutPoint {
+	return []OutPoint{{c.blocks[height].Txs[0].TxID(), 0}}
+}
+
+func expectMempoolReject(t *testing.T, mp *Mempool, tx *Tx, code uint8, reason string) {
+	t.Helper()
+	_, err := mp.AcceptTx(tx, "peer")
+	var rejectErr *RejectError
+	if !errors.As(err, &rejectErr) {
+		t.Errorf("Expected %s, got %v", reason, err)
+		return
+	}
+	if !strings.HasPrefix(rejectErr.Reason, reason) || rejectErr.Code != code {
+		t.Errorf("Expected %s (0x%02x), got %s (0x%02x): %v", reason, code, rejectErr.Reason, rejectErr.Code, err)
+	}
+}
+
+func mustAccept(t *testing.T, mp *Mempool, tx *Tx) []*MempoolEntry {
+	t.Helper()
+	entries, err := mp.AcceptTx(tx, "peer")
+	if err != nil {
+		t.Fatalf("Transaction not accepted: %v", err)
+	}
+	return entries
+}
+
+func TestGetDustThreshold(t *testing.T) {
+	p2pkh := append(append([]byte{OP_DUP, OP_HASH160, 20}, make([]byte, 20)...), OP_EQUALVERIFY, OP_CHECKSIG)
+	p2wpkh := append([]byte{OP_0, 20}, make([]byte, 20)...)
+	tests := []struct {
+		script    []byte
+		threshold int64
+	}{
+		{p2pkh, 546}, {p2wpkh, 294}, {anyoneCanSpend, 330}, {[]byte{OP_RETURN}, 0},
+	}
+	for _, test := range tests {
+		if threshold := GetDustThreshold(TxOut{PkScript: test.script}, DUST_RELAY_TX_FEE); threshold != test.threshold {
+			t.Errorf("Wrong dust threshold %d for %x, expected %d", threshold, test.script, test.threshold)
+		}
+	}
+}
+
+func TestMempoolAccept(t *testing.T) {
+	c, mp := newMempoolTestChain(t)
+	var announced []Hash
+	mp.OnAccept = func(entry *MempoolEntry) {
+		announced = append(announced, entry.TxID)
+	}
+
+	tx := mempoolTestTx(coinbaseOut(c, 1), 50*COIN-1000)
+	mustAccept(t, mp, tx)
+	entry, ok := mp.Get(tx.TxID())
+	if !ok || entry.Fee != 1000 || entry.VSize != 96 || entry.FeeRate() != 10416 {
+		t.Fatalf("Wrong entry %+v", entry)
+	}
+	if mp.Len() != 1 || mp.Size() != 96 || len(announced) != 1 || announced[0] != tx.TxID() {
+		t.Errorf("Wrong mempool state: %d transactions of size %d", mp.Len(), mp.Size())
+	}
+	if !mp.HaveTx(Inv{MSG_TX, tx.TxID()}) || !mp.HaveTx(Inv{MSG_WTX, tx.WTxID()}) || mp.HaveTx(Inv{MSG_WTX, tx.TxID()}) {
+		t.Errorf("Transaction not found by txid and wtxid")
+	}
+	expectMempoolReject(t, mp, tx, REJECT_DUPLICATE, "txn-already-in-mempool")
+
+	// Policy
+	nonstandard := mempoolTestTx(coinbaseOut(c, 2), 50*COIN-1000)
+	nonstandard.TxOut[0].PkScript = []byte{OP_TRUE}
+	expectMempoolReject(t, mp, nonstandard, REJECT_NONSTANDARD, "scriptpubkey")
+	expectMempoolReject(t, mp, mempoolTestTx(coinbaseOut(c, 2), 50*COIN-1000, 329), REJECT_NONSTANDARD, "dust")
+	expectMempoolReject(t, mp, mempoolTestTx(coinbaseOut(c, 2), 50*COIN-95), REJECT_INSUFFICIENTFEE, "min relay fee not met")
+	version := mempoolTestTx(coinbaseOut(c, 2), 50*COIN-1000)
+	version.Version = 3
+	expectMempoolReject(t, mp, version, REJECT_NONSTANDARD, "version")
+	final := mempoolTestTx(coinbaseOut(c, 2), 50*COIN-1000)
+	final.LockTime = uint32(c.tip.Height + 1)
+	expectMempoolReject(t, mp, final, REJECT_NONSTANDARD, "non-final")
+	final.LockTime--
+	mustAccept(t, mp, final)
+
+	// Consensus
+	expectMempoolReject(t, mp, mempoolTestTx(coinbaseOut(c, c.tip.Height), COIN), REJECT_INVALID, "bad-txns-premature-spend-of-coinbase")
+	expectMempoolReject(t, mp, mempoolTestTx(coinbaseOut(c, 3), 51*COIN), REJECT_INVALID, "bad-txns-in-belowout")
+	expectMempoolReject(t, mp, &c.blocks[3].Txs[0], REJECT_INVALID, "coinbase")
+	bad := mempoolTestTx(coinbaseOut(c, 3), 50*COIN-1000)
+	bad.TxIn[0].Witness = [][]byte{{OP_2}}
+	expectMempoolReject(t, mp, bad, REJECT_INVALID, "mandatory-script-verify-flag-failed")
+
+	// An output whose witness script pushes 1 with a non-minimal push is
+	// valid, but not standard
+	nonMinimal := []byte{1, 1}
+	parent := mempoolTestTx(coinbaseOut(c, 3), 50*COIN-1000)
+	parent.TxOut[0].PkScript = p2wshTestScript(nonMinimal)
+	mustAccept(t, mp, parent)
+	child := mempoolTestTx([]OutPoint{{parent.TxID(), 0}}, 50*COIN-2000)
+	child.TxIn[0].Witness = [][]byte{nonMinimal}
+	expectMempoolReject(t, mp, child, REJECT_NONSTANDARD, "non-mandatory-script-verify-flag")
+	mp.RequireStandard = false
+	expectMempoolReject(t, mp, child, REJECT_NONSTANDARD, "non-mandatory-script-verify-flag")
+	if _, ok := mp.Get(child.TxID()); ok || mp.Len() != 3 {
+		t.Errorf("Rejected transactions in mempool")
+	}
+}
+
+func TestMempoolOrphans(t *testing.T) {
+	c, mp := newMempoolTestChain(t)
+	parent := mempoolTestTx(coinbaseOut(c, 1), 50*COIN-1000)
+	child := mempoolTestTx([]OutPoint{{parent.TxID(), 0}}, 50*COIN-2000)
+	grandchild := mempoolTestTx([]OutPoint{{child.TxID(), 0}}, 50*COIN-3000)
+
+	for _, tx := range []*Tx{grandchild, child} {
+		if _, err := mp.AcceptTx(tx, "peer"); !errors.Is(err, ErrMissingInputs) {
+			t.Fatalf("Expected missing inputs, got %v", err)
+		}
+	}
+	if mp.Orphans() != 2 || mp.Len() != 0 || !mp.HaveTx(Inv{MSG_TX, child.TxID()}) {
+		t.Fatalf("Orphans not stored")
+	}
+	entries := mustAccept(t, mp, parent)
+	if len(entries) != 3 || entries[1].TxID != child.TxID() || entries[2].TxID != grandchild.TxID() {
+		t.Fatalf("Orphans not accepted: %d", len(entries))
+	}
+	if mp.Orphans() != 0 || mp.Len() != 3 {
+		t.Errorf("Wrong number of orphans %d", mp.Orphans())
+	}
+	if txids := mp.TxIDs(); txids[0] != parent.TxID() || txids[1] != child.TxID() || txids[2] != grandchild.TxID() {
+		t.Errorf("Transactions not in order")
+	}
+
+	// The orphan pool is bounded
+	mp.MaxOrphans = 5
+	for i := 0; i < 10; i++ {
+		orphan := mempoolTestTx([]OutPoint{{Hash{byte(i)}, 0}}, COIN)
+		mp.AcceptTx(orphan, "other")
+	}
+	if mp.Orphans() != 5 {
+		t.Errorf("Wrong number of orphans %d", mp.Orphans())
+	}
+	mp.RemovePeer("other")
+	if mp.Orphans() != 0 {
+		t.Errorf("Orphans of peer not removed")
+	}
+}
+
+func TestMempoolChainLimits(t *testing.T) {
+	c, mp := newMempoolTestChain(t)
+	mp.AncestorLimit = 3
+	var chain []*Tx
+	prev := coinbaseOut(c, 1)
+	for i := 1; i <= 3; i++ {
+		tx := mempoolTestTx(prev, 50*COIN-int64(i)*1000)
+		mustAccept(t, mp, tx)
+		chain = append(chain, tx)
+		prev = []OutPoint{{tx.TxID(), 0}}
+	}
+	expectMempoolReject(t, mp, mempoolTestTx(prev, 50*COIN-4000), REJECT_NONSTANDARD, "too-long-mempool-chain")
+
+	first, _ := mp.Get(chain[0].TxID())
+	last, _ := mp.Get(chain[2].TxID())
+	if first.countWithDescendants != 3 || first.feesWithDescendants != 3000 || last.countWithAncestors != 3 || last.sizeWithAncestors != 3*96 {
+		t.Errorf("Wrong aggregates %+v %+v", first, last)
+	}
+
+	mp.AncestorLimit = DEFAULT_ANCESTOR_LIMIT
+	mp.DescendantLimit = 3
+	expectMempoolReject(t, mp, mempoolTestTx(prev, 50*COIN-4000), REJECT_NONSTANDARD, "too-long-mempool-chain")
+	mp.DescendantLimit = DEFAULT_DESCENDANT_LIMIT
+	mp.DescendantSizeLimit = 3*96 + 95
+	expectMempoolReject(t, mp, mempoolTestTx(prev, 50*COIN-4000), REJECT_NONSTANDARD, "too-long-mempool-chain")
+	mp.DescendantSizeLimit = DEFAULT_DESCENDANT_SIZE_LIMIT
+	mustAccept(t, mp, mempoolTestTx(prev, 50*COIN-4000))
+}
+
+func TestMempoolReplacement(t *testing.T) {
+	c, mp := newMempoolTestChain(t)
+
+	// Without signaling there is no replacement
+	original := mempoolTestTx(coinbaseOut(c, 1), 50*COIN-1000)
+	original.TxIn[0].Sequence = SEQUENCE_FINAL - 1
+	mustAccept(t, mp, original)
+	expectMempoolReject(t, mp, mempoolTestTx(coinbaseOut(c, 1), 50*COIN-10000), REJECT_DUPLICATE, "txn-mempool-conflict")
+	child := mempoolTestTx([]OutPoint{{original.TxID(), 0}}, 50*COIN-2000)
+	child.TxIn[0].Sequence = SEQUENCE_FINAL
+	mustAccept(t, mp, child)
+	expectMempoolReject(t, mp, mempoolTestTx([]OutPoint{{original.TxID(), 0}}, 50*COIN-10000), REJECT_DUPLICATE, "txn-mempool-conflict")
+
+	// The child of a signaling transaction inherits the signal
+	signaling := mempoolTestTx(coinbaseOut(c, 2), 50*COIN-1000)
+	mustAccept(t, mp, signaling)
+	inheriting := mempoolTestTx([]OutPoint{{signaling.TxID(), 0}}, 50*COIN-11000)
+	inheriting.TxIn[0].Sequence = SEQUENCE_FINAL
+	mustAccept(t, mp, inheriting)
+	descendant := mempoolTestTx([]OutPoint{{signaling.TxID(), 0}}, 50*COIN-13000)
+	mustAccept(t, mp, descendant)
+	if _, ok := mp.Get(inheriting.TxID()); ok {
+		t.Errorf("Replaced transaction still in mempool")
+	}
+
+	// Higher fee rate, but less than the replaced fees
+	expectMempoolReject(t, mp, mempoolTestTx(coinbaseOut(c, 2), 50*COIN-5000), REJECT_INSUFFICIENTFEE, "insufficient fee")
+	// The additional fee must pay for the relay of the replacement
+	expectMempoolReject(t, mp, mempoolTestTx(coinbaseOut(c, 2), 50*COIN-13050), REJECT_INSUFFICIENTFEE, "insufficient fee")
+	// No new unconfirmed inputs
+	expectMempoolReject(t, mp, mempoolTestTx(append(coinbaseOut(c, 2), OutPoint{child.TxID(), 0}), 100*COIN-20000),
+		REJECT_NONSTANDARD, "replacement-adds-unconfirmed")
+
+	replacement := mempoolTestTx(coinbaseOut(c, 2), 50*COIN-20000)
+	mustAccept(t, mp, replacement)
+	for _, tx := range []*Tx{signaling, descendant} {
+		if _, ok := mp.Get(tx.TxID()); ok {
+			t.Errorf("Replaced transaction still in mempool")
+		}
+	}
+	if mp.Len() != 3 || mp.Size() != 3*96 {
+		t.Errorf("Wrong mempool state: %d transactions of size %d", mp.Len(), mp.Size())
+	}
+}
+
+func TestMempoolEviction(t *testing.T) {
+	c, mp := newMempoolTestChain(t)
+	mp.MaxSize = 4 * 96
+	parent := mempoolTestTx(coinbaseOut(c, 2), 50*COIN-1000)
+	child := mempoolTestTx([]OutPoint{{parent.TxID(), 0}}, 50*COIN-2200)
+	for _, tx := range []*Tx{mempoolTestTx(coinbaseOut(c, 1), 50*COIN-2000), parent, child, mempoolTestTx(coinbaseOut(c, 3), 50*COIN-4000)} {
+		mustAccept(t, mp, tx)
+	}
+	if mp.MinFee() != 0 || mp.Size() != mp.MaxSize {
+		t.Errorf("Minimum fee without evictions")
+	}
+
+	// The package with the lowest fee rate is evicted, although the child
+	// alone pays more than its parent
+	mustAccept(t, mp, mempoolTestTx(coinbaseOut(c, 4), 50*COIN-3000))
+	if _, ok := mp.Get(parent.TxID()); ok || mp.Len() != 3 {
+		t.Fatalf("Transactions with lowest fee rate not evicted")
+	}
+	// The minimum fee rate is raised above the rate of the evicted package
+	expected := NewFeeRate(2200, 2*96) + DEFAULT_INCREMENTAL_RELAY_FEE
+	if mp.MinFee() != expected {
+		t.Errorf("Wrong minimum fee rate %v, expected %v", mp.MinFee(), expected)
+	}
+	expectMempoolReject(t, mp, mempoolTestTx(coinbaseOut(c, 5), 50*COIN-1100), REJECT_INSUFFICIENTFEE, "mempool min fee not met")
+	mustAccept(t, mp, mempoolTestTx(coinbaseOut(c, 5), 50*COIN-1500))
+	expectMempoolReject(t, mp, mempoolTestTx(coinbaseOut(c, 6), 50*COIN-1300), REJECT_INSUFFICIENTFEE, "mempool full")
+	if mp.Len() != 4 {
+		t.Errorf("Wrong number of transactions %d", mp.Len())
+	}
+
+	// After a block the minimum fee rate halves every half-life while the
+	// mempool is full
+	now := time.Now()
+	mp.now = func() time.Time { return now }
+	minFee := mp.MinFee()
+	block := c.newBlock(c.coinbase(50 * COIN))
+	c.mustConnect(block)
+	mp.BlockConnected(block, c.tip)
+	if mp.MinFee() != minFee {
+		t.Errorf("Minimum fee rate %v changed at the block, expected %v", mp.MinFee(), minFee)
+	}
+	now = now.Add(ROLLING_FEE_HALFLIFE)
+	if halved := FeeRate(math.Round(float64(minFee) / 2)); mp.MinFee() != halved {
+		t.Errorf("Wrong minimum fee rate %v after a half-life, expected %v", mp.MinFee(), halved)
+	}
+}
+
+func TestMempoolBlocks(t *testing.T) {
+	c, mp := newMempoolTestChain(t)
+	parent := mempoolTestTx(coinbaseOut(c, 1), 50*COIN-1000)
+	child := mempoolTestTx([]OutPoint{{parent.TxID(), 0}}, 50*COIN-2000)
+	conflict := mempoolTestTx(coinbaseOut(c, 2), 50*COIN-1000)
+	mustAccept(t, mp, parent)
+	mustAccept(t, mp, child)
+	mustAccept(t, mp, conflict)
+	orphan := mempoolTestTx([]OutPoint{{Hash{1}, 0}}, COIN)
+	mp.AcceptTx(orphan, "peer")
+
+	// The block confirms parent and double spends conflict
+	confirmed := mempoolTestTx(coinbaseOut(c, 2), 50*COIN-5000)
+	block := c.newBlock(c.coinbase(50*COIN), *parent, *confirmed)
+	c.mustConnect(block)
+	mp.BlockConnected(block, c.tip)
+	if mp.Len() != 1 {
+		t.Fatalf("Wrong number of transactions %d", mp.Len())
+	}
+	entry, ok := mp.Get(child.TxID())
+	if !ok || entry.countWithAncestors != 1 || entry.sizeWithAncestors != entry.VSize {
+		t.Errorf("Wrong entry for child %+v", entry)
+	}
+	if mp.Orphans() != 1 {
+		t.Errorf("Unrelated orphan removed")
+	}
+
+	// Disconnecting the block adds its transactions again
+	node := c.tip
+	if err := c.utxo.Disconnect(block); err != nil {
+		t.Fatalf("Can't disconnect block: %v", err)
+	}
+	c.tip = node.Parent
+	mp.BlockDisconnected(block, node)
+	if mp.Len() != 3 {
+		t.Fatalf("Wrong number of transactions %d", mp.Len())
+	}
+	entry, ok = mp.Get(child.TxID())
+	if !ok || entry.countWithAncestors != 2 {
+		t.Errorf("Wrong entry for child %+v", entry)
+	}
+	if _, ok := mp.Get(confirmed.TxID()); !ok {
+		t.Errorf("Transaction of disconnected block not added")
+	}
+}
+
+func TestMempoolRelay(t *testing.T) {
+	c, mp := newMempoolTestChain(t)
+	tx := mempoolTestTx(coinbaseOut(c, 1), 50*COIN-1000)
+	mustAccept(t, mp, tx)
+
+	conn, peerConn := net.Pipe()
+	defer conn.Close()
+	defer peerConn.Close()
+	cl := Client(conn, MAGIC_regtest)
+	relay := NewMempoolRelay(&cl, mp, "peer")
+	peer := Client(peerConn, MAGIC_regtest)
+
+	// exchange lets the relay handle msg and returns its reply
+	exchange := func(msg Message) Message {
+		t.Helper()
+		done := make(chan bool)
+		go func() {
+			done <- relay.HandleMessage(msg)
+		}()
+		reply, _, err := peer.ReceiveMessage()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !<-done {
+			t.Errorf("Message %s not handled", msg.GetCommandString())
+		}
+		return *reply
+	}
+
+	inv, ok := exchange(&MempoolMessage{}).(*InvMessage)
+	if !ok || len(inv.Invs) != 1 || inv.Invs[0] != (Inv{MSG_TX, tx.TxID()}) {
+		t.Fatalf("Wrong reply to mempool %+v", inv)
+	}
+	// The transaction is known to the peer now
+	relay.Announce(tx.TxID())
+
+	reply := exchange(&GetDataMessage{Invs: []Inv{{MSG_TX, tx.TxID()}}})
+	if msg, ok := reply.(*TxMessage); !ok || msg.Tx.TxID() != tx.TxID() || msg.Tx.HasWitness() {
+		t.Errorf("Wrong reply to getdata %+v", reply)
+	}
+	reply = exchange(&GetDataMessage{Invs: []Inv{{MSG_WITNESS_TX, tx.TxID()}}})
+	if msg, ok := reply.(*TxMessage); !ok || msg.Tx.WTxID() != tx.WTxID() {
+		t.Errorf("Wrong reply to getdata %+v", reply)
+	}
+	reply = exchange(&GetDataMessage{Invs: []Inv{{MSG_TX, Hash{1}}}})
+	if msg, ok := reply.(*NotFoundMessage); !ok || len(msg.Invs) != 1 {
+		t.Errorf("Wrong reply to getdata %+v", reply)
+	}
+
+	// Unknown transactions are requested with witness
+	unknown := mempoolTestTx(coinbaseOut(c, 2), 50*COIN-1000)
+	reply = exchange(&InvMessage{Invs: []Inv{{MSG_TX, tx.TxID()}, {MSG_TX, unknown.TxID()}}})
+	if msg, ok := reply.(*GetDataMessage); !ok || len(msg.Invs) != 1 || msg.Invs[0] != (Inv{MSG_WITNESS_TX, unknown.TxID()}) {
+		t.Errorf("Wrong reply to inv %+v", reply)
+	}
+
+	// Orphans lead to requests of their parents, invalid transactions to
+	// reject messages
+	orphan := mempoolTestTx([]OutPoint{{unknown.TxID(), 0}}, 50*COIN-2000)
+	reply = exchange(&TxMessage{Tx: *orphan})
+	if msg, ok := reply.(*GetDataMessage); !ok || len(msg.Invs) != 1 || msg.Invs[0].Hash != unknown.TxID() {
+		t.Errorf("Wrong reply to orphan %+v", reply)
+	}
+	invalid := mempoolTestTx(coinbaseOut(c, 3), 51*COIN)
+	reply = exchange(&TxMessage{Tx: *invalid})
+	if msg, ok := reply.(*RejectMessage); !ok || msg.CCode != REJECT_INVALID || msg.Reason != "bad-txns-in-belowout" {
+		t.Errorf("Wrong reply to invalid tx %+v", reply)
+	}
+
+	// Transactions from other peers are announced
+	mp.OnAccept = func(entry *MempoolEntry) {
+		relay.Announce(entry.TxID)
+	}
+	fresh := mempoolTestTx(coinbaseOut(c, 4), 50*COIN-1000)
+	go mp.AcceptTx(fresh, "other")
+	msg, _, err := peer.ReceiveMessage()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if inv, ok := (*msg).(*InvMessage); !ok || len(inv.Invs) != 1 || inv.Invs[0] != (Inv{MSG_TX, fresh.TxID()}) {
+		t.Errorf("Wrong announcement %+v", *msg)
+	}
+}
+
+// queueSender is a MessageSender with a send queue that may be full
+type queueSender struct {
+	full bool
+	sent []Message
+}
+
+func (s *queueSender) SendMessage(message Message) error {
+	if s.full {
+		return ErrSendQueueFull
+	}
+	s.sent = append(s.sent, message)
+	return nil
+}
+
+func TestMempoolRelayQueueFull(t *testing.T) {
+	sender := &queueSender{full: true}
+	relay := NewMempoolRelay(sender, nil, "peer")
+	if err := relay.Announce(Hash{1}); !errors.Is(err, ErrSendQueueFull) {
+		t.Errorf("Got %v, expected %v", err, ErrSendQueueFull)
+	}
+	// Dropped announcements are repeated, sent ones are not
+	sender.full = false
+	for i := 0; i < 2; i++ {
+		if err := relay.Announce(Hash{1}); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	if len(sender.sent) != 1 {
+		t.Errorf("Sent %d announcements, expected 1", len(sender.sent))
+	}
+}
+
+func TestAttachMempool(t *testing.T) {
+	c, mp := newMempoolTestChain(t)
+	manager := NewPeerManager(testPeerConfig(PROTOCOL_VERSION, NewNonceSet()), NewAddressList())
+	AttachMempool(manager, mp)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// connect adds an inbound peer and returns the remote end
+	connect := func(relay bool) *Peer {
+		conn, remoteConn := tcpPair(t)
+		config := testPeerConfig(PROTOCOL_VERSION, NewNonceSet())
+		config.Relay = relay
+		remote := NewPeer(remoteConn, config, false)
+		handshake := make(chan error)
+		go func() { handshake <- remote.Handshake() }()
+		if err := manager.AddInbound(ctx, conn); err != nil {
+			t.Fatalf("AddInbound failed: %v", err)
+		}
+		if err := <-handshake; err != nil {
+			t.Fatalf("Handshake failed: %v", err)
+		}
+		return remote
+	}
+	receiveInv := func(remote *Peer) []Inv {
+		t.Helper()
+		msg, command, err := remote.ReceiveMessage()
+		if err != nil || command != "inv" {
+			t.Fatalf("Got %s %v, expected inv", command, err)
+		}
+		return (*msg).(*InvMessage).Invs
+	}
+	relaying := connect(true)
+	defer relaying.Close()
+	silent := connect(false)
+	defer silent.Close()
+
+	// A transaction from one peer is announced to the other one if it asked
+	// for relay
+	tx1 := mempoolTestTx(coinbaseOut(c, 1), 50*COIN-1000)
+	silent.SendMessage(&TxMessage{Tx: *tx1})
+	if invs := receiveInv(relaying); len(invs) != 1 || invs[0].Hash != tx1.TxID() {
+		t.Errorf("Wrong announcement %+v", invs)
+	}
+	// and never back to the peer it came from
+	tx2 := mempoolTestTx(coinbaseOut(c, 2), 50*COIN-1000)
+	relaying.SendMessage(&TxMessage{Tx: *tx2})
+	relaying.SendMessage(&MempoolMessage{})
+	if invs := receiveInv(relaying); len(invs) != 2 {
+		t.Errorf("Got %+v, expected the mempool contents", invs)
+	}
+
+	// Orphans of a peer are removed when it disconnects
+	orphan := mempoolTestTx([]OutPoint{{Hash{1}, 0}}, COIN)
+	silent.SendMessage(&TxMessage{Tx: *orphan})
+	silent.SendMessage(&MempoolMessage{})
+	if _, command, err := silent.ReceiveMessage(); err != nil || command != "getdata" {
+		t.Fatalf("Got %s %v, expected getdata for the parent", command, err)
+	}
+	if invs := receiveInv(silent); len(invs) != 2 || mp.Orphans() != 1 {
+		t.Fatalf("Got %+v and %d orphans, expected the mempool contents and the orphan", invs, mp.Orphans())
+	}
+	for _, peer := range manager.Peers() {
+		if !peer.Relay {
+			manager.Disconnect(peer)
+		}
+	}
+	if mp.Orphans() != 0 {
+		t.Errorf("Orphan of disconnected peer not removed")
+	}
+}
@@ -0,0 +1,141 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// Errors returned when checking the merkle root and the witness commitment
+// of a block. The texts are the reject reasons used by bitcoin core.
+var (
+	ErrBadMerkleRoot       = errors.New("bad-txnmrklroot")
+	ErrDuplicateTx         = errors.New("bad-txns-duplicate")
+	ErrNoTransactions      = errors.New("bad-blk-length")
+	ErrBadWitnessNonceSize = errors.New("bad-witness-nonce-size")
+	ErrBadWitnessMerkle    = errors.New("bad-witness-merkle-match")
+	ErrUnexpectedWitness   = errors.New("unexpected-witness")
+)
+
+// MerkleRoot computes the root of the merkle tree over the given hashes. On
+// each level with an odd number of entries the last hash is paired with
+// itself. Because of this, [a, b, c] and [a, b, c, c] have the same root
+// (CVE-2012-2459), so mutated is set if two identical hashes are paired on
+// any level. A block with such a tree must not be marked as permanently
+// invalid, since the same header may be valid with the original transactions.
+func MerkleRoot(hashes []Hash) (root Hash, mutated bool) {
+	if len(hashes) == 0 {
+		return root, false
+	}
+	level := make([]Hash, len(hashes))
+	copy(level, hashes)
+	buf := make([]byte, 64)
+	for len(level) > 1 {
+		for i := 0; i+1 < len(level); i += 2 {
+			if level[i] == level[i+1] {
+				mutated = true
+			}
+		}
+		if len(level)%2 == 1 {
+			level = append(level, level[len(level)-1])
+		}
+		for i := 0; i < len(level); i += 2 {
+			copy(buf[:32], level[i][:])
+			copy(buf[32:], level[i+1][:])
+			level[i/2] = doubleHash(buf)
+		}
+		level = level[:len(level)/2]
+	}
+	return level[0], mutated
+}
+
+// MerkleRoot computes the merkle root over the txids of the block
+func (b *Block) MerkleRoot() (Hash, bool) {
+	hashes := make([]Hash, len(b.Txs))
+	for i := range b.Txs {
+		hashes[i] = b.Txs[i].TxID()
+	}
+	return MerkleRoot(hashes)
+}
+
+// WitnessMerkleRoot computes the merkle root over the wtxids of the block
+// (BIP141). The wtxid of the coinbase is taken to be zero.
+func (b *Block) WitnessMerkleRoot() Hash {
+	hashes := make([]Hash, len(b.Txs))
+	for i := 1; i < len(b.Txs); i++ {
+		hashes[i] = b.Txs[i].WTxID()
+	}
+	root, _ := MerkleRoot(hashes)
+	return root
+}
+
+// CheckMerkleRoot checks that the merkle root in the header matches the
+// transactions and that the transaction list has not been mutated
+func (b *Block) CheckMerkleRoot() error {
+	if len(b.Txs) == 0 {
+		return ErrNoTransactions
+	}
+	root, mutated := b.MerkleRoot()
+	if root != b.MerkleRootHash {
+		return fmt.Errorf("%w: computed %v, header %v", ErrBadMerkleRoot, root.RPCString(), b.MerkleRootHash.RPCString())
+	}
+	if mutated {
+		return ErrDuplicateTx
+	}
+	return nil
+}
+
+// The witness commitment is an output of the coinbase with a script of at
+// least 38 bytes starting with OP_RETURN, a push of 36 bytes and this header
+var witnessCommitmentHeader = []byte{0x6a, 0x24, 0xaa, 0x21, 0xa9, 0xed}
+
+// WitnessCommitmentIndex returns the index of the coinbase output holding
+// the witness commitment, or -1 if there is none. If there are several, the
+// last one counts.
+func (b *Block) WitnessCommitmentIndex() int {
+	if len(b.Txs) == 0 {
+		return -1
+	}
+	pos := -1
+	for i, out := range b.Txs[0].TxOut {
+		if len(out.PkScript) >= 38 && bytes.HasPrefix(out.PkScript, witnessCommitmentHeader) {
+			pos = i
+		}
+	}
+	return pos
+}
+
+// WitnessCommitment computes the commitment for the given witness merkle
+// root and the witness reserved value from the coinbase witness
+func WitnessCommitment(root Hash, reserved []byte) Hash {
+	return doubleHash(append(root[:], reserved...))
+}
+
+// CheckWitnessCommitment checks the witness commitment of a segwit block.
+// If the coinbase has a commitment, the coinbase witness must hold a single
+// 32 byte reserved value and the commitment must match the witness merkle
+// root. Without a commitment no transaction may have witness data.
+func (b *Block) CheckWitnessCommitment() error {
+	pos := b.WitnessCommitmentIndex()
+	if pos < 0 {
+		for i := range b.Txs {
+			if b.Txs[i].HasWitness() {
+				return ErrUnexpectedWitness
+			}
+		}
+		return nil
+	}
+	// A coinbase without inputs can come from the network
+	if len(b.Txs[0].TxIn) == 0 {
+		return ErrBadWitnessNonceSize
+	}
+	witness := b.Txs[0].TxIn[0].Witness
+	if len(witness) != 1 || len(witness[0]) != 32 {
+		return ErrBadWitnessNonceSize
+	}
+	commitment := WitnessCommitment(b.WitnessMerkleRoot(), witness[0])
+	if !bytes.Equal(commitment[:], b.Txs[0].TxOut[pos].PkScript[6:38]) {
+		return ErrBadWitnessMerkle
+	}
+	return nil
+}
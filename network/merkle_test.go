@@ -0,0 +1,173 @@
+package network
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func genesisBlock(t *testing.T) Block {
+	tx, err := TxFromHex(genesisCoinbaseHex)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return Block{Header: MainNetParams.GenesisHeader, Txs: []Tx{tx}}
+}
+
+func TestMerkleRoot(t *testing.T) {
+	// Block 100000
+	txids := []Hash{
+		rs2h("8c14f0db3df150123e6f3dbbf30f8b955a8249b62ac1d1ff16284aefa3d06d87"),
+		rs2h("fff2525b8931402dd09222c50775608f75787bd2b87e56995a7bdd30f79702c4"),
+		rs2h("6359f0868171b1d194cbee1af2f16ea598ae8fad666d9b012c8ed2b79a236ec4"),
+		rs2h("e9a66845e05d5abc0ad04ec80f774a7e585c6e8db975962d069a522137b80c1d"),
+	}
+	exp := rs2h("f3e94742aca4b5ef85488dc37c06c3282295ffec960994b2c0d5ac2a25a95766")
+	root, mutated := MerkleRoot(txids)
+	if root != exp || mutated {
+		t.Errorf("Wrong merkle root %v (mutated %v)", root.RPCString(), mutated)
+	}
+
+	// A single hash is its own root
+	root, mutated = MerkleRoot(txids[:1])
+	if root != txids[0] || mutated {
+		t.Errorf("Wrong merkle root for single hash %v", root.RPCString())
+	}
+}
+
+func TestMerkleRootMutated(t *testing.T) {
+	hashes := []Hash{s2h("01"), s2h("02"), s2h("03")}
+	root, mutated := MerkleRoot(hashes)
+	if mutated {
+		t.Errorf("Odd number of hashes should not be mutated")
+	}
+	root2, mutated := MerkleRoot(append(hashes, hashes[2]))
+	if root2 != root || !mutated {
+		t.Errorf("Duplicated last hash should give same root and be mutated")
+	}
+
+	// Duplicates on a higher level are found as well
+	hashes = []Hash{s2h("01"), s2h("02"), s2h("03"), s2h("04"), s2h("05"), s2h("06")}
+	root, _ = MerkleRoot(hashes)
+	root2, mutated = MerkleRoot(append(hashes, hashes[4:]...))
+	if root2 != root || !mutated {
+		t.Errorf("Duplicated last pair should give same root and be mutated")
+	}
+}
+
+func TestBlockMessage(t *testing.T) {
+	block := genesisBlock(t)
+	if err := block.CheckMerkleRoot(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	msg := &BlockMessage{Block: block}
+	data := msg.Marshal(nil)
+	if len(data) != 285 {
+		t.Errorf(format_incorrect_length, len(data), 285, "genesis block")
+	}
+	msg2, rest, err := unmarshalMessage("block", data, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(rest) > 0 {
+		t.Errorf(format_cosume_data, len(rest), msg)
+	}
+	if !reflect.DeepEqual(msg2, msg) {
+		t.Errorf(format_unmarshalled_match, msg2, msg)
+	}
+
+	// Block with a merkle root not matching the transactions
+	block.Nonce++
+	block.MerkleRootHash[0] ^= 1
+	data = MarshalBlock(nil, block)
+	if _, _, err = unmarshalMessage("block", data, 0); !errors.Is(err, ErrBadMerkleRoot) {
+		t.Errorf("Expected bad merkle root error, got %v", err)
+	}
+
+	// Same merkle root but with the last transaction duplicated
+	block = genesisBlock(t)
+	spend := legacyTestTx()
+	block.Txs = append(block.Txs, witnessTestTx(), spend)
+	block.MerkleRootHash, _ = block.MerkleRoot()
+	block.Txs = append(block.Txs, spend)
+	if err = block.CheckMerkleRoot(); !errors.Is(err, ErrDuplicateTx) {
+		t.Errorf("Expected duplicate error, got %v", err)
+	}
+}
+
+func TestTxMessage(t *testing.T) {
+	msg := &TxMessage{Tx: witnessTestTx()}
+	data := msg.Marshal(nil)
+	msg2, rest, err := unmarshalMessage("tx", data, 0)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(rest) > 0 {
+		t.Errorf(format_cosume_data, len(rest), msg)
+	}
+	if !reflect.DeepEqual(msg2, msg) {
+		t.Errorf(format_unmarshalled_match, msg2, msg)
+	}
+}
+
+func TestWitnessCommitment(t *testing.T) {
+	block := genesisBlock(t)
+	block.Txs = append(block.Txs, witnessTestTx())
+
+	// Witness data without commitment
+	if err := block.CheckWitnessCommitment(); !errors.Is(err, ErrUnexpectedWitness) {
+		t.Errorf("Expected unexpected witness error, got %v", err)
+	}
+
+	reserved := make([]byte, 32)
+	commitment := WitnessCommitment(block.WitnessMerkleRoot(), reserved)
+	script := append(append([]byte{}, witnessCommitmentHeader...), commitment[:]...)
+	block.Txs[0].TxOut = append(block.Txs[0].TxOut, TxOut{PkScript: script})
+	if err := block.CheckWitnessCommitment(); !errors.Is(err, ErrBadWitnessNonceSize) {
+		t.Errorf("Expected bad nonce size error, got %v", err)
+	}
+
+	block.Txs[0].TxIn[0].Witness = [][]byte{reserved}
+	if block.WitnessCommitmentIndex() != 1 {
+		t.Errorf("Wrong witness commitment index %d", block.WitnessCommitmentIndex())
+	}
+	if err := block.CheckWitnessCommitment(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	block.MerkleRootHash, _ = block.MerkleRoot()
+	data := MarshalBlock(nil, block)
+	if _, _, err := unmarshalMessage("block", data, 0); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+
+	// Changing a witness changes the wtxid but not the merkle root
+	block.Txs[1].TxIn[0].Witness[1] = []byte{1}
+	if err := block.CheckMerkleRoot(); err != nil {
+		t.Errorf("Unexpected error: %v", err)
+	}
+	data = MarshalBlock(nil, block)
+	if _, _, err := unmarshalMessage("block", data, 0); !errors.Is(err, ErrBadWitnessMerkle) {
+		t.Errorf("Expected bad witness merkle error, got %v", err)
+	}
+}
+
+// A coinbase without inputs is accepted by UnmarshalTx (marker and a zero
+// flag), the witness commitment check must not assume an input
+func TestWitnessCommitmentNoInputs(t *testing.T) {
+	block := genesisBlock(t)
+	commitment := WitnessCommitment(Hash{}, make([]byte, 32))
+	script := append(append([]byte{}, witnessCommitmentHeader...), commitment[:]...)
+	block.Txs = []Tx{{Version: 1, TxOut: []TxOut{{PkScript: script}}}, witnessTestTx()}
+	block.MerkleRootHash, _ = block.MerkleRoot()
+	if err := block.CheckWitnessCommitment(); !errors.Is(err, ErrBadWitnessNonceSize) {
+		t.Errorf("Expected bad nonce size error, got %v", err)
+	}
+
+	// Header, tx count, version, then the 0x00 0x00 marker and flag
+	data := MarshalBlock(nil, block)
+	data = append(append(append([]byte{}, data[:80+1+4]...), 0), data[80+1+4:]...)
+	if _, _, err := unmarshalMessage("block", data, 0); !errors.Is(err, ErrBadWitnessNonceSize) {
+		t.Errorf("Expected bad nonce size error, got %v", err)
+	}
+}
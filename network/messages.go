@@ -1,8 +1,10 @@
 package network
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
@@ -12,41 +14,118 @@ type Message interface {
 	GetCommandString() string
 }
 
-func unmarshalMessage(command string, data []byte) (Message, []byte) {
-	var msg Message
-	switch command {
-	case "version":
-		msg = new(VersionMessage)
-	case "verack":
-		msg = new(VerAckMessage)
-	case "reject":
-		msg = new(RejectMessage)
-	case "ping":
-		msg = new(PingMessage)
-	case "pong":
-		msg = new(PongMessage)
-	case "alert":
-		msg = new(AlertMessage)
-	case "addr":
-		msg = new(AddrMessage)
-	case "sendheaders":
-		msg = new(SendHeadersMessage)
-	case "getheaders":
-		msg = new(GetHeadersMessage)
-	case "getblocks":
-		msg = new(GetBlocksMessage)
-	case "inv":
-		msg = new(InvMessage)
-	case "headers":
-		msg = new(HeadersMessage)
-	default:
-		panic(fmt.Sprintf("Unknown command to unmarshal: '%s'", command))
+// Protocol versions
+const (
+	PROTOCOL_VERSION       = 70016 // the version we speak
+	MIN_PEER_PROTO_VERSION = 31800 // peers with older versions are disconnected
+	CADDR_TIME_VERSION     = 31402 // addr entries have a timestamp from this version on
+	BIP0031_VERSION        = 60000 // ping has a nonce and is answered by pong after this version
+)
+
+// VersionedMessage is implemented by messages whose encoding depends on the
+// protocol version negotiated with the peer. Marshal and Unmarshal use
+// PROTOCOL_VERSION.
+type VersionedMessage interface {
+	Message
+	MarshalVersion(out []byte, version uint32) []byte
+	UnmarshalVersion(data []byte, version uint32) ([]byte, error)
+}
+
+// marshalMessage marshals msg for the protocol version, 0 meaning
+// PROTOCOL_VERSION
+func marshalMessage(out []byte, msg Message, version uint32) []byte {
+	if versioned, ok := msg.(VersionedMessage); ok && version != 0 {
+		return versioned.MarshalVersion(out, version)
+	}
+	return msg.Marshal(out)
+}
+
+// Registry of the message types, by command string. Commands without a
+// registered type are unmarshalled as RawMessage.
+var (
+	messageTypesMutex sync.RWMutex
+	messageTypes      = map[string]func() Message{
+		"version":     func() Message { return new(VersionMessage) },
+		"verack":      func() Message { return new(VerAckMessage) },
+		"reject":      func() Message { return new(RejectMessage) },
+		"ping":        func() Message { return new(PingMessage) },
+		"pong":        func() Message { return new(PongMessage) },
+		"alert":       func() Message { return new(AlertMessage) },
+		"addr":        func() Message { return new(AddrMessage) },
+		"getaddr":     func() Message { return new(GetAddrMessage) },
+		"sendheaders": func() Message { return new(SendHeadersMessage) },
+		"getheaders":  func() Message { return new(GetHeadersMessage) },
+		"getblocks":   func() Message { return new(GetBlocksMessage) },
+		"inv":         func() Message { return new(InvMessage) },
+		"headers":     func() Message { return new(HeadersMessage) },
+		"tx":          func() Message { return new(TxMessage) },
+		"block":       func() Message { return new(BlockMessage) },
+		"getdata":     func() Message { return new(GetDataMessage) },
+		"notfound":    func() Message { return new(NotFoundMessage) },
+		"mempool":     func() Message { return new(MempoolMessage) },
 	}
-	if command != msg.GetCommandString() {
-		panic("Internal error (command string mismatch)")
+)
+
+// RegisterMessage registers a constructor for the message type handling
+// command, replacing any previous registration. It panics if the messages
+// created report a different command string.
+func RegisterMessage(command string, create func() Message) {
+	if create().GetCommandString() != command {
+		panic(fmt.Sprintf("message type for '%s' has command string '%s'", command, create().GetCommandString()))
+	}
+	messageTypesMutex.Lock()
+	defer messageTypesMutex.Unlock()
+	messageTypes[command] = create
+}
+
+// NewMessage creates an empty message for command, or a RawMessage if no
+// type is registered for it
+func NewMessage(command string) Message {
+	messageTypesMutex.RLock()
+	create, ok := messageTypes[command]
+	messageTypesMutex.RUnlock()
+	if !ok {
+		return &RawMessage{Command: command}
+	}
+	return create()
+}
+
+func unmarshalMessage(command string, data []byte, version uint32) (Message, []byte, error) {
+	msg := NewMessage(command)
+	var err error
+	if versioned, ok := msg.(VersionedMessage); ok && version != 0 {
+		data, err = versioned.UnmarshalVersion(data, version)
+	} else {
+		data, err = msg.Unmarshal(data)
 	}
-	data = msg.Unmarshal(data)
-	return msg, data
+	if err != nil {
+		return nil, data, fmt.Errorf("unmarshalling '%s': %w", command, err)
+	}
+	return msg, data, nil
+}
+
+// ========================================================================
+
+// RawMessage holds the payload of a message with an unknown command (e.g.
+// sendcmpct, feefilter, wtxidrelay or sendaddrv2), so that it can be logged
+// or forwarded unchanged.
+
+type RawMessage struct {
+	Command string
+	Payload []byte
+}
+
+func (msg RawMessage) Marshal(out []byte) []byte {
+	return MarshalBytes(out, msg.Payload)
+}
+
+func (msg *RawMessage) Unmarshal(data []byte) ([]byte, error) {
+	msg.Payload = append([]byte{}, data...)
+	return data[len(data):], nil
+}
+
+func (msg RawMessage) GetCommandString() string {
+	return msg.Command
 }
 
 // ========================================================================
@@ -75,6 +154,8 @@ const NODE_XTHIN = 16             // 	Never formally proposed (as a BIP), and di
 const NODE_COMPACT_FILTERS = 64   // 	See BIP 0157
 const NODE_NETWORK_LIMITED = 1024 // 	See BIP 0159
 
+const DEFAULT_USER_AGENT = "Foobar client v0.1"
+
 func NewVersionMessage() *VersionMessage {
 
 	msg := VersionMessage{
@@ -84,7 +165,7 @@ func NewVersionMessage() *VersionMessage {
 		ReceiverAddr: NetAddr{NODE_NETWORK, net.IPv4(127, 0, 0, 1), 8333},
 		FromAddr:     NetAddr{NODE_NETWORK, net.IPv4(127, 0, 0, 1), 8333},
 		Nonce:        3141526,
-		UserAgent:    "Foobar client v0.1",
+		UserAgent:    DEFAULT_USER_AGENT,
 		StartHeight:  1,
 		Relay:        false,
 	}
@@ -108,21 +189,40 @@ func (msg VersionMessage) Marshal(out []byte) []byte {
 	return out
 }
 
-func (msg *VersionMessage) Unmarshal(data []byte) []byte {
-	msg.Version, data = UnmarshalUint32(data)
-	msg.Services, data = UnmarshalUint64(data)
-	msg.Timestamp, data = UnmarshalTimestamp(data)
-	msg.ReceiverAddr, data = UnmarshalNetAddr(data)
+func (msg *VersionMessage) Unmarshal(data []byte) ([]byte, error) {
+	var err error
+	if msg.Version, data, err = UnmarshalUint32(data); err != nil {
+		return data, err
+	}
+	if msg.Services, data, err = UnmarshalUint64(data); err != nil {
+		return data, err
+	}
+	if msg.Timestamp, data, err = UnmarshalTimestamp(data); err != nil {
+		return data, err
+	}
+	if msg.ReceiverAddr, data, err = UnmarshalNetAddr(data); err != nil {
+		return data, err
+	}
 	if msg.Version >= 106 {
-		msg.FromAddr, data = UnmarshalNetAddr(data)
-		msg.Nonce, data = UnmarshalUint64(data)
-		msg.UserAgent, data = UnmarshalVarStr(data)
-		msg.StartHeight, data = UnmarshalUint32(data)
+		if msg.FromAddr, data, err = UnmarshalNetAddr(data); err != nil {
+			return data, err
+		}
+		if msg.Nonce, data, err = UnmarshalUint64(data); err != nil {
+			return data, err
+		}
+		if msg.UserAgent, data, err = UnmarshalVarStr(data); err != nil {
+			return data, err
+		}
+		if msg.StartHeight, data, err = UnmarshalUint32(data); err != nil {
+			return data, err
+		}
 	}
 	if msg.Version >= 70001 {
-		msg.Relay, data = UnmarshalBool(data)
+		if msg.Relay, data, err = UnmarshalBool(data); err != nil {
+			return data, err
+		}
 	}
-	return data
+	return data, nil
 }
 
 func (msg VersionMessage) GetCommandString() string {
@@ -137,8 +237,8 @@ func (msg VerAckMessage) Marshal(out []byte) []byte {
 	return out
 }
 
-func (msg *VerAckMessage) Unmarshal(data []byte) []byte {
-	return data
+func (msg *VerAckMessage) Unmarshal(data []byte) ([]byte, error) {
+	return data, nil
 }
 
 func (msg VerAckMessage) GetCommandString() string {
@@ -171,12 +271,19 @@ func (msg RejectMessage) Marshal(out []byte) []byte {
 	return out
 }
 
-func (msg *RejectMessage) Unmarshal(data []byte) []byte {
-	msg.Message, data = UnmarshalVarStr(data)
-	msg.CCode, data = UnmarshalUint8(data)
-	msg.Reason, data = UnmarshalVarStr(data)
-	msg.Data, data = UnmarshalBytes(data, uint32(len(data)))
-	return data
+func (msg *RejectMessage) Unmarshal(data []byte) ([]byte, error) {
+	var err error
+	if msg.Message, data, err = UnmarshalVarStr(data); err != nil {
+		return data, err
+	}
+	if msg.CCode, data, err = UnmarshalUint8(data); err != nil {
+		return data, err
+	}
+	if msg.Reason, data, err = UnmarshalVarStr(data); err != nil {
+		return data, err
+	}
+	msg.Data, data, err = UnmarshalBytes(data, uint32(len(data)))
+	return data, err
 }
 
 func (msg RejectMessage) GetCommandString() string {
@@ -185,19 +292,36 @@ func (msg RejectMessage) GetCommandString() string {
 
 // ========================================================================
 type PingMessage struct {
-	Nonce uint64
+	Nonce uint64 // not sent up to BIP0031_VERSION
 }
 
 func (msg PingMessage) Marshal(out []byte) []byte {
-	out = MarshalUint64(out, msg.Nonce)
+	return msg.MarshalVersion(out, PROTOCOL_VERSION)
+}
+
+func (msg PingMessage) MarshalVersion(out []byte, version uint32) []byte {
+	if version > BIP0031_VERSION {
+		out = MarshalUint64(out, msg.Nonce)
+	}
 	return out
 }
 
-func (msg *PingMessage) Unmarshal(data []byte) []byte {
+func (msg *PingMessage) Unmarshal(data []byte) ([]byte, error) {
+	var err error
 	if len(data) >= 8 {
-		msg.Nonce, data = UnmarshalUint64(data)
+		msg.Nonce, data, err = UnmarshalUint64(data)
+	}
+	return data, err
+}
+
+func (msg *PingMessage) UnmarshalVersion(data []byte, version uint32) ([]byte, error) {
+	if version <= BIP0031_VERSION {
+		msg.Nonce = 0
+		return data, nil
 	}
-	return data
+	var err error
+	msg.Nonce, data, err = UnmarshalUint64(data)
+	return data, err
 }
 
 func (msg PingMessage) GetCommandString() string {
@@ -214,9 +338,10 @@ func (msg PongMessage) Marshal(out []byte) []byte {
 	return out
 }
 
-func (msg *PongMessage) Unmarshal(data []byte) []byte {
-	msg.Nonce, data = UnmarshalUint64(data)
-	return data
+func (msg *PongMessage) Unmarshal(data []byte) ([]byte, error) {
+	var err error
+	msg.Nonce, data, err = UnmarshalUint64(data)
+	return data, err
 }
 
 func (msg PongMessage) GetCommandString() string {
@@ -246,61 +371,121 @@ func (msg AlertMessage) Marshal(out []byte) []byte {
 	panic("I ain't gonna send no alert message (see https://bitcoin.org/en/alert/2016-11-01-alert-retirement) ")
 }
 
-func (msg *AlertMessage) Unmarshal(data []byte) []byte {
+func (msg *AlertMessage) Unmarshal(data []byte) ([]byte, error) {
 
 	// Unmarshal payload and signature
-	lenPayload, data := UnmarshalVarInt(data)
-	msg.Payload, data = UnmarshalBytes(data, uint32(lenPayload))
-	lenSignature, data := UnmarshalVarInt(data)
-	msg.Signature, data = UnmarshalBytes(data, uint32(lenSignature))
+	var err error
+	if msg.Payload, data, err = UnmarshalVarBytes(data); err != nil {
+		return data, err
+	}
+	if msg.Signature, data, err = UnmarshalVarBytes(data); err != nil {
+		return data, err
+	}
 
 	// Check signature
-	// Public key
-	//   04fc9702847840aaf195de8442ebecedf5b095cdbb9bc716bda9110971b28a49e0ead8564ff0db22209e0374782c093bb899692d524e9d6a6956e7c5ecbcd68284
-	//   (hash) 1AGRxqDa5WjUKBwHB9XYEjmkv1ucoUUy1s
-	// Public keys (in scripts) are given as
-	// 		04 <x> <y> where x and y are 32 byte big-endian integers representing the coordinates of a point on the curve
-	// or in compressed form given as
-	//     <sign> <x> where <sign> is 0x02 if y is even and 0x03 if y is odd.
-	key := PublicKeyFromString("04fc9702847840aaf195de8442ebecedf5b095cdbb9bc716bda9110971b28a49e0ead8564ff0db22209e0374782c093bb899692d524e9d6a6956e7c5ecbcd68284")
-	hash := doubleHash(msg.Payload)
-	valid := VerifyASN1(&key, hash[:], msg.Signature)
-	if !valid {
-		// we do nothing... does not matter anyway, as the alert
-		// system has been retired and the private key is in the wild
-		// (I just wanted to try whether I could validate the alert message
-		// about retiring the alert system - didn't work though...)
-		// And furthermore, it's send only to pre-70000 clients anyway
+	if err = msg.Verify(); err != nil {
+		return data, err
 	}
 
 	// Unmarshal fields from payload
-	payload := msg.Payload
-	msg.Version, payload = UnmarshalUint32(payload)
-	msg.RelayUntil, payload = UnmarshalTimestamp(payload)
-	msg.Expiration, payload = UnmarshalTimestamp(payload)
-	msg.ID, payload = UnmarshalUint32(payload)
-	msg.Cancel, payload = UnmarshalUint32(payload)
-	nCancel, payload := UnmarshalVarInt(payload)
+	if err := msg.unmarshalPayload(msg.Payload); err != nil {
+		return data, fmt.Errorf("alert payload: %w", err)
+	}
+
+	return data, nil
+}
+
+// The alert key, which has been retired along with the alert system (and
+// whose private key has since been published). Its P2PKH address is
+// 1AGRxqDa5WjUKBwHB9XYEjmkv1ucoUUy1s.
+const ALERT_PUBKEY = "04fc9702847840aaf195de8442ebecedf5b095cdbb9bc716bda9110971b28a49e0ead8564ff0db22209e0374782c093bb899692d524e9d6a6956e7c5ecbcd68284"
+
+var ErrBadAlertSignature = errors.New("alert signature verification failed")
+
+// Verify checks the signature of the alert payload against the alert key.
+// The only alert still sent (to pre-70000 clients) is the final alert
+// announcing the retirement of the alert system.
+func (msg *AlertMessage) Verify() error {
+	key, err := PublicKeyFromString(ALERT_PUBKEY)
+	if err != nil {
+		panic(err)
+	}
+	sig, err := ParseDERSignature(msg.Signature)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrBadAlertSignature, err)
+	}
+	hash := doubleHash(msg.Payload)
+	if !key.Verify(hash[:], sig) {
+		return ErrBadAlertSignature
+	}
+	return nil
+}
+
+func (msg *AlertMessage) unmarshalPayload(payload []byte) error {
+	var err error
+	if msg.Version, payload, err = UnmarshalUint32(payload); err != nil {
+		return err
+	}
+	if msg.RelayUntil, payload, err = UnmarshalTimestamp(payload); err != nil {
+		return err
+	}
+	if msg.Expiration, payload, err = UnmarshalTimestamp(payload); err != nil {
+		return err
+	}
+	if msg.ID, payload, err = UnmarshalUint32(payload); err != nil {
+		return err
+	}
+	if msg.Cancel, payload, err = UnmarshalUint32(payload); err != nil {
+		return err
+	}
+	nCancel, payload, err := UnmarshalLength(payload)
+	if err != nil {
+		return err
+	}
+	if err = checkCount(payload, nCancel, 4); err != nil {
+		return err
+	}
 	msg.setCancel = make([]uint32, nCancel)
 	for i := range msg.setCancel {
-		msg.setCancel[i], payload = UnmarshalUint32(payload)
+		if msg.setCancel[i], payload, err = UnmarshalUint32(payload); err != nil {
+			return err
+		}
+	}
+	if msg.MinVer, payload, err = UnmarshalUint32(payload); err != nil {
+		return err
+	}
+	if msg.MaxVer, payload, err = UnmarshalUint32(payload); err != nil {
+		return err
+	}
+	nSubVer, payload, err := UnmarshalLength(payload)
+	if err != nil {
+		return err
+	}
+	if err = checkCount(payload, nSubVer, 1); err != nil {
+		return err
 	}
-	msg.MinVer, payload = UnmarshalUint32(payload)
-	msg.MaxVer, payload = UnmarshalUint32(payload)
-	nSubVer, payload := UnmarshalVarInt(payload)
 	msg.setSubVer = make([]string, nSubVer)
 	for i := range msg.setSubVer {
-		msg.setSubVer[i], payload = UnmarshalVarStr(payload)
+		if msg.setSubVer[i], payload, err = UnmarshalVarStr(payload); err != nil {
+			return err
+		}
+	}
+	if msg.Priority, payload, err = UnmarshalUint32(payload); err != nil {
+		return err
+	}
+	if msg.Comment, payload, err = UnmarshalVarStr(payload); err != nil {
+		return err
+	}
+	if msg.StatusBar, payload, err = UnmarshalVarStr(payload); err != nil {
+		return err
+	}
+	if msg.Reserved, payload, err = UnmarshalVarStr(payload); err != nil {
+		return err
 	}
-	msg.Priority, payload = UnmarshalUint32(payload)
-	msg.Comment, payload = UnmarshalVarStr(payload)
-	msg.StatusBar, payload = UnmarshalVarStr(payload)
-	msg.Reserved, payload = UnmarshalVarStr(payload)
 	if len(payload) > 0 {
 		fmt.Printf("Warning: Payload not fully parsed at end of alert message...")
 	}
-
-	return data
+	return nil
 }
 
 func (msg AlertMessage) GetCommandString() string {
@@ -308,25 +493,60 @@ func (msg AlertMessage) GetCommandString() string {
 }
 
 // ========================================================================
+
+// Maximum number of addresses in an addr message
+const MAX_ADDR_TO_SEND = 1000
+
 type AddrMessage struct {
 	AddrList []TimeNetAddr
 }
 
 func (msg AddrMessage) Marshal(out []byte) []byte {
+	return msg.MarshalVersion(out, PROTOCOL_VERSION)
+}
+
+// MarshalVersion leaves out the timestamps before CADDR_TIME_VERSION
+func (msg AddrMessage) MarshalVersion(out []byte, version uint32) []byte {
 	out = MarshalVarInt(out, uint64(len(msg.AddrList)))
 	for i := range msg.AddrList {
-		out = MarshalTimeNetAddr(out, msg.AddrList[i])
+		if version >= CADDR_TIME_VERSION {
+			out = MarshalTimeNetAddr(out, msg.AddrList[i])
+		} else {
+			out = MarshalNetAddr(out, msg.AddrList[i].NetAddr)
+		}
 	}
 	return out
 }
 
-func (msg *AddrMessage) Unmarshal(data []byte) []byte {
-	count, data := UnmarshalVarInt(data)
+func (msg *AddrMessage) Unmarshal(data []byte) ([]byte, error) {
+	return msg.UnmarshalVersion(data, PROTOCOL_VERSION)
+}
+
+func (msg *AddrMessage) UnmarshalVersion(data []byte, version uint32) ([]byte, error) {
+	count, data, err := UnmarshalLength(data)
+	if err != nil {
+		return data, err
+	}
+	withTime := version >= CADDR_TIME_VERSION
+	size := uint64(26)
+	if withTime {
+		size += 4
+	}
+	if err = checkCount(data, count, size); err != nil {
+		return data, err
+	}
 	msg.AddrList = make([]TimeNetAddr, count)
 	for i := range msg.AddrList {
-		msg.AddrList[i], data = UnmarshalTimeNetAddr(data)
+		if withTime {
+			msg.AddrList[i], data, err = UnmarshalTimeNetAddr(data)
+		} else {
+			msg.AddrList[i].NetAddr, data, err = UnmarshalNetAddr(data)
+		}
+		if err != nil {
+			return data, err
+		}
 	}
-	return data
+	return data, nil
 }
 
 func (msg AddrMessage) GetCommandString() string {
@@ -335,6 +555,26 @@ func (msg AddrMessage) GetCommandString() string {
 
 // ========================================================================
 
+// getaddr asks the peer for addresses of other nodes. The peer replies with
+// addr messages. There is no payload.
+
+type GetAddrMessage struct {
+}
+
+func (msg GetAddrMessage) Marshal(out []byte) []byte {
+	return out
+}
+
+func (msg *GetAddrMessage) Unmarshal(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (msg GetAddrMessage) GetCommandString() string {
+	return "getaddr"
+}
+
+// ========================================================================
+
 // sendheaders
 //
 // Request for Direct headers announcement.
@@ -353,8 +593,8 @@ func (msg SendHeadersMessage) Marshal(out []byte) []byte {
 	return out
 }
 
-func (msg *SendHeadersMessage) Unmarshal(data []byte) []byte {
-	return data
+func (msg *SendHeadersMessage) Unmarshal(data []byte) ([]byte, error) {
+	return data, nil
 }
 
 func (msg SendHeadersMessage) GetCommandString() string {
@@ -386,11 +626,16 @@ func (msg GetHeadersMessage) Marshal(out []byte) []byte {
 	return out
 }
 
-func (msg *GetHeadersMessage) Unmarshal(data []byte) []byte {
-	msg.Version, data = UnmarshalUint32(data)
-	msg.BlockLocHashes, data = UnmarshalHashes(data)
-	msg.StopHash, data = UnmarshalHash(data)
-	return data
+func (msg *GetHeadersMessage) Unmarshal(data []byte) ([]byte, error) {
+	var err error
+	if msg.Version, data, err = UnmarshalUint32(data); err != nil {
+		return data, err
+	}
+	if msg.BlockLocHashes, data, err = UnmarshalHashes(data); err != nil {
+		return data, err
+	}
+	msg.StopHash, data, err = UnmarshalHash(data)
+	return data, err
 }
 
 func (msg GetHeadersMessage) GetCommandString() string {
@@ -426,11 +671,16 @@ func (msg GetBlocksMessage) Marshal(out []byte) []byte {
 	return out
 }
 
-func (msg *GetBlocksMessage) Unmarshal(data []byte) []byte {
-	msg.Version, data = UnmarshalUint32(data)
-	msg.BlockLocHashes, data = UnmarshalHashes(data)
-	msg.StopHash, data = UnmarshalHash(data)
-	return data
+func (msg *GetBlocksMessage) Unmarshal(data []byte) ([]byte, error) {
+	var err error
+	if msg.Version, data, err = UnmarshalUint32(data); err != nil {
+		return data, err
+	}
+	if msg.BlockLocHashes, data, err = UnmarshalHashes(data); err != nil {
+		return data, err
+	}
+	msg.StopHash, data, err = UnmarshalHash(data)
+	return data, err
 }
 
 func (msg GetBlocksMessage) GetCommandString() string {
@@ -447,22 +697,69 @@ func (msg GetBlocksMessage) GetCommandString() string {
 // 1+ 	count 	var_int 	Number of inventory entries
 // 36x? 	inventory 	inv_vect[] 	Inventory vectors
 
+// Maximum number of entries in an inv, getdata or notfound message
+const MAX_INV_SZ = 50000
+
 type Inv struct {
 	Type uint32 // 	Identifies the object type linked to this inventory
 	Hash Hash   // 	Hash of the object
 }
 
+// Object types for inventory vectors
+
+const MSG_ERROR = 0          // Any data of with this number may be ignored
+const MSG_TX = 1             // Hash is related to a transaction
+const MSG_BLOCK = 2          // Hash is related to a data block
+const MSG_FILTERED_BLOCK = 3 // Hash of a block header, only to be used in getdata. Requests a merkleblock (BIP37)
+const MSG_CMPCT_BLOCK = 4    // Hash of a block header, only to be used in getdata. Requests a cmpctblock (BIP152)
+const MSG_WTX = 5            // Hash is the wtxid of a transaction (BIP339)
+
+const MSG_WITNESS_FLAG = 1 << 30                                         // Set in getdata to request witness data (BIP144)
+const MSG_WITNESS_TX = MSG_TX | MSG_WITNESS_FLAG                         // Same as MSG_TX but with witness data
+const MSG_WITNESS_BLOCK = MSG_BLOCK | MSG_WITNESS_FLAG                   // Same as MSG_BLOCK but with witness data
+const MSG_FILTERED_WITNESS_BLOCK = MSG_FILTERED_BLOCK | MSG_WITNESS_FLAG // Reserved, not used
+
+func (inv Inv) String() string {
+	var name string
+	switch inv.Type {
+	case MSG_ERROR:
+		name = "error"
+	case MSG_TX:
+		name = "tx"
+	case MSG_BLOCK:
+		name = "block"
+	case MSG_FILTERED_BLOCK:
+		name = "merkleblock"
+	case MSG_CMPCT_BLOCK:
+		name = "cmpctblock"
+	case MSG_WTX:
+		name = "wtx"
+	case MSG_WITNESS_TX:
+		name = "witness-tx"
+	case MSG_WITNESS_BLOCK:
+		name = "witness-block"
+	case MSG_FILTERED_WITNESS_BLOCK:
+		name = "witness-merkleblock"
+	default:
+		name = fmt.Sprintf("0x%08x", inv.Type)
+	}
+	return name + " " + inv.Hash.RPCString()
+}
+
 func MarshalInv(out []byte, v Inv) []byte {
 	out = MarshalUint32(out, v.Type)
 	out = MarshalHash(out, v.Hash)
 	return out
 }
 
-func UnmarshalInv(data []byte) (Inv, []byte) {
+func UnmarshalInv(data []byte) (Inv, []byte, error) {
 	var v Inv
-	v.Type, data = UnmarshalUint32(data)
-	v.Hash, data = UnmarshalHash(data)
-	return v, data
+	var err error
+	if v.Type, data, err = UnmarshalUint32(data); err != nil {
+		return v, data, err
+	}
+	v.Hash, data, err = UnmarshalHash(data)
+	return v, data, err
 }
 
 func MarshalInvs(out []byte, v []Inv) []byte {
@@ -474,13 +771,21 @@ func MarshalInvs(out []byte, v []Inv) []byte {
 	return out
 }
 
-func UnmarshalInvs(data []byte) ([]Inv, []byte) {
-	l, data := UnmarshalVarInt(data)
+func UnmarshalInvs(data []byte) ([]Inv, []byte, error) {
+	l, data, err := UnmarshalLength(data)
+	if err != nil {
+		return nil, data, err
+	}
+	if err = checkCount(data, l, 36); err != nil {
+		return nil, data, err
+	}
 	v := make([]Inv, l)
 	for i := 0; i < int(l); i++ {
-		v[i], data = UnmarshalInv(data)
+		if v[i], data, err = UnmarshalInv(data); err != nil {
+			return nil, data, err
+		}
 	}
-	return v, data
+	return v, data, nil
 }
 
 type InvMessage struct {
@@ -491,9 +796,10 @@ func (msg InvMessage) Marshal(out []byte) []byte {
 	return MarshalInvs(out, msg.Invs)
 }
 
-func (msg *InvMessage) Unmarshal(data []byte) []byte {
-	msg.Invs, data = UnmarshalInvs(data)
-	return data
+func (msg *InvMessage) Unmarshal(data []byte) ([]byte, error) {
+	var err error
+	msg.Invs, data, err = UnmarshalInvs(data)
+	return data, err
 }
 
 func (msg InvMessage) GetCommandString() string {
@@ -502,6 +808,73 @@ func (msg InvMessage) GetCommandString() string {
 
 // ========================================================================
 
+// getdata is used in response to inv, to retrieve the content of a specific
+// object, and is usually sent after receiving an inv packet, after filtering
+// known elements. The payload is the same as for inv.
+
+type GetDataMessage struct {
+	Invs []Inv
+}
+
+func (msg GetDataMessage) Marshal(out []byte) []byte {
+	return MarshalInvs(out, msg.Invs)
+}
+
+func (msg *GetDataMessage) Unmarshal(data []byte) ([]byte, error) {
+	var err error
+	msg.Invs, data, err = UnmarshalInvs(data)
+	return data, err
+}
+
+func (msg GetDataMessage) GetCommandString() string {
+	return "getdata"
+}
+
+// ========================================================================
+
+// notfound is a response to a getdata, sent if any requested data items
+// could not be relayed. The payload is the same as for inv.
+
+type NotFoundMessage struct {
+	Invs []Inv
+}
+
+func (msg NotFoundMessage) Marshal(out []byte) []byte {
+	return MarshalInvs(out, msg.Invs)
+}
+
+func (msg *NotFoundMessage) Unmarshal(data []byte) ([]byte, error) {
+	var err error
+	msg.Invs, data, err = UnmarshalInvs(data)
+	return data, err
+}
+
+func (msg NotFoundMessage) GetCommandString() string {
+	return "notfound"
+}
+
+// ========================================================================
+
+// mempool requests the transactions in the peer's memory pool. The peer
+// replies with inv messages. There is no payload.
+
+type MempoolMessage struct {
+}
+
+func (msg MempoolMessage) Marshal(out []byte) []byte {
+	return out
+}
+
+func (msg *MempoolMessage) Unmarshal(data []byte) ([]byte, error) {
+	return data, nil
+}
+
+func (msg MempoolMessage) GetCommandString() string {
+	return "mempool"
+}
+
+// ========================================================================
+
 // Allows a node to advertise its knowledge of one or more objects. It can be
 // received unsolicited, or in reply to getblocks.
 
@@ -516,17 +889,27 @@ func MarshalHeaders(out []byte, v []Header, addZeros bool) []byte {
 	return out
 }
 
-func UnmarshalHeaders(data []byte, addZeros bool) ([]Header, []byte) {
-	l, data := UnmarshalVarInt(data)
+func UnmarshalHeaders(data []byte, addZeros bool) ([]Header, []byte, error) {
+	l, data, err := UnmarshalLength(data)
+	if err != nil {
+		return nil, data, err
+	}
+	if err = checkCount(data, l, 80); err != nil {
+		return nil, data, err
+	}
 	v := make([]Header, l)
 	for i := 0; i < int(l); i++ {
-		v[i], data = UnmarshalHeader(data)
+		if v[i], data, err = UnmarshalHeader(data); err != nil {
+			return nil, data, err
+		}
 		if addZeros {
-			_, data = UnmarshalVarInt(data)
+			if _, data, err = UnmarshalVarInt(data); err != nil {
+				return nil, data, err
+			}
 			// maybe should check if _ if really 0
 		}
 	}
-	return v, data
+	return v, data, nil
 }
 
 type HeadersMessage struct {
@@ -537,11 +920,70 @@ func (msg HeadersMessage) Marshal(out []byte) []byte {
 	return MarshalHeaders(out, msg.Headers, true)
 }
 
-func (msg *HeadersMessage) Unmarshal(data []byte) []byte {
-	msg.Headers, data = UnmarshalHeaders(data, true)
-	return data
+func (msg *HeadersMessage) Unmarshal(data []byte) ([]byte, error) {
+	var err error
+	msg.Headers, data, err = UnmarshalHeaders(data, true)
+	return data, err
 }
 
 func (msg HeadersMessage) GetCommandString() string {
 	return "headers"
 }
+
+// ========================================================================
+
+// tx describes a bitcoin transaction, in reply to getdata. Transactions with
+// witness data are sent in the BIP144 format.
+
+type TxMessage struct {
+	Tx Tx
+}
+
+func (msg TxMessage) Marshal(out []byte) []byte {
+	return MarshalTx(out, msg.Tx)
+}
+
+func (msg *TxMessage) Unmarshal(data []byte) ([]byte, error) {
+	var err error
+	msg.Tx, data, err = UnmarshalTx(data)
+	return data, err
+}
+
+func (msg TxMessage) GetCommandString() string {
+	return "tx"
+}
+
+// ========================================================================
+
+// The block message is sent in response to a getdata message which requests
+// transaction information from a block hash. Blocks whose transactions do
+// not match the merkle root (or the witness commitment if they carry
+// witness data) are rejected when unmarshalling.
+
+type BlockMessage struct {
+	Block Block
+}
+
+func (msg BlockMessage) Marshal(out []byte) []byte {
+	return MarshalBlock(out, msg.Block)
+}
+
+func (msg *BlockMessage) Unmarshal(data []byte) ([]byte, error) {
+	var err error
+	if msg.Block, data, err = UnmarshalBlock(data); err != nil {
+		return data, err
+	}
+	if err = msg.Block.CheckMerkleRoot(); err != nil {
+		return data, err
+	}
+	for i := range msg.Block.Txs {
+		if msg.Block.Txs[i].HasWitness() {
+			return data, msg.Block.CheckWitnessCommitment()
+		}
+	}
+	return data, nil
+}
+
+func (msg BlockMessage) GetCommandString() string {
+	return "block"
+}
@@ -2,9 +2,12 @@ package network
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -13,10 +16,14 @@ func AsJSON(object interface{}) string {
 	return string(json)
 }
 
+// Magic numbers identifying the network (see ChainParams for the networks
+// themselves)
 const MAGIC_main uint32 = 0xD9B4BEF9
-const MAGIC_testnet uint32 = 0xDAB5BFFA
+const MAGIC_testnet uint32 = 0xDAB5BFFA // the original testnet, now used by regtest
 const MAGIC_testnet3 uint32 = 0x0709110B
+const MAGIC_testnet4 uint32 = 0x283F161C
 const MAGIC_signet uint32 = 0x40CF030A
+const MAGIC_regtest uint32 = MAGIC_testnet
 const MAGIC_namecoin uint32 = 0xFEB4BEF9
 
 // ======================================================================
@@ -33,10 +40,16 @@ func CreatePacket(magic uint32, command string, msg Message) Packet {
 }
 
 func MarshalPacket(out []byte, packet Packet) []byte {
+	return marshalPacket(out, packet, 0)
+}
+
+// marshalPacket marshals the packet with the message encoded for the
+// protocol version (0 for PROTOCOL_VERSION)
+func marshalPacket(out []byte, packet Packet, version uint32) []byte {
 	out = MarshalUint32(out, packet.Magic)
 	out = MarshalFixedStr(out, packet.Command, 12)
 
-	payload := packet.Message.Marshal([]byte{})
+	payload := marshalMessage([]byte{}, packet.Message, version)
 	out = MarshalUint32(out, uint32(len(payload)))
 	out = MarshalUint32(out, checksum(payload))
 	out = MarshalBytes(out, payload)
@@ -65,56 +78,208 @@ func hexPrinter(in []byte) {
 	}
 }
 
-func UnmarshalPacket(data []byte, expectedMagic uint32) (*Packet, []byte) {
+// UnmarshalPacket tries to unmarshal one packet from the beginning of data.
+// If data does not contain a complete packet yet, it returns a nil packet and
+// no error. If the packet is complete, but its message could not be
+// unmarshalled, the error is returned together with the data following the
+// packet, so that the caller can skip it. Errors in the packet header are
+// returned with the original data, as there is no way to tell where the next
+// packet starts.
+func UnmarshalPacket(data []byte, expectedMagic uint32) (*Packet, []byte, error) {
 	origData := data
 	if len(data) < 4+12+4+4 {
-		return nil, origData
+		return nil, origData, nil
 	}
 
+	// The header is complete, so unmarshalling it can't fail from here on
 	var packet Packet
-	packet.Magic, data = UnmarshalUint32(data)
+	packet.Magic, data, _ = UnmarshalUint32(data)
 	if expectedMagic != 0 && packet.Magic != expectedMagic {
 		fmt.Printf("Warning: Magic number mismatch (%x!=%x)'\n", expectedMagic, packet.Magic)
 		hexPrinter(origData)
 	}
 
-	packet.Command, data = UnmarshalFixedStr(data, 12)
+	packet.Command, data, _ = UnmarshalFixedStr(data, 12)
 
-	length, data := UnmarshalUint32(data)
-	expectedChecksum, data := UnmarshalUint32(data)
+	length, data, _ := UnmarshalUint32(data)
+	expectedChecksum, data, _ := UnmarshalUint32(data)
+	if length > MAX_SIZE {
+		return nil, origData, fmt.Errorf("packet '%s': %w: %d", packet.Command, ErrLengthTooLarge, length)
+	}
 
 	if len(data) < int(length) {
-		return nil, origData
+		return nil, origData, nil
 	}
-	payload, data := UnmarshalBytes(data, length)
+	payload, data, _ := UnmarshalBytes(data, length)
 
 	actualChecksum := checksum(payload)
 	if expectedChecksum != actualChecksum {
 		fmt.Printf("Warning: Checksums don't match (%x!=%x) in %v\n", expectedChecksum, actualChecksum, packet.Command)
 	}
 
-	message, payload := unmarshalMessage(packet.Command, payload)
+	message, payload, err := unmarshalMessage(packet.Command, payload, 0)
+	if err != nil {
+		return nil, data, err
+	}
 	packet.Message = message
 	if len(payload) > 0 {
 		fmt.Printf("Warning: payload in message '%v' not fully used.", packet.Command)
 	}
 
-	return &packet, data
+	return &packet, data, nil
+}
+
+// ======================================================================
+
+// Size of the packet header: magic, command, payload length and checksum
+const PACKET_HEADER_SIZE = 4 + 12 + 4 + 4
+
+// Maximum payload size PacketReader accepts by default (as
+// MAX_PROTOCOL_MESSAGE_LENGTH in bitcoin core)
+const MAX_PROTOCOL_MESSAGE_LENGTH = 4 * 1000 * 1000
+
+// Errors returned by PacketReader
+var (
+	ErrBadMagic       = errors.New("magic number mismatch")
+	ErrPacketChecksum = errors.New("checksum mismatch")
+)
+
+// PacketError is an error in a single packet: a checksum mismatch or a
+// message which could not be unmarshalled. The packet has been read
+// completely, so the stream can still be used.
+type PacketError struct {
+	Command string
+	Err     error
+}
+
+func (e *PacketError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PacketError) Unwrap() error {
+	return e.Err
+}
+
+// PacketReader reads packets from a stream, e.g. a TCP connection or a
+// recorded capture. It reads the header first and checks the payload
+// length against MaxPayloadSize before allocating the payload.
+//
+// Errors in a packet are returned as *PacketError, the next call reads the
+// following packet. After other errors (read errors, a wrong magic number
+// or a payload above the limit) the stream is out of sync and must not be
+// read any more. At the end of the stream io.EOF is returned, or
+// io.ErrUnexpectedEOF if it ends within a packet.
+type PacketReader struct {
+	MaxPayloadSize uint32
+	Version        uint32 // protocol version of the messages, 0 for PROTOCOL_VERSION
+
+	r      io.Reader
+	magic  uint32 // expected magic number, 0 accepts any
+	header [PACKET_HEADER_SIZE]byte
+}
+
+func NewPacketReader(r io.Reader, magic uint32) *PacketReader {
+	return &PacketReader{
+		MaxPayloadSize: MAX_PROTOCOL_MESSAGE_LENGTH,
+		r:              r,
+		magic:          magic,
+	}
+}
+
+// ReadPacket reads the next packet from the stream
+func (pr *PacketReader) ReadPacket() (Packet, error) {
+	if _, err := io.ReadFull(pr.r, pr.header[:]); err != nil {
+		return Packet{}, err
+	}
+
+	// The header is complete, so unmarshalling it can't fail from here on
+	var packet Packet
+	data := pr.header[:]
+	packet.Magic, data, _ = UnmarshalUint32(data)
+	packet.Command, data, _ = UnmarshalFixedStr(data, 12)
+	length, data, _ := UnmarshalUint32(data)
+	expectedChecksum, _, _ := UnmarshalUint32(data)
+	if pr.magic != 0 && packet.Magic != pr.magic {
+		return Packet{}, fmt.Errorf("%w: %08x != %08x", ErrBadMagic, packet.Magic, pr.magic)
+	}
+	if length > pr.MaxPayloadSize {
+		return Packet{}, fmt.Errorf("packet '%s': %w: %d > %d", packet.Command, ErrLengthTooLarge, length, pr.MaxPayloadSize)
+	}
+
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(pr.r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return Packet{}, err
+	}
+	if actualChecksum := checksum(payload); actualChecksum != expectedChecksum {
+		err := fmt.Errorf("packet '%s': %w: %08x != %08x", packet.Command, ErrPacketChecksum, actualChecksum, expectedChecksum)
+		return Packet{}, &PacketError{Command: packet.Command, Err: err}
+	}
+
+	message, payload, err := unmarshalMessage(packet.Command, payload, pr.Version)
+	if err != nil {
+		return Packet{}, &PacketError{Command: packet.Command, Err: err}
+	}
+	packet.Message = message
+	if len(payload) > 0 {
+		fmt.Printf("Warning: payload in message '%v' not fully used.\n", packet.Command)
+	}
+	return packet, nil
+}
+
+// PacketWriter writes packets to a stream. It is safe for concurrent use,
+// every packet is written with a single Write call.
+type PacketWriter struct {
+	Version uint32 // protocol version of the messages, 0 for PROTOCOL_VERSION
+
+	w      io.Writer
+	magic  uint32
+	mutex  sync.Mutex
+	buffer []byte
+}
+
+func NewPacketWriter(w io.Writer, magic uint32) *PacketWriter {
+	return &PacketWriter{w: w, magic: magic}
+}
+
+func (pw *PacketWriter) WritePacket(packet Packet) error {
+	pw.mutex.Lock()
+	defer pw.mutex.Unlock()
+	pw.buffer = marshalPacket(pw.buffer[:0], packet, pw.Version)
+	_, err := pw.w.Write(pw.buffer)
+	return err
+}
+
+// WriteMessage writes a packet with the message and the magic number of
+// the writer
+func (pw *PacketWriter) WriteMessage(message Message) error {
+	return pw.WritePacket(CreatePacket(pw.magic, message.GetCommandString(), message))
 }
 
 // ======================================================================
 
+// MessageConn is a connection to a peer messages are exchanged over (a
+// client or a Peer)
+type MessageConn interface {
+	SendMessage(message Message) error
+	ReceiveMessage() (*Message, string, error)
+}
+
 type client struct {
 	conn   net.Conn
 	magic  uint32
-	buffer []byte
+	reader *PacketReader
+	writer *PacketWriter
 }
 
 func Client(netConn net.Conn, magic uint32) client {
 	return client{
 		conn:   netConn,
 		magic:  magic,
-		buffer: []byte{},
+		reader: NewPacketReader(netConn, magic),
+		writer: NewPacketWriter(netConn, magic),
 	}
 }
 
@@ -122,74 +287,74 @@ func (cl *client) Close() error {
 	return cl.conn.Close()
 }
 
-func (cl *client) ReadPacket() Packet {
-	readBuf := make([]byte, 2048)
-	for {
-		// See whether we have a complete packet in our buffer
-		packet, buffer := UnmarshalPacket(cl.buffer, cl.magic)
-		if packet != nil {
-			cl.buffer = buffer
-			return *packet
-		}
-
-		// Otherwise keep on reading from the tcp stream
-		n, err := cl.conn.Read(readBuf)
-		if err != nil {
-			panic(err)
-		}
-		fmt.Printf("Read %d bytes...\n", n)
-		cl.buffer = append(cl.buffer, readBuf[:n]...)
+// ReadPacket reads the next packet from the connection. Broken packets are
+// dropped and the error (a *PacketError) is returned, so the caller may
+// just go on reading. After other errors the connection is closed.
+func (cl *client) ReadPacket() (Packet, error) {
+	packet, err := cl.reader.ReadPacket()
+	var packetErr *PacketError
+	if err != nil && !errors.As(err, &packetErr) {
+		cl.conn.Close()
 	}
+	return packet, err
 }
 
-func (cl *client) SendPacket(packet Packet) {
-	out := MarshalPacket(nil, packet)
-	_, err := cl.conn.Write(out)
-	if err != nil {
-		panic(err)
-	}
+func (cl *client) SendPacket(packet Packet) error {
+	return cl.writer.WritePacket(packet)
 }
 
-func (cl *client) SendMessage(message Message) {
+func (cl *client) SendMessage(message Message) error {
 	command := message.GetCommandString()
 	packet := CreatePacket(cl.magic, command, message)
 	fmt.Println("Sending: ", AsJSON(packet))
-	cl.SendPacket(packet)
+	return cl.SendPacket(packet)
 }
 
-func (cl *client) ReceiveMessage() (*Message, string) {
-	packet := cl.ReadPacket()
-	if cl.magic != packet.Magic {
-		fmt.Printf("Warning: magic bytes did not match: %x != %x\n", cl.magic, packet.Magic)
+func (cl *client) ReceiveMessage() (*Message, string, error) {
+	packet, err := cl.ReadPacket()
+	if err != nil {
+		return nil, "", err
 	}
-	return &packet.Message, packet.Command
+	return &packet.Message, packet.Command, nil
 }
 
 // ================================================================================================
-func GetPeerAddress(seed string, port, n int) net.TCPAddr {
-	ips, _ := net.LookupIP(seed)
-	return net.TCPAddr{IP: ips[n], Port: port, Zone: ""}
+// GetPeerAddress returns the n-th address the DNS seed resolves to
+func GetPeerAddress(seed string, port, n int) (net.TCPAddr, error) {
+	ips, err := net.LookupIP(seed)
+	if err != nil {
+		return net.TCPAddr{}, err
+	}
+	if n < 0 || n >= len(ips) {
+		return net.TCPAddr{}, fmt.Errorf("DNS seed %s returned %d addresses, wanted #%d", seed, len(ips), n)
+	}
+	return net.TCPAddr{IP: ips[n], Port: port, Zone: ""}, nil
 }
 
-func GetConnection(seed string, port int, n int) net.Conn {
-	tcp := GetPeerAddress(seed, port, n)
-	conn, err := net.DialTimeout("tcp", tcp.String(), time.Millisecond*2000)
+// GetConnection connects to the n-th address of the DNS seed
+func GetConnection(seed string, port int, n int) (net.Conn, error) {
+	tcp, err := GetPeerAddress(seed, port, n)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	// fmt.Println(conn, err)
-	return conn
+	return net.DialTimeout("tcp", tcp.String(), time.Millisecond*2000)
 }
 
 // ==============================================================================================
 
-func TestClient(n int) client {
-	// https://bitcoin.stackexchange.com/questions/49634/testnet-peers-list-with-ip-addresses
-	// dig A testnet-seed.bitcoin.jonasschnelli.ch
-
-	seed := "testnet-seed.bitcoin.jonasschnelli.ch"
-	port := 18333
+// SeedClient connects to the n-th address returned by the first DNS seed of
+// the network
+func SeedClient(params *ChainParams, n int) (client, error) {
+	if len(params.DNSSeeds) == 0 {
+		return client{}, fmt.Errorf("no DNS seeds for network '%s'", params.Name)
+	}
+	conn, err := GetConnection(params.DNSSeeds[0], params.DefaultPort, n)
+	if err != nil {
+		return client{}, err
+	}
+	return Client(conn, params.Magic), nil
+}
 
-	conn := GetConnection(seed, port, n)
-	return Client(conn, MAGIC_testnet3)
+func TestClient(n int) (client, error) {
+	return SeedClient(&TestNet3Params, n)
 }
@@ -0,0 +1,228 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+func TestMarshalPacket(t *testing.T) {
+	msg := &PingMessage{Nonce: 0x1234}
+	data := MarshalPacket([]byte{}, CreatePacket(MAGIC_main, msg.GetCommandString(), msg))
+	if len(data) != 24+8 {
+		t.Errorf(format_incorrect_length, len(data), 24+8, msg)
+	}
+
+	// Incomplete packets are no error, just nothing to return yet
+	packet, rest, err := UnmarshalPacket(data[:len(data)-1], MAGIC_main)
+	if packet != nil || err != nil || len(rest) != len(data)-1 {
+		t.Errorf("Incomplete packet should not be unmarshalled (%v, %v)", packet, err)
+	}
+
+	packet, rest, err = UnmarshalPacket(data, MAGIC_main)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(rest) > 0 {
+		t.Errorf(format_cosume_data, len(rest), msg)
+	}
+	if !reflect.DeepEqual(packet.Message, msg) {
+		t.Errorf(format_unmarshalled_match, packet.Message, msg)
+	}
+}
+
+func TestUnmarshalPacketErrors(t *testing.T) {
+	// A headers message announcing one header but containing only 10 bytes
+	// of it, followed by a valid ping
+	msg := &PingMessage{Nonce: 42}
+	payload := append([]byte{1}, make([]byte, 10)...)
+	data := MarshalUint32([]byte{}, MAGIC_main)
+	data = MarshalFixedStr(data, "headers", 12)
+	data = MarshalUint32(data, uint32(len(payload)))
+	data = MarshalUint32(data, checksum(payload))
+	data = MarshalBytes(data, payload)
+	data = MarshalPacket(data, CreatePacket(MAGIC_main, "ping", msg))
+
+	packet, rest, err := UnmarshalPacket(data, MAGIC_main)
+	if packet != nil || !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("Expected short buffer error, got (%v, %v)", packet, err)
+	}
+	packet, _, err = UnmarshalPacket(rest, MAGIC_main)
+	if err != nil || !reflect.DeepEqual(packet.Message, msg) {
+		t.Errorf("Packet after broken packet should be readable (%v, %v)", packet, err)
+	}
+
+	// Payload length beyond MAX_SIZE
+	header := MarshalUint32([]byte{}, MAGIC_main)
+	header = MarshalFixedStr(header, "block", 12)
+	header = MarshalUint32(header, MAX_SIZE+1)
+	header = MarshalUint32(header, 0)
+	packet, rest, err = UnmarshalPacket(header, MAGIC_main)
+	if packet != nil || !errors.Is(err, ErrLengthTooLarge) || len(rest) != len(header) {
+		t.Errorf("Expected length too large error, got (%v, %v)", packet, err)
+	}
+}
+
+func TestPacketReader(t *testing.T) {
+	var stream bytes.Buffer
+	writer := NewPacketWriter(&stream, MAGIC_main)
+	ping, pong := &PingMessage{Nonce: 42}, &PongMessage{Nonce: 42}
+	if err := writer.WriteMessage(ping); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// A broken headers message and a packet with a wrong checksum
+	payload := append([]byte{1}, make([]byte, 10)...)
+	stream.Write(MarshalPacket(nil, CreatePacket(MAGIC_main, "headers", &RawMessage{Command: "headers", Payload: payload})))
+	data := MarshalPacket(nil, CreatePacket(MAGIC_main, "pong", pong))
+	data[PACKET_HEADER_SIZE-1] ^= 1
+	stream.Write(data)
+	writer.WriteMessage(pong)
+
+	reader := NewPacketReader(&stream, MAGIC_main)
+	packet, err := reader.ReadPacket()
+	if err != nil || packet.Command != "ping" || !reflect.DeepEqual(packet.Message, ping) {
+		t.Errorf("Wrong packet %v (%v)", packet, err)
+	}
+	var packetErr *PacketError
+	if _, err = reader.ReadPacket(); !errors.As(err, &packetErr) || packetErr.Command != "headers" || !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("Expected short buffer error, got %v", err)
+	}
+	if _, err = reader.ReadPacket(); !errors.As(err, &packetErr) || !errors.Is(err, ErrPacketChecksum) {
+		t.Errorf("Expected checksum error, got %v", err)
+	}
+	packet, err = reader.ReadPacket()
+	if err != nil || !reflect.DeepEqual(packet.Message, pong) {
+		t.Errorf("Packet after broken packets should be readable (%v, %v)", packet, err)
+	}
+	if _, err = reader.ReadPacket(); err != io.EOF {
+		t.Errorf("Expected end of stream, got %v", err)
+	}
+
+	// End of stream within a packet
+	data = MarshalPacket(nil, CreatePacket(MAGIC_main, "ping", ping))
+	for _, n := range []int{PACKET_HEADER_SIZE - 1, len(data) - 1} {
+		reader = NewPacketReader(bytes.NewReader(data[:n]), MAGIC_main)
+		if _, err = reader.ReadPacket(); err != io.ErrUnexpectedEOF {
+			t.Errorf("Expected unexpected end of stream, got %v", err)
+		}
+	}
+}
+
+// failingReader fails the test when read from
+type failingReader struct {
+	t *testing.T
+}
+
+func (r failingReader) Read(p []byte) (int, error) {
+	r.t.Errorf("Payload read after header error")
+	return 0, io.EOF
+}
+
+func TestPacketReaderErrors(t *testing.T) {
+	header := MarshalUint32([]byte{}, MAGIC_main)
+	header = MarshalFixedStr(header, "block", 12)
+	header = MarshalUint32(header, MAX_PROTOCOL_MESSAGE_LENGTH+1)
+	header = MarshalUint32(header, 0)
+
+	reader := NewPacketReader(io.MultiReader(bytes.NewReader(header), failingReader{t}), MAGIC_main)
+	var packetErr *PacketError
+	if _, err := reader.ReadPacket(); !errors.Is(err, ErrLengthTooLarge) || errors.As(err, &packetErr) {
+		t.Errorf("Expected length too large error, got %v", err)
+	}
+	reader = NewPacketReader(io.MultiReader(bytes.NewReader(header), failingReader{t}), MAGIC_testnet3)
+	if _, err := reader.ReadPacket(); !errors.Is(err, ErrBadMagic) {
+		t.Errorf("Expected magic mismatch, got %v", err)
+	}
+
+	// Any magic number is accepted with 0
+	data := MarshalPacket(nil, CreatePacket(MAGIC_signet, "verack", &VerAckMessage{}))
+	reader = NewPacketReader(bytes.NewReader(data), 0)
+	if packet, err := reader.ReadPacket(); err != nil || packet.Magic != MAGIC_signet {
+		t.Errorf("Wrong packet %v (%v)", packet, err)
+	}
+}
+
+func TestGetDataPacket(t *testing.T) {
+	invs := []Inv{{MSG_WITNESS_BLOCK, s2h("01")}, {MSG_WTX, s2h("02")}}
+	for _, msg := range []Message{&GetDataMessage{Invs: invs}, &NotFoundMessage{Invs: invs}} {
+		data := MarshalPacket([]byte{}, CreatePacket(MAGIC_main, msg.GetCommandString(), msg))
+		packet, _, err := UnmarshalPacket(data, MAGIC_main)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if !reflect.DeepEqual(packet.Message, msg) {
+			t.Errorf(format_unmarshalled_match, packet.Message, msg)
+		}
+	}
+	if MSG_WITNESS_BLOCK != 0x40000002 || invs[0].String() != "witness-block "+s2h("01").RPCString() {
+		t.Errorf("Wrong inventory type %v", invs[0])
+	}
+}
+
+type feeFilterMessage struct {
+	FeeRate uint64
+}
+
+func (msg feeFilterMessage) Marshal(out []byte) []byte {
+	return MarshalUint64(out, msg.FeeRate)
+}
+
+func (msg *feeFilterMessage) Unmarshal(data []byte) ([]byte, error) {
+	var err error
+	msg.FeeRate, data, err = UnmarshalUint64(data)
+	return data, err
+}
+
+func (msg feeFilterMessage) GetCommandString() string {
+	return "feefilter"
+}
+
+func TestUnknownCommand(t *testing.T) {
+	msg := &RawMessage{Command: "sendcmpct", Payload: []byte{0, 1, 0, 0, 0, 0, 0, 0, 0}}
+	data := MarshalPacket([]byte{}, CreatePacket(MAGIC_main, msg.GetCommandString(), msg))
+	packet, rest, err := UnmarshalPacket(data, MAGIC_main)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(rest) > 0 {
+		t.Errorf(format_cosume_data, len(rest), msg)
+	}
+	if !reflect.DeepEqual(packet.Message, msg) {
+		t.Errorf(format_unmarshalled_match, packet.Message, msg)
+	}
+}
+
+func TestRegisterMessage(t *testing.T) {
+	msg := &feeFilterMessage{FeeRate: 1000}
+	data := MarshalPacket([]byte{}, CreatePacket(MAGIC_main, msg.GetCommandString(), msg))
+	packet, _, err := UnmarshalPacket(data, MAGIC_main)
+	if _, ok := packet.Message.(*RawMessage); err != nil || !ok {
+		t.Errorf("Unregistered command should give raw message (%v, %v)", packet, err)
+	}
+
+	RegisterMessage("feefilter", func() Message { return new(feeFilterMessage) })
+	defer func() {
+		messageTypesMutex.Lock()
+		delete(messageTypes, "feefilter")
+		messageTypesMutex.Unlock()
+	}()
+	packet, _, err = UnmarshalPacket(data, MAGIC_main)
+	if err != nil || !reflect.DeepEqual(packet.Message, msg) {
+		t.Errorf("Registered command should be unmarshalled (%v, %v)", packet, err)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Registering a type with wrong command should panic")
+		}
+	}()
+	RegisterMessage("fee", func() Message { return new(feeFilterMessage) })
+}
+
+func TestSeedClientNoSeeds(t *testing.T) {
+	if _, err := SeedClient(&RegTestParams, 0); err == nil {
+		t.Errorf("SeedClient for network without DNS seeds succeeded")
+	}
+}
@@ -0,0 +1,279 @@
+package network
+
+import (
+	"fmt"
+	"math/big"
+	"time"
+)
+
+// Checkpoint is a block hash known to be in the best chain at some height
+type Checkpoint struct {
+	Height int
+	Hash   Hash
+}
+
+// ChainParams holds everything that differs between the bitcoin networks
+type ChainParams struct {
+	Name          string // as in bitcoin core's -chain option
+	Magic         uint32
+	DefaultPort   int
+	DNSSeeds      []string
+	GenesisHeader Header
+	Checkpoints   []Checkpoint // in ascending order of height
+	Consensus     ConsensusParams
+
+	// Version bytes of base58 encoded data
+	PrivateKeyID     byte // WIF encoded private keys
+	PubKeyHashAddrID byte // P2PKH addresses
+	ScriptHashAddrID byte // P2SH addresses
+
+	Bech32HRP string // human readable part of segwit addresses
+}
+
+// Checkpoint returns the checkpoint at height (or nil if there is none)
+func (params *ChainParams) Checkpoint(height int) *Checkpoint {
+	for i := range params.Checkpoints {
+		if params.Checkpoints[i].Height == height {
+			return &params.Checkpoints[i]
+		}
+	}
+	return nil
+}
+
+// LastCheckpoint returns the checkpoint with the highest height (or nil if
+// there are no checkpoints)
+func (params *ChainParams) LastCheckpoint() *Checkpoint {
+	if len(params.Checkpoints) == 0 {
+		return nil
+	}
+	return &params.Checkpoints[len(params.Checkpoints)-1]
+}
+
+// ParamsByName returns the parameters for the network name, which is one of
+// "main", "test" (testnet3), "testnet4", "signet" or "regtest"
+func ParamsByName(name string) (*ChainParams, error) {
+	for _, params := range []*ChainParams{&MainNetParams, &TestNet3Params, &TestNet4Params, &SigNetParams, &RegTestParams} {
+		if params.Name == name {
+			return params, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown network '%s'", name)
+}
+
+func mustParseTarget(s string) *big.Int {
+	target, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic("Invalid target: " + s)
+	}
+	return target
+}
+
+func mustParseHash(s string) Hash {
+	hash, err := RPCStringToHash(s)
+	if err != nil {
+		panic(err)
+	}
+	return hash
+}
+
+// Merkle root of the genesis block (it contains only the coinbase with "The
+// Times 03/Jan/2009 Chancellor on brink of second bailout for banks"), which
+// all networks except testnet4 share
+var genesisMerkleRoot = mustParseHash("4a5e1e4baab89f3a32518a88c31bc87f618f76673e2cc77ab2127b7afdeda33b")
+
+var MainNetParams = ChainParams{
+	Name:        "main",
+	Magic:       MAGIC_main,
+	DefaultPort: 8333,
+	DNSSeeds: []string{
+		"seed.bitcoin.sipa.be",
+		"dnsseed.bluematt.me",
+		"seed.bitcoin.jonasschnelli.ch",
+		"seed.btc.petertodd.net",
+		"seed.bitcoin.sprovoost.nl",
+		"dnsseed.emzy.de",
+		"seed.bitcoin.wiz.biz",
+	},
+	GenesisHeader: Header{
+		Version:        1,
+		MerkleRootHash: genesisMerkleRoot,
+		Timestamp:      time.Unix(1231006505, 0),
+		Bits:           0x1d00ffff,
+		Nonce:          2083236893,
+	},
+	Checkpoints: []Checkpoint{
+		{11111, mustParseHash("0000000069e244f73d78e8fd29ba2fd2ed618bd6fa2ee92559f542fdb26e7c1d")},
+		{33333, mustParseHash("000000002dd5588a74784eaa7ab0507a18ad16a236e7b1ce69f00d7ddfb5d0a6")},
+		{74000, mustParseHash("0000000000573993a3c9e41ce34471c079dcf5f52a0e824a81e7f953b8661a20")},
+		{105000, mustParseHash("00000000000291ce28027faea320c8d2b054b2e0fe44a773f3eefb151d6bdc97")},
+		{134444, mustParseHash("00000000000005b12ffd4cd315cd34ffd4a594f430ac814c91184a0d42d2b0fe")},
+		{168000, mustParseHash("000000000000099e61ea72015e79632f216fe6cb33d7899acb35b75c8303b763")},
+		{193000, mustParseHash("000000000000059f452a5f7340de6682a977387c17010ff6e6c3bd83ca8b1317")},
+		{210000, mustParseHash("000000000000048b95347e83192f69cf0366076336c639f9b7228e9ba171342e")},
+		{216116, mustParseHash("00000000000001b4f4b433e81ee46494af945cf96014816a4e2370f11b23df4e")},
+		{225430, mustParseHash("00000000000001c108384350f74090433e7fcf79a606b8e797f065b130575932")},
+		{250000, mustParseHash("000000000000003887df1f29024b06fc2200b55f8af8f35453d7be294df2d214")},
+		{279000, mustParseHash("0000000000000001ae8c72a0b0c301f67e3afca10e819efa9041e458e9bd7e40")},
+		{295000, mustParseHash("00000000000000004d9b4ef50f0f9d686fd69db2e03af35a100370c64632a983")},
+	},
+	Consensus: ConsensusParams{
+		PowLimit:               mustParseTarget("00000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffff"),
+		PowTargetTimespan:      14 * 24 * time.Hour,
+		PowTargetSpacing:       10 * time.Minute,
+		BIP34Height:            227931,
+		BIP66Height:            363725,
+		BIP65Height:            388381,
+		CSVHeight:              419328,
+		SegwitHeight:           481824,
+		SubsidyHalvingInterval: 210000,
+		ScriptFlagExceptions: map[Hash]ScriptFlags{
+			// BIP16 exception (block 170060)
+			mustParseHash("00000000000002dc756eebf4f49723ed8d30cc28a5f108eb94b1ba88ac4f9c22"): SCRIPT_VERIFY_NONE,
+			// Taproot exception (block 692261)
+			mustParseHash("0000000000000000000f14c35b2d841e986ab5441de8c585d85ffe2f0286a8ce"): SCRIPT_VERIFY_P2SH | SCRIPT_VERIFY_WITNESS,
+		},
+	},
+	PrivateKeyID:     0x80,
+	PubKeyHashAddrID: 0x00,
+	ScriptHashAddrID: 0x05,
+	Bech32HRP:        "bc",
+}
+
+var TestNet3Params = ChainParams{
+	Name:        "test",
+	Magic:       MAGIC_testnet3,
+	DefaultPort: 18333,
+	DNSSeeds: []string{
+		// https://bitcoin.stackexchange.com/questions/49634/testnet-peers-list-with-ip-addresses
+		"testnet-seed.bitcoin.jonasschnelli.ch",
+		"seed.tbtc.petertodd.net",
+		"seed.testnet.bitcoin.sprovoost.nl",
+		"testnet-seed.bluematt.me",
+	},
+	GenesisHeader: Header{
+		Version:        1,
+		MerkleRootHash: genesisMerkleRoot,
+		Timestamp:      time.Unix(1296688602, 0),
+		Bits:           0x1d00ffff,
+		Nonce:          414098458,
+	},
+	Checkpoints: []Checkpoint{
+		{546, mustParseHash("000000002a936ca763904c3c35fce2f3556c559c0214345d31b1bcebf76acb70")},
+	},
+	Consensus: ConsensusParams{
+		PowLimit:                    mustParseTarget("00000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffff"),
+		PowTargetTimespan:           14 * 24 * time.Hour,
+		PowTargetSpacing:            10 * time.Minute,
+		PowAllowMinDifficultyBlocks: true,
+		BIP34Height:                 21111,
+		BIP66Height:                 330776,
+		BIP65Height:                 581885,
+		CSVHeight:                   770112,
+		SegwitHeight:                834624,
+		SubsidyHalvingInterval:      210000,
+		ScriptFlagExceptions: map[Hash]ScriptFlags{
+			// BIP16 exception
+			mustParseHash("00000000dd30457c001f4095d208cc1296b0eed002427aa599874af7a432b105"): SCRIPT_VERIFY_NONE,
+		},
+	},
+	PrivateKeyID:     0xef,
+	PubKeyHashAddrID: 0x6f,
+	ScriptHashAddrID: 0xc4,
+	Bech32HRP:        "tb",
+}
+
+var TestNet4Params = ChainParams{
+	Name:        "testnet4",
+	Magic:       MAGIC_testnet4,
+	DefaultPort: 48333,
+	DNSSeeds: []string{
+		"seed.testnet4.bitcoin.sprovoost.nl",
+		"seed.testnet4.wiz.biz",
+	},
+	GenesisHeader: Header{
+		Version:        1,
+		MerkleRootHash: mustParseHash("7aa0a7ae1e223414cb807e40cd57e667b718e42aaf9306db9102fe28912b7b4e"),
+		Timestamp:      time.Unix(1714777860, 0),
+		Bits:           0x1d00ffff,
+		Nonce:          393743547,
+	},
+	Consensus: ConsensusParams{
+		PowLimit:                    mustParseTarget("00000000ffffffffffffffffffffffffffffffffffffffffffffffffffffffff"),
+		PowTargetTimespan:           14 * 24 * time.Hour,
+		PowTargetSpacing:            10 * time.Minute,
+		PowAllowMinDifficultyBlocks: true,
+		EnforceBIP94:                true,
+		BIP34Height:                 1,
+		BIP66Height:                 1,
+		BIP65Height:                 1,
+		CSVHeight:                   1,
+		SegwitHeight:                1,
+		SubsidyHalvingInterval:      210000,
+	},
+	PrivateKeyID:     0xef,
+	PubKeyHashAddrID: 0x6f,
+	ScriptHashAddrID: 0xc4,
+	Bech32HRP:        "tb",
+}
+
+var SigNetParams = ChainParams{
+	Name:        "signet",
+	Magic:       MAGIC_signet,
+	DefaultPort: 38333,
+	DNSSeeds: []string{
+		"seed.signet.bitcoin.sprovoost.nl",
+	},
+	GenesisHeader: Header{
+		Version:        1,
+		MerkleRootHash: genesisMerkleRoot,
+		Timestamp:      time.Unix(1598918400, 0),
+		Bits:           0x1e0377ae,
+		Nonce:          52613770,
+	},
+	Consensus: ConsensusParams{
+		PowLimit:               mustParseTarget("00000377ae000000000000000000000000000000000000000000000000000000"),
+		PowTargetTimespan:      14 * 24 * time.Hour,
+		PowTargetSpacing:       10 * time.Minute,
+		BIP34Height:            1,
+		BIP66Height:            1,
+		BIP65Height:            1,
+		CSVHeight:              1,
+		SegwitHeight:           1,
+		SubsidyHalvingInterval: 210000,
+	},
+	PrivateKeyID:     0xef,
+	PubKeyHashAddrID: 0x6f,
+	ScriptHashAddrID: 0xc4,
+	Bech32HRP:        "tb",
+}
+
+var RegTestParams = ChainParams{
+	Name:        "regtest",
+	Magic:       MAGIC_regtest,
+	DefaultPort: 18444,
+	DNSSeeds:    []string{},
+	GenesisHeader: Header{
+		Version:        1,
+		MerkleRootHash: genesisMerkleRoot,
+		Timestamp:      time.Unix(1296688602, 0),
+		Bits:           0x207fffff,
+		Nonce:          2,
+	},
+	Consensus: ConsensusParams{
+		PowLimit:                    mustParseTarget("7fffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff"),
+		PowTargetTimespan:           14 * 24 * time.Hour,
+		PowTargetSpacing:            10 * time.Minute,
+		PowAllowMinDifficultyBlocks: true,
+		PowNoRetargeting:            true,
+		BIP34Height:                 1,
+		BIP66Height:                 1,
+		BIP65Height:                 1,
+		CSVHeight:                   1,
+		SegwitHeight:                0,
+		SubsidyHalvingInterval:      150,
+	},
+	PrivateKeyID:     0xef,
+	PubKeyHashAddrID: 0x6f,
+	ScriptHashAddrID: 0xc4,
+	Bech32HRP:        "bcrt",
+}
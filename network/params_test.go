@@ -0,0 +1,48 @@
+package network
+
+import (
+	"testing"
+)
+
+func TestGenesisHeaders(t *testing.T) {
+	// Hashes as given in bitcoin core's chainparams.cpp
+	genesisHashes := map[string]string{
+		"main":     "000000000019d6689c085ae165831e934ff763ae46a2a6c172b3f1b60a8ce26f",
+		"test":     "000000000933ea01ad0ee984209779baaec3ced90fa3f408719526f8d77f4943",
+		"testnet4": "00000000da84f2bafbbc53dee25a72ae507ff4914b867c565be350b0da8bf043",
+		"signet":   "00000008819873e925422c1ff0f99f7cc9bbb232af63a077a480a3633bee1ef6",
+		"regtest":  "0f9188f13cb7b2c71f2a335e3a4fc328bf5beb436012afca590b1a11466e2206",
+	}
+	for name, expected := range genesisHashes {
+		params, err := ParamsByName(name)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		hash := params.GenesisHeader.Hash()
+		if hash != rs2h(expected) {
+			t.Errorf("Wrong genesis hash for %s (\n%v (actual) != \n%v (expected))", name, hash.RPCString(), expected)
+		}
+		if err := CheckHeader(params.GenesisHeader, &params.Consensus); err != nil {
+			t.Errorf("Genesis header of %s is invalid: %v", name, err)
+		}
+	}
+	if _, err := ParamsByName("namecoin"); err == nil {
+		t.Errorf("Unknown network should give an error")
+	}
+}
+
+func TestCheckpoints(t *testing.T) {
+	params := &MainNetParams
+	if cp := params.Checkpoint(11111); cp == nil || cp.Hash != rs2h("0000000069e244f73d78e8fd29ba2fd2ed618bd6fa2ee92559f542fdb26e7c1d") {
+		t.Errorf("Wrong checkpoint at height 11111: %v", cp)
+	}
+	if cp := params.Checkpoint(11112); cp != nil {
+		t.Errorf("There should be no checkpoint at height 11112: %v", cp)
+	}
+	if cp := params.LastCheckpoint(); cp == nil || cp.Height != 295000 {
+		t.Errorf("Wrong last checkpoint: %v", cp)
+	}
+	if cp := RegTestParams.LastCheckpoint(); cp != nil {
+		t.Errorf("Regtest should not have checkpoints: %v", cp)
+	}
+}
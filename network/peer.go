@@ -0,0 +1,433 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// Peer connections
+//=================
+
+const (
+	HANDSHAKE_TIMEOUT = 60 * time.Second // default time allowed for the version handshake
+	PING_INTERVAL     = 2 * time.Minute  // time between pings
+	PING_TIMEOUT      = 20 * time.Minute // time to wait for a pong before disconnecting
+)
+
+var (
+	ErrObsoleteVersion  = errors.New("obsolete version")
+	ErrSelfConnection   = errors.New("connected to self")
+	ErrHandshakeTimeout = errors.New("handshake timeout")
+	ErrHandshake        = errors.New("handshake failed")
+	ErrPingTimeout      = errors.New("ping timeout")
+)
+
+// NonceSet holds the nonces of the version messages we sent on outbound
+// connections that are still in the handshake. An inbound connection whose
+// version carries one of them is a connection to ourselves. All peers of a
+// node must share the same set. It is safe for concurrent use.
+type NonceSet struct {
+	mutex  sync.Mutex
+	nonces map[uint64]bool
+}
+
+func NewNonceSet() *NonceSet {
+	return &NonceSet{nonces: make(map[uint64]bool)}
+}
+
+var defaultNonces = NewNonceSet()
+
+// new returns a fresh nonzero nonce and adds it to the set
+func (set *NonceSet) new() uint64 {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	for {
+		nonce := rand.Uint64()
+		if nonce != 0 && !set.nonces[nonce] {
+			set.nonces[nonce] = true
+			return nonce
+		}
+	}
+}
+
+func (set *NonceSet) remove(nonce uint64) {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	delete(set.nonces, nonce)
+}
+
+func (set *NonceSet) has(nonce uint64) bool {
+	set.mutex.Lock()
+	defer set.mutex.Unlock()
+	return set.nonces[nonce]
+}
+
+// PeerConfig describes the local node to its peers
+type PeerConfig struct {
+	Magic            uint32
+	Version          uint32 // protocol version we offer
+	MinVersion       uint32 // peers with older versions are disconnected
+	Services         uint64
+	UserAgent        string
+	StartHeight      uint32
+	Relay            bool // whether we want transactions announced
+	HandshakeTimeout time.Duration
+	Nonces           *NonceSet
+}
+
+// NewPeerConfig returns the default configuration for a network
+func NewPeerConfig(params *ChainParams) *PeerConfig {
+	return &PeerConfig{
+		Magic:            params.Magic,
+		Version:          PROTOCOL_VERSION,
+		MinVersion:       MIN_PEER_PROTO_VERSION,
+		UserAgent:        DEFAULT_USER_AGENT,
+		HandshakeTimeout: HANDSHAKE_TIMEOUT,
+		Nonces:           defaultNonces,
+	}
+}
+
+// Peer is a connection to another node. Handshake must be called before
+// anything else; it exchanges version and verack and fills in what the
+// remote node told about itself. Messages are then encoded for the
+// negotiated protocol version, the lower of both sides.
+type Peer struct {
+	client
+	config  *PeerConfig
+	Inbound bool
+
+	// Set by the handshake
+	Version     uint32 // negotiated protocol version
+	Services    uint64
+	UserAgent   string
+	StartHeight uint32
+	Relay       bool
+	TimeOffset  time.Duration // remote clock minus ours
+	LocalAddr   NetAddr       // our address as seen by the peer
+
+	pending []Packet // received after the version but before the verack
+
+	getAddrAnswered bool // only the first getaddr is answered
+
+	mutex     sync.Mutex
+	pingNonce uint64    // nonce of the ping in flight, 0 if none
+	pingSent  time.Time // time the last ping was sent
+	latency   time.Duration
+	minPing   time.Duration
+	err       error // reason for disconnecting the peer
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func NewPeer(conn net.Conn, config *PeerConfig, inbound bool) *Peer {
+	return &Peer{
+		client:  Client(conn, config.Magic),
+		config:  config,
+		Inbound: inbound,
+		done:    make(chan struct{}),
+	}
+}
+
+// DialPeer connects to address and runs the handshake
+func DialPeer(address string, config *PeerConfig) (*Peer, error) {
+	conn, err := net.DialTimeout("tcp", address, config.HandshakeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	peer := NewPeer(conn, config, false)
+	if err = peer.Handshake(); err != nil {
+		return nil, err
+	}
+	return peer, nil
+}
+
+func (p *Peer) Addr() string {
+	return p.conn.RemoteAddr().String()
+}
+
+func (p *Peer) String() string {
+	return fmt.Sprintf("%s (version %d, %q)", p.Addr(), p.Version, p.UserAgent)
+}
+
+// Handshake exchanges version and verack messages. An outbound peer sends
+// its version first, an inbound peer answers the remote one. The connection
+// is closed if the handshake fails or does not finish within the
+// HandshakeTimeout.
+func (p *Peer) Handshake() error {
+	p.conn.SetDeadline(time.Now().Add(p.config.HandshakeTimeout))
+	err := p.handshake()
+	if err != nil {
+		p.disconnect(nil)
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			return fmt.Errorf("%w with %s: %v", ErrHandshakeTimeout, p.Addr(), err)
+		}
+		return err
+	}
+	return p.conn.SetDeadline(time.Time{})
+}
+
+func (p *Peer) handshake() error {
+	if !p.Inbound {
+		nonce := p.config.Nonces.new()
+		defer p.config.Nonces.remove(nonce)
+		if err := p.sendVersion(nonce); err != nil {
+			return err
+		}
+	}
+	gotVersion, gotVerack := false, false
+	for !gotVersion || !gotVerack {
+		packet, err := p.client.ReadPacket()
+		if err != nil {
+			return err
+		}
+		switch msg := packet.Message.(type) {
+		case *VersionMessage:
+			if gotVersion {
+				return fmt.Errorf("%w: duplicate version message from %s", ErrHandshake, p.Addr())
+			}
+			if err = p.handleVersion(msg); err != nil {
+				return err
+			}
+			gotVersion = true
+		case *VerAckMessage:
+			if !gotVersion {
+				return fmt.Errorf("%w: verack before version from %s", ErrHandshake, p.Addr())
+			}
+			gotVerack = true
+		default:
+			// Like Core, ignore anything before the version. Messages
+			// between version and verack (e.g. sendheaders, wtxidrelay)
+			// are kept for the caller.
+			if gotVersion {
+				p.pending = append(p.pending, packet)
+			}
+		}
+	}
+	return nil
+}
+
+func (p *Peer) sendVersion(nonce uint64) error {
+	remote := NetAddr{IPAddr: net.IPv6zero}
+	if addr, ok := p.conn.RemoteAddr().(*net.TCPAddr); ok {
+		remote = NetAddr{Services: p.Services, IPAddr: addr.IP.To16(), Port: uint16(addr.Port)}
+	}
+	return p.SendMessage(&VersionMessage{
+		Version:      p.config.Version,
+		Services:     p.config.Services,
+		Timestamp:    time.Now().Truncate(time.Second),
+		ReceiverAddr: remote,
+		FromAddr:     NetAddr{Services: p.config.Services, IPAddr: net.IPv6zero},
+		Nonce:        nonce,
+		UserAgent:    p.config.UserAgent,
+		StartHeight:  p.config.StartHeight,
+		Relay:        p.config.Relay,
+	})
+}
+
+func (p *Peer) handleVersion(msg *VersionMessage) error {
+	if msg.Version < p.config.MinVersion {
+		p.SendMessage(&RejectMessage{
+			Message: msg.GetCommandString(),
+			CCode:   REJECT_OBSOLETE,
+			Reason:  fmt.Sprintf("Version must be %d or greater", p.config.MinVersion),
+		})
+		return fmt.Errorf("%w: %s uses version %d", ErrObsoleteVersion, p.Addr(), msg.Version)
+	}
+	if p.Inbound && p.config.Nonces.has(msg.Nonce) {
+		return fmt.Errorf("%w: %s", ErrSelfConnection, p.Addr())
+	}
+	p.Services = msg.Services
+	p.UserAgent = msg.UserAgent
+	p.StartHeight = msg.StartHeight
+	p.Relay = msg.Version < 70001 || msg.Relay
+	p.TimeOffset = time.Until(msg.Timestamp)
+	p.LocalAddr = msg.ReceiverAddr
+	p.Version = p.config.Version
+	if msg.Version < p.Version {
+		p.Version = msg.Version
+	}
+
+	if p.Inbound {
+		if err := p.sendVersion(rand.Uint64()); err != nil {
+			return err
+		}
+	}
+	p.reader.Version = p.Version
+	p.writer.Version = p.Version
+	return p.SendMessage(&VerAckMessage{})
+}
+
+// Close disconnects the peer
+func (p *Peer) Close() error {
+	return p.disconnect(nil)
+}
+
+func (p *Peer) disconnect(reason error) error {
+	var err error
+	p.closeOnce.Do(func() {
+		p.mutex.Lock()
+		p.err = reason
+		p.mutex.Unlock()
+		close(p.done)
+		err = p.conn.Close()
+	})
+	return err
+}
+
+// ReadPacket returns the messages received during the handshake first.
+// Pings are answered and pongs are consumed, neither is returned. If the
+// peer was disconnected for a reason (e.g. ErrPingTimeout) that is returned
+// instead of the error from the closed connection.
+func (p *Peer) ReadPacket() (Packet, error) {
+	for {
+		var packet Packet
+		if len(p.pending) > 0 {
+			packet = p.pending[0]
+			p.pending = p.pending[1:]
+		} else {
+			var err error
+			if packet, err = p.client.ReadPacket(); err != nil {
+				p.mutex.Lock()
+				reason := p.err
+				p.mutex.Unlock()
+				if reason != nil {
+					return packet, reason
+				}
+				return packet, err
+			}
+		}
+		switch msg := packet.Message.(type) {
+		case *PingMessage:
+			if p.Version > BIP0031_VERSION {
+				if err := p.SendMessage(&PongMessage{Nonce: msg.Nonce}); err != nil {
+					return Packet{}, err
+				}
+			}
+		case *PongMessage:
+			p.handlePong(msg.Nonce)
+		default:
+			return packet, nil
+		}
+	}
+}
+
+func (p *Peer) ReceiveMessage() (*Message, string, error) {
+	packet, err := p.ReadPacket()
+	if err != nil {
+		return nil, "", err
+	}
+	return &packet.Message, packet.Command, nil
+}
+
+// SendMessage writes the message without logging it, unlike the client it
+// embeds: peers send far too many messages for that
+func (p *Peer) SendMessage(message Message) error {
+	return p.writer.WriteMessage(message)
+}
+
+// Keepalive
+//==========
+
+// Ping sends a ping unless one is in flight. Peers up to BIP0031_VERSION
+// do not answer pings, so no latency is measured for them.
+func (p *Peer) Ping() error {
+	p.mutex.Lock()
+	if p.pingNonce != 0 {
+		p.mutex.Unlock()
+		return nil
+	}
+	var nonce uint64
+	if p.Version > BIP0031_VERSION {
+		for nonce == 0 {
+			nonce = rand.Uint64()
+		}
+	}
+	p.pingNonce = nonce
+	p.pingSent = time.Now()
+	p.mutex.Unlock()
+	return p.SendMessage(&PingMessage{Nonce: nonce})
+}
+
+func (p *Peer) handlePong(nonce uint64) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.pingNonce == 0 {
+		return
+	}
+	switch nonce {
+	case p.pingNonce:
+		p.latency = time.Since(p.pingSent)
+		if p.minPing == 0 || p.latency < p.minPing {
+			p.minPing = p.latency
+		}
+		p.pingNonce = 0
+	case 0:
+		// Like Core, a zero nonce cancels the ping
+		p.pingNonce = 0
+	}
+}
+
+// KeepAlive pings the peer every interval until it is closed. A peer that
+// does not answer a ping within timeout is disconnected with
+// ErrPingTimeout. Pongs are only seen while someone reads from the peer.
+func (p *Peer) KeepAlive(interval, timeout time.Duration) {
+	tick := interval
+	if timeout < tick {
+		tick = timeout
+	}
+	ticker := time.NewTicker(tick / 4)
+	go func() {
+		defer ticker.Stop()
+		if p.Ping() != nil {
+			return
+		}
+		for {
+			select {
+			case <-p.done:
+				return
+			case now := <-ticker.C:
+				p.mutex.Lock()
+				waiting, sent := p.pingNonce != 0, p.pingSent
+				p.mutex.Unlock()
+				if waiting && now.Sub(sent) > timeout {
+					p.disconnect(fmt.Errorf("%w: no pong from %s within %v", ErrPingTimeout, p.Addr(), timeout))
+					return
+				}
+				if !waiting && now.Sub(sent) >= interval && p.Ping() != nil {
+					return
+				}
+			}
+		}
+	}()
+}
+
+// Latency returns the round-trip time of the last answered ping, 0 if
+// there was none
+func (p *Peer) Latency() time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.latency
+}
+
+// MinPing returns the lowest round-trip time measured
+func (p *Peer) MinPing() time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.minPing
+}
+
+// PingWait returns how long the ping in flight has been waiting for a
+// pong, 0 if there is none
+func (p *Peer) PingWait() time.Duration {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.pingNonce == 0 {
+		return 0
+	}
+	return time.Since(p.pingSent)
+}
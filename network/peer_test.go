@@ -0,0 +1,258 @@
+package network
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tcpPair returns both ends of a loopback TCP connection. net.Pipe is not
+// buffered, so both sides sending at once would block.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn)
+	go func() {
+		conn, _ := listener.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	remote := <-accepted
+	if remote == nil {
+		t.Fatalf("Accept failed")
+	}
+	return conn, remote
+}
+
+func testPeerConfig(version uint32, nonces *NonceSet) *PeerConfig {
+	config := NewPeerConfig(&RegTestParams)
+	config.Version = version
+	config.HandshakeTimeout = 5 * time.Second
+	config.Nonces = nonces
+	return config
+}
+
+// handshakePeers runs the handshake between an outbound and an inbound peer
+func handshakePeers(t *testing.T, outConfig, inConfig *PeerConfig) (*Peer, *Peer, error, error) {
+	conn, remote := tcpPair(t)
+	out := NewPeer(conn, outConfig, false)
+	in := NewPeer(remote, inConfig, true)
+	done := make(chan error)
+	go func() {
+		done <- in.Handshake()
+	}()
+	outErr := out.Handshake()
+	return out, in, outErr, <-done
+}
+
+func TestPeerHandshake(t *testing.T) {
+	outConfig := testPeerConfig(PROTOCOL_VERSION, NewNonceSet())
+	outConfig.Services = NODE_WITNESS
+	outConfig.StartHeight = 100
+	inConfig := testPeerConfig(70012, NewNonceSet())
+	inConfig.Services = NODE_NETWORK
+	inConfig.UserAgent = "/test:1.0/"
+	inConfig.StartHeight = 200
+	inConfig.Relay = true
+
+	out, in, outErr, inErr := handshakePeers(t, outConfig, inConfig)
+	if outErr != nil || inErr != nil {
+		t.Fatalf("Handshake failed: %v, %v", outErr, inErr)
+	}
+	defer out.Close()
+	defer in.Close()
+	if out.Version != 70012 || in.Version != 70012 {
+		t.Errorf("Negotiated versions %d and %d, expected 70012", out.Version, in.Version)
+	}
+	if out.Services != NODE_NETWORK || out.UserAgent != "/test:1.0/" || out.StartHeight != 200 || !out.Relay {
+		t.Errorf("Wrong remote info on outbound peer: %x %q %d %v", out.Services, out.UserAgent, out.StartHeight, out.Relay)
+	}
+	if in.Services != NODE_WITNESS || in.UserAgent != DEFAULT_USER_AGENT || in.StartHeight != 100 || in.Relay {
+		t.Errorf("Wrong remote info on inbound peer: %x %q %d %v", in.Services, in.UserAgent, in.StartHeight, in.Relay)
+	}
+	if len(outConfig.Nonces.nonces) != 0 {
+		t.Errorf("Nonce not removed after the handshake")
+	}
+
+	// Messages still flow after the handshake
+	out.SendMessage(&RejectMessage{Message: "tx", CCode: REJECT_INVALID, Reason: "test"})
+	msg, command, err := in.ReceiveMessage()
+	if err != nil || command != "reject" || (*msg).(*RejectMessage).Reason != "test" {
+		t.Errorf("Got %s %v, expected reject", command, err)
+	}
+}
+
+func TestPeerHandshakeErrors(t *testing.T) {
+	// Obsolete version
+	outConfig := testPeerConfig(60000, NewNonceSet())
+	inConfig := testPeerConfig(PROTOCOL_VERSION, NewNonceSet())
+	inConfig.MinVersion = 70001
+	_, _, outErr, inErr := handshakePeers(t, outConfig, inConfig)
+	if !errors.Is(inErr, ErrObsoleteVersion) {
+		t.Errorf("Got %v, expected %v", inErr, ErrObsoleteVersion)
+	}
+	if outErr == nil {
+		t.Errorf("Outbound handshake with disconnecting peer succeeded")
+	}
+
+	// Connection to ourselves
+	nonces := NewNonceSet()
+	_, _, outErr, inErr = handshakePeers(t, testPeerConfig(PROTOCOL_VERSION, nonces), testPeerConfig(PROTOCOL_VERSION, nonces))
+	if !errors.Is(inErr, ErrSelfConnection) {
+		t.Errorf("Got %v, expected %v", inErr, ErrSelfConnection)
+	}
+	if outErr == nil {
+		t.Errorf("Outbound handshake with self succeeded")
+	}
+
+	// Silent remote
+	conn, remote := tcpPair(t)
+	defer remote.Close()
+	config := testPeerConfig(PROTOCOL_VERSION, NewNonceSet())
+	config.HandshakeTimeout = 50 * time.Millisecond
+	if err := NewPeer(conn, config, false).Handshake(); !errors.Is(err, ErrHandshakeTimeout) {
+		t.Errorf("Got %v, expected %v", err, ErrHandshakeTimeout)
+	}
+
+	// Verack before version
+	conn, remote = tcpPair(t)
+	defer remote.Close()
+	raw := Client(remote, RegTestParams.Magic)
+	raw.SendMessage(&VerAckMessage{})
+	err := NewPeer(conn, testPeerConfig(PROTOCOL_VERSION, NewNonceSet()), true).Handshake()
+	if !errors.Is(err, ErrHandshake) {
+		t.Errorf("Got %v, expected %v", err, ErrHandshake)
+	}
+}
+
+func TestPeerVersionedMessages(t *testing.T) {
+	conn, remote := tcpPair(t)
+	defer remote.Close()
+	raw := Client(remote, RegTestParams.Magic)
+	config := testPeerConfig(PROTOCOL_VERSION, NewNonceSet())
+	config.MinVersion = 209
+	peer := NewPeer(conn, config, true)
+	defer peer.Close()
+
+	// An old node that sends a message between version and verack
+	version := NewVersionMessage()
+	version.Version = 209
+	raw.SendMessage(version)
+	raw.SendMessage(&SendHeadersMessage{})
+	raw.SendMessage(&VerAckMessage{})
+	if err := peer.Handshake(); err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	if peer.Version != 209 {
+		t.Fatalf("Negotiated version %d, expected 209", peer.Version)
+	}
+	for _, command := range []string{"version", "verack"} {
+		if _, got, err := raw.ReceiveMessage(); err != nil || got != command {
+			t.Fatalf("Got %s %v, expected %s", got, err, command)
+		}
+	}
+	if _, command, err := peer.ReceiveMessage(); err != nil || command != "sendheaders" {
+		t.Errorf("Got %s %v, expected the pending sendheaders", command, err)
+	}
+
+	// No ping nonce and no addr timestamps at version 209
+	addr := TimeNetAddr{time.Unix(1600000000, 0), NetAddr{NODE_NETWORK, net.IPv4(10, 0, 0, 1), 8333}}
+	peer.SendMessage(&PingMessage{Nonce: 42})
+	peer.SendMessage(&AddrMessage{AddrList: []TimeNetAddr{addr}})
+	command, payload := readRawPacket(t, remote)
+	if command != "ping" || len(payload) != 0 {
+		t.Errorf("Got %s with payload %x, expected ping without nonce", command, payload)
+	}
+	command, payload = readRawPacket(t, remote)
+	if command != "addr" || len(payload) != 1+26 {
+		t.Fatalf("Got %s of length %d, expected addr of length %d", command, len(payload), 1+26)
+	}
+	var msg AddrMessage
+	if _, err := msg.UnmarshalVersion(payload, 209); err != nil {
+		t.Fatalf("Unmarshal failed: %v", err)
+	}
+	got := msg.AddrList
+	if len(got) != 1 || !got[0].IPAddr.Equal(addr.IPAddr) || got[0].Port != addr.Port {
+		t.Errorf("Got %v, expected %v", got, addr.NetAddr)
+	}
+}
+
+func readRawPacket(t *testing.T, conn net.Conn) (string, []byte) {
+	header := make([]byte, PACKET_HEADER_SIZE)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		t.Fatalf("Reading header failed: %v", err)
+	}
+	payload := make([]byte, binary.LittleEndian.Uint32(header[16:20]))
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		t.Fatalf("Reading payload failed: %v", err)
+	}
+	return strings.TrimRight(string(header[4:16]), "\x00"), payload
+}
+
+func TestPeerPing(t *testing.T) {
+	out, in, outErr, inErr := handshakePeers(t,
+		testPeerConfig(PROTOCOL_VERSION, NewNonceSet()), testPeerConfig(PROTOCOL_VERSION, NewNonceSet()))
+	if outErr != nil || inErr != nil {
+		t.Fatalf("Handshake failed: %v, %v", outErr, inErr)
+	}
+	defer in.Close()
+
+	// Pings are answered with the same nonce and not returned
+	out.SendMessage(&PingMessage{Nonce: 7})
+	out.SendMessage(&SendHeadersMessage{})
+	if _, command, err := in.ReceiveMessage(); err != nil || command != "sendheaders" {
+		t.Fatalf("Got %s %v, expected sendheaders", command, err)
+	}
+	packet, err := out.client.ReadPacket()
+	if pong, ok := packet.Message.(*PongMessage); err != nil || !ok || pong.Nonce != 7 {
+		t.Fatalf("Got %v %v, expected pong 7", packet.Message, err)
+	}
+
+	// Latency is measured while the remote answers
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := out.ReceiveMessage()
+		read <- err
+	}()
+	go in.ReceiveMessage()
+	out.KeepAlive(10*time.Millisecond, time.Second)
+	deadline := time.Now().Add(2 * time.Second)
+	for out.Latency() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if out.Latency() == 0 || out.MinPing() == 0 || out.MinPing() > out.Latency() {
+		t.Errorf("Got latency %v and min ping %v after pings were answered", out.Latency(), out.MinPing())
+	}
+	out.Close()
+	if err := <-read; err == nil {
+		t.Errorf("Read from closed peer succeeded")
+	}
+}
+
+func TestPeerPingTimeout(t *testing.T) {
+	out, in, outErr, inErr := handshakePeers(t,
+		testPeerConfig(PROTOCOL_VERSION, NewNonceSet()), testPeerConfig(PROTOCOL_VERSION, NewNonceSet()))
+	if outErr != nil || inErr != nil {
+		t.Fatalf("Handshake failed: %v, %v", outErr, inErr)
+	}
+	defer in.Close()
+
+	// The inbound peer never reads, so the ping is not answered
+	out.KeepAlive(time.Second, 50*time.Millisecond)
+	if _, _, err := out.ReceiveMessage(); !errors.Is(err, ErrPingTimeout) {
+		t.Errorf("Got %v, expected %v", err, ErrPingTimeout)
+	}
+	if out.PingWait() < 50*time.Millisecond {
+		t.Errorf("Got ping wait %v, expected at least the timeout", out.PingWait())
+	}
+}
@@ -0,0 +1,378 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Peer manager
+//=============
+
+const (
+	DEFAULT_MAX_OUTBOUND = 8                      // outbound connections to keep
+	SEND_QUEUE_SIZE      = 100                    // messages queued per peer
+	CONNECT_INTERVAL     = 500 * time.Millisecond // time between connection rounds
+	MAX_CONNECT_TRIES    = 100                    // candidates tried per round
+)
+
+var (
+	ErrSendQueueFull = errors.New("send queue full")
+	ErrUnknownPeer   = errors.New("unknown peer")
+)
+
+// AddressSource supplies the addresses of outbound connections. The
+// PeerManager reports each connection attempt and each successful
+// handshake back.
+type AddressSource interface {
+	Candidate() (string, bool) // an address to connect to, false if there is none
+	Attempt(address string)
+	Good(address string)
+}
+
+// AddressList is an AddressSource handing out a fixed list of addresses in
+// turn
+type AddressList struct {
+	mutex sync.Mutex
+	addrs []string
+	next  int
+}
+
+func NewAddressList(addrs ...string) *AddressList {
+	return &AddressList{addrs: addrs}
+}
+
+func (list *AddressList) Candidate() (string, bool) {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	if len(list.addrs) == 0 {
+		return "", false
+	}
+	addr := list.addrs[list.next%len(list.addrs)]
+	list.next++
+	return addr, true
+}
+
+func (list *AddressList) Attempt(address string) {}
+func (list *AddressList) Good(address string)    {}
+
+// MessageHandler is called with every message a subscriber gets. It runs
+// on the read goroutine of the peer, so messages of one peer arrive in
+// order, and a slow handler holds up that peer only.
+type MessageHandler func(peer *Peer, msg Message)
+
+type subscription struct {
+	id      int
+	command string // "" for all messages
+	handler MessageHandler
+}
+
+// PeerManager keeps MaxOutbound outbound connections to addresses from its
+// AddressSource. Every peer gets a read goroutine that dispatches incoming
+// messages to the subscribed handlers and a write goroutine draining a
+// bounded send queue. Run returns after its context is cancelled and all
+// peers are disconnected.
+type PeerManager struct {
+	Config          *PeerConfig
+	MaxOutbound     int
+	SendQueueSize   int
+	ConnectInterval time.Duration
+	PingInterval    time.Duration
+	PingTimeout     time.Duration
+
+	// Called on the goroutines of the peer. The error says why the peer
+	// was disconnected, nil after Close or shutdown.
+	OnConnect    func(peer *Peer)
+	OnDisconnect func(peer *Peer, err error)
+
+	source        AddressSource
+	dialer        net.Dialer
+	mutex         sync.Mutex
+	peers         map[*Peer]*managedPeer
+	connecting    map[string]bool // addresses of outbound connections, in handshake or up
+	subscriptions []subscription
+	nextID        int
+	wake          chan struct{}
+	wg            sync.WaitGroup
+}
+
+type managedPeer struct {
+	*Peer
+	address string // dial address of outbound peers
+	send    chan Message
+	once    sync.Once
+}
+
+func NewPeerManager(config *PeerConfig, source AddressSource) *PeerManager {
+	return &PeerManager{
+		Config:          config,
+		MaxOutbound:     DEFAULT_MAX_OUTBOUND,
+		SendQueueSize:   SEND_QUEUE_SIZE,
+		ConnectInterval: CONNECT_INTERVAL,
+		PingInterval:    PING_INTERVAL,
+		PingTimeout:     PING_TIMEOUT,
+		source:          source,
+		peers:           make(map[*Peer]*managedPeer),
+		connecting:      make(map[string]bool),
+		wake:            make(chan struct{}, 1),
+	}
+}
+
+// Subscribe registers a handler for messages with the command, or for all
+// messages if command is "". The returned function removes the handler.
+func (m *PeerManager) Subscribe(command string, handler MessageHandler) func() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.nextID++
+	id := m.nextID
+	m.subscriptions = append(m.subscriptions, subscription{id, command, handler})
+	return func() {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		for i, sub := range m.subscriptions {
+			if sub.id == id {
+				// Copy, dispatch may be iterating over the old slice
+				m.subscriptions = append(append([]subscription{}, m.subscriptions[:i]...), m.subscriptions[i+1:]...)
+				return
+			}
+		}
+	}
+}
+
+func (m *PeerManager) dispatch(peer *Peer, packet Packet) {
+	m.mutex.Lock()
+	subscriptions := m.subscriptions
+	m.mutex.Unlock()
+	for _, sub := range subscriptions {
+		if sub.command == "" || sub.command == packet.Command {
+			sub.handler(peer, packet.Message)
+		}
+	}
+}
+
+// Run keeps the outbound connections up until ctx is cancelled, then
+// disconnects all peers and waits for their goroutines. It returns the
+// error of the context.
+func (m *PeerManager) Run(ctx context.Context) error {
+	ticker := time.NewTicker(m.ConnectInterval)
+	defer ticker.Stop()
+	for {
+		m.connectOutbound(ctx)
+		select {
+		case <-ctx.Done():
+			m.wg.Wait()
+			return ctx.Err()
+		case <-ticker.C:
+		case <-m.wake:
+		}
+	}
+}
+
+// connectOutbound starts connections to new candidates until there are
+// MaxOutbound. Only one connection per network group is made, so an
+// attacker needs addresses in many groups to take over all of them.
+// Unroutable addresses (e.g. local test nodes) are exempt.
+func (m *PeerManager) connectOutbound(ctx context.Context) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	groups := make(map[string]bool)
+	for address := range m.connecting {
+		groups[netGroupOf(address)] = true
+	}
+	for tries := 0; len(m.connecting) < m.MaxOutbound && tries < MAX_CONNECT_TRIES; tries++ {
+		address, ok := m.source.Candidate()
+		if !ok {
+			return
+		}
+		group := netGroupOf(address)
+		if m.connecting[address] || (group != "" && groups[group]) {
+			continue
+		}
+		m.connecting[address] = true
+		groups[group] = true
+		m.wg.Add(1)
+		go m.connect(ctx, address)
+	}
+}
+
+func (m *PeerManager) connect(ctx context.Context, address string) {
+	defer m.wg.Done()
+	peer, err := m.dial(ctx, address)
+	if err != nil {
+		m.mutex.Lock()
+		delete(m.connecting, address)
+		m.mutex.Unlock()
+		return
+	}
+	m.source.Good(address)
+	m.add(ctx, peer, address)
+}
+
+func (m *PeerManager) dial(ctx context.Context, address string) (*Peer, error) {
+	m.source.Attempt(address)
+	dialCtx, cancel := context.WithTimeout(ctx, m.Config.HandshakeTimeout)
+	defer cancel()
+	conn, err := m.dialer.DialContext(dialCtx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	peer := NewPeer(conn, m.Config, false)
+	return peer, m.handshake(ctx, peer)
+}
+
+// handshake runs the handshake of the peer, aborting it if ctx is
+// cancelled
+func (m *PeerManager) handshake(ctx context.Context, peer *Peer) error {
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			peer.Close()
+		case <-done:
+		}
+	}()
+	err := peer.Handshake()
+	if err == nil && ctx.Err() != nil {
+		err = ctx.Err()
+	}
+	return err
+}
+
+// AddInbound runs the handshake on an accepted connection and manages the
+// peer until ctx is cancelled
+func (m *PeerManager) AddInbound(ctx context.Context, conn net.Conn) error {
+	peer := NewPeer(conn, m.Config, true)
+	if err := m.handshake(ctx, peer); err != nil {
+		return err
+	}
+	m.add(ctx, peer, "")
+	return nil
+}
+
+func (m *PeerManager) add(ctx context.Context, peer *Peer, address string) {
+	mp := &managedPeer{
+		Peer:    peer,
+		address: address,
+		send:    make(chan Message, m.SendQueueSize),
+	}
+	m.mutex.Lock()
+	m.peers[peer] = mp
+	m.wg.Add(2)
+	m.mutex.Unlock()
+
+	peer.KeepAlive(m.PingInterval, m.PingTimeout)
+	if m.OnConnect != nil {
+		m.OnConnect(peer)
+	}
+	go m.writeLoop(ctx, mp)
+	go m.readLoop(mp)
+}
+
+func (m *PeerManager) writeLoop(ctx context.Context, mp *managedPeer) {
+	defer m.wg.Done()
+	for {
+		select {
+		case <-ctx.Done():
+			m.remove(mp, nil)
+			return
+		case <-mp.done:
+			return
+		case msg := <-mp.send:
+			if err := mp.SendMessage(msg); err != nil {
+				m.remove(mp, err)
+				return
+			}
+		}
+	}
+}
+
+func (m *PeerManager) readLoop(mp *managedPeer) {
+	defer m.wg.Done()
+	for {
+		packet, err := mp.ReadPacket()
+		var packetErr *PacketError
+		if errors.As(err, &packetErr) {
+			continue
+		}
+		if err != nil {
+			m.remove(mp, err)
+			return
+		}
+		m.dispatch(mp.Peer, packet)
+	}
+}
+
+// remove disconnects the peer and forgets it. The first error wins: when
+// one goroutine of the peer fails, the other one sees the closed
+// connection.
+func (m *PeerManager) remove(mp *managedPeer, err error) {
+	mp.once.Do(func() {
+		mp.disconnect(err)
+		mp.mutex.Lock()
+		err = mp.err
+		mp.mutex.Unlock()
+
+		m.mutex.Lock()
+		delete(m.peers, mp.Peer)
+		if mp.address != "" {
+			delete(m.connecting, mp.address)
+		}
+		m.mutex.Unlock()
+		if m.OnDisconnect != nil {
+			m.OnDisconnect(mp.Peer, err)
+		}
+		select {
+		case m.wake <- struct{}{}:
+		default:
+		}
+	})
+}
+
+// Send queues a message for the peer. It does not block; if the queue of
+// the peer is full, ErrSendQueueFull is returned.
+func (m *PeerManager) Send(peer *Peer, msg Message) error {
+	m.mutex.Lock()
+	mp, ok := m.peers[peer]
+	m.mutex.Unlock()
+	if !ok {
+		return ErrUnknownPeer
+	}
+	select {
+	case mp.send <- msg:
+		return nil
+	default:
+		return ErrSendQueueFull
+	}
+}
+
+// Broadcast queues a message for all peers, skipping those with a full
+// queue
+func (m *PeerManager) Broadcast(msg Message) {
+	for _, peer := range m.Peers() {
+		m.Send(peer, msg)
+	}
+}
+
+// Disconnect closes the connection to the peer
+func (m *PeerManager) Disconnect(peer *Peer) {
+	m.mutex.Lock()
+	mp, ok := m.peers[peer]
+	m.mutex.Unlock()
+	if ok {
+		m.remove(mp, nil)
+	}
+}
+
+// Peers returns the connected peers
+func (m *PeerManager) Peers() []*Peer {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	peers := make([]*Peer, 0, len(m.peers))
+	for peer := range m.peers {
+		peers = append(peers, peer)
+	}
+	return peers
+}
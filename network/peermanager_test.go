@@ -0,0 +1,140 @@
+package network
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+// listenPeers accepts connections on a loopback port and sends the peers
+// that completed the handshake to the channel
+func listenPeers(t *testing.T, peers chan<- *Peer) net.Listener {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen failed: %v", err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			peer := NewPeer(conn, testPeerConfig(PROTOCOL_VERSION, NewNonceSet()), true)
+			if peer.Handshake() == nil {
+				peers <- peer
+			}
+		}
+	}()
+	return listener
+}
+
+func receiveFrom(t *testing.T, ch <-chan *Peer) *Peer {
+	select {
+	case peer := <-ch:
+		return peer
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Timeout waiting for peer")
+	}
+	return nil
+}
+
+func TestPeerManager(t *testing.T) {
+	remotes := make(chan *Peer, 10)
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		listener := listenPeers(t, remotes)
+		defer listener.Close()
+		addrs = append(addrs, listener.Addr().String())
+	}
+	manager := NewPeerManager(testPeerConfig(PROTOCOL_VERSION, NewNonceSet()), NewAddressList(addrs...))
+	manager.MaxOutbound = 2
+	manager.ConnectInterval = 10 * time.Millisecond
+	connected := make(chan *Peer, 10)
+	disconnected := make(chan *Peer, 10)
+	manager.OnConnect = func(peer *Peer) { connected <- peer }
+	manager.OnDisconnect = func(peer *Peer, err error) { disconnected <- peer }
+
+	type received struct {
+		peer    *Peer
+		command string
+	}
+	headers := make(chan *Peer, 10)
+	all := make(chan received, 10)
+	unsubscribe := manager.Subscribe("sendheaders", func(peer *Peer, msg Message) { headers <- peer })
+	manager.Subscribe("", func(peer *Peer, msg Message) { all <- received{peer, msg.GetCommandString()} })
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- manager.Run(ctx) }()
+
+	first, second := receiveFrom(t, connected), receiveFrom(t, connected)
+	remote1, remote2 := receiveFrom(t, remotes), receiveFrom(t, remotes)
+	if first == second || len(manager.Peers()) != 2 {
+		t.Fatalf("Got %d peers, expected 2", len(manager.Peers()))
+	}
+	select {
+	case peer := <-connected:
+		t.Fatalf("Connected to %v beyond MaxOutbound", peer)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// Dispatch to subscribers
+	remote1.SendMessage(&SendHeadersMessage{})
+	peer := receiveFrom(t, headers)
+	if got := <-all; got.peer != peer || got.command != "sendheaders" {
+		t.Errorf("Got %s from %v, expected sendheaders from %v", got.command, got.peer, peer)
+	}
+	unsubscribe()
+	remote1.SendMessage(&SendHeadersMessage{})
+	if got := <-all; got.peer != peer || got.command != "sendheaders" {
+		t.Errorf("Got %s from %v, expected sendheaders from %v", got.command, got.peer, peer)
+	}
+	select {
+	case <-headers:
+		t.Errorf("Unsubscribed handler was called")
+	default:
+	}
+
+	// Sending through the queue
+	if err := manager.Send(peer, &SendHeadersMessage{}); err != nil {
+		t.Fatalf("Send failed: %v", err)
+	}
+	if _, command, err := remote1.ReceiveMessage(); err != nil || command != "sendheaders" {
+		t.Errorf("Got %s %v, expected sendheaders", command, err)
+	}
+	if err := manager.Send(NewPeer(nil, manager.Config, false), &SendHeadersMessage{}); err != ErrUnknownPeer {
+		t.Errorf("Got %v, expected %v", err, ErrUnknownPeer)
+	}
+
+	// A lost peer is replaced
+	remote1.Close()
+	if got := receiveFrom(t, disconnected); got != peer {
+		t.Errorf("Got disconnect of %v, expected %v", got, peer)
+	}
+	receiveFrom(t, connected)
+	remote3 := receiveFrom(t, remotes)
+	if len(manager.Peers()) != 2 {
+		t.Errorf("Got %d peers, expected 2", len(manager.Peers()))
+	}
+
+	// Shutdown closes all connections
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Errorf("Run returned %v, expected %v", err, context.Canceled)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Run did not return after cancel")
+	}
+	if len(manager.Peers()) != 0 {
+		t.Errorf("Got %d peers after shutdown", len(manager.Peers()))
+	}
+	for _, remote := range []*Peer{remote2, remote3} {
+		if _, _, err := remote.ReceiveMessage(); err == nil {
+			t.Errorf("Connection to %v still open after shutdown", remote)
+		}
+		remote.Close()
+	}
+}
@@ -0,0 +1,187 @@
+package network
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// Private keys
+//=============
+
+// PrivateKey is a secp256k1 secret key. Compressed tells whether the public
+// key is serialized in compressed form, which is recorded in the WIF
+// encoding (and changes the resulting addresses).
+//
+// Note that the arithmetic is not constant time, see secp256k1.go.
+type PrivateKey struct {
+	D          *big.Int
+	Compressed bool
+}
+
+var ErrInvalidWIF = errors.New("invalid WIF private key")
+
+// GeneratePrivateKey creates a new random key from crypto/rand
+func GeneratePrivateKey() (*PrivateKey, error) {
+	b := make([]byte, 32)
+	for {
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		// retry in the (unlikely) case the number is not below n
+		if key, err := PrivateKeyFromBytes(b); err == nil {
+			return key, nil
+		}
+	}
+}
+
+// PrivateKeyFromBytes creates a key (with compressed public key) from the
+// 32 byte big-endian secret, which must be in [1, n-1]
+func PrivateKeyFromBytes(b []byte) (*PrivateKey, error) {
+	if _, _, err := parseSecretKey(b); err != nil {
+		return nil, err
+	}
+	return &PrivateKey{D: new(big.Int).SetBytes(b), Compressed: true}, nil
+}
+
+// Serialize returns the 32 byte big-endian secret
+func (k *PrivateKey) Serialize() []byte {
+	return bigTo32Bytes(k.D)
+}
+
+// PubKey returns the public key d*G
+func (k *PrivateKey) PubKey() *PublicKey {
+	x, y, _ := scalarBaseMult(k.D)
+	return &PublicKey{x, y}
+}
+
+// SerializePubKey returns the SEC1 encoding of the public key, compressed or
+// not depending on the key
+func (k *PrivateKey) SerializePubKey() []byte {
+	if k.Compressed {
+		return k.PubKey().SerializeCompressed()
+	}
+	return k.PubKey().SerializeUncompressed()
+}
+
+// Sign creates an ECDSA signature of the 32 byte hash, with the nonce
+// derived from the key and hash as in RFC6979 (with HMAC-SHA256). S is
+// normalized to the lower half, as required by standardness rules (BIP62).
+func (k *PrivateKey) Sign(hash []byte) *Signature {
+	e := new(big.Int).SetBytes(hash)
+	nonces := newRFC6979(k.Serialize(), hash)
+	for {
+		nonce := nonces.next()
+		rx, _, _ := scalarBaseMult(nonce)
+		r := rx.Mod(rx, secp256k1N)
+		if r.Sign() == 0 {
+			continue
+		}
+		// s = (e + r*d) / k
+		s := new(big.Int).Mul(r, k.D)
+		s.Add(s, e)
+		s.Mul(s, new(big.Int).ModInverse(nonce, secp256k1N))
+		s.Mod(s, secp256k1N)
+		if s.Sign() == 0 {
+			continue
+		}
+		sig := &Signature{R: r, S: s}
+		sig.Normalize()
+		return sig
+	}
+}
+
+// SignSchnorr creates a BIP340 signature of msg, with fresh auxiliary
+// randomness from crypto/rand
+func (k *PrivateKey) SignSchnorr(msg []byte) ([]byte, error) {
+	aux := make([]byte, 32)
+	if _, err := rand.Read(aux); err != nil {
+		return nil, err
+	}
+	return SignSchnorr(k.Serialize(), msg, aux)
+}
+
+// WIF returns the key in wallet import format for the network, i.e. base58
+// check encoded with the network's version byte and a trailing 0x01 for
+// compressed keys
+func (k *PrivateKey) WIF(params *ChainParams) string {
+	payload := k.Serialize()
+	if k.Compressed {
+		payload = append(payload, 0x01)
+	}
+	return Base58CheckEncode(params.PrivateKeyID, payload)
+}
+
+// DecodeWIF decodes a key in wallet import format, which must be for the
+// given network
+func DecodeWIF(s string, params *ChainParams) (*PrivateKey, error) {
+	version, payload, err := Base58CheckDecode(s)
+	if err != nil {
+		return nil, err
+	}
+	if version != params.PrivateKeyID {
+		return nil, fmt.Errorf("%w: version 0x%02x is not for network '%s'", ErrInvalidWIF, version, params.Name)
+	}
+	compressed := false
+	switch {
+	case len(payload) == 33 && payload[32] == 0x01:
+		compressed = true
+		payload = payload[:32]
+	case len(payload) != 32:
+		return nil, fmt.Errorf("%w: length %d", ErrInvalidWIF, len(payload))
+	}
+	key, err := PrivateKeyFromBytes(payload)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidWIF, err)
+	}
+	key.Compressed = compressed
+	return key, nil
+}
+
+// rfc6979 generates the sequence of deterministic nonces of RFC6979,
+// section 3.2, for a 256 bit curve order and SHA256
+type rfc6979 struct {
+	k, v []byte
+}
+
+func newRFC6979(secKey, hash []byte) *rfc6979 {
+	// bits2octets: the hash reduced modulo n
+	h := new(big.Int).SetBytes(hash)
+	h.Mod(h, secp256k1N)
+	msg := bigTo32Bytes(h)
+
+	g := &rfc6979{k: make([]byte, 32), v: make([]byte, 32)}
+	for i := range g.v {
+		g.v[i] = 0x01
+	}
+	g.k = g.hmac(g.v, []byte{0x00}, secKey, msg)
+	g.v = g.hmac(g.v)
+	g.k = g.hmac(g.v, []byte{0x01}, secKey, msg)
+	g.v = g.hmac(g.v)
+	return g
+}
+
+func (g *rfc6979) hmac(data ...[]byte) []byte {
+	mac := hmac.New(sha256.New, g.k)
+	for _, d := range data {
+		mac.Write(d)
+	}
+	return mac.Sum(nil)
+}
+
+// next returns the next candidate nonce in [1, n-1]
+func (g *rfc6979) next() *big.Int {
+	for {
+		g.v = g.hmac(g.v)
+		nonce := new(big.Int).SetBytes(g.v)
+		// prepare the state for the next call
+		g.k = g.hmac(g.v, []byte{0x00})
+		g.v = g.hmac(g.v)
+		if nonce.Sign() > 0 && nonce.Cmp(secp256k1N) < 0 {
+			return nonce
+		}
+	}
+}
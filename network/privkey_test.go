@@ -0,0 +1,143 @@
+package network
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func TestRFC6979Nonce(t *testing.T) {
+	// Vectors matching the Trezor and CoreBitcoin implementations
+	tests := []struct {
+		key   string
+		msg   string
+		nonce string
+	}{
+		{"cca9fbcc1b41e5a95d369eaa6ddcff73b61a4efaa279cfc6567e8daa39cbaf50", "sample", "2df40ca70e639d89528a6b670d9d48d9165fdc0febc0974056bdce192b8e16a3"},
+		{"0000000000000000000000000000000000000000000000000000000000000001", "Satoshi Nakamoto", "8f8a276c19f4149656b280621e358cce24f5f52542772691ee69063b74f15d15"},
+		{"fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364140", "Satoshi Nakamoto", "33a19b60e25fb6f4435af53a3d42d493644827367e6453928554f43e49aa6f90"},
+		{"f8b8af8ce3c7cca5e300d33939540c10d45ce001b8f252bfbc57ba0342904181", "Alan Turing", "525a82b70e67874398067543fd84c83d30c175fdc45fdeee082fe13b1d7cfdf1"},
+		{"0000000000000000000000000000000000000000000000000000000000000001", "All those moments will be lost in time, like tears in rain. Time to die...", "38aa22d72376b4dbc472e06c3ba403ee0a394da63fc58d88686c611aba98d6b3"},
+	}
+	for _, test := range tests {
+		hash := sha256.Sum256([]byte(test.msg))
+		nonce := newRFC6979(h2b(test.key), hash[:]).next()
+		if hex.EncodeToString(bigTo32Bytes(nonce)) != test.nonce {
+			t.Errorf("Wrong nonce for '%s': %x", test.msg, nonce)
+		}
+	}
+}
+
+func TestSign(t *testing.T) {
+	tests := []struct {
+		key  string
+		hash string
+		r, s string
+	}{
+		// sha256("Satoshi Nakamoto"), where S had to be normalized
+		{"0000000000000000000000000000000000000000000000000000000000000001", "", "934b1ea10a4b3c1757e2b0c017d0b6143ce3c9a7e6a4a49860d7a6ab210ee3d8", "2442ce9d2b916064108014783e923ec36b49743e2ffa1c4496f01a512aafd9e5"},
+		// Vectors from the decred secp256k1 module
+		{"0000000000000000000000000000000000000000000000000000000000000001", "c301ba9de5d6053caad9f5eb46523f007702add2c62fa39de03146a36b8026b7", "c6c4137b0e5fbfc88ae3f293d7e80c8566c43ae20340075d44f75b009c943d09", "00ba213513572e35943d5acdd17215561b03f11663192a7252196cc8b2a99560"},
+		{"0000000000000000000000000000000000000000000000000000000000000002", "c301ba9de5d6053caad9f5eb46523f007702add2c62fa39de03146a36b8026b7", "e6f137b52377250760cc702e19b7aee3c63b0e7d95a91939b14ab3b5c4771e59", "44b9bc4620afa158b7efdfea5234ff2d5f2f78b42886f02cf581827ee55318ea"},
+		{"0000000000000000000000000000000000000000000000000000000000000001", "dc063eba3c8d52a159e725c1a161506f6cb6b53478ad5ef3f08d534efa871d9f", "dda8308cdbda2edf51ccf598b42b42b19597e102eb2ed4a04a16dd57084d3b40", "0b6d67bab4929624e28f690407a15efc551354544fdc179970ff401eec2e5dc9"},
+		{"a1becef2069444a9dc6331c3247e113c3ee142edda683db8643f9cb0af7cbe33", "4a6c419a1e25c85327115c4ace586decddfe2990ed8f3d4d801871158338501d", "ef392791d87afca8256c4c9c68d981248ee34a09069f50fa8dfc19ae34cd92ce", "0a2b9cb69fd794f7f204c272293b8585a294916a21a11fd94ec04acae2dc6d21"},
+		{"c249bbd5f533672b7dcd514eb1256854783531c2b85fe60bf4ce6ea1f26afc2b", "53d661e71e47a0a7e416591200175122d83f8af31be6a70af7417ad6f54d0038", "7a57a5222fb7d615eaa0041193f682262cebfa9b448f9c519d3644d0a3348521", "574923b7b5aec66b62f1589002db29342c9f5ed56d5e80f5361c0307ff1561fa"},
+	}
+	for _, test := range tests {
+		key, err := PrivateKeyFromBytes(h2b(test.key))
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		hash := h2b(test.hash)
+		if len(hash) == 0 {
+			h := sha256.Sum256([]byte("Satoshi Nakamoto"))
+			hash = h[:]
+		}
+		sig := key.Sign(hash)
+		if hex.EncodeToString(bigTo32Bytes(sig.R)) != test.r || hex.EncodeToString(bigTo32Bytes(sig.S)) != test.s {
+			t.Errorf("Wrong signature for key %s: %x", test.key, sig.Serialize())
+		}
+		if !sig.IsLowS() || !key.PubKey().Verify(hash, sig) {
+			t.Errorf("Signature should be low S and verify")
+		}
+	}
+}
+
+func TestGeneratePrivateKey(t *testing.T) {
+	key, err := GeneratePrivateKey()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	msg := make([]byte, 32)
+	if !key.PubKey().Verify(msg, key.Sign(msg)) {
+		t.Errorf("ECDSA signature should verify")
+	}
+	sig, err := key.SignSchnorr(msg)
+	if err != nil || !key.PubKey().VerifySchnorr(msg, sig) {
+		t.Errorf("Schnorr signature should verify (%v)", err)
+	}
+
+	if _, err = PrivateKeyFromBytes(bigTo32Bytes(secp256k1N)); !errors.Is(err, ErrInvalidSecretKey) {
+		t.Errorf("Expected invalid key error, got %v", err)
+	}
+}
+
+func TestWIF(t *testing.T) {
+	tests := []struct {
+		wif        string
+		params     *ChainParams
+		compressed bool
+	}{
+		{"KwDiBf89QgGbjEhKnhXJuH7LrciVrZi3qYjgd9M7rFU73sVHnoWn", &MainNetParams, true},
+		{"5HpHagT65TZzG1PH3CSu63k8DbpvD8s5ip4nEB3kEsreAnchuDf", &MainNetParams, false},
+		{"cMahea7zqjxrtgAbB7LSGbcQUr1uX1ojuat9jZodMN87JcbXMTcA", &RegTestParams, true},
+	}
+	for _, test := range tests {
+		key, err := DecodeWIF(test.wif, test.params)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if key.D.Int64() != 1 || key.Compressed != test.compressed {
+			t.Errorf("Wrong key %v", key)
+		}
+		if key.WIF(test.params) != test.wif {
+			t.Errorf("Wrong WIF %s", key.WIF(test.params))
+		}
+		if len(key.SerializePubKey()) != map[bool]int{true: 33, false: 65}[test.compressed] {
+			t.Errorf("Wrong public key length %x", key.SerializePubKey())
+		}
+	}
+
+	if _, err := DecodeWIF(tests[0].wif, &TestNet3Params); !errors.Is(err, ErrInvalidWIF) {
+		t.Errorf("Expected error for wrong network, got %v", err)
+	}
+	if _, err := DecodeWIF("KwDiBf89QgGbjEhKnhXJuH7LrciVrZi3qYjgd9M7rFU73sVHnoWo", &MainNetParams); !errors.Is(err, ErrBadChecksum) {
+		t.Errorf("Expected checksum error, got %v", err)
+	}
+}
+
+func TestBase58(t *testing.T) {
+	tests := []struct {
+		data string
+		enc  string
+	}{
+		{"", ""},
+		{"61", "2g"},
+		{"626262", "a3gV"},
+		{"00000000", "1111"},
+		{"00010966776006953d5567439e5e39f86a0d273beed61967f6", "16UwLL9Risc3QfPqBUvKofHmBQ7wMtjvM"},
+	}
+	for _, test := range tests {
+		if enc := Base58Encode(h2b(test.data)); enc != test.enc {
+			t.Errorf("Wrong encoding of %s: %s", test.data, enc)
+		}
+		data, err := Base58Decode(test.enc)
+		if err != nil || hex.EncodeToString(data) != test.data {
+			t.Errorf("Wrong decoding of %s: %x (%v)", test.enc, data, err)
+		}
+	}
+	if _, err := Base58Decode("0OIl"); !errors.Is(err, ErrInvalidBase58) {
+		t.Errorf("Expected invalid character error, got %v", err)
+	}
+}
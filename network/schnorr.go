@@ -0,0 +1,188 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// BIP340 Schnorr signatures
+//==========================
+
+// Errors returned when signing and tweaking keys
+var (
+	ErrInvalidSecretKey = errors.New("invalid secret key")
+	ErrInvalidTweak     = errors.New("invalid tweak")
+)
+
+// ParseXOnlyPublicKey parses a 32 byte x-only public key (BIP340), which is
+// the point with the given x coordinate and an even y coordinate
+func ParseXOnlyPublicKey(b []byte) (*PublicKey, error) {
+	if len(b) != 32 {
+		return nil, fmt.Errorf("%w: x-only key with length %d", ErrInvalidPubKey, len(b))
+	}
+	x := new(big.Int).SetBytes(b)
+	y := liftX(x, false)
+	if y == nil {
+		return nil, fmt.Errorf("%w: x not on curve", ErrInvalidPubKey)
+	}
+	return &PublicKey{x, y}, nil
+}
+
+// SerializeXOnly returns the 32 byte x coordinate of the key
+func (pk *PublicKey) SerializeXOnly() []byte {
+	return bigTo32Bytes(pk.X)
+}
+
+// parseSecretKey converts a 32 byte secret key to a number in [1, n-1] and
+// returns it together with its public key
+func parseSecretKey(secKey []byte) (*big.Int, *PublicKey, error) {
+	d := new(big.Int).SetBytes(secKey)
+	if len(secKey) != 32 || d.Sign() == 0 || d.Cmp(secp256k1N) >= 0 {
+		return nil, nil, ErrInvalidSecretKey
+	}
+	x, y, _ := scalarBaseMult(d)
+	return d, &PublicKey{x, y}, nil
+}
+
+// SignSchnorr creates a BIP340 signature of msg with the 32 byte secret
+// key. auxRand should be 32 bytes of fresh randomness, which is mixed into
+// the nonce as protection against side channel attacks.
+func SignSchnorr(secKey, msg, auxRand []byte) ([]byte, error) {
+	d, pub, err := parseSecretKey(secKey)
+	if err != nil {
+		return nil, err
+	}
+	if pub.Y.Bit(0) == 1 {
+		d.Sub(secp256k1N, d)
+	}
+	px := pub.SerializeXOnly()
+
+	aux := TaggedHash("BIP0340/aux", auxRand)
+	t := bigTo32Bytes(d)
+	for i := range t {
+		t[i] ^= aux[i]
+	}
+	rand := TaggedHash("BIP0340/nonce", t, px, msg)
+	k := new(big.Int).SetBytes(rand[:])
+	k.Mod(k, secp256k1N)
+	if k.Sign() == 0 {
+		return nil, errors.New("schnorr nonce is zero")
+	}
+	rx, ry, _ := scalarBaseMult(k)
+	if ry.Bit(0) == 1 {
+		k.Sub(secp256k1N, k)
+	}
+	r := bigTo32Bytes(rx)
+
+	e := schnorrChallenge(r, px, msg)
+	s := e.Mul(e, d)
+	s.Add(s, k)
+	s.Mod(s, secp256k1N)
+	sig := append(r, bigTo32Bytes(s)...)
+
+	// Verify the signature to protect against computation errors
+	if !pub.VerifySchnorr(msg, sig) {
+		return nil, errors.New("created schnorr signature does not verify")
+	}
+	return sig, nil
+}
+
+func schnorrChallenge(r, px, msg []byte) *big.Int {
+	h := TaggedHash("BIP0340/challenge", r, px, msg)
+	e := new(big.Int).SetBytes(h[:])
+	return e.Mod(e, secp256k1N)
+}
+
+// VerifySchnorr checks the 64 byte BIP340 signature of msg. Only the x
+// coordinate of the key is used.
+func (pk *PublicKey) VerifySchnorr(msg, sig []byte) bool {
+	if len(sig) != 64 {
+		return false
+	}
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:])
+	if r.Cmp(secp256k1P) >= 0 || s.Cmp(secp256k1N) >= 0 {
+		return false
+	}
+	// Use the point with even y
+	y := pk.Y
+	if y.Bit(0) == 1 {
+		y = new(big.Int).Sub(secp256k1P, y)
+	}
+	e := schnorrChallenge(sig[:32], pk.SerializeXOnly(), msg)
+	// R = s*G - e*P
+	rx, ry, ok := doubleScalarMult(s, pk.X, y, e.Sub(secp256k1N, e))
+	if !ok || ry.Bit(0) == 1 {
+		return false
+	}
+	return rx.Cmp(r) == 0
+}
+
+// BIP341 key tweaking
+//====================
+
+// tapTweak computes the BIP341 tweak for the internal key and the merkle
+// root of the script tree (empty if there are no scripts)
+func tapTweak(internal *PublicKey, merkleRoot []byte) (*big.Int, error) {
+	h := TaggedHash("TapTweak", internal.SerializeXOnly(), merkleRoot)
+	t := new(big.Int).SetBytes(h[:])
+	if t.Cmp(secp256k1N) >= 0 {
+		return nil, ErrInvalidTweak
+	}
+	return t, nil
+}
+
+// TweakPublicKey computes the taproot output key Q = P + t*G for the
+// internal key P (taken with even y) and the merkle root of the script tree
+// (nil for a key path only output). The parity of Q's y coordinate is
+// needed for script path spends.
+func TweakPublicKey(internal *PublicKey, merkleRoot []byte) (*PublicKey, bool, error) {
+	t, err := tapTweak(internal, merkleRoot)
+	if err != nil {
+		return nil, false, err
+	}
+	y := internal.Y
+	if y.Bit(0) == 1 {
+		y = new(big.Int).Sub(secp256k1P, y)
+	}
+	x, y, ok := doubleScalarMult(t, internal.X, y, big.NewInt(1))
+	if !ok {
+		return nil, false, ErrInvalidTweak
+	}
+	return &PublicKey{x, y}, y.Bit(0) == 1, nil
+}
+
+// CheckTapTweak checks that output is the tweak of internal with the merkle
+// root and that the parity of its y coordinate matches (as needed to verify
+// taproot script path spends)
+func CheckTapTweak(internal *PublicKey, merkleRoot []byte, output []byte, odd bool) bool {
+	q, parity, err := TweakPublicKey(internal, merkleRoot)
+	if err != nil {
+		return false
+	}
+	return parity == odd && bytes.Equal(q.SerializeXOnly(), output)
+}
+
+// TweakSecretKey tweaks the 32 byte secret key of an internal key, so that
+// it can sign for the output key with the key path
+func TweakSecretKey(secKey []byte, merkleRoot []byte) ([]byte, error) {
+	d, pub, err := parseSecretKey(secKey)
+	if err != nil {
+		return nil, err
+	}
+	if pub.Y.Bit(0) == 1 {
+		d.Sub(secp256k1N, d)
+	}
+	t, err := tapTweak(pub, merkleRoot)
+	if err != nil {
+		return nil, err
+	}
+	d.Add(d, t)
+	d.Mod(d, secp256k1N)
+	if d.Sign() == 0 {
+		return nil, ErrInvalidTweak
+	}
+	return bigTo32Bytes(d), nil
+}
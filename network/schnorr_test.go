@@ -0,0 +1,98 @@
+package network
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/hex"
+	"os"
+	"testing"
+)
+
+func TestTaggedHash(t *testing.T) {
+	if TaggedHash("TapLeaf") != TaggedHash("TapLeaf", []byte{}) {
+		t.Errorf("Empty data should not change the hash")
+	}
+	if TaggedHash("TapLeaf") == TaggedHash("TapBranch") {
+		t.Errorf("Different tags should give different hashes")
+	}
+	if TaggedHash("TapLeaf", []byte{1, 2}) != TaggedHash("TapLeaf", []byte{1}, []byte{2}) {
+		t.Errorf("Tagged hash should hash the concatenation of the data")
+	}
+}
+
+// TestBIP340Vectors runs the test vectors from
+// https://github.com/bitcoin/bips/blob/master/bip-0340/test-vectors.csv
+// including those for messages that are not 32 bytes long
+func TestBIP340Vectors(t *testing.T) {
+	f, err := os.Open("testdata/bip340-vectors.csv")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer f.Close()
+	records, err := csv.NewReader(f).ReadAll()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, r := range records[1:] {
+		index, secKey, pubKey, auxRand, msg, sig := r[0], h2b(r[1]), h2b(r[2]), h2b(r[3]), h2b(r[4]), h2b(r[5])
+		expected := r[6] == "TRUE"
+
+		if len(secKey) > 0 {
+			sig2, err := SignSchnorr(secKey, msg, auxRand)
+			if err != nil {
+				t.Errorf("Vector %s: unexpected error: %v", index, err)
+			} else if !bytes.Equal(sig, sig2) {
+				t.Errorf("Vector %s: wrong signature %X", index, sig2)
+			}
+		}
+
+		key, err := ParseXOnlyPublicKey(pubKey)
+		if err != nil {
+			if expected {
+				t.Errorf("Vector %s: unexpected error: %v", index, err)
+			}
+			continue
+		}
+		if !bytes.Equal(key.SerializeXOnly(), pubKey) {
+			t.Errorf("Vector %s: wrong x-only key %X", index, key.SerializeXOnly())
+		}
+		if key.VerifySchnorr(msg, sig) != expected {
+			t.Errorf("Vector %s: verification should be %v (%s)", index, expected, r[7])
+		}
+	}
+}
+
+func TestTweakPublicKey(t *testing.T) {
+	// First scriptPubKey vector of the BIP341 wallet test vectors (no
+	// script tree)
+	internal, _ := ParseXOnlyPublicKey(h2b("d6889cb081036e0faefa3a35157ad71086b123b2b144b649798b494c300a961d"))
+	output, odd, err := TweakPublicKey(internal, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	exp := "53a1f6e454df1aa2776a2814a721372d6258050de330b3c6d10ee8f4e0dda343"
+	if hex.EncodeToString(output.SerializeXOnly()) != exp {
+		t.Errorf("Wrong output key %x", output.SerializeXOnly())
+	}
+	if !CheckTapTweak(internal, nil, output.SerializeXOnly(), odd) || CheckTapTweak(internal, nil, output.SerializeXOnly(), !odd) {
+		t.Errorf("Tweak check failed")
+	}
+
+	// Signing with the tweaked secret key verifies against the output key
+	secKey := h2b("0000000000000000000000000000000000000000000000000000000000000003")
+	_, pub, _ := parseSecretKey(secKey)
+	root := TaggedHash("TapLeaf", []byte{0xc0, 0x01, 0x51})
+	tweaked, err := TweakSecretKey(secKey, root[:])
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	output, _, _ = TweakPublicKey(pub, root[:])
+	msg := make([]byte, 32)
+	sig, err := SignSchnorr(tweaked, msg, msg)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !output.VerifySchnorr(msg, sig) || pub.VerifySchnorr(msg, sig) {
+		t.Errorf("Signature should only verify for the output key")
+	}
+}
@@ -0,0 +1,742 @@
+package network
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Limits from bitcoin core's script.h
+const (
+	MAX_SCRIPT_ELEMENT_SIZE  = 520 // bytes
+	MAX_OPS_PER_SCRIPT       = 201 // non-push operations
+	MAX_PUBKEYS_PER_MULTISIG = 20
+	MAX_SCRIPT_SIZE          = 10000 // bytes
+	MAX_STACK_SIZE           = 1000  // stack and altstack elements
+)
+
+// Signature hash types
+const (
+	SIGHASH_DEFAULT      = 0x00 // taproot only, same as SIGHASH_ALL
+	SIGHASH_ALL          = 0x01
+	SIGHASH_NONE         = 0x02
+	SIGHASH_SINGLE       = 0x03
+	SIGHASH_ANYONECANPAY = 0x80
+)
+
+// Opcodes
+//========
+
+const (
+	// push value
+	OP_0         = 0x00
+	OP_FALSE     = OP_0
+	OP_PUSHDATA1 = 0x4c
+	OP_PUSHDATA2 = 0x4d
+	OP_PUSHDATA4 = 0x4e
+	OP_1NEGATE   = 0x4f
+	OP_RESERVED  = 0x50
+	OP_1         = 0x51
+	OP_TRUE      = OP_1
+	OP_2         = 0x52
+	OP_3         = 0x53
+	OP_4         = 0x54
+	OP_5         = 0x55
+	OP_6         = 0x56
+	OP_7         = 0x57
+	OP_8         = 0x58
+	OP_9         = 0x59
+	OP_10        = 0x5a
+	OP_11        = 0x5b
+	OP_12        = 0x5c
+	OP_13        = 0x5d
+	OP_14        = 0x5e
+	OP_15        = 0x5f
+	OP_16        = 0x60
+
+	// control
+	OP_NOP      = 0x61
+	OP_VER      = 0x62
+	OP_IF       = 0x63
+	OP_NOTIF    = 0x64
+	OP_VERIF    = 0x65
+	OP_VERNOTIF = 0x66
+	OP_ELSE     = 0x67
+	OP_ENDIF    = 0x68
+	OP_VERIFY   = 0x69
+	OP_RETURN   = 0x6a
+
+	// stack ops
+	OP_TOALTSTACK   = 0x6b
+	OP_FROMALTSTACK = 0x6c
+	OP_2DROP        = 0x6d
+	OP_2DUP         = 0x6e
+	OP_3DUP         = 0x6f
+	OP_2OVER        = 0x70
+	OP_2ROT         = 0x71
+	OP_2SWAP        = 0x72
+	OP_IFDUP        = 0x73
+	OP_DEPTH        = 0x74
+	OP_DROP         = 0x75
+	OP_DUP          = 0x76
+	OP_NIP          = 0x77
+	OP_OVER         = 0x78
+	OP_PICK         = 0x79
+	OP_ROLL         = 0x7a
+	OP_ROT          = 0x7b
+	OP_SWAP         = 0x7c
+	OP_TUCK         = 0x7d
+
+	// splice ops
+	OP_CAT    = 0x7e
+	OP_SUBSTR = 0x7f
+	OP_LEFT   = 0x80
+	OP_RIGHT  = 0x81
+	OP_SIZE   = 0x82
+
+	// bit logic
+	OP_INVERT      = 0x83
+	OP_AND         = 0x84
+	OP_OR          = 0x85
+	OP_XOR         = 0x86
+	OP_EQUAL       = 0x87
+	OP_EQUALVERIFY = 0x88
+	OP_RESERVED1   = 0x89
+	OP_RESERVED2   = 0x8a
+
+	// numeric
+	OP_1ADD      = 0x8b
+	OP_1SUB      = 0x8c
+	OP_2MUL      = 0x8d
+	OP_2DIV      = 0x8e
+	OP_NEGATE    = 0x8f
+	OP_ABS       = 0x90
+	OP_NOT       = 0x91
+	OP_0NOTEQUAL = 0x92
+
+	OP_ADD    = 0x93
+	OP_SUB    = 0x94
+	OP_MUL    = 0x95
+	OP_DIV    = 0x96
+	OP_MOD    = 0x97
+	OP_LSHIFT = 0x98
+	OP_RSHIFT = 0x99
+
+	OP_BOOLAND            = 0x9a
+	OP_BOOLOR             = 0x9b
+	OP_NUMEQUAL           = 0x9c
+	OP_NUMEQUALVERIFY     = 0x9d
+	OP_NUMNOTEQUAL        = 0x9e
+	OP_LESSTHAN           = 0x9f
+	OP_GREATERTHAN        = 0xa0
+	OP_LESSTHANOREQUAL    = 0xa1
+	OP_GREATERTHANOREQUAL = 0xa2
+	OP_MIN                = 0xa3
+	OP_MAX                = 0xa4
+
+	OP_WITHIN = 0xa5
+
+	// crypto
+	OP_RIPEMD160           = 0xa6
+	OP_SHA1                = 0xa7
+	OP_SHA256              = 0xa8
+	OP_HASH160             = 0xa9
+	OP_HASH256             = 0xaa
+	OP_CODESEPARATOR       = 0xab
+	OP_CHECKSIG            = 0xac
+	OP_CHECKSIGVERIFY      = 0xad
+	OP_CHECKMULTISIG       = 0xae
+	OP_CHECKMULTISIGVERIFY = 0xaf
+
+	// expansion
+	OP_NOP1                = 0xb0
+	OP_CHECKLOCKTIMEVERIFY = 0xb1
+	OP_NOP2                = OP_CHECKLOCKTIMEVERIFY
+	OP_CHECKSEQUENCEVERIFY = 0xb2
+	OP_NOP3                = OP_CHECKSEQUENCEVERIFY
+	OP_NOP4                = 0xb3
+	OP_NOP5                = 0xb4
+	OP_NOP6                = 0xb5
+	OP_NOP7                = 0xb6
+	OP_NOP8                = 0xb7
+	OP_NOP9                = 0xb8
+	OP_NOP10               = 0xb9
+
+	// Opcode added by BIP 342 (Tapscript)
+	OP_CHECKSIGADD = 0xba
+
+	OP_INVALIDOPCODE = 0xff
+)
+
+var opcodeNames = map[byte]string{
+	OP_0: "0", OP_PUSHDATA1: "OP_PUSHDATA1", OP_PUSHDATA2: "OP_PUSHDATA2", OP_PUSHDATA4: "OP_PUSHDATA4",
+	OP_1NEGATE: "-1", OP_RESERVED: "OP_RESERVED",
+	OP_NOP: "OP_NOP", OP_VER: "OP_VER", OP_IF: "OP_IF", OP_NOTIF: "OP_NOTIF", OP_VERIF: "OP_VERIF",
+	OP_VERNOTIF: "OP_VERNOTIF", OP_ELSE: "OP_ELSE", OP_ENDIF: "OP_ENDIF", OP_VERIFY: "OP_VERIFY",
+	OP_RETURN: "OP_RETURN", OP_TOALTSTACK: "OP_TOALTSTACK", OP_FROMALTSTACK: "OP_FROMALTSTACK",
+	OP_2DROP: "OP_2DROP", OP_2DUP: "OP_2DUP", OP_3DUP: "OP_3DUP", OP_2OVER: "OP_2OVER", OP_2ROT: "OP_2ROT",
+	OP_2SWAP: "OP_2SWAP", OP_IFDUP: "OP_IFDUP", OP_DEPTH: "OP_DEPTH", OP_DROP: "OP_DROP", OP_DUP: "OP_DUP",
+	OP_NIP: "OP_NIP", OP_OVER: "OP_OVER", OP_PICK: "OP_PICK", OP_ROLL: "OP_ROLL", OP_ROT: "OP_ROT",
+	OP_SWAP: "OP_SWAP", OP_TUCK: "OP_TUCK", OP_CAT: "OP_CAT", OP_SUBSTR: "OP_SUBSTR", OP_LEFT: "OP_LEFT",
+	OP_RIGHT: "OP_RIGHT", OP_SIZE: "OP_SIZE", OP_INVERT: "OP_INVERT", OP_AND: "OP_AND", OP_OR: "OP_OR",
+	OP_XOR: "OP_XOR", OP_EQUAL: "OP_EQUAL", OP_EQUALVERIFY: "OP_EQUALVERIFY", OP_RESERVED1: "OP_RESERVED1",
+	OP_RESERVED2: "OP_RESERVED2", OP_1ADD: "OP_1ADD", OP_1SUB: "OP_1SUB", OP_2MUL: "OP_2MUL",
+	OP_2DIV: "OP_2DIV", OP_NEGATE: "OP_NEGATE", OP_ABS: "OP_ABS", OP_NOT: "OP_NOT",
+	OP_0NOTEQUAL: "OP_0NOTEQUAL", OP_ADD: "OP_ADD", OP_SUB: "OP_SUB", OP_MUL: "OP_MUL", OP_DIV: "OP_DIV",
+	OP_MOD: "OP_MOD", OP_LSHIFT: "OP_LSHIFT", OP_RSHIFT: "OP_RSHIFT", OP_BOOLAND: "OP_BOOLAND",
+	OP_BOOLOR: "OP_BOOLOR", OP_NUMEQUAL: "OP_NUMEQUAL", OP_NUMEQUALVERIFY: "OP_NUMEQUALVERIFY",
+	OP_NUMNOTEQUAL: "OP_NUMNOTEQUAL", OP_LESSTHAN: "OP_LESSTHAN", OP_GREATERTHAN: "OP_GREATERTHAN",
+	OP_LESSTHANOREQUAL: "OP_LESSTHANOREQUAL", OP_GREATERTHANOREQUAL: "OP_GREATERTHANOREQUAL",
+	OP_MIN: "OP_MIN", OP_MAX: "OP_MAX", OP_WITHIN: "OP_WITHIN", OP_RIPEMD160: "OP_RIPEMD160",
+	OP_SHA1: "OP_SHA1", OP_SHA256: "OP_SHA256", OP_HASH160: "OP_HASH160", OP_HASH256: "OP_HASH256",
+	OP_CODESEPARATOR: "OP_CODESEPARATOR", OP_CHECKSIG: "OP_CHECKSIG", OP_CHECKSIGVERIFY: "OP_CHECKSIGVERIFY",
+	OP_CHECKMULTISIG: "OP_CHECKMULTISIG", OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+	OP_NOP1: "OP_NOP1", OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY",
+	OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY", OP_NOP4: "OP_NOP4", OP_NOP5: "OP_NOP5",
+	OP_NOP6: "OP_NOP6", OP_NOP7: "OP_NOP7", OP_NOP8: "OP_NOP8", OP_NOP9: "OP_NOP9", OP_NOP10: "OP_NOP10",
+	OP_CHECKSIGADD: "OP_CHECKSIGADD", OP_INVALIDOPCODE: "OP_INVALIDOPCODE",
+}
+
+// OpcodeName returns the name of the opcode as used by bitcoin core, where
+// OP_0 to OP_16 and OP_1NEGATE are shown as numbers
+func OpcodeName(op byte) string {
+	if op >= OP_1 && op <= OP_16 {
+		return fmt.Sprintf("%d", op-OP_1+1)
+	}
+	if name, ok := opcodeNames[op]; ok {
+		return name
+	}
+	return "OP_UNKNOWN"
+}
+
+// Tokenizer
+//==========
+
+var ErrMalformedPush = errors.New("malformed push")
+
+// ScriptTokenizer iterates over the opcodes of a script:
+//
+//	t := NewScriptTokenizer(script)
+//	for t.Next() {
+//		... t.Opcode(), t.Data() ...
+//	}
+//	if t.Err() != nil { ... }
+type ScriptTokenizer struct {
+	script []byte
+	offset int
+	op     byte
+	data   []byte
+	err    error
+}
+
+func NewScriptTokenizer(script []byte) *ScriptTokenizer {
+	return &ScriptTokenizer{script: script}
+}
+
+// Next advances to the next opcode. It returns false at the end of the
+// script or when a push is truncated (then Err is set).
+func (t *ScriptTokenizer) Next() bool {
+	if t.err != nil || t.offset >= len(t.script) {
+		return false
+	}
+	op, data, next, ok := getScriptOp(t.script, t.offset)
+	if !ok {
+		return t.fail(op)
+	}
+	t.op = op
+	t.data = data
+	t.offset = next
+	return true
+}
+
+// getScriptOp reads the opcode at position pc like bitcoin core's GetOp and
+// returns it with its data and the position of the next opcode. If the push
+// is truncated, ok is false and next points behind the length bytes read so
+// far (which matters for the legacy signature hash).
+func getScriptOp(script []byte, pc int) (op byte, data []byte, next int, ok bool) {
+	if pc >= len(script) {
+		return OP_INVALIDOPCODE, nil, pc, false
+	}
+	op = script[pc]
+	pc++
+	if op > OP_PUSHDATA4 {
+		return op, nil, pc, true
+	}
+	var n uint64
+	switch op {
+	case OP_PUSHDATA1:
+		if len(script)-pc < 1 {
+			return op, nil, pc, false
+		}
+		n = uint64(script[pc])
+		pc++
+	case OP_PUSHDATA2:
+		if len(script)-pc < 2 {
+			return op, nil, pc, false
+		}
+		n = uint64(binary.LittleEndian.Uint16(script[pc:]))
+		pc += 2
+	case OP_PUSHDATA4:
+		if len(script)-pc < 4 {
+			return op, nil, pc, false
+		}
+		n = uint64(binary.LittleEndian.Uint32(script[pc:]))
+		pc += 4
+	default:
+		n = uint64(op)
+	}
+	if uint64(len(script)-pc) < n {
+		return op, nil, pc, false
+	}
+	return op, script[pc : pc+int(n)], pc + int(n), true
+}
+
+func (t *ScriptTokenizer) fail(op byte) bool {
+	t.err = fmt.Errorf("%w: %s at offset %d", ErrMalformedPush, OpcodeName(op), t.offset)
+	return false
+}
+
+// Opcode returns the current opcode
+func (t *ScriptTokenizer) Opcode() byte {
+	return t.op
+}
+
+// Data returns the data pushed by the current opcode (nil for non-push
+// opcodes, empty for OP_0)
+func (t *ScriptTokenizer) Data() []byte {
+	return t.data
+}
+
+// Offset returns the position after the current opcode
+func (t *ScriptTokenizer) Offset() int {
+	return t.offset
+}
+
+// Done returns true if the whole script was read without error
+func (t *ScriptTokenizer) Done() bool {
+	return t.err == nil && t.offset >= len(t.script)
+}
+
+func (t *ScriptTokenizer) Err() error {
+	return t.err
+}
+
+// ScriptOp is an opcode with its pushed data
+type ScriptOp struct {
+	Opcode byte
+	Data   []byte
+}
+
+// ParseScript splits the script into its opcodes
+func ParseScript(script []byte) ([]ScriptOp, error) {
+	var ops []ScriptOp
+	t := NewScriptTokenizer(script)
+	for t.Next() {
+		ops = append(ops, ScriptOp{t.Opcode(), t.Data()})
+	}
+	return ops, t.Err()
+}
+
+// IsPushOnly returns true if the script only consists of push opcodes (the
+// small integers and OP_RESERVED count as pushes here)
+func IsPushOnly(script []byte) bool {
+	t := NewScriptTokenizer(script)
+	for t.Next() {
+		if t.Opcode() > OP_16 {
+			return false
+		}
+	}
+	return t.Err() == nil
+}
+
+// Disassembler
+//=============
+
+var sighashTypeNames = map[byte]string{
+	SIGHASH_ALL:                           "ALL",
+	SIGHASH_ALL | SIGHASH_ANYONECANPAY:    "ALL|ANYONECANPAY",
+	SIGHASH_NONE:                          "NONE",
+	SIGHASH_NONE | SIGHASH_ANYONECANPAY:   "NONE|ANYONECANPAY",
+	SIGHASH_SINGLE:                        "SINGLE",
+	SIGHASH_SINGLE | SIGHASH_ANYONECANPAY: "SINGLE|ANYONECANPAY",
+}
+
+// ScriptToAsm renders the script like bitcoin core's ScriptToAsmStr. Pushes
+// of up to 4 bytes are shown as numbers, longer ones in hex. With
+// attemptSighashDecode (used for scriptSigs), pushes which look like
+// signatures are shown with their sighash type, e.g. "3044...01" becomes
+// "3044...[ALL]".
+func ScriptToAsm(script []byte, attemptSighashDecode bool) string {
+	var parts []string
+	t := NewScriptTokenizer(script)
+	for t.Next() {
+		op, data := t.Opcode(), t.Data()
+		if op > OP_PUSHDATA4 {
+			parts = append(parts, OpcodeName(op))
+			continue
+		}
+		if len(data) <= 4 {
+			n, _ := decodeScriptNum(data, 4, false)
+			parts = append(parts, fmt.Sprintf("%d", n))
+			continue
+		}
+		if attemptSighashDecode && !IsUnspendable(script) && len(data) > 0 {
+			hashType := data[len(data)-1]
+			if name, ok := sighashTypeNames[hashType]; ok && isValidSignatureEncoding(data) {
+				parts = append(parts, hex.EncodeToString(data[:len(data)-1])+"["+name+"]")
+				continue
+			}
+		}
+		parts = append(parts, hex.EncodeToString(data))
+	}
+	if t.Err() != nil {
+		parts = append(parts, "[error]")
+	}
+	return strings.Join(parts, " ")
+}
+
+// isValidSignatureEncoding checks the strict DER encoding (BIP66) of a
+// signature as used in scripts, i.e. followed by the sighash type byte
+func isValidSignatureEncoding(sig []byte) bool {
+	if len(sig) < 1 {
+		return false
+	}
+	_, err := ParseDERSignature(sig[:len(sig)-1])
+	return err == nil
+}
+
+// IsUnspendable returns true for scripts which can never be spent, i.e.
+// starting with OP_RETURN or larger than MAX_SCRIPT_SIZE
+func IsUnspendable(script []byte) bool {
+	return (len(script) > 0 && script[0] == OP_RETURN) || len(script) > MAX_SCRIPT_SIZE
+}
+
+// Script numbers
+//===============
+
+var (
+	ErrScriptNumOverflow   = errors.New("script number overflow")
+	ErrScriptNumNotMinimal = errors.New("non-minimally encoded script number")
+)
+
+// encodeScriptNum encodes n as script number, i.e. little endian with the
+// sign in the highest bit of the last byte, and zero as empty array
+func encodeScriptNum(n int64) []byte {
+	if n == 0 {
+		return []byte{}
+	}
+	neg := n < 0
+	abs := uint64(n)
+	if neg {
+		abs = uint64(-n)
+	}
+	var out []byte
+	for abs > 0 {
+		out = append(out, byte(abs&0xff))
+		abs >>= 8
+	}
+	// If the highest bit is used, add a byte for the sign, otherwise set
+	// the sign in the highest byte
+	if out[len(out)-1]&0x80 != 0 {
+		if neg {
+			out = append(out, 0x80)
+		} else {
+			out = append(out, 0x00)
+		}
+	} else if neg {
+		out[len(out)-1] |= 0x80
+	}
+	return out
+}
+
+// decodeScriptNum decodes a script number of at most maxLen bytes. With
+// requireMinimal, encodings with unnecessary zero bytes are rejected.
+func decodeScriptNum(data []byte, maxLen int, requireMinimal bool) (int64, error) {
+	if len(data) > maxLen {
+		return 0, fmt.Errorf("%w: %d bytes", ErrScriptNumOverflow, len(data))
+	}
+	if requireMinimal && len(data) > 0 {
+		// The last byte may only be 0x00 or 0x80 if the byte before
+		// needs its highest bit (otherwise the sign could go there)
+		last := data[len(data)-1]
+		if last&0x7f == 0 && (len(data) == 1 || data[len(data)-2]&0x80 == 0) {
+			return 0, ErrScriptNumNotMinimal
+		}
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+	var n int64
+	for i, b := range data {
+		n |= int64(b) << uint(8*i)
+	}
+	// Remove the sign bit and negate if it was set
+	if data[len(data)-1]&0x80 != 0 {
+		n &^= int64(0x80) << uint(8*(len(data)-1))
+		n = -n
+	}
+	return n, nil
+}
+
+// Builder
+//========
+
+// ScriptBuilder builds scripts using minimal pushes:
+//
+//	script := NewScriptBuilder().AddOp(OP_DUP).AddOp(OP_HASH160).AddData(hash).
+//		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).Script()
+type ScriptBuilder struct {
+	script []byte
+}
+
+func NewScriptBuilder() *ScriptBuilder {
+	return &ScriptBuilder{script: []byte{}}
+}
+
+// AddOp appends an opcode
+func (b *ScriptBuilder) AddOp(op byte) *ScriptBuilder {
+	b.script = append(b.script, op)
+	return b
+}
+
+// AddOps appends several opcodes
+func (b *ScriptBuilder) AddOps(ops ...byte) *ScriptBuilder {
+	b.script = append(b.script, ops...)
+	return b
+}
+
+// AddData appends the smallest possible push of data (as required by the
+// MINIMALDATA rule): empty data and single bytes 1 to 16 and 0x81 use
+// OP_0, OP_1 to OP_16 and OP_1NEGATE, other data is pushed directly or with
+// the smallest OP_PUSHDATA variant.
+func (b *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	n := len(data)
+	switch {
+	case n == 0:
+		return b.AddOp(OP_0)
+	case n == 1 && data[0] >= 1 && data[0] <= 16:
+		return b.AddOp(OP_1 - 1 + data[0])
+	case n == 1 && data[0] == 0x81:
+		return b.AddOp(OP_1NEGATE)
+	case n < OP_PUSHDATA1:
+		b.script = append(b.script, byte(n))
+	case n <= 0xff:
+		b.script = append(b.script, OP_PUSHDATA1, byte(n))
+	case n <= 0xffff:
+		b.script = append(b.script, OP_PUSHDATA2, byte(n), byte(n>>8))
+	default:
+		b.script = append(b.script, OP_PUSHDATA4, byte(n), byte(n>>8), byte(n>>16), byte(n>>24))
+	}
+	b.script = append(b.script, data...)
+	return b
+}
+
+// AddInt64 appends a number, using OP_0, OP_1NEGATE and OP_1 to OP_16 where
+// possible and a push of the script number otherwise
+func (b *ScriptBuilder) AddInt64(n int64) *ScriptBuilder {
+	switch {
+	case n == 0:
+		return b.AddOp(OP_0)
+	case n == -1 || (n >= 1 && n <= 16):
+		return b.AddOp(byte(OP_1 - 1 + n))
+	}
+	return b.AddData(encodeScriptNum(n))
+}
+
+// Script returns the script built so far
+func (b *ScriptBuilder) Script() []byte {
+	return b.script
+}
+
+// Templates
+//==========
+
+// ScriptClass is the type of a standard output script
+type ScriptClass int
+
+const (
+	NonStandardTy ScriptClass = iota
+	PubKeyTy
+	PubKeyHashTy
+	ScriptHashTy
+	MultiSigTy
+	NullDataTy
+	WitnessV0KeyHashTy
+	WitnessV0ScriptHashTy
+	WitnessV1TaprootTy
+	WitnessUnknownTy
+)
+
+// String returns the name used by bitcoin core (e.g. in decodescript)
+func (c ScriptClass) String() string {
+	switch c {
+	case PubKeyTy:
+		return "pubkey"
+	case PubKeyHashTy:
+		return "pubkeyhash"
+	case ScriptHashTy:
+		return "scripthash"
+	case MultiSigTy:
+		return "multisig"
+	case NullDataTy:
+		return "nulldata"
+	case WitnessV0KeyHashTy:
+		return "witness_v0_keyhash"
+	case WitnessV0ScriptHashTy:
+		return "witness_v0_scripthash"
+	case WitnessV1TaprootTy:
+		return "witness_v1_taproot"
+	case WitnessUnknownTy:
+		return "witness_unknown"
+	}
+	return "nonstandard"
+}
+
+// IsPayToScriptHash checks for OP_HASH160 <20 bytes> OP_EQUAL (BIP16)
+func IsPayToScriptHash(script []byte) bool {
+	return len(script) == 23 && script[0] == OP_HASH160 && script[1] == 20 && script[22] == OP_EQUAL
+}
+
+// IsWitnessProgram checks whether script is a witness program (BIP141),
+// i.e. a version opcode followed by a single push of 2 to 40 bytes, and
+// returns the version and program
+func IsWitnessProgram(script []byte) (byte, []byte, bool) {
+	if len(script) < 4 || len(script) > 42 || int(script[1]) != len(script)-2 {
+		return 0, nil, false
+	}
+	switch {
+	case script[0] == OP_0:
+		return 0, script[2:], true
+	case script[0] >= OP_1 && script[0] <= OP_16:
+		return script[0] - OP_1 + 1, script[2:], true
+	}
+	return 0, nil, false
+}
+
+// validPubKeySize checks that the length of a public key matches its prefix
+func validPubKeySize(key []byte) bool {
+	if len(key) == 0 {
+		return false
+	}
+	switch key[0] {
+	case 0x02, 0x03:
+		return len(key) == 33
+	case 0x04, 0x06, 0x07:
+		return len(key) == 65
+	}
+	return false
+}
+
+// ClassifyScript determines the template of an output script like bitcoin
+// core's Solver. It returns the class and the relevant data: the key for
+// P2PK, the hash for P2PKH, P2SH and P2WPKH/P2WSH, the output key for P2TR,
+// version and program for unknown witness versions and for multisig the
+// number of required signatures, the keys and the number of keys (the
+// numbers as single bytes).
+func ClassifyScript(script []byte) (ScriptClass, [][]byte) {
+	if IsPayToScriptHash(script) {
+		return ScriptHashTy, [][]byte{script[2:22]}
+	}
+	if version, program, ok := IsWitnessProgram(script); ok {
+		switch {
+		case version == 0 && len(program) == 20:
+			return WitnessV0KeyHashTy, [][]byte{program}
+		case version == 0 && len(program) == 32:
+			return WitnessV0ScriptHashTy, [][]byte{program}
+		case version == 1 && len(program) == 32:
+			return WitnessV1TaprootTy, [][]byte{program}
+		case version != 0:
+			return WitnessUnknownTy, [][]byte{{version}, program}
+		}
+		return NonStandardTy, nil
+	}
+	if len(script) >= 1 && script[0] == OP_RETURN && IsPushOnly(script[1:]) {
+		return NullDataTy, nil
+	}
+	if (len(script) == 35 || len(script) == 67) && int(script[0]) == len(script)-2 && script[len(script)-1] == OP_CHECKSIG && validPubKeySize(script[1:len(script)-1]) {
+		return PubKeyTy, [][]byte{script[1 : len(script)-1]}
+	}
+	if len(script) == 25 && script[0] == OP_DUP && script[1] == OP_HASH160 && script[2] == 20 && script[23] == OP_EQUALVERIFY && script[24] == OP_CHECKSIG {
+		return PubKeyHashTy, [][]byte{script[3:23]}
+	}
+	if solutions, ok := matchMultisig(script); ok {
+		return MultiSigTy, solutions
+	}
+	return NonStandardTy, nil
+}
+
+// matchMultisig matches OP_m <key>... OP_n OP_CHECKMULTISIG
+func matchMultisig(script []byte) ([][]byte, bool) {
+	if len(script) < 1 || script[len(script)-1] != OP_CHECKMULTISIG {
+		return nil, false
+	}
+	ops, err := ParseScript(script[:len(script)-1])
+	if err != nil || len(ops) < 3 {
+		return nil, false
+	}
+	m, n := ops[0].Opcode, ops[len(ops)-1].Opcode
+	if m < OP_1 || m > OP_16 || n < OP_1 || n > OP_16 {
+		return nil, false
+	}
+	required, keys := int(m-OP_1+1), int(n-OP_1+1)
+	if len(ops)-2 != keys || keys < required {
+		return nil, false
+	}
+	solutions := [][]byte{{byte(required)}}
+	for _, op := range ops[1 : len(ops)-1] {
+		if op.Opcode > OP_PUSHDATA4 || !validPubKeySize(op.Data) {
+			return nil, false
+		}
+		solutions = append(solutions, op.Data)
+	}
+	return append(solutions, []byte{byte(keys)}), true
+}
+
+// Signature operations
+//=====================
+
+// CountSigOps counts the signature operations of a script like bitcoin
+// core's GetSigOpCount. CHECKMULTISIG counts as 20 operations, or if
+// accurate is set and it is preceded by OP_1 to OP_16, as that number. The
+// counting stops at a malformed push.
+func CountSigOps(script []byte, accurate bool) int {
+	n := 0
+	var last byte = OP_INVALIDOPCODE
+	for t := NewScriptTokenizer(script); t.Next(); {
+		switch op := t.Opcode(); op {
+		case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+			n++
+		case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+			if accurate && last >= OP_1 && last <= OP_16 {
+				n += int(last - OP_1 + 1)
+			} else {
+				n += MAX_PUBKEYS_PER_MULTISIG
+			}
+		}
+		last = t.Opcode()
+	}
+	return n
+}
+
+// P2SHSigOpCount counts the signature operations of the redeem script of a
+// P2SH input, which is the last push of scriptSig. It returns 0 if
+// scriptPubKey is not P2SH or scriptSig isn't push only.
+func P2SHSigOpCount(scriptSig, scriptPubKey []byte) int {
+	if !IsPayToScriptHash(scriptPubKey) {
+		return 0
+	}
+	var redeemScript []byte
+	t := NewScriptTokenizer(scriptSig)
+	for t.Next() {
+		if t.Opcode() > OP_16 {
+			return 0
+		}
+		redeemScript = t.Data()
+	}
+	if t.Err() != nil {
+		return 0
+	}
+	return CountSigOps(redeemScript, true)
+}
@@ -0,0 +1,218 @@
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestGenesisScriptAsm(t *testing.T) {
+	tx, err := TxFromHex(genesisCoinbaseHex)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	// As shown by bitcoin-cli getblock with verbosity 2
+	asm := ScriptToAsm(tx.TxIn[0].SignatureScript, true)
+	expected := "486604799 4 5468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73"
+	if asm != expected {
+		t.Errorf("Wrong scriptSig asm %s", asm)
+	}
+	asm = ScriptToAsm(tx.TxOut[0].PkScript, false)
+	expected = "04678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5f OP_CHECKSIG"
+	if asm != expected {
+		t.Errorf("Wrong scriptPubKey asm %s", asm)
+	}
+	if class, solutions := ClassifyScript(tx.TxOut[0].PkScript); class != PubKeyTy || len(solutions[0]) != 65 {
+		t.Errorf("Wrong class %v", class)
+	}
+}
+
+func TestScriptAsm(t *testing.T) {
+	tests := []struct {
+		script string
+		asm    string
+	}{
+		{"", ""},
+		{"76a91462e907b15cbf27d5425399ebf6f0fb50ebb88f1888ac", "OP_DUP OP_HASH160 62e907b15cbf27d5425399ebf6f0fb50ebb88f18 OP_EQUALVERIFY OP_CHECKSIG"},
+		{"004f515a60", "0 -1 1 10 16"},
+		{"0181028000", "-1 128"},
+		{"b1b2ba50ff", "OP_CHECKLOCKTIMEVERIFY OP_CHECKSEQUENCEVERIFY OP_CHECKSIGADD OP_RESERVED OP_INVALIDOPCODE"},
+		{"bb", "OP_UNKNOWN"},
+		{"6a0568656c6c6f", "OP_RETURN 68656c6c6f"},
+		// the same push with PUSHDATA1/2/4
+		{"4c0568656c6c6f4d050068656c6c6f4e0500000068656c6c6f", "68656c6c6f 68656c6c6f 68656c6c6f"},
+		// truncated pushes
+		{"7605aabbcc", "OP_DUP [error]"},
+		{"4c", "[error]"},
+		{"4d0100", "[error]"},
+		{"4effffffff00", "[error]"},
+	}
+	for _, test := range tests {
+		if asm := ScriptToAsm(h2b(test.script), false); asm != test.asm {
+			t.Errorf("Wrong asm for %s: got '%s', expected '%s'", test.script, asm, test.asm)
+		}
+	}
+}
+
+func TestScriptAsmSighash(t *testing.T) {
+	key, _ := PrivateKeyFromBytes(h2b("0000000000000000000000000000000000000000000000000000000000000001"))
+	hash := doubleHash([]byte("test"))
+	sig := key.Sign(hash[:]).Serialize()
+	pubKey := key.SerializePubKey()
+	script := NewScriptBuilder().AddData(append(sig, SIGHASH_SINGLE|SIGHASH_ANYONECANPAY)).AddData(pubKey).Script()
+
+	expected := hex.EncodeToString(sig) + "[SINGLE|ANYONECANPAY] " + hex.EncodeToString(pubKey)
+	if asm := ScriptToAsm(script, true); asm != expected {
+		t.Errorf("Wrong asm %s", asm)
+	}
+	expected = hex.EncodeToString(sig) + "83 " + hex.EncodeToString(pubKey)
+	if asm := ScriptToAsm(script, false); asm != expected {
+		t.Errorf("Wrong asm %s", asm)
+	}
+	// Undefined hash types are not decoded
+	script = NewScriptBuilder().AddData(append(sig, 0x04)).Script()
+	if asm := ScriptToAsm(script, true); !strings.HasSuffix(asm, "04") {
+		t.Errorf("Wrong asm %s", asm)
+	}
+}
+
+func TestScriptTokenizer(t *testing.T) {
+	ops, err := ParseScript(h2b("004c0001aa4d0200bbcc76"))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected := []ScriptOp{
+		{OP_0, []byte{}},
+		{OP_PUSHDATA1, []byte{}},
+		{0x01, []byte{0xaa}},
+		{OP_PUSHDATA2, []byte{0xbb, 0xcc}},
+		{OP_DUP, nil},
+	}
+	if len(ops) != len(expected) {
+		t.Fatalf("Wrong number of ops %d", len(ops))
+	}
+	for i := range ops {
+		if ops[i].Opcode != expected[i].Opcode || !bytes.Equal(ops[i].Data, expected[i].Data) || (ops[i].Data == nil) != (expected[i].Data == nil) {
+			t.Errorf("Wrong op %d: %v", i, ops[i])
+		}
+	}
+
+	if _, err = ParseScript(h2b("4d01")); !errors.Is(err, ErrMalformedPush) {
+		t.Errorf("Expected malformed push, got %v", err)
+	}
+	if !IsPushOnly(h2b("00514c0001aa")) || IsPushOnly(h2b("0076")) || IsPushOnly(h2b("01")) {
+		t.Errorf("Wrong IsPushOnly")
+	}
+}
+
+func TestScriptBuilder(t *testing.T) {
+	tests := []struct {
+		data   []byte
+		script string
+	}{
+		{[]byte{}, "00"},
+		{[]byte{0}, "0100"},
+		{[]byte{1}, "51"},
+		{[]byte{16}, "60"},
+		{[]byte{17}, "0111"},
+		{[]byte{0x81}, "4f"},
+		{bytes.Repeat([]byte{0xaa}, 75), "4b" + strings.Repeat("aa", 75)},
+		{bytes.Repeat([]byte{0xaa}, 76), "4c4c" + strings.Repeat("aa", 76)},
+		{bytes.Repeat([]byte{0xaa}, 255), "4cff" + strings.Repeat("aa", 255)},
+		{bytes.Repeat([]byte{0xaa}, 256), "4d0001" + strings.Repeat("aa", 256)},
+		{bytes.Repeat([]byte{0xaa}, 65536), "4e00000100" + strings.Repeat("aa", 65536)},
+	}
+	for _, test := range tests {
+		script := NewScriptBuilder().AddData(test.data).Script()
+		if hex.EncodeToString(script) != test.script {
+			t.Errorf("Wrong push for %d bytes", len(test.data))
+		}
+		ops, err := ParseScript(script)
+		if err != nil || len(ops) != 1 {
+			t.Errorf("Push for %d bytes can't be parsed: %v", len(test.data), err)
+		}
+	}
+
+	numbers := []struct {
+		n      int64
+		script string
+	}{
+		{0, "00"}, {-1, "4f"}, {1, "51"}, {16, "60"}, {17, "0111"}, {-2, "0182"},
+		{127, "017f"}, {128, "028000"}, {-128, "028080"}, {255, "02ff00"}, {256, "020001"},
+		{-32768, "03008080"}, {0x7fffffff, "04ffffff7f"}, {-0x7fffffff, "04ffffffff"},
+	}
+	for _, test := range numbers {
+		script := NewScriptBuilder().AddInt64(test.n).Script()
+		if hex.EncodeToString(script) != test.script {
+			t.Errorf("Wrong script %x for %d", script, test.n)
+		}
+		if len(script) > 1 {
+			n, err := decodeScriptNum(script[1:], 4, true)
+			if err != nil || n != test.n {
+				t.Errorf("Wrong decoded number %d for %d: %v", n, test.n, err)
+			}
+		}
+	}
+
+	// Not minimally encoded numbers
+	for _, s := range []string{"00", "80", "0100", "7f00", "0080", "000080"} {
+		if _, err := decodeScriptNum(h2b(s), 4, true); !errors.Is(err, ErrScriptNumNotMinimal) {
+			t.Errorf("%s should not be minimal", s)
+		}
+		if _, err := decodeScriptNum(h2b(s), 4, false); err != nil {
+			t.Errorf("Unexpected error for %s: %v", s, err)
+		}
+	}
+	if _, err := decodeScriptNum(h2b("0000000000"), 4, false); !errors.Is(err, ErrScriptNumOverflow) {
+		t.Errorf("Expected overflow")
+	}
+}
+
+func TestClassifyScript(t *testing.T) {
+	key := "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+	multisig := "52" + "21" + key + "21" + key + "52ae"
+	tests := []struct {
+		script string
+		class  ScriptClass
+		n      int
+	}{
+		{"21" + key + "ac", PubKeyTy, 1},
+		{"76a91462e907b15cbf27d5425399ebf6f0fb50ebb88f1888ac", PubKeyHashTy, 1},
+		{"a91462e907b15cbf27d5425399ebf6f0fb50ebb88f1887", ScriptHashTy, 1},
+		{multisig, MultiSigTy, 4},
+		{"6a0568656c6c6f", NullDataTy, 0},
+		{"6a", NullDataTy, 0},
+		{"0014751e76e8199196d454941c45d1b3a323f1433bd6", WitnessV0KeyHashTy, 1},
+		{"00201863143c14c5166804bd19203356da136c985678cd4d27a1b8c6329604903262", WitnessV0ScriptHashTy, 1},
+		{"512079be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798", WitnessV1TaprootTy, 1},
+		{"6002751e", WitnessUnknownTy, 2},
+		// witness v0 with a wrong program size
+		{"0010751e76e8199196d454941c45d1b3a323", NonStandardTy, 0},
+		// OP_RETURN followed by a non-push
+		{"6a76", NonStandardTy, 0},
+		// multisig with more required signatures than keys
+		{"53" + "21" + key + "21" + key + "52ae", NonStandardTy, 0},
+		// multisig with a wrong key count
+		{"51" + "21" + key + "53ae", NonStandardTy, 0},
+		// public key with a wrong prefix
+		{"21" + "05" + key[2:] + "ac", NonStandardTy, 0},
+		{"", NonStandardTy, 0},
+	}
+	for _, test := range tests {
+		class, solutions := ClassifyScript(h2b(test.script))
+		if class != test.class || len(solutions) != test.n {
+			t.Errorf("Wrong class %v (%d solutions) for %s", class, len(solutions), test.script)
+		}
+	}
+
+	_, solutions := ClassifyScript(h2b(multisig))
+	if solutions[0][0] != 2 || solutions[3][0] != 2 || hex.EncodeToString(solutions[1]) != key {
+		t.Errorf("Wrong multisig solutions %x", solutions)
+	}
+	if MultiSigTy.String() != "multisig" || WitnessV1TaprootTy.String() != "witness_v1_taproot" {
+		t.Errorf("Wrong class names")
+	}
+}
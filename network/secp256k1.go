@@ -0,0 +1,467 @@
+package network
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// The secp256k1 curve y^2 = x^3 + 7 over the prime field p, with base point
+// G of order n (see https://www.secg.org/sec2-v2.pdf, section 2.4.1).
+//
+// The arithmetic below uses math/big and is not constant time. This is fine
+// for verification, which only handles public data.
+
+func mustParseBig(s string) *big.Int {
+	v, ok := new(big.Int).SetString(s, 16)
+	if !ok {
+		panic(fmt.Sprintf("invalid number %s", s))
+	}
+	return v
+}
+
+var (
+	secp256k1P     = mustParseBig("fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc2f")
+	secp256k1N     = mustParseBig("fffffffffffffffffffffffffffffffebaaedce6af48a03bbfd25e8cd0364141")
+	secp256k1HalfN = new(big.Int).Rsh(secp256k1N, 1)
+	secp256k1Gx    = mustParseBig("79be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798")
+	secp256k1Gy    = mustParseBig("483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8")
+	secp256k1B     = big.NewInt(7)
+
+	// exponent for square roots, as p = 3 mod 4
+	secp256k1SqrtExp = new(big.Int).Rsh(new(big.Int).Add(secp256k1P, big.NewInt(1)), 2)
+)
+
+// jacobianPoint is a point in jacobian coordinates, i.e. the affine point
+// (x/z^2, y/z^3). A z of zero is the point at infinity.
+type jacobianPoint struct {
+	x, y, z *big.Int
+}
+
+func newJacobianPoint(x, y *big.Int) jacobianPoint {
+	return jacobianPoint{new(big.Int).Set(x), new(big.Int).Set(y), big.NewInt(1)}
+}
+
+func (p jacobianPoint) infinity() bool {
+	return p.z.Sign() == 0
+}
+
+// affine converts the point back to affine coordinates. It must not be
+// called for the point at infinity.
+func (p jacobianPoint) affine() (*big.Int, *big.Int) {
+	zinv := new(big.Int).ModInverse(p.z, secp256k1P)
+	zinv2 := fmul(zinv, zinv)
+	return fmul(p.x, zinv2), fmul(p.y, fmul(zinv2, zinv))
+}
+
+func fmul(a, b *big.Int) *big.Int {
+	r := new(big.Int).Mul(a, b)
+	return r.Mod(r, secp256k1P)
+}
+
+func fsub(a, b *big.Int) *big.Int {
+	r := new(big.Int).Sub(a, b)
+	return r.Mod(r, secp256k1P)
+}
+
+func fadd(a, b *big.Int) *big.Int {
+	r := new(big.Int).Add(a, b)
+	return r.Mod(r, secp256k1P)
+}
+
+func (p jacobianPoint) double() jacobianPoint {
+	if p.infinity() || p.y.Sign() == 0 {
+		return jacobianPoint{new(big.Int), new(big.Int), new(big.Int)}
+	}
+	yy := fmul(p.y, p.y)
+	s := fmul(big.NewInt(4), fmul(p.x, yy))
+	m := fmul(big.NewInt(3), fmul(p.x, p.x))
+	x := fsub(fmul(m, m), fadd(s, s))
+	y := fsub(fmul(m, fsub(s, x)), fmul(big.NewInt(8), fmul(yy, yy)))
+	z := fmul(big.NewInt(2), fmul(p.y, p.z))
+	return jacobianPoint{x, y, z}
+}
+
+func (p jacobianPoint) add(q jacobianPoint) jacobianPoint {
+	if p.infinity() {
+		return q
+	}
+	if q.infinity() {
+		return p
+	}
+	pz2 := fmul(p.z, p.z)
+	qz2 := fmul(q.z, q.z)
+	u1 := fmul(p.x, qz2)
+	u2 := fmul(q.x, pz2)
+	s1 := fmul(p.y, fmul(qz2, q.z))
+	s2 := fmul(q.y, fmul(pz2, p.z))
+	if u1.Cmp(u2) == 0 {
+		if s1.Cmp(s2) == 0 {
+			return p.double()
+		}
+		return jacobianPoint{new(big.Int), new(big.Int), new(big.Int)}
+	}
+	h := fsub(u2, u1)
+	r := fsub(s2, s1)
+	hh := fmul(h, h)
+	hhh := fmul(hh, h)
+	u1hh := fmul(u1, hh)
+	x := fsub(fsub(fmul(r, r), hhh), fadd(u1hh, u1hh))
+	y := fsub(fmul(r, fsub(u1hh, x)), fmul(s1, hhh))
+	z := fmul(h, fmul(p.z, q.z))
+	return jacobianPoint{x, y, z}
+}
+
+// doubleScalarMult computes k1*G + k2*(x, y) with a simultaneous double and
+// add. It returns false if the result is the point at infinity.
+func doubleScalarMult(k1 *big.Int, x, y *big.Int, k2 *big.Int) (*big.Int, *big.Int, bool) {
+	g := newJacobianPoint(secp256k1Gx, secp256k1Gy)
+	q := newJacobianPoint(x, y)
+	gq := g.add(q)
+	r := jacobianPoint{new(big.Int), new(big.Int), new(big.Int)}
+	bits := k1.BitLen()
+	if k2.BitLen() > bits {
+		bits = k2.BitLen()
+	}
+	for i := bits - 1; i >= 0; i-- {
+		r = r.double()
+		switch {
+		case k1.Bit(i) == 1 && k2.Bit(i) == 1:
+			r = r.add(gq)
+		case k1.Bit(i) == 1:
+			r = r.add(g)
+		case k2.Bit(i) == 1:
+			r = r.add(q)
+		}
+	}
+	if r.infinity() {
+		return nil, nil, false
+	}
+	rx, ry := r.affine()
+	return rx, ry, true
+}
+
+// scalarMult computes k*(x, y). It returns false if the result is the point
+// at infinity.
+func scalarMult(x, y *big.Int, k *big.Int) (*big.Int, *big.Int, bool) {
+	return doubleScalarMult(new(big.Int), x, y, k)
+}
+
+// scalarBaseMult computes k*G. It returns false if the result is the point
+// at infinity.
+func scalarBaseMult(k *big.Int) (*big.Int, *big.Int, bool) {
+	return doubleScalarMult(k, secp256k1Gx, secp256k1Gy, new(big.Int))
+}
+
+// isOnCurve checks that x and y are field elements and satisfy the curve
+// equation
+func isOnCurve(x, y *big.Int) bool {
+	if x.Sign() < 0 || x.Cmp(secp256k1P) >= 0 || y.Sign() < 0 || y.Cmp(secp256k1P) >= 0 {
+		return false
+	}
+	rhs := fadd(fmul(fmul(x, x), x), secp256k1B)
+	return fmul(y, y).Cmp(rhs) == 0
+}
+
+// liftX returns the y coordinate of the point with the given x coordinate
+// and the requested parity, or nil if there is no such point
+func liftX(x *big.Int, odd bool) *big.Int {
+	if x.Sign() < 0 || x.Cmp(secp256k1P) >= 0 {
+		return nil
+	}
+	c := fadd(fmul(fmul(x, x), x), secp256k1B)
+	y := new(big.Int).Exp(c, secp256k1SqrtExp, secp256k1P)
+	if fmul(y, y).Cmp(c) != 0 {
+		return nil
+	}
+	if (y.Bit(0) == 1) != odd {
+		y.Sub(secp256k1P, y)
+	}
+	return y
+}
+
+// Public keys
+//============
+
+// Errors returned when parsing keys and signatures
+var (
+	ErrInvalidPubKey    = errors.New("invalid public key")
+	ErrInvalidSignature = errors.New("invalid signature encoding")
+)
+
+// PublicKey is a point on the secp256k1 curve
+type PublicKey struct {
+	X, Y *big.Int
+}
+
+// ParsePublicKey parses a public key in SEC1 encoding. Public keys (in
+// scripts) are given as
+//
+//	04 <x> <y> where x and y are 32 byte big-endian integers representing
+//	           the coordinates of a point on the curve
+//
+// or in compressed form as
+//
+//	<sign> <x> where <sign> is 0x02 if y is even and 0x03 if y is odd.
+//
+// The hybrid form (06 or 07 <x> <y>, with the parity of y in the prefix) is
+// accepted as well, as it is valid by consensus.
+func ParsePublicKey(b []byte) (*PublicKey, error) {
+	if len(b) == 0 {
+		return nil, fmt.Errorf("%w: empty", ErrInvalidPubKey)
+	}
+	switch b[0] {
+	case 0x02, 0x03:
+		if len(b) != 33 {
+			return nil, fmt.Errorf("%w: compressed key with length %d", ErrInvalidPubKey, len(b))
+		}
+		x := new(big.Int).SetBytes(b[1:])
+		y := liftX(x, b[0] == 0x03)
+		if y == nil {
+			return nil, fmt.Errorf("%w: x not on curve", ErrInvalidPubKey)
+		}
+		return &PublicKey{x, y}, nil
+	case 0x04, 0x06, 0x07:
+		if len(b) != 65 {
+			return nil, fmt.Errorf("%w: uncompressed key with length %d", ErrInvalidPubKey, len(b))
+		}
+		x := new(big.Int).SetBytes(b[1:33])
+		y := new(big.Int).SetBytes(b[33:])
+		if !isOnCurve(x, y) {
+			return nil, fmt.Errorf("%w: point not on curve", ErrInvalidPubKey)
+		}
+		if b[0] != 0x04 && (b[0] == 0x07) != (y.Bit(0) == 1) {
+			return nil, fmt.Errorf("%w: hybrid key with wrong parity", ErrInvalidPubKey)
+		}
+		return &PublicKey{x, y}, nil
+	}
+	return nil, fmt.Errorf("%w: unknown prefix 0x%02x", ErrInvalidPubKey, b[0])
+}
+
+// PublicKeyFromString parses a hex encoded public key
+func PublicKeyFromString(s string) (*PublicKey, error) {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePublicKey(b)
+}
+
+func bigTo32Bytes(v *big.Int) []byte {
+	b := v.Bytes()
+	out := make([]byte, 32-len(b), 32)
+	return append(out, b...)
+}
+
+// SerializeCompressed returns the 33 byte compressed SEC1 encoding
+func (pk *PublicKey) SerializeCompressed() []byte {
+	prefix := byte(0x02)
+	if pk.Y.Bit(0) == 1 {
+		prefix = 0x03
+	}
+	return append([]byte{prefix}, bigTo32Bytes(pk.X)...)
+}
+
+// SerializeUncompressed returns the 65 byte uncompressed SEC1 encoding
+func (pk *PublicKey) SerializeUncompressed() []byte {
+	out := append([]byte{0x04}, bigTo32Bytes(pk.X)...)
+	return append(out, bigTo32Bytes(pk.Y)...)
+}
+
+// Signatures
+//===========
+
+// Signature is an ECDSA signature
+type Signature struct {
+	R, S *big.Int
+}
+
+// ParseDERSignature parses a DER encoded signature (without the sighash
+// type byte used in scripts), enforcing the strict encoding rules of BIP66:
+//
+//	0x30 [total-length] 0x02 [R-length] [R] 0x02 [S-length] [S]
+//
+// R and S must be positive and minimally encoded. Values not below the
+// curve order are accepted here, but never verify.
+func ParseDERSignature(sig []byte) (*Signature, error) {
+	// Minimum size is 8 bytes (with one byte R and S), the maximum 72 bytes
+	// (with 33 byte R and S)
+	if len(sig) < 8 || len(sig) > 72 {
+		return nil, fmt.Errorf("%w: length %d", ErrInvalidSignature, len(sig))
+	}
+	if sig[0] != 0x30 || int(sig[1]) != len(sig)-2 {
+		return nil, fmt.Errorf("%w: bad sequence", ErrInvalidSignature)
+	}
+	lenR := int(sig[3])
+	if 5+lenR >= len(sig) {
+		return nil, fmt.Errorf("%w: R too long", ErrInvalidSignature)
+	}
+	lenS := int(sig[5+lenR])
+	if lenR+lenS+6 != len(sig) {
+		return nil, fmt.Errorf("%w: lengths don't match", ErrInvalidSignature)
+	}
+	if err := checkDERInteger(sig[2 : 4+lenR]); err != nil {
+		return nil, fmt.Errorf("%w: R %v", ErrInvalidSignature, err)
+	}
+	if err := checkDERInteger(sig[4+lenR:]); err != nil {
+		return nil, fmt.Errorf("%w: S %v", ErrInvalidSignature, err)
+	}
+	return &Signature{
+		R: new(big.Int).SetBytes(sig[4 : 4+lenR]),
+		S: new(big.Int).SetBytes(sig[6+lenR:]),
+	}, nil
+}
+
+// ParseDERSignatureLax parses signatures the way bitcoin core did before
+// BIP66 (libsecp256k1's lax_der_parsing), which is still used to verify
+// signatures in scripts without the DERSIG rule. Length bytes may use the
+// long form, the sequence length is ignored and integers may have leading
+// zeros. Values above the curve order give a zero signature, which never
+// verifies.
+func ParseDERSignatureLax(sig []byte) (*Signature, error) {
+	pos := 0
+	if pos == len(sig) || sig[pos] != 0x30 {
+		return nil, fmt.Errorf("%w: bad sequence", ErrInvalidSignature)
+	}
+	pos++
+	if pos == len(sig) {
+		return nil, fmt.Errorf("%w: missing length", ErrInvalidSignature)
+	}
+	lenByte := int(sig[pos])
+	pos++
+	if lenByte&0x80 != 0 {
+		lenByte -= 0x80
+		if lenByte > len(sig)-pos {
+			return nil, fmt.Errorf("%w: bad length", ErrInvalidSignature)
+		}
+		pos += lenByte
+	}
+
+	readInt := func() ([]byte, error) {
+		if pos == len(sig) || sig[pos] != 0x02 {
+			return nil, errors.New("not an integer")
+		}
+		pos++
+		if pos == len(sig) {
+			return nil, errors.New("missing length")
+		}
+		lenByte := int(sig[pos])
+		pos++
+		l := lenByte
+		if lenByte&0x80 != 0 {
+			lenByte -= 0x80
+			if lenByte > len(sig)-pos {
+				return nil, errors.New("bad length")
+			}
+			for lenByte > 0 && sig[pos] == 0 {
+				pos++
+				lenByte--
+			}
+			if lenByte >= 8 {
+				return nil, errors.New("bad length")
+			}
+			l = 0
+			for ; lenByte > 0; lenByte-- {
+				l = l<<8 + int(sig[pos])
+				pos++
+			}
+		}
+		if l > len(sig)-pos {
+			return nil, errors.New("too long")
+		}
+		v := sig[pos : pos+l]
+		pos += l
+		// Ignore leading zeros
+		for len(v) > 0 && v[0] == 0 {
+			v = v[1:]
+		}
+		return v, nil
+	}
+	r, err := readInt()
+	if err != nil {
+		return nil, fmt.Errorf("%w: R %v", ErrInvalidSignature, err)
+	}
+	s, err := readInt()
+	if err != nil {
+		return nil, fmt.Errorf("%w: S %v", ErrInvalidSignature, err)
+	}
+
+	result := &Signature{R: new(big.Int), S: new(big.Int)}
+	if len(r) > 32 || len(s) > 32 {
+		return result, nil
+	}
+	result.R.SetBytes(r)
+	result.S.SetBytes(s)
+	if result.R.Cmp(secp256k1N) >= 0 || result.S.Cmp(secp256k1N) >= 0 {
+		result.R.SetInt64(0)
+		result.S.SetInt64(0)
+	}
+	return result, nil
+}
+
+// checkDERInteger checks the type, length and encoding of an integer
+// element (type, length and value)
+func checkDERInteger(b []byte) error {
+	switch {
+	case b[0] != 0x02:
+		return errors.New("not an integer")
+	case len(b) == 2:
+		return errors.New("zero length")
+	case b[2]&0x80 != 0:
+		return errors.New("negative")
+	case len(b) > 3 && b[2] == 0x00 && b[3]&0x80 == 0:
+		return errors.New("not minimally encoded")
+	}
+	return nil
+}
+
+// Serialize returns the DER encoding of the signature
+func (sig *Signature) Serialize() []byte {
+	encode := func(v *big.Int) []byte {
+		b := v.Bytes()
+		if len(b) == 0 || b[0]&0x80 != 0 {
+			b = append([]byte{0x00}, b...)
+		}
+		return append([]byte{0x02, byte(len(b))}, b...)
+	}
+	r := encode(sig.R)
+	s := encode(sig.S)
+	out := []byte{0x30, byte(len(r) + len(s))}
+	out = append(out, r...)
+	return append(out, s...)
+}
+
+// IsLowS returns true if S is at most half the curve order (BIP62/BIP146)
+func (sig *Signature) IsLowS() bool {
+	return sig.S.Cmp(secp256k1HalfN) <= 0
+}
+
+// Normalize replaces a high S by n - S, which gives an equally valid
+// signature. It returns true if the signature was changed.
+func (sig *Signature) Normalize() bool {
+	if sig.IsLowS() {
+		return false
+	}
+	sig.S = new(big.Int).Sub(secp256k1N, sig.S)
+	return true
+}
+
+// Verify checks the ECDSA signature of the 32 byte hash. High S values are
+// accepted (as by consensus), use IsLowS to check for them.
+func (pk *PublicKey) Verify(hash []byte, sig *Signature) bool {
+	if sig.R.Sign() <= 0 || sig.R.Cmp(secp256k1N) >= 0 || sig.S.Sign() <= 0 || sig.S.Cmp(secp256k1N) >= 0 {
+		return false
+	}
+	e := new(big.Int).SetBytes(hash)
+	w := new(big.Int).ModInverse(sig.S, secp256k1N)
+	u1 := e.Mul(e, w)
+	u1.Mod(u1, secp256k1N)
+	u2 := w.Mul(w, sig.R)
+	u2.Mod(u2, secp256k1N)
+	x, _, ok := doubleScalarMult(u1, pk.X, pk.Y, u2)
+	if !ok {
+		return false
+	}
+	return x.Mod(x, secp256k1N).Cmp(sig.R) == 0
+}
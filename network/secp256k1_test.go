@@ -0,0 +1,164 @@
+package network
+
+import (
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+)
+
+// The final alert, sent to all pre-70000 clients after the retirement of
+// the alert system (https://bitcoin.org/en/alert/2016-11-01-alert-retirement)
+const finalAlertPacket = "f9beb4d9616c65727400000000000000a80000001bf9aaea" +
+	"60010000000000000000000000ffffff7f00000000ffffff7ffeffff7f01ffffff7f00000000ffffff7f00ffffff7f002f555247454e543a20416c657274206b657920636f6d70726f6d697365642c207570677261646520726571756972656400" +
+	"4630440220653febd6410f470f6bae11cad19c48413becb1ac2c17f908fd0fd53bdc3abd5202206d0e9c96fe88d4a0f01ed9dedae2b6f9e00da94cad0fecaae66ecf689bf71b50"
+
+func TestFinalAlert(t *testing.T) {
+	data, _ := hex.DecodeString(finalAlertPacket)
+	packet, rest, err := UnmarshalPacket(data, MAGIC_main)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(rest) > 0 {
+		t.Errorf(format_cosume_data, len(rest), packet)
+	}
+	alert, ok := packet.Message.(*AlertMessage)
+	if !ok {
+		t.Fatalf("Expected alert message, got %v", packet.Message)
+	}
+	if alert.ID != 0x7fffffff || alert.StatusBar != "URGENT: Alert key compromised, upgrade required" {
+		t.Errorf("Wrong alert content %v", AsJSON(alert))
+	}
+
+	// Tampered payload
+	data[24+10] ^= 1
+	data[20] = byte(checksum(data[24:]))
+	data[21] = byte(checksum(data[24:]) >> 8)
+	data[22] = byte(checksum(data[24:]) >> 16)
+	data[23] = byte(checksum(data[24:]) >> 24)
+	if _, _, err = UnmarshalPacket(data, MAGIC_main); !errors.Is(err, ErrBadAlertSignature) {
+		t.Errorf("Expected bad signature error, got %v", err)
+	}
+}
+
+func TestParsePublicKey(t *testing.T) {
+	// The generator, i.e. the public key for private key 1
+	compressed := "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+	uncompressed := "0479be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8"
+	for _, s := range []string{compressed, uncompressed, "06" + uncompressed[2:]} {
+		key, err := PublicKeyFromString(s)
+		if err != nil {
+			t.Fatalf("Unexpected error for %s: %v", s, err)
+		}
+		if key.X.Cmp(secp256k1Gx) != 0 || key.Y.Cmp(secp256k1Gy) != 0 {
+			t.Errorf("Wrong point for %s", s)
+		}
+		if hex.EncodeToString(key.SerializeCompressed()) != compressed {
+			t.Errorf("Wrong compressed encoding %x", key.SerializeCompressed())
+		}
+		if hex.EncodeToString(key.SerializeUncompressed()) != uncompressed {
+			t.Errorf("Wrong uncompressed encoding %x", key.SerializeUncompressed())
+		}
+	}
+
+	invalid := []string{
+		"",
+		"0379be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f817",                                                                   // too short
+		"020000000000000000000000000000000000000000000000000000000000000005",                                                                 // x^3+7 not a square
+		"02fffffffffffffffffffffffffffffffffffffffffffffffffffffffefffffc30",                                                                 // x >= p
+		"0579be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798",                                                                 // bad prefix
+		"0779be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b8", // wrong parity
+		"0479be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798483ada7726a3c4655da4fbfc0e1108a8fd17b448a68554199c47d08ffb10d4b9", // not on curve
+	}
+	for _, s := range invalid {
+		if _, err := PublicKeyFromString(s); !errors.Is(err, ErrInvalidPubKey) {
+			t.Errorf("Expected invalid key error for '%s', got %v", s, err)
+		}
+	}
+}
+
+func TestScalarMult(t *testing.T) {
+	// 2G and 3G computed in different ways
+	x2, y2, _ := scalarBaseMult(big.NewInt(2))
+	if x2.Text(16) != "c6047f9441ed7d6d3045406e95c07cd85c778e4b8cef3ca7abac09b95c709ee5" {
+		t.Errorf("Wrong 2G %x", x2)
+	}
+	x3, y3, _ := scalarMult(x2, y2, big.NewInt(3))
+	x6, y6, _ := scalarBaseMult(big.NewInt(6))
+	if x3.Cmp(x6) != 0 || y3.Cmp(y6) != 0 {
+		t.Errorf("3*2G != 6G")
+	}
+	if _, _, ok := scalarBaseMult(secp256k1N); ok {
+		t.Errorf("nG should be infinity")
+	}
+	if !isOnCurve(x6, y6) {
+		t.Errorf("6G not on curve")
+	}
+}
+
+func TestParseDERSignature(t *testing.T) {
+	valid := "30440220653febd6410f470f6bae11cad19c48413becb1ac2c17f908fd0fd53bdc3abd5202206d0e9c96fe88d4a0f01ed9dedae2b6f9e00da94cad0fecaae66ecf689bf71b50"
+	b, _ := hex.DecodeString(valid)
+	sig, err := ParseDERSignature(b)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hex.EncodeToString(sig.Serialize()) != valid {
+		t.Errorf("Wrong serialization %x", sig.Serialize())
+	}
+
+	invalid := []string{
+		"300602010102010100",             // too long sequence
+		"30050201010201",                 // too short
+		"3007020101020101",               // wrong sequence length
+		"3106020101020101",               // not a sequence
+		"3006030101020101",               // R not an integer
+		"30060200020201010101",           // zero length R
+		"3006020181020101",               // negative R
+		"300702020001020101",             // R not minimal
+		"3006020101020181",               // negative S
+		"300702010102020001",             // S not minimal
+		"30060201010202010101",           // S length mismatch
+		"300602010102010101" + "00",      // trailing data
+		"30" + strings.Repeat("00", 100), // too long
+	}
+	for _, s := range invalid {
+		b, _ := hex.DecodeString(s)
+		if _, err := ParseDERSignature(b); !errors.Is(err, ErrInvalidSignature) {
+			t.Errorf("Expected invalid signature error for '%s', got %v", s, err)
+		}
+	}
+}
+
+func TestVerifyLowS(t *testing.T) {
+	data, _ := hex.DecodeString(finalAlertPacket)
+	var alert AlertMessage
+	if _, err := alert.Unmarshal(data[24:]); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	key, _ := PublicKeyFromString(ALERT_PUBKEY)
+	sig, _ := ParseDERSignature(alert.Signature)
+	hash := doubleHash(alert.Payload)
+	if !sig.IsLowS() || sig.Normalize() {
+		t.Errorf("Alert signature should have low S")
+	}
+
+	// The high S version verifies as well, and normalizes back
+	high := &Signature{R: sig.R, S: new(big.Int).Sub(secp256k1N, sig.S)}
+	if high.IsLowS() || !key.Verify(hash[:], high) {
+		t.Errorf("High S signature should verify")
+	}
+	if !high.Normalize() || high.S.Cmp(sig.S) != 0 {
+		t.Errorf("Normalized signature should match")
+	}
+
+	hash[0] ^= 1
+	if key.Verify(hash[:], sig) {
+		t.Errorf("Signature should not verify for other hash")
+	}
+	hash[0] ^= 1
+	if key.Verify(hash[:], &Signature{R: sig.R, S: secp256k1N}) {
+		t.Errorf("Signature with S = n should not verify")
+	}
+}
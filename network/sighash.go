@@ -0,0 +1,340 @@
+package network
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+)
+
+// SigVersion selects the signature hash algorithm and script rules
+type SigVersion int
+
+const (
+	SigVersionBase      SigVersion = iota // legacy and P2SH scripts
+	SigVersionWitnessV0                   // P2WPKH and P2WSH (BIP143)
+	SigVersionTaproot                     // taproot key path (BIP341)
+	SigVersionTapscript                   // taproot script path (BIP342)
+)
+
+// Hash type masks for taproot signatures
+const (
+	SIGHASH_OUTPUT_MASK = 0x03
+	SIGHASH_INPUT_MASK  = 0x80
+)
+
+// ScriptExecutionData holds the data of the executed taproot script which is
+// committed to in BIP341 signature hashes
+type ScriptExecutionData struct {
+	TapleafHash      Hash   // hash of the executed leaf (tapscript only)
+	CodeSeparatorPos uint32 // opcode position of the last OP_CODESEPARATOR, 0xffffffff if none
+	AnnexPresent     bool
+	AnnexHash        Hash // sha256 of the serialized annex
+
+	// remaining validation weight for signature checks (BIP342)
+	ValidationWeightLeft int64
+}
+
+// ErrMissingPrevOuts is returned if the spent outputs needed for taproot
+// signature hashes are not given
+var ErrMissingPrevOuts = errors.New("spent outputs missing")
+
+// sighashOne is returned by the legacy algorithm for SIGHASH_SINGLE without
+// a matching output. Signing this "hash" is a well known bug, which is part
+// of the consensus rules now.
+var sighashOne = Hash{1}
+
+// PrecomputedTxData caches the hashes over all inputs and outputs of a
+// transaction, which are shared by the BIP143 and BIP341 signature hashes of
+// its inputs. Without it, verifying a transaction would be quadratic in the
+// number of inputs.
+type PrecomputedTxData struct {
+	// BIP341 single SHA256 hashes
+	PrevoutsHash     Hash
+	SequencesHash    Hash
+	OutputsHash      Hash
+	SpentAmountsHash Hash
+	SpentScriptsHash Hash
+
+	// BIP143 double SHA256 hashes
+	HashPrevouts Hash
+	HashSequence Hash
+	HashOutputs  Hash
+
+	// PrevOuts are the outputs spent by all inputs, nil if they are unknown
+	// (taproot signature hashes can't be computed then)
+	PrevOuts []TxOut
+}
+
+// NewPrecomputedTxData computes the shared hashes of tx. prevOuts may be nil
+// if only legacy and segwit v0 inputs are verified, otherwise it must have
+// an output for each input.
+func NewPrecomputedTxData(tx *Tx, prevOuts []TxOut) *PrecomputedTxData {
+	if prevOuts != nil && len(prevOuts) != len(tx.TxIn) {
+		panic(fmt.Sprintf("%d spent outputs for %d inputs", len(prevOuts), len(tx.TxIn)))
+	}
+	d := &PrecomputedTxData{
+		PrevoutsHash:  singleHash(marshalPrevouts(nil, tx)),
+		SequencesHash: singleHash(marshalSequences(nil, tx)),
+		OutputsHash:   singleHash(marshalOutputs(nil, tx)),
+	}
+	d.HashPrevouts = singleHash(d.PrevoutsHash[:])
+	d.HashSequence = singleHash(d.SequencesHash[:])
+	d.HashOutputs = singleHash(d.OutputsHash[:])
+
+	if prevOuts != nil {
+		var amounts, scripts []byte
+		for _, o := range prevOuts {
+			amounts = MarshalUint64(amounts, uint64(o.Value))
+			scripts = MarshalVarBytes(scripts, o.PkScript)
+		}
+		d.SpentAmountsHash = singleHash(amounts)
+		d.SpentScriptsHash = singleHash(scripts)
+		d.PrevOuts = prevOuts
+	}
+	return d
+}
+
+// SignatureHash computes the hash signed by ECDSA signatures in legacy and
+// segwit v0 scripts. scriptCode is the executed script (from the last
+// OP_CODESEPARATOR), amount the value of the spent output (only used for
+// segwit). txData may be nil, the BIP143 hashes are computed then.
+func SignatureHash(scriptCode []byte, tx *Tx, index int, hashType uint32, amount int64, sigVersion SigVersion, txData *PrecomputedTxData) Hash {
+	if sigVersion == SigVersionWitnessV0 {
+		if txData == nil {
+			txData = NewPrecomputedTxData(tx, nil)
+		}
+		return witnessV0SignatureHash(scriptCode, tx, index, hashType, amount, txData)
+	}
+	return legacySignatureHash(scriptCode, tx, index, hashType)
+}
+
+// legacySignatureHash serializes a modified copy of the transaction: all
+// input scripts are emptied except the signed one, which is replaced by the
+// script code without OP_CODESEPARATORs, then the hash type selects which
+// inputs and outputs are included.
+func legacySignatureHash(scriptCode []byte, tx *Tx, index int, hashType uint32) Hash {
+	if index >= len(tx.TxIn) {
+		return sighashOne
+	}
+	anyoneCanPay := hashType&SIGHASH_ANYONECANPAY != 0
+	hashSingle := hashType&0x1f == SIGHASH_SINGLE
+	hashNone := hashType&0x1f == SIGHASH_NONE
+	if hashSingle && index >= len(tx.TxOut) {
+		return sighashOne
+	}
+
+	out := MarshalUint32(nil, tx.Version)
+
+	inputs := tx.TxIn
+	if anyoneCanPay {
+		inputs = tx.TxIn[index : index+1]
+		out = MarshalVarInt(out, 1)
+	} else {
+		out = MarshalVarInt(out, uint64(len(inputs)))
+	}
+	for i, in := range inputs {
+		signed := anyoneCanPay || i == index
+		out = MarshalOutPoint(out, in.PreviousOutput)
+		if signed {
+			out = marshalScriptCode(out, scriptCode)
+		} else {
+			out = MarshalVarInt(out, 0)
+		}
+		if !signed && (hashSingle || hashNone) {
+			out = MarshalUint32(out, 0)
+		} else {
+			out = MarshalUint32(out, in.Sequence)
+		}
+	}
+
+	switch {
+	case hashNone:
+		out = MarshalVarInt(out, 0)
+	case hashSingle:
+		out = MarshalVarInt(out, uint64(index+1))
+		for i := 0; i < index; i++ {
+			out = MarshalTxOut(out, TxOut{Value: -1, PkScript: []byte{}})
+		}
+		out = MarshalTxOut(out, tx.TxOut[index])
+	default:
+		out = MarshalVarInt(out, uint64(len(tx.TxOut)))
+		for _, o := range tx.TxOut {
+			out = MarshalTxOut(out, o)
+		}
+	}
+	out = MarshalUint32(out, tx.LockTime)
+	out = MarshalUint32(out, hashType)
+	return doubleHash(out)
+}
+
+// marshalScriptCode marshals the script with all OP_CODESEPARATORs removed.
+// Like bitcoin core, the length is calculated from the whole script, while
+// a truncated push at the end is cut off after its length bytes.
+func marshalScriptCode(out []byte, script []byte) []byte {
+	separators := 0
+	for pc := 0; pc < len(script); {
+		op, _, next, ok := getScriptOp(script, pc)
+		if !ok {
+			break
+		}
+		if op == OP_CODESEPARATOR {
+			separators++
+		}
+		pc = next
+	}
+	out = MarshalVarInt(out, uint64(len(script)-separators))
+
+	begin, pc := 0, 0
+	for pc < len(script) {
+		op, _, next, ok := getScriptOp(script, pc)
+		pc = next
+		if !ok {
+			break
+		}
+		if op == OP_CODESEPARATOR {
+			out = append(out, script[begin:pc-1]...)
+			begin = pc
+		}
+	}
+	if begin != len(script) {
+		out = append(out, script[begin:pc]...)
+	}
+	return out
+}
+
+// witnessV0SignatureHash computes the BIP143 signature hash
+func witnessV0SignatureHash(scriptCode []byte, tx *Tx, index int, hashType uint32, amount int64, txData *PrecomputedTxData) Hash {
+	var hashPrevouts, hashSequence, hashOutputs Hash
+	anyoneCanPay := hashType&SIGHASH_ANYONECANPAY != 0
+	baseType := hashType & 0x1f
+
+	if !anyoneCanPay {
+		hashPrevouts = txData.HashPrevouts
+	}
+	if !anyoneCanPay && baseType != SIGHASH_SINGLE && baseType != SIGHASH_NONE {
+		hashSequence = txData.HashSequence
+	}
+	if baseType != SIGHASH_SINGLE && baseType != SIGHASH_NONE {
+		hashOutputs = txData.HashOutputs
+	} else if baseType == SIGHASH_SINGLE && index < len(tx.TxOut) {
+		hashOutputs = doubleHash(MarshalTxOut(nil, tx.TxOut[index]))
+	}
+
+	in := tx.TxIn[index]
+	out := MarshalUint32(nil, tx.Version)
+	out = MarshalHash(out, hashPrevouts)
+	out = MarshalHash(out, hashSequence)
+	out = MarshalOutPoint(out, in.PreviousOutput)
+	out = MarshalVarBytes(out, scriptCode)
+	out = MarshalUint64(out, uint64(amount))
+	out = MarshalUint32(out, in.Sequence)
+	out = MarshalHash(out, hashOutputs)
+	out = MarshalUint32(out, tx.LockTime)
+	out = MarshalUint32(out, hashType)
+	return doubleHash(out)
+}
+
+func marshalPrevouts(out []byte, tx *Tx) []byte {
+	for _, in := range tx.TxIn {
+		out = MarshalOutPoint(out, in.PreviousOutput)
+	}
+	return out
+}
+
+func marshalSequences(out []byte, tx *Tx) []byte {
+	for _, in := range tx.TxIn {
+		out = MarshalUint32(out, in.Sequence)
+	}
+	return out
+}
+
+func marshalOutputs(out []byte, tx *Tx) []byte {
+	for _, o := range tx.TxOut {
+		out = MarshalTxOut(out, o)
+	}
+	return out
+}
+
+func singleHash(data []byte) Hash {
+	return sha256.Sum256(data)
+}
+
+// TaprootSignatureHash computes the BIP341 signature hash for key path
+// (SigVersionTaproot) and script path (SigVersionTapscript) spends. txData
+// must contain the outputs spent by all inputs of the transaction, execData
+// provides the annex and for tapscript the leaf and OP_CODESEPARATOR
+// position.
+func TaprootSignatureHash(tx *Tx, index int, hashType byte, sigVersion SigVersion, execData *ScriptExecutionData, txData *PrecomputedTxData) (Hash, error) {
+	msg, err := taprootSigMsg(tx, index, hashType, sigVersion, execData, txData)
+	if err != nil {
+		return Hash{}, err
+	}
+	return TaggedHash("TapSighash", msg), nil
+}
+
+// taprootSigMsg serializes the message hashed by TaprootSignatureHash
+func taprootSigMsg(tx *Tx, index int, hashType byte, sigVersion SigVersion, execData *ScriptExecutionData, txData *PrecomputedTxData) ([]byte, error) {
+	if txData == nil || txData.PrevOuts == nil {
+		return nil, ErrMissingPrevOuts
+	}
+	if !(hashType <= 0x03 || (hashType >= 0x81 && hashType <= 0x83)) {
+		return nil, fmt.Errorf("%w: 0x%02x", ErrSchnorrSigHashType, hashType)
+	}
+	var extFlag byte
+	if sigVersion == SigVersionTapscript {
+		extFlag = 1
+	}
+	outputType := hashType & SIGHASH_OUTPUT_MASK
+	if hashType == SIGHASH_DEFAULT {
+		outputType = SIGHASH_ALL
+	}
+	inputType := hashType & SIGHASH_INPUT_MASK
+
+	// Epoch
+	out := []byte{0x00}
+	out = append(out, hashType)
+	out = MarshalUint32(out, tx.Version)
+	out = MarshalUint32(out, tx.LockTime)
+	if inputType != SIGHASH_ANYONECANPAY {
+		out = MarshalHash(out, txData.PrevoutsHash)
+		out = MarshalHash(out, txData.SpentAmountsHash)
+		out = MarshalHash(out, txData.SpentScriptsHash)
+		out = MarshalHash(out, txData.SequencesHash)
+	}
+	if outputType == SIGHASH_ALL {
+		out = MarshalHash(out, txData.OutputsHash)
+	}
+
+	// The spent input, the low bit of the spend type indicates an annex
+	spendType := extFlag << 1
+	if execData.AnnexPresent {
+		spendType |= 1
+	}
+	out = append(out, spendType)
+	if inputType == SIGHASH_ANYONECANPAY {
+		out = MarshalOutPoint(out, tx.TxIn[index].PreviousOutput)
+		out = MarshalTxOut(out, txData.PrevOuts[index])
+		out = MarshalUint32(out, tx.TxIn[index].Sequence)
+	} else {
+		out = MarshalUint32(out, uint32(index))
+	}
+	if execData.AnnexPresent {
+		out = MarshalHash(out, execData.AnnexHash)
+	}
+
+	// The output with the same index for SIGHASH_SINGLE
+	if outputType == SIGHASH_SINGLE {
+		if index >= len(tx.TxOut) {
+			return nil, fmt.Errorf("%w: no output %d for SIGHASH_SINGLE", ErrSchnorrSigHashType, index)
+		}
+		out = MarshalHash(out, singleHash(MarshalTxOut(nil, tx.TxOut[index])))
+	}
+
+	// BIP342 extension: leaf hash, key version and OP_CODESEPARATOR position
+	if sigVersion == SigVersionTapscript {
+		out = MarshalHash(out, execData.TapleafHash)
+		out = append(out, 0x00)
+		out = MarshalUint32(out, execData.CodeSeparatorPos)
+	}
+	return out, nil
+}
@@ -0,0 +1,261 @@
+package network
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSighashJSON(t *testing.T) {
+	for i, test := range loadTestJSON(t, "sighash.json") {
+		if len(test) < 5 {
+			// comment
+			continue
+		}
+		tx, err := TxFromHex(test[0].(string))
+		if err != nil {
+			t.Fatalf("test %d: bad tx: %v", i, err)
+		}
+		expected, err := RPCStringToHash(test[4].(string))
+		if err != nil {
+			t.Fatalf("test %d: bad hash: %v", i, err)
+		}
+		index := int(test[2].(float64))
+		hashType := uint32(int32(test[3].(float64)))
+		hash := SignatureHash(h2b(test[1].(string)), &tx, index, hashType, 0, SigVersionBase, nil)
+		if hash != expected {
+			t.Errorf("test %d: wrong hash %v, expected %v", i, hash, expected)
+		}
+	}
+}
+
+func TestSighashSingleBug(t *testing.T) {
+	tx := Tx{
+		Version: 1,
+		TxIn:    []TxIn{{Sequence: SEQUENCE_FINAL}, {Sequence: SEQUENCE_FINAL}},
+		TxOut:   []TxOut{{Value: 1, PkScript: []byte{OP_TRUE}}},
+	}
+	if hash := SignatureHash(nil, &tx, 1, SIGHASH_SINGLE, 0, SigVersionBase, nil); hash != sighashOne {
+		t.Errorf("Expected the SIGHASH_SINGLE bug, got %v", hash)
+	}
+	if hash := SignatureHash(nil, &tx, 0, SIGHASH_SINGLE, 0, SigVersionBase, nil); hash == sighashOne {
+		t.Errorf("Unexpected one hash for a matching output")
+	}
+	// BIP143 signs an empty output hash instead
+	if hash := SignatureHash(nil, &tx, 1, SIGHASH_SINGLE, 0, SigVersionWitnessV0, nil); hash == sighashOne {
+		t.Errorf("Unexpected one hash for segwit")
+	}
+}
+
+func TestSighashPrecomputed(t *testing.T) {
+	tests := loadTestJSON(t, "sighash.json")
+	hashTypes := []uint32{
+		SIGHASH_ALL, SIGHASH_NONE, SIGHASH_SINGLE,
+		SIGHASH_ALL | SIGHASH_ANYONECANPAY, SIGHASH_NONE | SIGHASH_ANYONECANPAY, SIGHASH_SINGLE | SIGHASH_ANYONECANPAY,
+	}
+	for i, test := range tests[1:20] {
+		tx, err := TxFromHex(test[0].(string))
+		if err != nil {
+			t.Fatalf("test %d: bad tx: %v", i, err)
+		}
+		txData := NewPrecomputedTxData(&tx, nil)
+		script := h2b(test[1].(string))
+		for index := range tx.TxIn {
+			for _, hashType := range hashTypes {
+				cached := SignatureHash(script, &tx, index, hashType, 1000, SigVersionWitnessV0, txData)
+				if cached != SignatureHash(script, &tx, index, hashType, 1000, SigVersionWitnessV0, nil) {
+					t.Errorf("test %d: cached hash differs for input %d, hash type %x", i, index, hashType)
+				}
+			}
+		}
+	}
+}
+
+// TestSighashBIP143 checks the signature hashes of the native P2WPKH and
+// the P2SH-P2WPKH examples of BIP143
+func TestSighashBIP143(t *testing.T) {
+	tests := []struct {
+		tx         string
+		index      int
+		scriptCode string
+		amount     int64
+		hash       string
+	}{
+		{
+			"0100000002fff7f7881a8099afa6940d42d1e7f6362bec38171ea3edf433541db4e4ad969f0000000000eeffffffef51e1b804cc89d182d279655c3aa89e815b1b309fe287d9b2b55d57b90ec68a0100000000ffffffff02202cb206000000001976a9148280b37df378db99f66f85c95a783a76ac7a6d5988ac9093510d000000001976a9143bde42dbee7e4dbe6a21b2d50ce2f0167faa815988ac11000000",
+			1, "76a9141d0f172a0ecb48aee1be1f2687d2963ae33f71a188ac", 600000000,
+			"c37af31116d1b27caf68aae9e3ac82f1477929014d5b917657d0eb49478cb670",
+		},
+		{
+			"0100000001db6b1b20aa0fd7b23880be2ecbd4a98130974cf4748fb66092ac4d3ceb1a54770100000000feffffff02b8b4eb0b000000001976a914a457b684d7f0d539a46a45bbc043f35b59d0d96388ac0008af2f000000001976a914fd270b1ee6abcaea97fea7ad0402e8bd8ad6d77c88ac92040000",
+			0, "76a91479091972186c449eb1ded22b78e40d009bdf008988ac", 1000000000,
+			"64f3b0f4dd2bb3aa1ce8566d220cc74dda9df97d8490cc81d89d735c92e59fb6",
+		},
+	}
+	for i, test := range tests {
+		tx, err := TxFromHex(test.tx)
+		if err != nil {
+			t.Fatalf("test %d: bad tx: %v", i, err)
+		}
+		for _, txData := range []*PrecomputedTxData{nil, NewPrecomputedTxData(&tx, nil)} {
+			hash := SignatureHash(h2b(test.scriptCode), &tx, test.index, SIGHASH_ALL, test.amount, SigVersionWitnessV0, txData)
+			if hex.EncodeToString(hash[:]) != test.hash {
+				t.Errorf("test %d: wrong hash %x", i, hash)
+			}
+		}
+	}
+}
+
+func TestTaprootSignatureHash(t *testing.T) {
+	tx := Tx{
+		Version: 2,
+		TxIn:    []TxIn{{Sequence: SEQUENCE_FINAL}, {PreviousOutput: OutPoint{Index: 1}, Sequence: SEQUENCE_FINAL}},
+		TxOut:   []TxOut{{Value: 1, PkScript: []byte{OP_TRUE}}},
+	}
+	prevOuts := []TxOut{{Value: 2, PkScript: []byte{OP_1, 0x20}}, {Value: 3, PkScript: []byte{OP_1, 0x20}}}
+	execData := &ScriptExecutionData{CodeSeparatorPos: 0xffffffff}
+
+	if _, err := TaprootSignatureHash(&tx, 0, SIGHASH_DEFAULT, SigVersionTaproot, execData, NewPrecomputedTxData(&tx, nil)); !errors.Is(err, ErrMissingPrevOuts) {
+		t.Errorf("Expected missing prevouts, got %v", err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Errorf("No panic for prevouts not matching the inputs")
+			}
+		}()
+		NewPrecomputedTxData(&tx, prevOuts[:1])
+	}()
+	txData := NewPrecomputedTxData(&tx, prevOuts)
+	for _, hashType := range []byte{0x04, 0x80, 0x84, 0xff} {
+		if _, err := TaprootSignatureHash(&tx, 0, hashType, SigVersionTaproot, execData, txData); !errors.Is(err, ErrSchnorrSigHashType) {
+			t.Errorf("Expected invalid hash type for %x, got %v", hashType, err)
+		}
+	}
+	if _, err := TaprootSignatureHash(&tx, 1, SIGHASH_SINGLE, SigVersionTaproot, execData, txData); !errors.Is(err, ErrSchnorrSigHashType) {
+		t.Errorf("Expected an error for SIGHASH_SINGLE without output, got %v", err)
+	}
+
+	// Every hash type, the annex and the tapscript extension commit to
+	// different data
+	seen := make(map[Hash]bool)
+	for _, hashType := range []byte{0x00, 0x01, 0x02, 0x03, 0x81, 0x82, 0x83} {
+		for _, sigVersion := range []SigVersion{SigVersionTaproot, SigVersionTapscript} {
+			for _, annex := range []bool{false, true} {
+				data := *execData
+				data.AnnexPresent = annex
+				data.AnnexHash = singleHash([]byte{ANNEX_TAG})
+				hash, err := TaprootSignatureHash(&tx, 0, hashType, sigVersion, &data, txData)
+				if err != nil {
+					t.Fatalf("Unexpected error for %x: %v", hashType, err)
+				}
+				if seen[hash] {
+					t.Errorf("Duplicate hash for %x (version %d, annex %v)", hashType, sigVersion, annex)
+				}
+				seen[hash] = true
+			}
+		}
+	}
+}
+
+// bip341KeyPathVectors is the keyPathSpending part of the BIP341 wallet test
+// vectors (bip-0341/wallet-test-vectors.json), without the private keys
+type bip341KeyPathVectors struct {
+	KeyPathSpending []struct {
+		Given struct {
+			RawUnsignedTx string `json:"rawUnsignedTx"`
+			UtxosSpent    []struct {
+				ScriptPubKey string `json:"scriptPubKey"`
+				AmountSats   int64  `json:"amountSats"`
+			} `json:"utxosSpent"`
+		} `json:"given"`
+		Intermediary struct {
+			HashAmounts       string `json:"hashAmounts"`
+			HashOutputs       string `json:"hashOutputs"`
+			HashPrevouts      string `json:"hashPrevouts"`
+			HashScriptPubkeys string `json:"hashScriptPubkeys"`
+			HashSequences     string `json:"hashSequences"`
+		} `json:"intermediary"`
+		InputSpending []struct {
+			Given struct {
+				TxinIndex int  `json:"txinIndex"`
+				HashType  byte `json:"hashType"`
+			} `json:"given"`
+			Intermediary struct {
+				SigMsg  string `json:"sigMsg"`
+				SigHash string `json:"sigHash"`
+			} `json:"intermediary"`
+			Expected struct {
+				Witness []string `json:"witness"`
+			} `json:"expected"`
+		} `json:"inputSpending"`
+	} `json:"keyPathSpending"`
+}
+
+func TestBIP341KeyPathVectors(t *testing.T) {
+	data, err := ioutil.ReadFile("testdata/bip341-wallet-vectors.json")
+	if err != nil {
+		t.Fatalf("Can't read test data: %v", err)
+	}
+	var vectors bip341KeyPathVectors
+	if err = json.Unmarshal(data, &vectors); err != nil {
+		t.Fatalf("Can't parse test data: %v", err)
+	}
+	for _, v := range vectors.KeyPathSpending {
+		tx, err := TxFromHex(v.Given.RawUnsignedTx)
+		if err != nil {
+			t.Fatalf("Bad tx: %v", err)
+		}
+		prevOuts := make([]TxOut, len(v.Given.UtxosSpent))
+		for i, utxo := range v.Given.UtxosSpent {
+			prevOuts[i] = TxOut{Value: utxo.AmountSats, PkScript: h2b(utxo.ScriptPubKey)}
+		}
+		txData := NewPrecomputedTxData(&tx, prevOuts)
+		for _, h := range []struct {
+			name     string
+			got      Hash
+			expected string
+		}{
+			{"hashAmounts", txData.SpentAmountsHash, v.Intermediary.HashAmounts},
+			{"hashOutputs", txData.OutputsHash, v.Intermediary.HashOutputs},
+			{"hashPrevouts", txData.PrevoutsHash, v.Intermediary.HashPrevouts},
+			{"hashScriptPubkeys", txData.SpentScriptsHash, v.Intermediary.HashScriptPubkeys},
+			{"hashSequences", txData.SequencesHash, v.Intermediary.HashSequences},
+		} {
+			if hex.EncodeToString(h.got[:]) != h.expected {
+				t.Errorf("Wrong %s %x", h.name, h.got)
+			}
+		}
+
+		for _, input := range v.InputSpending {
+			index := input.Given.TxinIndex
+			execData := &ScriptExecutionData{CodeSeparatorPos: 0xffffffff}
+			msg, err := taprootSigMsg(&tx, index, input.Given.HashType, SigVersionTaproot, execData, txData)
+			if err != nil {
+				t.Fatalf("Input %d: unexpected error: %v", index, err)
+			}
+			if hex.EncodeToString(msg) != input.Intermediary.SigMsg {
+				t.Errorf("Input %d: wrong sigMsg %x", index, msg)
+			}
+			hash, err := TaprootSignatureHash(&tx, index, input.Given.HashType, SigVersionTaproot, execData, txData)
+			if err != nil {
+				t.Fatalf("Input %d: unexpected error: %v", index, err)
+			}
+			if hex.EncodeToString(hash[:]) != input.Intermediary.SigHash {
+				t.Errorf("Input %d: wrong sigHash %x", index, hash)
+			}
+
+			// The expected signature is valid for the output key
+			witness := h2b(input.Expected.Witness[0])
+			key, err := ParseXOnlyPublicKey(prevOuts[index].PkScript[2:])
+			if err != nil {
+				t.Fatalf("Input %d: bad output key: %v", index, err)
+			}
+			if !key.VerifySchnorr(hash[:], witness[:64]) {
+				t.Errorf("Input %d: signature does not verify", index)
+			}
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package network
+
+import (
+	"fmt"
+)
+
+// Maximum number of headers a peer sends in reply to getheaders
+const MAX_HEADERS_RESULTS = 2000
+
+// HeaderSync downloads the headers from a peer (headers first sync). It sends
+// getheaders messages with a locator built from its chain, until the peer
+// returns less than MAX_HEADERS_RESULTS headers, which means we are at the
+// tip of the peer's chain.
+type HeaderSync struct {
+	client  MessageConn
+	chain   *HeaderChain
+	Version uint32 // protocol version sent in getheaders
+
+	// Called after each batch of headers has been added to the chain
+	Progress func(tip *HeaderNode, received int)
+}
+
+func NewHeaderSync(cl MessageConn, chain *HeaderChain, version uint32) *HeaderSync {
+	return &HeaderSync{
+		client:  cl,
+		chain:   chain,
+		Version: version,
+		Progress: func(tip *HeaderNode, received int) {
+			fmt.Printf("Received %d headers, tip now at height %d (%v, %v)\n",
+				received, tip.Height, tip.Hash.RPCString(), tip.Timestamp)
+		},
+	}
+}
+
+// Run syncs headers until the peer has no more headers to give and returns
+// the resulting tip
+func (sync *HeaderSync) Run() (*HeaderNode, error) {
+	for {
+		err := sync.client.SendMessage(&GetHeadersMessage{
+			Version:        sync.Version,
+			BlockLocHashes: sync.chain.BlockLocator(),
+			StopHash:       Hash{},
+		})
+		if err != nil {
+			return sync.chain.Tip(), err
+		}
+		headers, err := sync.receiveHeaders()
+		if err != nil {
+			return sync.chain.Tip(), err
+		}
+		if err := sync.chain.AddHeaders(headers); err != nil {
+			return sync.chain.Tip(), err
+		}
+		if sync.Progress != nil {
+			sync.Progress(sync.chain.Tip(), len(headers))
+		}
+		if len(headers) < MAX_HEADERS_RESULTS {
+			return sync.chain.Tip(), nil
+		}
+	}
+}
+
+// receiveHeaders waits for the next headers message and ignores all other
+// messages
+func (sync *HeaderSync) receiveHeaders() ([]Header, error) {
+	for {
+		msg, command, err := sync.client.ReceiveMessage()
+		if err != nil {
+			return nil, err
+		}
+		if headers, ok := (*msg).(*HeadersMessage); ok {
+			if len(headers.Headers) > MAX_HEADERS_RESULTS {
+				return nil, fmt.Errorf("peer sent too many headers (%d)", len(headers.Headers))
+			}
+			return headers.Headers, nil
+		}
+		fmt.Printf("Ignoring '%s' message while waiting for headers\n", command)
+	}
+}
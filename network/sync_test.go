@@ -0,0 +1,64 @@
+package network
+
+import (
+	"net"
+	"testing"
+)
+
+// serveHeaders answers getheaders messages from the headers in chain, as a
+// real peer would do
+func serveHeaders(conn net.Conn, chain *HeaderChain) {
+	peer := Client(conn, MAGIC_testnet3)
+	for {
+		msg, _, err := peer.ReceiveMessage()
+		if err != nil {
+			return
+		}
+		getheaders, ok := (*msg).(*GetHeadersMessage)
+		if !ok {
+			continue
+		}
+		start := 0
+		for _, hash := range getheaders.BlockLocHashes {
+			if node := chain.Lookup(hash); node != nil {
+				start = node.Height + 1
+				break
+			}
+		}
+		headers := []Header{}
+		for h := start; h <= chain.Height() && len(headers) < MAX_HEADERS_RESULTS; h++ {
+			headers = append(headers, chain.NodeAt(h).Header)
+		}
+		peer.SendMessage(&HeadersMessage{Headers: headers})
+	}
+}
+
+func TestHeaderSync(t *testing.T) {
+	genesis := RegTestParams.GenesisHeader
+	peerChain := NewHeaderChain(&RegTestParams)
+	if err := peerChain.AddHeaders(mineHeaders(genesis, MAX_HEADERS_RESULTS+10)); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	conn, peerConn := net.Pipe()
+	defer conn.Close()
+	go serveHeaders(peerConn, peerChain)
+
+	cl := Client(conn, MAGIC_testnet3)
+	chain := NewHeaderChain(&RegTestParams)
+	sync := NewHeaderSync(&cl, chain, 70015)
+	batches := []int{}
+	sync.Progress = func(tip *HeaderNode, received int) {
+		batches = append(batches, received)
+	}
+	tip, err := sync.Run()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if tip.Hash != peerChain.Tip().Hash || tip.Height != MAX_HEADERS_RESULTS+10 {
+		t.Errorf("Wrong tip after sync %v (height %d)", tip.Hash, tip.Height)
+	}
+	if len(batches) != 2 || batches[0] != MAX_HEADERS_RESULTS || batches[1] != 10 {
+		t.Errorf("Wrong batches received: %v", batches)
+	}
+}
@@ -0,0 +1,167 @@
+package network
+
+import "time"
+
+// Default time to wait for a requested object before asking another peer
+const INV_REQUEST_TIMEOUT = 60 * time.Second
+
+// InvTracker keeps track of announced inventory and of the getdata requests
+// in flight. Each object is requested from only one peer at a time. If that
+// peer does not deliver in time, replies with notfound or disconnects, the
+// object is requested from the next peer that announced it.
+//
+// Peers are identified by a string (e.g. their address). The tracker does
+// not send anything itself, it returns the invs to request per peer. Objects
+// the caller already has must be filtered out before calling Announce. The
+// tracker is not safe for concurrent use.
+type InvTracker struct {
+	Timeout time.Duration
+	invs    map[Inv]*invRequest
+	peers   map[string]int // number of requests in flight per peer
+}
+
+type invRequest struct {
+	peer       string    // peer the object was requested from
+	sent       time.Time // time of the request
+	candidates []string  // other peers that announced the object, in order
+}
+
+func NewInvTracker() *InvTracker {
+	return &InvTracker{
+		Timeout: INV_REQUEST_TIMEOUT,
+		invs:    make(map[Inv]*invRequest),
+		peers:   make(map[string]int),
+	}
+}
+
+// Announce records that peer has announced the given invs and returns the
+// ones which should be requested from it now, i.e. which are not already in
+// flight to another peer
+func (t *InvTracker) Announce(peer string, invs []Inv, now time.Time) []Inv {
+	var request []Inv
+	for _, inv := range invs {
+		req, ok := t.invs[inv]
+		if !ok {
+			t.invs[inv] = &invRequest{peer: peer, sent: now}
+			t.peers[peer]++
+			request = append(request, inv)
+			continue
+		}
+		if req.peer == peer || containsString(req.candidates, peer) {
+			continue
+		}
+		req.candidates = append(req.candidates, peer)
+	}
+	return request
+}
+
+// Received marks the object as delivered. It returns false if the object
+// was not requested from this peer, i.e. it was unsolicited.
+func (t *InvTracker) Received(peer string, inv Inv) bool {
+	req, ok := t.invs[inv]
+	if !ok || req.peer != peer {
+		return false
+	}
+	t.remove(inv, req)
+	return true
+}
+
+// NotFound handles a notfound reply. The objects are requested from the
+// next candidate peer, if there is one.
+func (t *InvTracker) NotFound(peer string, invs []Inv, now time.Time) map[string][]Inv {
+	retry := make(map[string][]Inv)
+	for _, inv := range invs {
+		if req, ok := t.invs[inv]; ok && req.peer == peer {
+			t.next(inv, req, now, retry)
+		}
+	}
+	return retry
+}
+
+// Expire re-requests all objects which have been in flight for longer than
+// the timeout from the next candidate peer. Objects without other
+// candidates are forgotten.
+func (t *InvTracker) Expire(now time.Time) map[string][]Inv {
+	retry := make(map[string][]Inv)
+	for inv, req := range t.invs {
+		if now.Sub(req.sent) >= t.Timeout {
+			t.next(inv, req, now, retry)
+		}
+	}
+	return retry
+}
+
+// RemovePeer forgets about the peer and re-requests the objects in flight
+// to it from other peers
+func (t *InvTracker) RemovePeer(peer string, now time.Time) map[string][]Inv {
+	retry := make(map[string][]Inv)
+	for inv, req := range t.invs {
+		if req.peer == peer {
+			t.next(inv, req, now, retry)
+		} else if i := stringIndex(req.candidates, peer); i >= 0 {
+			req.candidates = append(req.candidates[:i], req.candidates[i+1:]...)
+		}
+	}
+	delete(t.peers, peer)
+	return retry
+}
+
+// InFlight returns the number of objects requested from peer and not yet
+// delivered
+func (t *InvTracker) InFlight(peer string) int {
+	return t.peers[peer]
+}
+
+// Requested returns the peer the object is currently requested from
+func (t *InvTracker) Requested(inv Inv) (string, bool) {
+	req, ok := t.invs[inv]
+	if !ok {
+		return "", false
+	}
+	return req.peer, true
+}
+
+// Len returns the number of tracked objects
+func (t *InvTracker) Len() int {
+	return len(t.invs)
+}
+
+// next moves the request to the next candidate and adds it to retry, or
+// forgets it if there is none
+func (t *InvTracker) next(inv Inv, req *invRequest, now time.Time, retry map[string][]Inv) {
+	if len(req.candidates) == 0 {
+		t.remove(inv, req)
+		return
+	}
+	t.release(req.peer)
+	req.peer, req.candidates = req.candidates[0], req.candidates[1:]
+	req.sent = now
+	t.peers[req.peer]++
+	retry[req.peer] = append(retry[req.peer], inv)
+}
+
+func (t *InvTracker) remove(inv Inv, req *invRequest) {
+	t.release(req.peer)
+	delete(t.invs, inv)
+}
+
+func (t *InvTracker) release(peer string) {
+	if t.peers[peer] <= 1 {
+		delete(t.peers, peer)
+	} else {
+		t.peers[peer]--
+	}
+}
+
+func stringIndex(list []string, s string) int {
+	for i, x := range list {
+		if x == s {
+			return i
+		}
+	}
+	return -1
+}
+
+func containsString(list []string, s string) bool {
+	return stringIndex(list, s) >= 0
+}
@@ -0,0 +1,85 @@
+package network
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestInvTrackerAnnounce(t *testing.T) {
+	tracker := NewInvTracker()
+	now := time.Unix(1600000000, 0)
+	a := Inv{MSG_TX, s2h("01")}
+	b := Inv{MSG_TX, s2h("02")}
+
+	got := tracker.Announce("peer1", []Inv{a, b}, now)
+	if !reflect.DeepEqual(got, []Inv{a, b}) {
+		t.Errorf("Expected both invs to be requested, got %v", got)
+	}
+	// Already in flight, nothing to request from the second peer
+	if got = tracker.Announce("peer2", []Inv{a}, now); len(got) > 0 {
+		t.Errorf("Inv in flight should not be requested again, got %v", got)
+	}
+	if tracker.InFlight("peer1") != 2 || tracker.InFlight("peer2") != 0 {
+		t.Errorf("Wrong in flight count %d %d", tracker.InFlight("peer1"), tracker.InFlight("peer2"))
+	}
+
+	if tracker.Received("peer2", a) {
+		t.Errorf("Inv from wrong peer should be unsolicited")
+	}
+	if !tracker.Received("peer1", a) {
+		t.Errorf("Requested inv should be solicited")
+	}
+	if tracker.Received("peer1", a) {
+		t.Errorf("Inv should only be received once")
+	}
+	if tracker.InFlight("peer1") != 1 || tracker.Len() != 1 {
+		t.Errorf("Wrong in flight count %d (len %d)", tracker.InFlight("peer1"), tracker.Len())
+	}
+}
+
+func TestInvTrackerRetry(t *testing.T) {
+	tracker := NewInvTracker()
+	now := time.Unix(1600000000, 0)
+	a := Inv{MSG_BLOCK, s2h("01")}
+	b := Inv{MSG_BLOCK, s2h("02")}
+	tracker.Announce("peer1", []Inv{a, b}, now)
+	tracker.Announce("peer2", []Inv{a, b}, now)
+	tracker.Announce("peer3", []Inv{a}, now)
+
+	// Nothing expired yet
+	if retry := tracker.Expire(now.Add(tracker.Timeout - time.Second)); len(retry) > 0 {
+		t.Errorf("Nothing should have expired, got %v", retry)
+	}
+
+	// peer1 doesn't have a, ask peer2
+	retry := tracker.NotFound("peer1", []Inv{a}, now)
+	if !reflect.DeepEqual(retry, map[string][]Inv{"peer2": {a}}) {
+		t.Errorf("Wrong retry after notfound %v", retry)
+	}
+
+	// peer1 times out on b, peer2 too slow on a as well
+	now = now.Add(tracker.Timeout)
+	retry = tracker.Expire(now)
+	exp := map[string][]Inv{"peer2": {b}, "peer3": {a}}
+	if !reflect.DeepEqual(retry, exp) {
+		t.Errorf("Wrong retry after timeout %v != %v", retry, exp)
+	}
+	if peer, _ := tracker.Requested(a); peer != "peer3" {
+		t.Errorf("Inv should be requested from peer3, not %v", peer)
+	}
+
+	// peer2 disconnects, no other candidate for b
+	if retry = tracker.RemovePeer("peer2", now); len(retry) > 0 {
+		t.Errorf("No retry expected, got %v", retry)
+	}
+	if _, ok := tracker.Requested(b); ok {
+		t.Errorf("Inv without candidates should be forgotten")
+	}
+
+	// peer3 disconnects as well
+	tracker.RemovePeer("peer3", now)
+	if tracker.Len() != 0 || tracker.InFlight("peer1") != 0 {
+		t.Errorf("Tracker should be empty (len %d)", tracker.Len())
+	}
+}
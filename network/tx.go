@@ -0,0 +1,403 @@
+package network
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// OutPoint references an output of a previous transaction
+type OutPoint struct {
+	Hash  Hash   // hash (txid) of the referenced transaction
+	Index uint32 // index of the specific output in the transaction (first output is 0)
+}
+
+func MarshalOutPoint(out []byte, v OutPoint) []byte {
+	out = MarshalHash(out, v.Hash)
+	out = MarshalUint32(out, v.Index)
+	return out
+}
+
+func UnmarshalOutPoint(data []byte) (OutPoint, []byte, error) {
+	var v OutPoint
+	var err error
+	if v.Hash, data, err = UnmarshalHash(data); err != nil {
+		return v, data, err
+	}
+	v.Index, data, err = UnmarshalUint32(data)
+	return v, data, err
+}
+
+// TxIn is a transaction input
+type TxIn struct {
+	PreviousOutput  OutPoint // the previous output transaction reference
+	SignatureScript []byte   // computational script for confirming transaction authorization
+	Sequence        uint32   // transaction version as defined by the sender (used for relative lock times)
+	Witness         [][]byte // witness stack (BIP144), only marshalled as part of the transaction
+}
+
+// MarshalTxIn marshals the input without its witness
+func MarshalTxIn(out []byte, v TxIn) []byte {
+	out = MarshalOutPoint(out, v.PreviousOutput)
+	out = MarshalVarBytes(out, v.SignatureScript)
+	out = MarshalUint32(out, v.Sequence)
+	return out
+}
+
+func UnmarshalTxIn(data []byte) (TxIn, []byte, error) {
+	var v TxIn
+	var err error
+	if v.PreviousOutput, data, err = UnmarshalOutPoint(data); err != nil {
+		return v, data, err
+	}
+	if v.SignatureScript, data, err = UnmarshalVarBytes(data); err != nil {
+		return v, data, err
+	}
+	v.Sequence, data, err = UnmarshalUint32(data)
+	return v, data, err
+}
+
+// TxOut is a transaction output
+type TxOut struct {
+	Value    int64  // transaction value in satoshis
+	PkScript []byte // script containing the conditions to claim this output
+}
+
+func MarshalTxOut(out []byte, v TxOut) []byte {
+	out = MarshalUint64(out, uint64(v.Value))
+	out = MarshalVarBytes(out, v.PkScript)
+	return out
+}
+
+func UnmarshalTxOut(data []byte) (TxOut, []byte, error) {
+	var v TxOut
+	value, data, err := UnmarshalUint64(data)
+	if err != nil {
+		return v, data, err
+	}
+	v.Value = int64(value)
+	v.PkScript, data, err = UnmarshalVarBytes(data)
+	return v, data, err
+}
+
+// Witness stacks are marshalled as a list of byte arrays
+func MarshalWitness(out []byte, v [][]byte) []byte {
+	out = MarshalVarInt(out, uint64(len(v)))
+	for _, item := range v {
+		out = MarshalVarBytes(out, item)
+	}
+	return out
+}
+
+func UnmarshalWitness(data []byte) ([][]byte, []byte, error) {
+	l, data, err := UnmarshalLength(data)
+	if err != nil {
+		return nil, data, err
+	}
+	if err = checkCount(data, l, 1); err != nil {
+		return nil, data, err
+	}
+	v := make([][]byte, l)
+	for i := range v {
+		if v[i], data, err = UnmarshalVarBytes(data); err != nil {
+			return nil, data, err
+		}
+	}
+	return v, data, nil
+}
+
+// Tx is a bitcoin transaction
+type Tx struct {
+	Version  uint32 // transaction data format version (note, this is signed)
+	TxIn     []TxIn
+	TxOut    []TxOut
+	LockTime uint32 // the block number or timestamp at which this transaction is unlocked
+}
+
+// Errors returned when unmarshalling transactions
+var (
+	ErrUnknownTxData      = errors.New("unknown transaction optional data")
+	ErrSuperfluousWitness = errors.New("superfluous witness record")
+	ErrTrailingTxData     = errors.New("data after end of transaction")
+)
+
+// HasWitness returns true if any of the inputs has witness data
+func (tx *Tx) HasWitness() bool {
+	for _, in := range tx.TxIn {
+		if len(in.Witness) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalTx marshals the transaction. If it has witness data, the BIP144
+// format with marker and flag is used, otherwise the original format.
+func MarshalTx(out []byte, v Tx) []byte {
+	return marshalTx(out, v, v.HasWitness())
+}
+
+// MarshalTxNoWitness marshals the transaction in the original format
+// without witness data (as used for the txid)
+func MarshalTxNoWitness(out []byte, v Tx) []byte {
+	return marshalTx(out, v, false)
+}
+
+func marshalTx(out []byte, v Tx, witness bool) []byte {
+	out = MarshalUint32(out, v.Version)
+	if witness {
+		// marker and flag
+		out = MarshalUint8(out, 0x00)
+		out = MarshalUint8(out, 0x01)
+	}
+	out = MarshalVarInt(out, uint64(len(v.TxIn)))
+	for _, in := range v.TxIn {
+		out = MarshalTxIn(out, in)
+	}
+	out = MarshalVarInt(out, uint64(len(v.TxOut)))
+	for _, o := range v.TxOut {
+		out = MarshalTxOut(out, o)
+	}
+	if witness {
+		for _, in := range v.TxIn {
+			out = MarshalWitness(out, in.Witness)
+		}
+	}
+	out = MarshalUint32(out, v.LockTime)
+	return out
+}
+
+func unmarshalTxIns(data []byte) ([]TxIn, []byte, error) {
+	l, data, err := UnmarshalLength(data)
+	if err != nil {
+		return nil, data, err
+	}
+	// outpoint (36), script length (1) and sequence (4)
+	if err = checkCount(data, l, 41); err != nil {
+		return nil, data, err
+	}
+	v := make([]TxIn, l)
+	for i := range v {
+		if v[i], data, err = UnmarshalTxIn(data); err != nil {
+			return nil, data, err
+		}
+	}
+	return v, data, nil
+}
+
+func unmarshalTxOuts(data []byte) ([]TxOut, []byte, error) {
+	l, data, err := UnmarshalLength(data)
+	if err != nil {
+		return nil, data, err
+	}
+	// value (8) and script length (1)
+	if err = checkCount(data, l, 9); err != nil {
+		return nil, data, err
+	}
+	v := make([]TxOut, l)
+	for i := range v {
+		if v[i], data, err = UnmarshalTxOut(data); err != nil {
+			return nil, data, err
+		}
+	}
+	return v, data, nil
+}
+
+// UnmarshalTx unmarshals a transaction in either the original or the BIP144
+// format. The BIP144 format is recognized by the marker byte 0x00 where the
+// input count would be (a transaction without inputs is invalid anyway).
+func UnmarshalTx(data []byte) (Tx, []byte, error) {
+	var v Tx
+	var err error
+	if v.Version, data, err = UnmarshalUint32(data); err != nil {
+		return v, data, err
+	}
+	if v.TxIn, data, err = unmarshalTxIns(data); err != nil {
+		return v, data, err
+	}
+	var flags uint8
+	if len(v.TxIn) == 0 {
+		// Marker found, next is the flag
+		if flags, data, err = UnmarshalUint8(data); err != nil {
+			return v, data, err
+		}
+		if flags != 0 {
+			if v.TxIn, data, err = unmarshalTxIns(data); err != nil {
+				return v, data, err
+			}
+		}
+	}
+	if v.TxOut, data, err = unmarshalTxOuts(data); err != nil {
+		return v, data, err
+	}
+	if flags&1 != 0 {
+		flags &^= 1
+		for i := range v.TxIn {
+			if v.TxIn[i].Witness, data, err = UnmarshalWitness(data); err != nil {
+				return v, data, err
+			}
+		}
+		if !v.HasWitness() {
+			return v, data, ErrSuperfluousWitness
+		}
+	}
+	if flags != 0 {
+		return v, data, fmt.Errorf("%w (flags 0x%02x)", ErrUnknownTxData, flags)
+	}
+	v.LockTime, data, err = UnmarshalUint32(data)
+	return v, data, err
+}
+
+// TxFromHex decodes a hex encoded raw transaction (as returned by
+// getrawtransaction)
+func TxFromHex(s string) (Tx, error) {
+	data, err := hex.DecodeString(s)
+	if err != nil {
+		return Tx{}, err
+	}
+	tx, data, err := UnmarshalTx(data)
+	if err == nil && len(data) > 0 {
+		err = fmt.Errorf("%w (%d bytes)", ErrTrailingTxData, len(data))
+	}
+	return tx, err
+}
+
+// Hex returns the hex encoded raw transaction
+func (tx *Tx) Hex() string {
+	return hex.EncodeToString(MarshalTx(nil, *tx))
+}
+
+// TxID returns the transaction hash without witness data, which is used to
+// reference the transaction in outpoints and in the merkle tree
+func (tx *Tx) TxID() Hash {
+	return doubleHash(MarshalTxNoWitness(nil, *tx))
+}
+
+// WTxID returns the transaction hash including witness data (BIP141). For
+// transactions without witness it is the same as the txid.
+func (tx *Tx) WTxID() Hash {
+	return doubleHash(MarshalTx(nil, *tx))
+}
+
+// Amounts
+const (
+	COIN      = 100000000       // satoshis per bitcoin
+	MAX_MONEY = 21000000 * COIN // no amount larger than this is valid
+)
+
+// MoneyRange checks that the amount is not negative and at most MAX_MONEY
+func MoneyRange(value int64) bool {
+	return value >= 0 && value <= MAX_MONEY
+}
+
+// Lock times and sequence numbers
+const (
+	// LockTime values below are block heights, above unix timestamps
+	LOCKTIME_THRESHOLD = 500000000
+
+	// Setting all inputs to SEQUENCE_FINAL disables the lock time
+	SEQUENCE_FINAL = 0xffffffff
+
+	// BIP68 relative lock times: if the disable flag is set, the sequence
+	// is not interpreted as relative lock time, the type flag selects
+	// units of 512 seconds instead of blocks, the mask extracts the value
+	SEQUENCE_LOCKTIME_DISABLE_FLAG = 1 << 31
+	SEQUENCE_LOCKTIME_TYPE_FLAG    = 1 << 22
+	SEQUENCE_LOCKTIME_MASK         = 0x0000ffff
+
+	// Time based relative lock times are in units of 2^9 seconds
+	SEQUENCE_LOCKTIME_GRANULARITY = 9
+)
+
+// Block size limits (BIP141)
+const (
+	MAX_BLOCK_WEIGHT      = 4000000
+	WITNESS_SCALE_FACTOR  = 4
+	MAX_BLOCK_SIGOPS_COST = 80000
+)
+
+// Coinbase outputs can only be spent after this many blocks
+const COINBASE_MATURITY = 100
+
+// Weight returns the weight of the transaction (BIP141): the size without
+// witness counts three times, the total size once
+func (tx *Tx) Weight() int {
+	return len(MarshalTxNoWitness(nil, *tx))*(WITNESS_SCALE_FACTOR-1) + len(MarshalTx(nil, *tx))
+}
+
+// IsNull returns true for the outpoint used by coinbase inputs
+func (o OutPoint) IsNull() bool {
+	return o.Hash == Hash{} && o.Index == 0xffffffff
+}
+
+// IsCoinBase returns true if this is a coinbase transaction, which has a
+// single input with a null outpoint
+func (tx *Tx) IsCoinBase() bool {
+	return len(tx.TxIn) == 1 && tx.TxIn[0].PreviousOutput.IsNull()
+}
+
+// Errors returned by CheckTransaction, with bitcoin core's reject reasons
+var (
+	ErrTxVinEmpty         = errors.New("bad-txns-vin-empty")
+	ErrTxVoutEmpty        = errors.New("bad-txns-vout-empty")
+	ErrTxOversize         = errors.New("bad-txns-oversize")
+	ErrTxVoutNegative     = errors.New("bad-txns-vout-negative")
+	ErrTxVoutTooLarge     = errors.New("bad-txns-vout-toolarge")
+	ErrTxOutTotalTooLarge = errors.New("bad-txns-txouttotal-toolarge")
+	ErrTxInputsDuplicate  = errors.New("bad-txns-inputs-duplicate")
+	ErrCoinbaseLength     = errors.New("bad-cb-length")
+	ErrTxPrevOutNull      = errors.New("bad-txns-prevout-null")
+)
+
+// CheckTransaction performs the context free checks of a transaction (as
+// bitcoin core's CheckTransaction): inputs and outputs must be present,
+// output values in range, inputs unique and the coinbase script between 2
+// and 100 bytes.
+func CheckTransaction(tx *Tx) error {
+	if len(tx.TxIn) == 0 {
+		return ErrTxVinEmpty
+	}
+	if len(tx.TxOut) == 0 {
+		return ErrTxVoutEmpty
+	}
+	// The witness is not taken into account here, as it hasn't been
+	// checked for malleability yet
+	if len(MarshalTxNoWitness(nil, *tx))*WITNESS_SCALE_FACTOR > MAX_BLOCK_WEIGHT {
+		return ErrTxOversize
+	}
+
+	var total int64
+	for i, out := range tx.TxOut {
+		if out.Value < 0 {
+			return fmt.Errorf("%w: output %d", ErrTxVoutNegative, i)
+		}
+		if out.Value > MAX_MONEY {
+			return fmt.Errorf("%w: output %d", ErrTxVoutTooLarge, i)
+		}
+		total += out.Value
+		if !MoneyRange(total) {
+			return ErrTxOutTotalTooLarge
+		}
+	}
+
+	seen := make(map[OutPoint]bool, len(tx.TxIn))
+	for _, in := range tx.TxIn {
+		if seen[in.PreviousOutput] {
+			return ErrTxInputsDuplicate
+		}
+		seen[in.PreviousOutput] = true
+	}
+
+	if tx.IsCoinBase() {
+		if l := len(tx.TxIn[0].SignatureScript); l < 2 || l > 100 {
+			return fmt.Errorf("%w: %d bytes", ErrCoinbaseLength, l)
+		}
+		return nil
+	}
+	for i, in := range tx.TxIn {
+		if in.PreviousOutput.IsNull() {
+			return fmt.Errorf("%w: input %d", ErrTxPrevOutNull, i)
+		}
+	}
+	return nil
+}
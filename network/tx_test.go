@@ -0,0 +1,156 @@
+package network
+
+import (
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+const genesisCoinbaseHex = "01000000010000000000000000000000000000000000000000000000000000000000000000ffffffff4d04ffff001d0104455468652054696d65732030332f4a616e2f32303039204368616e63656c6c6f72206f6e206272696e6b206f66207365636f6e64206261696c6f757420666f722062616e6b73ffffffff0100f2052a01000000434104678afdb0fe5548271967f1a67130b7105cd6a828e03909a67962e0ea1f61deb649f6bc3f4cef38c4f35504e51ec112de5c384df7ba0b8d578a4c702b6bf11d5fac00000000"
+
+func h2b(s string) []byte {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return b
+}
+
+// Coinbase of block 113875
+func legacyTestTx() Tx {
+	return Tx{
+		Version: 1,
+		TxIn: []TxIn{{
+			PreviousOutput:  OutPoint{Index: 0xffffffff},
+			SignatureScript: h2b("0431dc001b0162"),
+			Sequence:        0xffffffff,
+		}},
+		TxOut: []TxOut{{
+			Value:    5000000000,
+			PkScript: h2b("4104d64bdfd09eb1c5fe295abdeb1dca4281be988e2da0b6c1c6a59dc226c28624e18175e851c96b973d81b01cc31f047834bc06d6d6edf620d184241a6aed8b63a6ac"),
+		}},
+	}
+}
+
+// Segwit transaction from segnet block 23157
+func witnessTestTx() Tx {
+	return Tx{
+		Version: 1,
+		TxIn: []TxIn{{
+			PreviousOutput:  OutPoint{Hash: s2h("a53352d5135766f03076597418263da2d9c958315968fea823529467481ff9cd"), Index: 19},
+			SignatureScript: []byte{},
+			Sequence:        0xffffffff,
+			Witness: [][]byte{
+				h2b("3043021f4d2381dc97f182abd8185f51753018523212f5ddc07cc4e63a8dc03658da190220608b5c4d92b86b6de7d78ef23a2fa735bcb59b914a48b0e187c5e7569a18197001"),
+				h2b("0307ead084807eb76346df6977000c89392f45c76425b26181f521d7f370066a8f"),
+			},
+		}},
+		TxOut: []TxOut{{
+			Value:    395019,
+			PkScript: h2b("00149ddac6f39d51e0398e532a22c41ba189406a8523"),
+		}},
+	}
+}
+
+func TestTxID(t *testing.T) {
+	tx := legacyTestTx()
+	if tx.HasWitness() {
+		t.Errorf("Transaction should not have witness data")
+	}
+	exp := rs2h("f051e59b5e2503ac626d03aaeac8ab7be2d72ba4b7e97119c5852d70d52dcb86")
+	if tx.TxID() != exp {
+		t.Errorf("Wrong txid %v", tx.TxID().RPCString())
+	}
+	if tx.WTxID() != exp {
+		t.Errorf("WTxID should equal txid without witness: %v", tx.WTxID().RPCString())
+	}
+}
+
+func TestWTxID(t *testing.T) {
+	tx := witnessTestTx()
+	if !tx.HasWitness() {
+		t.Errorf("Transaction should have witness data")
+	}
+	if tx.TxID() != rs2h("0f167d1385a84d1518cfee208b653fc9163b605ccf1b75347e2850b3e2eb19f3") {
+		t.Errorf("Wrong txid %v", tx.TxID().RPCString())
+	}
+	if tx.WTxID() != rs2h("0858eab78e77b6b033da30f46699996396cf48fcf625a783c85a51403e175e74") {
+		t.Errorf("Wrong wtxid %v", tx.WTxID().RPCString())
+	}
+}
+
+func TestMarshalTx(t *testing.T) {
+	for _, tx := range []Tx{legacyTestTx(), witnessTestTx()} {
+		data := MarshalTx(nil, tx)
+		tx2, data, err := UnmarshalTx(data)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if len(data) > 0 {
+			t.Errorf(format_cosume_data, len(data), tx)
+		}
+		if !reflect.DeepEqual(tx, tx2) {
+			t.Errorf(format_unmarshalled_match, tx2, tx)
+		}
+
+		// Without witness data the transaction must parse as legacy
+		// and drop the witness
+		data = MarshalTxNoWitness(nil, tx)
+		tx2, _, err = UnmarshalTx(data)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if tx2.HasWitness() || tx2.TxID() != tx.TxID() {
+			t.Errorf("Stripped transaction does not match %v", tx2)
+		}
+	}
+}
+
+func TestTxFromHex(t *testing.T) {
+	tx, err := TxFromHex(genesisCoinbaseHex)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if tx.TxID() != genesisMerkleRoot {
+		t.Errorf("Wrong genesis coinbase txid %v", tx.TxID().RPCString())
+	}
+	if tx.Hex() != genesisCoinbaseHex {
+		t.Errorf("Hex round trip failed")
+	}
+	if len(tx.TxOut) != 1 || tx.TxOut[0].Value != 5000000000 {
+		t.Errorf("Wrong outputs %v", tx.TxOut)
+	}
+
+	if _, err = TxFromHex(genesisCoinbaseHex + "00"); !errors.Is(err, ErrTrailingTxData) {
+		t.Errorf("Expected trailing data error, got %v", err)
+	}
+}
+
+func TestUnmarshalTxErrors(t *testing.T) {
+	full := MarshalTx(nil, witnessTestTx())
+	for i := 0; i < len(full); i++ {
+		if _, _, err := UnmarshalTx(full[:i]); err == nil {
+			t.Errorf("Expected error for truncated transaction (%d bytes)", i)
+		}
+	}
+
+	// Witness flag set but all witnesses empty
+	tx := legacyTestTx()
+	data := marshalTx(nil, tx, true)
+	if _, _, err := UnmarshalTx(data); !errors.Is(err, ErrSuperfluousWitness) {
+		t.Errorf("Expected superfluous witness error, got %v", err)
+	}
+
+	// Unknown flag bits
+	data[5] = 0x02
+	if _, _, err := UnmarshalTx(data); !errors.Is(err, ErrUnknownTxData) {
+		t.Errorf("Expected unknown data error, got %v", err)
+	}
+
+	// Huge input count must not allocate
+	data = append(MarshalUint32(nil, 1), 0xfe, 0xff, 0xff, 0xff, 0x00)
+	if _, _, err := UnmarshalTx(data); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("Expected short buffer error, got %v", err)
+	}
+}
@@ -3,6 +3,7 @@ package network
 import (
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"strings"
@@ -15,7 +16,38 @@ type Marshaller interface {
 }
 
 type Unmarshaller interface {
-	Unmarshal(data []byte) []byte
+	Unmarshal(data []byte) ([]byte, error)
+}
+
+// Errors returned by the unmarshalling functions. They are usually wrapped
+// with some context, so use errors.Is to check for them.
+var (
+	ErrShortBuffer        = errors.New("short buffer")
+	ErrLengthTooLarge     = errors.New("length prefix too large")
+	ErrNonCanonicalVarInt = errors.New("non-canonical var_int")
+)
+
+// Maximum size of anything we accept from the wire (same as MAX_SIZE in
+// bitcoin core)
+const MAX_SIZE = 0x02000000
+
+// checkLength returns an error if data has less than n bytes left
+func checkLength(data []byte, n uint64) error {
+	if uint64(len(data)) < n {
+		return fmt.Errorf("%w: need %d bytes, have %d", ErrShortBuffer, n, len(data))
+	}
+	return nil
+}
+
+// checkCount returns an error if data cannot possibly hold count elements of
+// at least minSize bytes each. This is checked before allocating memory for
+// the elements, so that a bogus count can't make us allocate huge amounts of
+// memory.
+func checkCount(data []byte, count uint64, minSize uint64) error {
+	if count > MAX_SIZE {
+		return fmt.Errorf("%w: %d elements", ErrLengthTooLarge, count)
+	}
+	return checkLength(data, count*minSize)
 }
 
 // Helper functions for marshalling and unmarshalling integers
@@ -23,8 +55,11 @@ func MarshalUint8(out []byte, v uint8) []byte {
 	return append(out, v)
 }
 
-func UnmarshalUint8(data []byte) (uint8, []byte) {
-	return data[0], data[1:]
+func UnmarshalUint8(data []byte) (uint8, []byte, error) {
+	if err := checkLength(data, 1); err != nil {
+		return 0, data, err
+	}
+	return data[0], data[1:], nil
 }
 
 func MarshalUint16(out []byte, v uint16) []byte {
@@ -33,8 +68,11 @@ func MarshalUint16(out []byte, v uint16) []byte {
 	return append(out, data...)
 }
 
-func UnmarshalUint16(data []byte) (uint16, []byte) {
-	return binary.LittleEndian.Uint16(data), data[2:]
+func UnmarshalUint16(data []byte) (uint16, []byte, error) {
+	if err := checkLength(data, 2); err != nil {
+		return 0, data, err
+	}
+	return binary.LittleEndian.Uint16(data), data[2:], nil
 }
 
 func MarshalUint32(out []byte, v uint32) []byte {
@@ -43,8 +81,11 @@ func MarshalUint32(out []byte, v uint32) []byte {
 	return append(out, data...)
 }
 
-func UnmarshalUint32(data []byte) (uint32, []byte) {
-	return binary.LittleEndian.Uint32(data), data[4:]
+func UnmarshalUint32(data []byte) (uint32, []byte, error) {
+	if err := checkLength(data, 4); err != nil {
+		return 0, data, err
+	}
+	return binary.LittleEndian.Uint32(data), data[4:], nil
 }
 
 func MarshalUint64(out []byte, v uint64) []byte {
@@ -53,8 +94,11 @@ func MarshalUint64(out []byte, v uint64) []byte {
 	return append(out, data...)
 }
 
-func UnmarshalUint64(data []byte) (uint64, []byte) {
-	return binary.LittleEndian.Uint64(data), data[8:]
+func UnmarshalUint64(data []byte) (uint64, []byte, error) {
+	if err := checkLength(data, 8); err != nil {
+		return 0, data, err
+	}
+	return binary.LittleEndian.Uint64(data), data[8:], nil
 }
 
 // Other integer types
@@ -71,24 +115,49 @@ func MarshalVarInt(out []byte, v uint64) []byte {
 	}
 }
 
-func UnmarshalVarInt(data []byte) (uint64, []byte) {
-	b := data[0]
-	if b < 0xFD {
-		value, data := UnmarshalUint8(data)
-		return uint64(value), data
-	} else {
-		switch b {
-		case 0xFD:
-			value, data := UnmarshalUint16(data[1:])
-			return uint64(value), data
-		case 0xFE:
-			value, data := UnmarshalUint32(data[1:])
-			return uint64(value), data
-		default:
-			value, data := UnmarshalUint64(data[1:])
-			return uint64(value), data
-		}
+// UnmarshalVarInt reads a var_int. Values that could have been encoded in a
+// shorter form are rejected with ErrNonCanonicalVarInt (as bitcoin core does).
+func UnmarshalVarInt(data []byte) (uint64, []byte, error) {
+	b, rest, err := UnmarshalUint8(data)
+	if err != nil {
+		return 0, data, err
+	}
+	var value, min uint64
+	switch b {
+	case 0xFD:
+		var v uint16
+		v, rest, err = UnmarshalUint16(rest)
+		value, min = uint64(v), 0xFD
+	case 0xFE:
+		var v uint32
+		v, rest, err = UnmarshalUint32(rest)
+		value, min = uint64(v), 0x10000
+	case 0xFF:
+		value, rest, err = UnmarshalUint64(rest)
+		min = 0x100000000
+	default:
+		return uint64(b), rest, nil
+	}
+	if err != nil {
+		return 0, data, err
+	}
+	if value < min {
+		return 0, data, fmt.Errorf("%w: 0x%X encoded with prefix 0x%X", ErrNonCanonicalVarInt, value, b)
+	}
+	return value, rest, nil
+}
+
+// UnmarshalLength reads a var_int that is used as length prefix or element
+// count and checks it against MAX_SIZE
+func UnmarshalLength(data []byte) (uint64, []byte, error) {
+	l, rest, err := UnmarshalVarInt(data)
+	if err != nil {
+		return 0, data, err
 	}
+	if l > MAX_SIZE {
+		return 0, data, fmt.Errorf("%w: %d > %d", ErrLengthTooLarge, l, MAX_SIZE)
+	}
+	return l, rest, nil
 }
 
 func MarshalBool(out []byte, v bool) []byte {
@@ -99,9 +168,9 @@ func MarshalBool(out []byte, v bool) []byte {
 	}
 }
 
-func UnmarshalBool(data []byte) (bool, []byte) {
-	b, data := UnmarshalUint8(data)
-	return b != 0, data
+func UnmarshalBool(data []byte) (bool, []byte, error) {
+	b, data, err := UnmarshalUint8(data)
+	return b != 0, data, err
 }
 
 // Timestamps
@@ -109,18 +178,24 @@ func MarshalTimestamp(out []byte, v time.Time) []byte {
 	return MarshalUint64(out, uint64(v.Unix()))
 }
 
-func UnmarshalTimestamp(data []byte) (time.Time, []byte) {
-	value, data := UnmarshalUint64(data)
-	return time.Unix(int64(value), 0), data
+func UnmarshalTimestamp(data []byte) (time.Time, []byte, error) {
+	value, data, err := UnmarshalUint64(data)
+	if err != nil {
+		return time.Time{}, data, err
+	}
+	return time.Unix(int64(value), 0), data, nil
 }
 
 func MarshalTimestamp4(out []byte, v time.Time) []byte {
 	return MarshalUint32(out, uint32(v.Unix()))
 }
 
-func UnmarshalTimestamp4(data []byte) (time.Time, []byte) {
-	value, data := UnmarshalUint32(data)
-	return time.Unix(int64(value), 0), data
+func UnmarshalTimestamp4(data []byte) (time.Time, []byte, error) {
+	value, data, err := UnmarshalUint32(data)
+	if err != nil {
+		return time.Time{}, data, err
+	}
+	return time.Unix(int64(value), 0), data, nil
 }
 
 // String types
@@ -131,9 +206,9 @@ func MarshalVarStr(out []byte, v string) []byte {
 	return out
 }
 
-func UnmarshalVarStr(data []byte) (string, []byte) {
-	l, data := UnmarshalVarInt(data)
-	return string(data[:l]), data[l:]
+func UnmarshalVarStr(data []byte) (string, []byte, error) {
+	v, data, err := UnmarshalVarBytes(data)
+	return string(v), data, err
 }
 
 func MarshalFixedStr(out []byte, v string, l int) []byte {
@@ -142,18 +217,42 @@ func MarshalFixedStr(out []byte, v string, l int) []byte {
 	return append(out, s[:]...)
 }
 
-func UnmarshalFixedStr(data []byte, l int) (string, []byte) {
+func UnmarshalFixedStr(data []byte, l int) (string, []byte, error) {
+	if err := checkLength(data, uint64(l)); err != nil {
+		return "", data, err
+	}
 	v := string(data[:l])
 	v = strings.TrimRight(v, "\x00")
-	return v, data[l:]
+	return v, data[l:], nil
 }
 
 func MarshalBytes(out []byte, v []byte) []byte {
 	return append(out, v...)
 }
 
-func UnmarshalBytes(data []byte, l uint32) ([]byte, []byte) {
-	return data[:l], data[l:]
+func UnmarshalBytes(data []byte, l uint32) ([]byte, []byte, error) {
+	if err := checkLength(data, uint64(l)); err != nil {
+		return nil, data, err
+	}
+	return data[:l], data[l:], nil
+}
+
+// Byte arrays prefixed with their length as var_int
+func MarshalVarBytes(out []byte, v []byte) []byte {
+	out = MarshalVarInt(out, uint64(len(v)))
+	return MarshalBytes(out, v)
+}
+
+func UnmarshalVarBytes(data []byte) ([]byte, []byte, error) {
+	l, rest, err := UnmarshalLength(data)
+	if err != nil {
+		return nil, data, err
+	}
+	v, rest, err := UnmarshalBytes(rest, uint32(l))
+	if err != nil {
+		return nil, data, err
+	}
+	return v, rest, nil
 }
 
 // Network related types
@@ -167,9 +266,12 @@ func MarshalIP(out []byte, v net.IP) []byte {
 	return MarshalBytes(out, bytes)
 }
 
-func UnmarshalIP(data []byte) (net.IP, []byte) {
-	bytes, data := UnmarshalBytes(data, 16)
-	return net.IP(bytes), data
+func UnmarshalIP(data []byte) (net.IP, []byte, error) {
+	bytes, data, err := UnmarshalBytes(data, 16)
+	if err != nil {
+		return nil, data, err
+	}
+	return net.IP(bytes), data, nil
 }
 
 type NetAddr struct {
@@ -190,12 +292,19 @@ func MarshalNetAddr(out []byte, v NetAddr) []byte {
 	return out
 }
 
-func UnmarshalNetAddr(data []byte) (NetAddr, []byte) {
+func UnmarshalNetAddr(data []byte) (NetAddr, []byte, error) {
 	var v NetAddr
-	v.Services, data = UnmarshalUint64(data)
-	v.IPAddr, data = UnmarshalIP(data)
-	v.Port, data = UnmarshalUint16(data)
-	return v, data
+	var err error
+	if v.Services, data, err = UnmarshalUint64(data); err != nil {
+		return v, data, err
+	}
+	if v.IPAddr, data, err = UnmarshalIP(data); err != nil {
+		return v, data, err
+	}
+	if v.Port, data, err = UnmarshalUint16(data); err != nil {
+		return v, data, err
+	}
+	return v, data, nil
 }
 
 func (addr TimeNetAddr) String() string {
@@ -214,11 +323,16 @@ func MarshalTimeNetAddr(out []byte, v TimeNetAddr) []byte {
 	return out
 }
 
-func UnmarshalTimeNetAddr(data []byte) (TimeNetAddr, []byte) {
+func UnmarshalTimeNetAddr(data []byte) (TimeNetAddr, []byte, error) {
 	var v TimeNetAddr
-	v.Time, data = UnmarshalTimestamp4(data)
-	v.NetAddr, data = UnmarshalNetAddr(data)
-	return v, data
+	var err error
+	if v.Time, data, err = UnmarshalTimestamp4(data); err != nil {
+		return v, data, err
+	}
+	if v.NetAddr, data, err = UnmarshalNetAddr(data); err != nil {
+		return v, data, err
+	}
+	return v, data, nil
 }
 
 // Crypto related types
@@ -227,10 +341,13 @@ func MarshalHash(out []byte, v Hash) []byte {
 	return append(out, v[:]...)
 }
 
-func UnmarshalHash(data []byte) (Hash, []byte) {
+func UnmarshalHash(data []byte) (Hash, []byte, error) {
 	v := Hash{}
+	if err := checkLength(data, 32); err != nil {
+		return v, data, err
+	}
 	copy(v[:], data[:32])
-	return v, data[32:]
+	return v, data[32:], nil
 }
 
 func (h Hash) MarshalJSON() ([]byte, error) {
@@ -246,20 +363,28 @@ func MarshalHashes(out []byte, v []Hash) []byte {
 	return out
 }
 
-func UnmarshalHashes(data []byte) ([]Hash, []byte) {
-	l, data := UnmarshalVarInt(data)
+func UnmarshalHashes(data []byte) ([]Hash, []byte, error) {
+	l, data, err := UnmarshalLength(data)
+	if err != nil {
+		return nil, data, err
+	}
+	if err := checkCount(data, l, 32); err != nil {
+		return nil, data, err
+	}
 	v := make([]Hash, l)
 	for i := 0; i < int(l); i++ {
-		v[i], data = UnmarshalHash(data)
+		if v[i], data, err = UnmarshalHash(data); err != nil {
+			return nil, data, err
+		}
 	}
-	return v, data
+	return v, data, nil
 }
 
 func MarshalCompact(out []byte, v Compact) []byte {
 	return MarshalUint32(out, uint32(v))
 }
 
-func UnmarshalCompact(data []byte) (Compact, []byte) {
-	value, data := UnmarshalUint32(data)
-	return Compact(value), data
+func UnmarshalCompact(data []byte) (Compact, []byte, error) {
+	value, data, err := UnmarshalUint32(data)
+	return Compact(value), data, err
 }
@@ -1,6 +1,7 @@
 package network
 
 import (
+	"errors"
 	"net"
 	"reflect"
 	"testing"
@@ -21,7 +22,10 @@ func TestMarshalUint8(t *testing.T) {
 		if len(data) != lens[i] {
 			t.Errorf("Incorrect length of marshalled data for 0x%X (%v!=%v)", x, len(data), lens[i])
 		}
-		y, data := UnmarshalUint8(data)
+		y, data, err := UnmarshalUint8(data)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
 		if len(data) > 0 {
 			t.Errorf("Len of data should be zero after unmarshalling (%d)", len(data))
 		}
@@ -39,7 +43,10 @@ func TestMarshalUint16(t *testing.T) {
 		if len(data) != lens[i] {
 			t.Errorf("Incorrect length of marshalled data for 0x%X (%v!=%v)", x, len(data), lens[i])
 		}
-		y, data := UnmarshalUint16(data)
+		y, data, err := UnmarshalUint16(data)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
 		if len(data) > 0 {
 			t.Errorf("Len of data should be zero after unmarshalling (%d)", len(data))
 		}
@@ -57,7 +64,10 @@ func TestMarshalUint32(t *testing.T) {
 		if len(data) != lens[i] {
 			t.Errorf("Incorrect length of marshalled data for 0x%X (%v!=%v)", x, len(data), lens[i])
 		}
-		y, data := UnmarshalUint32(data)
+		y, data, err := UnmarshalUint32(data)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
 		if len(data) > 0 {
 			t.Errorf("Len of data should be zero after unmarshalling (%d)", len(data))
 		}
@@ -75,7 +85,10 @@ func TestMarshalUint64(t *testing.T) {
 		if len(data) != lens[i] {
 			t.Errorf("Incorrect length of marshalled data for 0x%X (%v!=%v)", x, len(data), lens[i])
 		}
-		y, data := UnmarshalUint64(data)
+		y, data, err := UnmarshalUint64(data)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
 		if len(data) > 0 {
 			t.Errorf("Len of data should be zero after unmarshalling (%d)", len(data))
 		}
@@ -93,7 +106,10 @@ func TestMarshalVarInt(t *testing.T) {
 		if len(data) != lens[i] {
 			t.Errorf("Incorrect length of marshalled data for 0x%X (%v!=%v)", x, len(data), lens[i])
 		}
-		y, data := UnmarshalVarInt(data)
+		y, data, err := UnmarshalVarInt(data)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
 		if len(data) > 0 {
 			t.Errorf("Len Data should be zero after unmarshalling (%d)", len(data))
 		}
@@ -111,7 +127,10 @@ func TestMarshalBool(t *testing.T) {
 		if len(data) != lens[i] {
 			t.Errorf("Incorrect length of marshalled data for '%v' (%v!=%v)", x, len(data), lens[i])
 		}
-		y, data := UnmarshalBool(data)
+		y, data, err := UnmarshalBool(data)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
 		if len(data) > 0 {
 			t.Errorf("Len Data should be zero after unmarshalling (%d)", len(data))
 		}
@@ -131,7 +150,10 @@ func TestMarshalTimestamp(t *testing.T) {
 		if len(data) != lens[i] {
 			t.Errorf("Incorrect length of marshalled data for '%v' (%v!=%v)", x, len(data), lens[i])
 		}
-		y, data := UnmarshalTimestamp(data)
+		y, data, err := UnmarshalTimestamp(data)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
 		if len(data) > 0 {
 			t.Errorf("Len of data should be zero after unmarshalling (%d)", len(data))
 		}
@@ -151,7 +173,10 @@ func TestMarshalTimestamp4(t *testing.T) {
 		if len(data) != lens[i] {
 			t.Errorf("Incorrect length of marshalled data for '%v' (%v!=%v)", x, len(data), lens[i])
 		}
-		y, data := UnmarshalTimestamp4(data)
+		y, data, err := UnmarshalTimestamp4(data)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
 		if len(data) > 0 {
 			t.Errorf("Len of data should be zero after unmarshalling (%d)", len(data))
 		}
@@ -169,7 +194,10 @@ func TestMarshalVarString(t *testing.T) {
 		if len(data) != lens[i] {
 			t.Errorf("Incorrect length of marshalled data for '%v' (%v!=%v)", "", len(data), lens[i])
 		}
-		y, data := UnmarshalVarStr(data)
+		y, data, err := UnmarshalVarStr(data)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
 		if len(data) > 0 {
 			t.Errorf("Len Data should be zero after unmarshalling (%d)", len(data))
 		}
@@ -186,7 +214,10 @@ func TestMarshalFixedString(t *testing.T) {
 		if len(data) != 12 {
 			t.Errorf("Incorrect length of marshalled data for string %s (%v!=12)", x, len(data))
 		}
-		y, data := UnmarshalFixedStr(data, 12)
+		y, data, err := UnmarshalFixedStr(data, 12)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
 		if len(data) > 0 {
 			t.Errorf("Len Data should be zero after unmarshalling (%d)", len(data))
 		}
@@ -204,7 +235,10 @@ func TestMarshalBytes(t *testing.T) {
 		if len(data) != lens[i] {
 			t.Errorf("Incorrect length of marshalled data for '%v' (%v!=%v)", "", len(data), lens[i])
 		}
-		y, data := UnmarshalBytes(data, uint32(lens[i]))
+		y, data, err := UnmarshalBytes(data, uint32(lens[i]))
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
 		if len(data) > 0 {
 			t.Errorf("Len Data should be zero after unmarshalling (%d)", len(data))
 		}
@@ -222,7 +256,10 @@ func TestMarshalIP(t *testing.T) {
 		if len(data) != lens[i] {
 			t.Errorf("Incorrect length of marshalled data for '%v' (%v!=%v)", x, len(data), lens[i])
 		}
-		y, data := UnmarshalIP(data)
+		y, data, err := UnmarshalIP(data)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
 		if len(data) > 0 {
 			t.Errorf("Len of data should be zero after unmarshalling (%d)", len(data))
 		}
@@ -240,7 +277,10 @@ func TestMarshalNetAddr(t *testing.T) {
 		if len(data) != lens[i] {
 			t.Errorf("Incorrect length of marshalled data for '%v' (%v!=%v)", x, len(data), lens[i])
 		}
-		y, data := UnmarshalNetAddr(data)
+		y, data, err := UnmarshalNetAddr(data)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
 		if len(data) > 0 {
 			t.Errorf("Len of data should be zero after unmarshalling (%d)", len(data))
 		}
@@ -258,7 +298,10 @@ func TestMarshalTimeNetAddr(t *testing.T) {
 		if len(data) != lens[i] {
 			t.Errorf(format_incorrect_length, len(data), lens[i], x)
 		}
-		y, data := UnmarshalTimeNetAddr(data)
+		y, data, err := UnmarshalTimeNetAddr(data)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
 		if len(data) > 0 {
 			t.Errorf(format_cosume_data, len(data), x)
 		}
@@ -276,7 +319,10 @@ func TestMarshalHash(t *testing.T) {
 		if len(data) != lens[i] {
 			t.Errorf(format_incorrect_length, len(data), lens[i], x)
 		}
-		y, data := UnmarshalHash(data)
+		y, data, err := UnmarshalHash(data)
+		if err != nil {
+			t.Errorf("Unexpected error: %v", err)
+		}
 		if len(data) > 0 {
 			t.Errorf(format_cosume_data, len(data), x)
 		}
@@ -285,3 +331,57 @@ func TestMarshalHash(t *testing.T) {
 		}
 	}
 }
+
+func TestUnmarshalShortBuffer(t *testing.T) {
+	data := []byte{1, 2, 3}
+	if _, _, err := UnmarshalUint32(data); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("Expected short buffer error, got '%v'", err)
+	}
+	if _, _, err := UnmarshalUint64(data); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("Expected short buffer error, got '%v'", err)
+	}
+	if _, _, err := UnmarshalHash(data); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("Expected short buffer error, got '%v'", err)
+	}
+	if _, _, err := UnmarshalUint8([]byte{}); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("Expected short buffer error, got '%v'", err)
+	}
+	if _, _, err := UnmarshalVarInt([]byte{0xFE, 1, 2}); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("Expected short buffer error, got '%v'", err)
+	}
+	if _, _, err := UnmarshalVarStr([]byte{5, 'a', 'b'}); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("Expected short buffer error, got '%v'", err)
+	}
+	if _, _, err := UnmarshalFixedStr(data, 12); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("Expected short buffer error, got '%v'", err)
+	}
+	// Two hashes announced, but only one present
+	hashes := MarshalHash([]byte{2}, Hash{})
+	if _, _, err := UnmarshalHashes(hashes); !errors.Is(err, ErrShortBuffer) {
+		t.Errorf("Expected short buffer error, got '%v'", err)
+	}
+}
+
+func TestUnmarshalNonCanonicalVarInt(t *testing.T) {
+	vals := [][]byte{{0xFD, 0xFC, 0x00}, {0xFE, 0xFF, 0xFF, 0x00, 0x00}, {0xFF, 1, 0, 0, 0, 0, 0, 0, 0}}
+	for _, x := range vals {
+		_, data, err := UnmarshalVarInt(x)
+		if !errors.Is(err, ErrNonCanonicalVarInt) {
+			t.Errorf("Expected non-canonical error for %x, got '%v'", x, err)
+		}
+		if len(data) != len(x) {
+			t.Errorf("Data should not be consumed on error (%d!=%d)", len(data), len(x))
+		}
+	}
+}
+
+func TestUnmarshalLengthTooLarge(t *testing.T) {
+	data := MarshalVarInt([]byte{}, MAX_SIZE+1)
+	if _, _, err := UnmarshalVarStr(data); !errors.Is(err, ErrLengthTooLarge) {
+		t.Errorf("Expected length too large error, got '%v'", err)
+	}
+	data = MarshalVarInt([]byte{}, 0xFFFFFFFFFFFF)
+	if _, _, err := UnmarshalHashes(data); !errors.Is(err, ErrLengthTooLarge) {
+		t.Errorf("Expected length too large error, got '%v'", err)
+	}
+}
@@ -0,0 +1,606 @@
+package network
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// Coins
+//======
+
+// Coin is an unspent transaction output with the height of the block which
+// created it
+type Coin struct {
+	TxOut
+	Height   int
+	CoinBase bool
+}
+
+func MarshalCoin(out []byte, v Coin) []byte {
+	code := uint64(v.Height) << 1
+	if v.CoinBase {
+		code |= 1
+	}
+	out = MarshalVarInt(out, code)
+	return MarshalTxOut(out, v.TxOut)
+}
+
+func UnmarshalCoin(data []byte) (Coin, []byte, error) {
+	var v Coin
+	code, data, err := UnmarshalVarInt(data)
+	if err != nil {
+		return v, data, err
+	}
+	v.Height = int(code >> 1)
+	v.CoinBase = code&1 != 0
+	v.TxOut, data, err = UnmarshalTxOut(data)
+	return v, data, err
+}
+
+// TxUndo holds the coins spent by the inputs of a transaction
+type TxUndo struct {
+	Spent []Coin
+}
+
+// BlockUndo holds the data needed to disconnect a block: the spent coins of
+// all transactions except the coinbase
+type BlockUndo struct {
+	Txs []TxUndo
+}
+
+func MarshalBlockUndo(out []byte, v BlockUndo) []byte {
+	out = MarshalVarInt(out, uint64(len(v.Txs)))
+	for _, tx := range v.Txs {
+		out = MarshalVarInt(out, uint64(len(tx.Spent)))
+		for _, coin := range tx.Spent {
+			out = MarshalCoin(out, coin)
+		}
+	}
+	return out
+}
+
+func UnmarshalBlockUndo(data []byte) (BlockUndo, []byte, error) {
+	var v BlockUndo
+	l, data, err := UnmarshalLength(data)
+	if err != nil {
+		return v, data, err
+	}
+	if err = checkCount(data, l, 1); err != nil {
+		return v, data, err
+	}
+	v.Txs = make([]TxUndo, l)
+	for i := range v.Txs {
+		if l, data, err = UnmarshalLength(data); err != nil {
+			return v, data, err
+		}
+		// smallest coin: code, value and an empty script
+		if err = checkCount(data, l, 10); err != nil {
+			return v, data, err
+		}
+		v.Txs[i].Spent = make([]Coin, l)
+		for j := range v.Txs[i].Spent {
+			if v.Txs[i].Spent[j], data, err = UnmarshalCoin(data); err != nil {
+				return v, data, err
+			}
+		}
+	}
+	return v, data, nil
+}
+
+// marshalCoreVarInt writes the variable length integer format of bitcoin
+// core's databases (VARINT in serialize.h), which is used for the output
+// index in coin keys
+func marshalCoreVarInt(out []byte, n uint64) []byte {
+	var tmp [10]byte
+	l := 0
+	for {
+		tmp[l] = byte(n & 0x7f)
+		if l > 0 {
+			tmp[l] |= 0x80
+		}
+		if n <= 0x7f {
+			break
+		}
+		n = (n >> 7) - 1
+		l++
+	}
+	for ; l >= 0; l-- {
+		out = append(out, tmp[l])
+	}
+	return out
+}
+
+func unmarshalCoreVarInt(data []byte) (uint64, []byte, error) {
+	var n uint64
+	for i, b := range data {
+		if i == 9 {
+			break
+		}
+		n = n<<7 | uint64(b&0x7f)
+		if b&0x80 == 0 {
+			return n, data[i+1:], nil
+		}
+		n++
+	}
+	return 0, data, ErrShortBuffer
+}
+
+// UTXO set
+//=========
+
+// Keys in the UTXO store
+const (
+	utxoCoinPrefix = "C" // followed by txid and output index
+	utxoUndoPrefix = "U" // followed by the block hash
+	utxoBestBlock  = "B" // hash and height of the last connected block
+)
+
+// DEFAULT_UTXO_CACHE_SIZE is the number of cached coins after which the
+// cache is written to disk
+const DEFAULT_UTXO_CACHE_SIZE = 1000000
+
+// Errors returned when connecting and disconnecting blocks
+var (
+	ErrMissingInputs  = errors.New("bad-txns-inputs-missingorspent")
+	ErrNotUtxoTip     = errors.New("block does not connect to the tip of the UTXO set")
+	ErrMissingUndo    = errors.New("undo data missing")
+	ErrCorruptUtxoSet = errors.New("corrupt UTXO set")
+)
+
+func coinKey(op OutPoint) string {
+	key := append([]byte(utxoCoinPrefix), op.Hash[:]...)
+	return string(marshalCoreVarInt(key, uint64(op.Index)))
+}
+
+func coinKeyOutPoint(key string) (OutPoint, error) {
+	var op OutPoint
+	hash, data, err := UnmarshalHash([]byte(key[len(utxoCoinPrefix):]))
+	if err != nil {
+		return op, err
+	}
+	index, data, err := unmarshalCoreVarInt(data)
+	if err != nil || len(data) != 0 || index > 0xffffffff {
+		return op, ErrCorruptUtxoSet
+	}
+	return OutPoint{hash, uint32(index)}, nil
+}
+
+func undoKey(hash Hash) string {
+	return utxoUndoPrefix + string(hash[:])
+}
+
+// coinEntry is a cached coin. Dirty entries differ from the store, fresh
+// entries don't exist in the store, so they can be dropped when spent.
+type coinEntry struct {
+	coin  Coin
+	spent bool
+	dirty bool
+	fresh bool
+}
+
+// UtxoSet is the set of unspent transaction outputs as of its best block.
+// Coins are kept in a key/value store on disk with a write-back cache in
+// memory (or only in memory, see NewUtxoSet). Connecting a block records
+// undo data, with which the block can be disconnected again.
+//
+// A UtxoSet is not safe for concurrent use.
+type UtxoSet struct {
+	store     *kvStore
+	cache     map[OutPoint]*coinEntry
+	undo      map[Hash]*BlockUndo // undo data not yet written, nil if deleted
+	bestBlock Hash
+	height    int
+
+	// The cache is written to disk after connecting or disconnecting a
+	// block when it holds more coins than this
+	MaxCacheSize int
+}
+
+// NewUtxoSet returns an empty UTXO set that is only kept in memory
+func NewUtxoSet() *UtxoSet {
+	return &UtxoSet{
+		cache:        make(map[OutPoint]*coinEntry),
+		undo:         make(map[Hash]*BlockUndo),
+		height:       -1,
+		MaxCacheSize: DEFAULT_UTXO_CACHE_SIZE,
+	}
+}
+
+// OpenUtxoSet returns the UTXO set stored in the file at path, which is
+// created if it doesn't exist
+func OpenUtxoSet(path string) (*UtxoSet, error) {
+	store, err := openKVStore(path)
+	if err != nil {
+		return nil, err
+	}
+	set := NewUtxoSet()
+	set.store = store
+	best, err := store.get(utxoBestBlock)
+	if err == nil && best != nil {
+		var height uint32
+		if set.bestBlock, best, err = UnmarshalHash(best); err == nil {
+			height, _, err = UnmarshalUint32(best)
+			set.height = int(int32(height))
+		}
+	}
+	if err != nil {
+		store.close()
+		return nil, fmt.Errorf("%w: %v", ErrCorruptUtxoSet, err)
+	}
+	return set, nil
+}
+
+// Close writes the cache to disk and closes the file (if any)
+func (set *UtxoSet) Close() error {
+	if set.store == nil {
+		return nil
+	}
+	err := set.Flush()
+	if closeErr := set.store.close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// BestBlock returns the hash and height of the last connected block. The
+// height is -1 for an empty set.
+func (set *UtxoSet) BestBlock() (Hash, int) {
+	return set.bestBlock, set.height
+}
+
+// CacheSize returns the number of cached coins (including spent ones which
+// are not yet written)
+func (set *UtxoSet) CacheSize() int {
+	return len(set.cache)
+}
+
+// fetch returns the cache entry for op, loading the coin from the store if
+// needed. It returns nil if the coin is not known.
+func (set *UtxoSet) fetch(op OutPoint) (*coinEntry, error) {
+	if entry, ok := set.cache[op]; ok {
+		return entry, nil
+	}
+	if set.store == nil {
+		return nil, nil
+	}
+	data, err := set.store.get(coinKey(op))
+	if err != nil || data == nil {
+		return nil, err
+	}
+	coin, _, err := UnmarshalCoin(data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: coin %v:%d: %v", ErrCorruptUtxoSet, op.Hash.RPCString(), op.Index, err)
+	}
+	entry := &coinEntry{coin: coin}
+	set.cache[op] = entry
+	return entry, nil
+}
+
+// Coin returns the unspent output op
+func (set *UtxoSet) Coin(op OutPoint) (Coin, bool, error) {
+	entry, err := set.fetch(op)
+	if err != nil || entry == nil || entry.spent {
+		return Coin{}, false, err
+	}
+	return entry.coin, true, nil
+}
+
+// addCoin adds an unspent output. Coinbases may overwrite an existing coin
+// (see BIP30), so they are never assumed to be missing from the store.
+func (set *UtxoSet) addCoin(op OutPoint, coin Coin) {
+	entry, cached := set.cache[op]
+	fresh := !coin.CoinBase && (!cached || !entry.dirty)
+	if cached {
+		fresh = fresh || entry.fresh
+	}
+	set.cache[op] = &coinEntry{coin: coin, dirty: true, fresh: fresh}
+}
+
+// spendCoin removes a cached coin
+func (set *UtxoSet) spendCoin(op OutPoint) {
+	entry := set.cache[op]
+	if entry.fresh {
+		delete(set.cache, op)
+		return
+	}
+	entry.spent = true
+	entry.dirty = true
+}
+
+// blockChanges are the changes of the UTXO set by a block
+type blockChanges struct {
+	hash   Hash
+	height int
+	spent  []OutPoint
+	added  []OutPoint // in order, outputs spent in the block are removed from coins
+	coins  map[OutPoint]Coin
+	undo   *BlockUndo
+}
+
+// Connect applies the transactions of block, which must be a child of the
+// best block: the outputs spent by its inputs are removed, its outputs are
+// added (except unspendable ones). The returned undo data is stored with
+// the set. If an input is missing, nothing is changed.
+func (set *UtxoSet) Connect(block *Block, height int) (*BlockUndo, error) {
+	changes, err := set.prepareConnect(block, height)
+	if err != nil {
+		return nil, err
+	}
+	return changes.undo, set.applyConnect(changes)
+}
+
+// prepareConnect collects the changes of block without modifying the set.
+// The undo data holds the coins spent by each transaction.
+func (set *UtxoSet) prepareConnect(block *Block, height int) (*blockChanges, error) {
+	hash := block.Hash()
+	if block.PrevBlockHash != set.bestBlock || height != set.height+1 {
+		return nil, fmt.Errorf("%w: %v at height %d", ErrNotUtxoTip, hash.RPCString(), height)
+	}
+	changes := &blockChanges{hash: hash, height: height, coins: make(map[OutPoint]Coin), undo: &BlockUndo{}}
+	// Like in bitcoin core, the outputs of the genesis block are not added
+	if height == 0 {
+		return changes, nil
+	}
+
+	// Outputs spent in the same block never reach the set
+	spentSet := make(map[OutPoint]bool)
+	for i := range block.Txs {
+		tx := &block.Txs[i]
+		if !tx.IsCoinBase() {
+			var txUndo TxUndo
+			for _, in := range tx.TxIn {
+				op := in.PreviousOutput
+				if coin, ok := changes.coins[op]; ok {
+					delete(changes.coins, op)
+					txUndo.Spent = append(txUndo.Spent, coin)
+					continue
+				}
+				coin, ok, err := set.Coin(op)
+				if err != nil {
+					return nil, err
+				}
+				if !ok || spentSet[op] {
+					return nil, fmt.Errorf("%w: %v:%d in tx %v", ErrMissingInputs, op.Hash.RPCString(), op.Index, tx.TxID().RPCString())
+				}
+				changes.spent = append(changes.spent, op)
+				spentSet[op] = true
+				txUndo.Spent = append(txUndo.Spent, coin)
+			}
+			changes.undo.Txs = append(changes.undo.Txs, txUndo)
+		}
+		txid := tx.TxID()
+		for j, out := range tx.TxOut {
+			if IsUnspendable(out.PkScript) {
+				continue
+			}
+			op := OutPoint{txid, uint32(j)}
+			changes.coins[op] = Coin{TxOut: out, Height: height, CoinBase: tx.IsCoinBase()}
+			changes.added = append(changes.added, op)
+		}
+	}
+	return changes, nil
+}
+
+// applyConnect applies the changes of a block prepared by prepareConnect
+func (set *UtxoSet) applyConnect(changes *blockChanges) error {
+	for _, op := range changes.spent {
+		set.spendCoin(op)
+	}
+	for _, op := range changes.added {
+		if coin, ok := changes.coins[op]; ok {
+			set.addCoin(op, coin)
+		}
+	}
+	set.undo[changes.hash] = changes.undo
+	set.bestBlock = changes.hash
+	set.height = changes.height
+	return set.flushIfFull()
+}
+
+// Disconnect reverts the best block using its undo data: the outputs of its
+// transactions are removed and the spent outputs restored.
+func (set *UtxoSet) Disconnect(block *Block) error {
+	hash := block.Hash()
+	if hash != set.bestBlock {
+		return fmt.Errorf("%w: %v is not the best block", ErrNotUtxoTip, hash.RPCString())
+	}
+	undo, err := set.Undo(hash)
+	if err != nil {
+		return err
+	}
+	if set.height > 0 && len(undo.Txs) != len(block.Txs)-1 {
+		return fmt.Errorf("%w: undo data for %v doesn't match the block", ErrCorruptUtxoSet, hash.RPCString())
+	}
+
+	for i := len(block.Txs) - 1; i >= 0 && set.height > 0; i-- {
+		tx := &block.Txs[i]
+		txid := tx.TxID()
+		for j, out := range tx.TxOut {
+			if IsUnspendable(out.PkScript) {
+				continue
+			}
+			op := OutPoint{txid, uint32(j)}
+			// The coin may be missing if it was overwritten by a
+			// duplicate coinbase (see BIP30)
+			if entry, err := set.fetch(op); err != nil {
+				return err
+			} else if entry != nil && !entry.spent {
+				set.spendCoin(op)
+			}
+		}
+		if i == 0 {
+			break
+		}
+		txUndo := undo.Txs[i-1]
+		if len(txUndo.Spent) != len(tx.TxIn) {
+			return fmt.Errorf("%w: undo data for %v doesn't match the block", ErrCorruptUtxoSet, hash.RPCString())
+		}
+		for j := len(tx.TxIn) - 1; j >= 0; j-- {
+			if _, err := set.fetch(tx.TxIn[j].PreviousOutput); err != nil {
+				return err
+			}
+			set.addCoin(tx.TxIn[j].PreviousOutput, txUndo.Spent[j])
+		}
+	}
+
+	set.undo[hash] = nil
+	set.bestBlock = block.PrevBlockHash
+	set.height--
+	return set.flushIfFull()
+}
+
+// Undo returns the undo data of a connected block
+func (set *UtxoSet) Undo(hash Hash) (*BlockUndo, error) {
+	if undo, ok := set.undo[hash]; ok {
+		if undo == nil {
+			return nil, fmt.Errorf("%w: block %v", ErrMissingUndo, hash.RPCString())
+		}
+		return undo, nil
+	}
+	if set.store != nil {
+		data, err := set.store.get(undoKey(hash))
+		if err != nil {
+			return nil, err
+		}
+		if data != nil {
+			undo, _, err := UnmarshalBlockUndo(data)
+			if err != nil {
+				return nil, fmt.Errorf("%w: undo data for %v: %v", ErrCorruptUtxoSet, hash.RPCString(), err)
+			}
+			return &undo, nil
+		}
+	}
+	return nil, fmt.Errorf("%w: block %v", ErrMissingUndo, hash.RPCString())
+}
+
+func (set *UtxoSet) flushIfFull() error {
+	if set.store == nil || len(set.cache) <= set.MaxCacheSize {
+		return nil
+	}
+	return set.Flush()
+}
+
+// Flush writes all changes together with the best block to disk in one
+// batch and empties the cache. Without a file, it only drops spent coins.
+func (set *UtxoSet) Flush() error {
+	if set.store == nil {
+		for op, entry := range set.cache {
+			if entry.spent {
+				delete(set.cache, op)
+			} else {
+				entry.dirty, entry.fresh = false, false
+			}
+		}
+		for hash, undo := range set.undo {
+			if undo == nil {
+				delete(set.undo, hash)
+			}
+		}
+		return nil
+	}
+
+	var batch []kvEntry
+	for op, entry := range set.cache {
+		if !entry.dirty {
+			continue
+		}
+		if entry.spent {
+			batch = append(batch, kvEntry{coinKey(op), nil})
+		} else {
+			batch = append(batch, kvEntry{coinKey(op), MarshalCoin(nil, entry.coin)})
+		}
+	}
+	for hash, undo := range set.undo {
+		if undo == nil {
+			batch = append(batch, kvEntry{undoKey(hash), nil})
+		} else {
+			batch = append(batch, kvEntry{undoKey(hash), MarshalBlockUndo(nil, *undo)})
+		}
+	}
+	best := MarshalHash(nil, set.bestBlock)
+	best = MarshalUint32(best, uint32(int32(set.height)))
+	batch = append(batch, kvEntry{utxoBestBlock, best})
+	if err := set.store.write(batch); err != nil {
+		return err
+	}
+	set.cache = make(map[OutPoint]*coinEntry)
+	set.undo = make(map[Hash]*BlockUndo)
+	return nil
+}
+
+// Statistics
+//===========
+
+// UtxoStats summarizes the UTXO set like bitcoin core's gettxoutsetinfo
+type UtxoStats struct {
+	Height         int
+	BestBlock      Hash
+	Transactions   int // number of transactions with unspent outputs
+	TxOuts         int
+	BogoSize       int64 // database independent size (see Core's GetBogoSize)
+	HashSerialized Hash  // hash_serialized_3
+	TotalAmount    int64
+	DiskSize       int64
+}
+
+// Stats computes the statistics of the set. The cache is flushed first.
+// HashSerialized matches the hash_serialized_3 of bitcoin core, which
+// hashes the coins in the order of its database keys.
+func (set *UtxoSet) Stats() (*UtxoStats, error) {
+	if err := set.Flush(); err != nil {
+		return nil, err
+	}
+	stats := &UtxoStats{Height: set.height, BestBlock: set.bestBlock}
+
+	type keyedCoin struct {
+		key  string
+		op   OutPoint
+		coin Coin
+	}
+	var coins []keyedCoin
+	if set.store == nil {
+		for op, entry := range set.cache {
+			coins = append(coins, keyedCoin{coinKey(op), op, entry.coin})
+		}
+		sort.Slice(coins, func(i, j int) bool { return coins[i].key < coins[j].key })
+	} else {
+		for _, key := range set.store.keys(utxoCoinPrefix) {
+			op, err := coinKeyOutPoint(key)
+			if err != nil {
+				return nil, err
+			}
+			data, err := set.store.get(key)
+			if err != nil {
+				return nil, err
+			}
+			coin, _, err := UnmarshalCoin(data)
+			if err != nil {
+				return nil, fmt.Errorf("%w: coin %v:%d: %v", ErrCorruptUtxoSet, op.Hash.RPCString(), op.Index, err)
+			}
+			coins = append(coins, keyedCoin{key, op, coin})
+		}
+		stats.DiskSize = set.store.diskSize()
+	}
+
+	hasher := sha256.New()
+	for i, c := range coins {
+		if i == 0 || c.op.Hash != coins[i-1].op.Hash {
+			stats.Transactions++
+		}
+		stats.TxOuts++
+		stats.TotalAmount += c.coin.Value
+		stats.BogoSize += 32 + 4 + 4 + 8 + 2 + int64(len(c.coin.PkScript))
+
+		code := uint32(c.coin.Height) << 1
+		if c.coin.CoinBase {
+			code |= 1
+		}
+		serialized := MarshalOutPoint(nil, c.op)
+		serialized = MarshalUint32(serialized, code)
+		hasher.Write(MarshalTxOut(serialized, c.coin.TxOut))
+	}
+	stats.HashSerialized = singleHash(hasher.Sum(nil))
+	return stats, nil
+}
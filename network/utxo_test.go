@@ -0,0 +1,244 @@
+package network
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCoreVarInt(t *testing.T) {
+	// Examples from serialize.h
+	tests := []struct {
+		n       uint64
+		encoded string
+	}{
+		{0, "00"}, {1, "01"}, {127, "7f"}, {128, "8000"}, {255, "807f"}, {256, "8100"},
+		{16383, "fe7f"}, {16384, "ff00"}, {16511, "ff7f"}, {65535, "82fe7f"}, {1 << 32, "8efefeff00"},
+	}
+	for _, test := range tests {
+		encoded := marshalCoreVarInt(nil, test.n)
+		if hex.EncodeToString(encoded) != test.encoded {
+			t.Errorf("Wrong encoding %x for %d", encoded, test.n)
+		}
+		n, rest, err := unmarshalCoreVarInt(encoded)
+		if err != nil || n != test.n || len(rest) != 0 {
+			t.Errorf("Wrong decoding %d for %s: %v", n, test.encoded, err)
+		}
+	}
+	if _, _, err := unmarshalCoreVarInt(h2b("8080")); err == nil {
+		t.Errorf("Truncated varint should fail")
+	}
+}
+
+// utxoTestChain creates a chain of blocks on top of the regtest genesis
+// block: every block has a coinbase paying to a unique script, the third
+// block spends the first coinbase and an output created in the same
+// block.
+func utxoTestChain() []Block {
+	genesis := Block{Header: RegTestParams.GenesisHeader, Txs: []Tx{{Version: 1}}}
+	blocks := []Block{genesis}
+	coinbase := func(height int) Tx {
+		return Tx{
+			Version: 1,
+			TxIn: []TxIn{{
+				PreviousOutput:  OutPoint{Index: 0xffffffff},
+				SignatureScript: NewScriptBuilder().AddInt64(int64(height)).AddOp(OP_0).Script(),
+				Sequence:        SEQUENCE_FINAL,
+			}},
+			TxOut: []TxOut{
+				{Value: 50 * COIN, PkScript: NewScriptBuilder().AddInt64(int64(height)).Script()},
+				{Value: 0, PkScript: []byte{OP_RETURN}},
+			},
+		}
+	}
+	for height := 1; height <= 3; height++ {
+		block := Block{Header: Header{Version: 4, PrevBlockHash: blocks[height-1].Hash(), Nonce: uint32(height)}}
+		block.Txs = append(block.Txs, coinbase(height))
+		if height == 3 {
+			spend := Tx{
+				Version: 2,
+				TxIn:    []TxIn{{PreviousOutput: OutPoint{blocks[1].Txs[0].TxID(), 0}, Sequence: SEQUENCE_FINAL}},
+				TxOut:   []TxOut{{Value: 30 * COIN, PkScript: []byte{OP_TRUE}}, {Value: 20 * COIN, PkScript: []byte{OP_2}}},
+			}
+			chained := Tx{
+				Version: 2,
+				TxIn:    []TxIn{{PreviousOutput: OutPoint{spend.TxID(), 1}, Sequence: SEQUENCE_FINAL}},
+				TxOut:   []TxOut{{Value: 19 * COIN, PkScript: []byte{OP_3}}},
+			}
+			block.Txs = append(block.Txs, spend, chained)
+		}
+		block.MerkleRootHash, _ = block.MerkleRoot()
+		blocks = append(blocks, block)
+	}
+	return blocks
+}
+
+func TestUtxoSetConnect(t *testing.T) {
+	blocks := utxoTestChain()
+	set := NewUtxoSet()
+
+	// The empty set as reported by gettxoutsetinfo
+	stats, err := set.Stats()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if stats.HashSerialized.RPCString() != "56944c5d3f98413ef45cf54545538103cc9f298e0575820ad3591376e2e0f65d" || stats.Height != -1 {
+		t.Errorf("Wrong stats for the empty set: %+v", stats)
+	}
+
+	var history []*UtxoStats
+	for height := range blocks {
+		if _, err := set.Connect(&blocks[height], height); err != nil {
+			t.Fatalf("Can't connect block %d: %v", height, err)
+		}
+		stats, err := set.Stats()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		history = append(history, stats)
+	}
+	if hash, height := set.BestBlock(); hash != blocks[3].Hash() || height != 3 {
+		t.Errorf("Wrong best block %v at %d", hash, height)
+	}
+
+	// Genesis outputs and OP_RETURN outputs are not added, outputs spent
+	// in the same block never show up
+	stats = history[3]
+	if stats.TxOuts != 4 || stats.Transactions != 4 || stats.TotalAmount != 149*COIN || stats.BogoSize != 4*50+4 {
+		t.Errorf("Wrong stats %+v", stats)
+	}
+	if history[0].TxOuts != 0 || history[0].BestBlock != blocks[0].Hash() || history[0].Height != 0 {
+		t.Errorf("Wrong stats after genesis %+v", history[0])
+	}
+	spend, chained := &blocks[3].Txs[1], &blocks[3].Txs[2]
+	if _, ok, _ := set.Coin(spend.TxIn[0].PreviousOutput); ok {
+		t.Errorf("Spent coinbase still in set")
+	}
+	if _, ok, _ := set.Coin(chained.TxIn[0].PreviousOutput); ok {
+		t.Errorf("Output spent in the same block is in set")
+	}
+	coin, ok, err := set.Coin(OutPoint{chained.TxID(), 0})
+	if !ok || err != nil || coin.Height != 3 || coin.CoinBase || coin.Value != 19*COIN {
+		t.Errorf("Wrong coin %+v", coin)
+	}
+	if coin, ok, _ := set.Coin(OutPoint{blocks[2].Txs[0].TxID(), 0}); !ok || !coin.CoinBase {
+		t.Errorf("Wrong coinbase coin %+v", coin)
+	}
+
+	undo, err := set.Undo(blocks[3].Hash())
+	if err != nil || len(undo.Txs) != 2 || undo.Txs[0].Spent[0].Height != 1 || undo.Txs[1].Spent[0].Value != 20*COIN {
+		t.Fatalf("Wrong undo data %+v (%v)", undo, err)
+	}
+	decoded, rest, err := UnmarshalBlockUndo(MarshalBlockUndo(nil, *undo))
+	if err != nil || len(rest) != 0 || !reflect.DeepEqual(decoded, *undo) {
+		t.Errorf("Undo data round trip failed: %v", err)
+	}
+
+	// Disconnecting restores the previous states
+	for height := 3; height >= 0; height-- {
+		if err := set.Disconnect(&blocks[height]); err != nil {
+			t.Fatalf("Can't disconnect block %d: %v", height, err)
+		}
+		stats, _ := set.Stats()
+		if height > 0 && !reflect.DeepEqual(stats, history[height-1]) {
+			t.Errorf("Wrong stats after disconnecting %d: %+v", height, stats)
+		}
+	}
+	if stats, _ := set.Stats(); stats.TxOuts != 0 || stats.Height != -1 {
+		t.Errorf("Set not empty: %+v", stats)
+	}
+}
+
+func TestUtxoSetConnectErrors(t *testing.T) {
+	blocks := utxoTestChain()
+	set := NewUtxoSet()
+	if _, err := set.Connect(&blocks[1], 1); !errors.Is(err, ErrNotUtxoTip) {
+		t.Errorf("Expected wrong tip, got %v", err)
+	}
+	for height := 0; height < 2; height++ {
+		if _, err := set.Connect(&blocks[height], height); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+	}
+	before, _ := set.Stats()
+
+	// Spending the same output twice
+	block := blocks[3]
+	block.PrevBlockHash = blocks[1].Hash()
+	block.Txs = append(block.Txs[:2:2], block.Txs[1])
+	if _, err := set.Connect(&block, 2); !errors.Is(err, ErrMissingInputs) {
+		t.Errorf("Expected missing inputs, got %v", err)
+	}
+	if after, _ := set.Stats(); !reflect.DeepEqual(before, after) {
+		t.Errorf("Failed block changed the set")
+	}
+	if err := set.Disconnect(&blocks[3]); !errors.Is(err, ErrNotUtxoTip) {
+		t.Errorf("Expected wrong tip, got %v", err)
+	}
+}
+
+func TestOpenUtxoSet(t *testing.T) {
+	dir, err := ioutil.TempDir("", "utxo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "utxo.dat")
+
+	blocks := utxoTestChain()
+	memory := NewUtxoSet()
+	set, err := OpenUtxoSet(path)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	// Flush after every block
+	set.MaxCacheSize = 0
+	for height := range blocks {
+		if _, err := set.Connect(&blocks[height], height); err != nil {
+			t.Fatalf("Can't connect block %d: %v", height, err)
+		}
+		memory.Connect(&blocks[height], height)
+	}
+	if set.CacheSize() != 0 {
+		t.Errorf("Cache not flushed")
+	}
+	if err = set.Close(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	if set, err = OpenUtxoSet(path); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer set.Close()
+	stats, err := set.Stats()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	expected, _ := memory.Stats()
+	if stats.DiskSize == 0 {
+		t.Errorf("Disk size missing")
+	}
+	expected.DiskSize = stats.DiskSize
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("Wrong stats after reopening: %+v, expected %+v", stats, expected)
+	}
+
+	// The undo data is read from disk
+	if err := set.Disconnect(&blocks[3]); err != nil {
+		t.Fatalf("Can't disconnect block: %v", err)
+	}
+	memory.Disconnect(&blocks[3])
+	stats, _ = set.Stats()
+	expected, _ = memory.Stats()
+	expected.DiskSize = stats.DiskSize
+	if !reflect.DeepEqual(stats, expected) {
+		t.Errorf("Wrong stats after disconnecting: %+v, expected %+v", stats, expected)
+	}
+	if _, err := set.Undo(blocks[3].Hash()); !errors.Is(err, ErrMissingUndo) {
+		t.Errorf("Undo data of disconnected block not removed: %v", err)
+	}
+}
@@ -0,0 +1,642 @@
+package network
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+// Reject errors
+//==============
+
+// RejectError is a validation failure with the code and reason bitcoin core
+// uses in reject messages. It wraps the error describing the failure, so
+// errors.Is works with the sentinel errors.
+type RejectError struct {
+	Code   uint8  // one of the REJECT_* codes
+	Reason string // e.g. "bad-txns-vin-empty"
+	Err    error
+}
+
+func (e *RejectError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RejectError) Unwrap() error {
+	return e.Err
+}
+
+// RejectMessage returns the reject message for the rejected object with the
+// given command ("block" or "tx") and hash
+func (e *RejectError) RejectMessage(command string, hash Hash) *RejectMessage {
+	return &RejectMessage{Message: command, CCode: e.Code, Reason: e.Reason, Data: hash[:]}
+}
+
+// Errors returned by block validation, with bitcoin core's reject reasons
+var (
+	ErrBlockLength           = errors.New("bad-blk-length")
+	ErrBlockWeight           = errors.New("bad-blk-weight")
+	ErrBlockSigOps           = errors.New("bad-blk-sigops")
+	ErrCoinbaseMissing       = errors.New("bad-cb-missing")
+	ErrCoinbaseMultiple      = errors.New("bad-cb-multiple")
+	ErrCoinbaseHeight        = errors.New("bad-cb-height")
+	ErrCoinbaseAmount        = errors.New("bad-cb-amount")
+	ErrTxNonFinal            = errors.New("bad-txns-nonfinal")
+	ErrTxBIP30               = errors.New("bad-txns-BIP30")
+	ErrPrematureSpend        = errors.New("bad-txns-premature-spend-of-coinbase")
+	ErrInputValuesRange      = errors.New("bad-txns-inputvalues-outofrange")
+	ErrInBelowOut            = errors.New("bad-txns-in-belowout")
+	ErrFeeOutOfRange         = errors.New("bad-txns-fee-outofrange")
+	ErrAccumulatedFeeRange   = errors.New("bad-txns-accumulated-fee-outofrange")
+	ErrScriptVerifyFailed    = errors.New("mandatory-script-verify-flag-failed")
+	ErrBlockValidationFailed = errors.New("block-validation-failed")
+)
+
+// rejectCodes maps the errors of header, block and transaction validation
+// and of the mempool policy to reject codes. Errors not listed here are
+// REJECT_INVALID.
+var rejectCodes = []struct {
+	err  error
+	code uint8
+}{
+	// headers
+	{ErrBadDiffBits, REJECT_INVALID},
+	{ErrTimeTooOld, REJECT_INVALID},
+	{ErrTimeTooNew, REJECT_INVALID},
+	{ErrTimewarp, REJECT_INVALID},
+	{ErrBadVersion, REJECT_OBSOLETE},
+	{ErrCheckpointMismatch, REJECT_CHECKPOINT},
+	{ErrForkBeforeCheckpoint, REJECT_CHECKPOINT},
+	{ErrHighHash, REJECT_INVALID},
+	{ErrBadBits, REJECT_INVALID},
+	// merkle tree and witness commitment
+	{ErrBadMerkleRoot, REJECT_INVALID},
+	{ErrDuplicateTx, REJECT_INVALID},
+	{ErrNoTransactions, REJECT_INVALID},
+	{ErrBadWitnessNonceSize, REJECT_INVALID},
+	{ErrBadWitnessMerkle, REJECT_INVALID},
+	{ErrUnexpectedWitness, REJECT_INVALID},
+	// transactions
+	{ErrTxVinEmpty, REJECT_INVALID},
+	{ErrTxVoutEmpty, REJECT_INVALID},
+	{ErrTxOversize, REJECT_INVALID},
+	{ErrTxVoutNegative, REJECT_INVALID},
+	{ErrTxVoutTooLarge, REJECT_INVALID},
+	{ErrTxOutTotalTooLarge, REJECT_INVALID},
+	{ErrTxInputsDuplicate, REJECT_INVALID},
+	{ErrCoinbaseLength, REJECT_INVALID},
+	{ErrTxPrevOutNull, REJECT_INVALID},
+	{ErrMissingInputs, REJECT_INVALID},
+	// blocks
+	{ErrBlockLength, REJECT_INVALID},
+	{ErrBlockWeight, REJECT_INVALID},
+	{ErrBlockSigOps, REJECT_INVALID},
+	{ErrCoinbaseMissing, REJECT_INVALID},
+	{ErrCoinbaseMultiple, REJECT_INVALID},
+	{ErrCoinbaseHeight, REJECT_INVALID},
+	{ErrCoinbaseAmount, REJECT_INVALID},
+	{ErrTxNonFinal, REJECT_INVALID},
+	{ErrTxBIP30, REJECT_INVALID},
+	{ErrPrematureSpend, REJECT_INVALID},
+	{ErrInputValuesRange, REJECT_INVALID},
+	{ErrInBelowOut, REJECT_INVALID},
+	{ErrFeeOutOfRange, REJECT_INVALID},
+	{ErrAccumulatedFeeRange, REJECT_INVALID},
+	// mempool policy
+	{ErrTxVersion, REJECT_NONSTANDARD},
+	{ErrTxWeight, REJECT_NONSTANDARD},
+	{ErrTxSizeSmall, REJECT_NONSTANDARD},
+	{ErrScriptSigSize, REJECT_NONSTANDARD},
+	{ErrScriptSigNotPushOnly, REJECT_NONSTANDARD},
+	{ErrScriptPubKey, REJECT_NONSTANDARD},
+	{ErrDust, REJECT_NONSTANDARD},
+	{ErrMultiOpReturn, REJECT_NONSTANDARD},
+	{ErrNonstandardInputs, REJECT_NONSTANDARD},
+	{ErrNonstandardWitness, REJECT_NONSTANDARD},
+	{ErrTooManySigOps, REJECT_NONSTANDARD},
+	{ErrTxCoinbase, REJECT_INVALID},
+	{ErrTxNotFinal, REJECT_NONSTANDARD},
+	{ErrTxNotBIP68Final, REJECT_NONSTANDARD},
+	{ErrTxInMempool, REJECT_DUPLICATE},
+	{ErrTxSameNonWitness, REJECT_DUPLICATE},
+	{ErrTxAlreadyKnown, REJECT_DUPLICATE},
+	{ErrMempoolConflict, REJECT_DUPLICATE},
+	{ErrSpendsConflicting, REJECT_INVALID},
+	{ErrTooManyReplacements, REJECT_NONSTANDARD},
+	{ErrReplacementAddsUnconfirmed, REJECT_NONSTANDARD},
+	{ErrInsufficientFee, REJECT_INSUFFICIENTFEE},
+	{ErrMinRelayFee, REJECT_INSUFFICIENTFEE},
+	{ErrMempoolMinFee, REJECT_INSUFFICIENTFEE},
+	{ErrTooLongMempoolChain, REJECT_NONSTANDARD},
+	{ErrMempoolFull, REJECT_INSUFFICIENTFEE},
+}
+
+// NewRejectError wraps err in a RejectError. The reason is the message of
+// the known validation error err wraps, the code is taken from rejectCodes.
+// A RejectError is returned unchanged, other errors get reason
+// "block-validation-failed".
+func NewRejectError(err error) *RejectError {
+	var rejectErr *RejectError
+	if errors.As(err, &rejectErr) {
+		return rejectErr
+	}
+	for _, entry := range rejectCodes {
+		if errors.Is(err, entry.err) {
+			return &RejectError{Code: entry.code, Reason: entry.err.Error(), Err: err}
+		}
+	}
+	return &RejectError{Code: REJECT_INVALID, Reason: ErrBlockValidationFailed.Error(), Err: err}
+}
+
+func rejectError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return NewRejectError(err)
+}
+
+// Helpers
+//========
+
+// GetBlockSubsidy returns the newly created coins a coinbase at height may
+// claim: 50 BTC halved every SubsidyHalvingInterval blocks
+func GetBlockSubsidy(height int, params *ConsensusParams) int64 {
+	halvings := height / params.SubsidyHalvingInterval
+	if halvings >= 64 {
+		return 0
+	}
+	return (50 * COIN) >> uint(halvings)
+}
+
+// IsFinalTx checks the lock time of tx for a block at height with the lock
+// time cutoff blockTime (the median time past since BIP113)
+func IsFinalTx(tx *Tx, height int, blockTime int64) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+	cutoff := blockTime
+	if tx.LockTime < LOCKTIME_THRESHOLD {
+		cutoff = int64(height)
+	}
+	if int64(tx.LockTime) < cutoff {
+		return true
+	}
+	for _, in := range tx.TxIn {
+		if in.Sequence != SEQUENCE_FINAL {
+			return false
+		}
+	}
+	return true
+}
+
+// Weight returns the weight of the block (BIP141)
+func (b *Block) Weight() int {
+	weight := len(MarshalHeader(nil, b.Header)) + len(MarshalVarInt(nil, uint64(len(b.Txs))))
+	weight *= WITNESS_SCALE_FACTOR
+	for i := range b.Txs {
+		weight += b.Txs[i].Weight()
+	}
+	return weight
+}
+
+// strippedSize returns the size of the block without witness data
+func (b *Block) strippedSize() int {
+	size := len(MarshalHeader(nil, b.Header)) + len(MarshalVarInt(nil, uint64(len(b.Txs))))
+	for _, tx := range b.Txs {
+		size += len(MarshalTxNoWitness(nil, tx))
+	}
+	return size
+}
+
+// LegacySigOpCount counts the signature operations in the scripts of tx
+// the inaccurate legacy way
+func LegacySigOpCount(tx *Tx) int {
+	n := 0
+	for _, in := range tx.TxIn {
+		n += CountSigOps(in.SignatureScript, false)
+	}
+	for _, out := range tx.TxOut {
+		n += CountSigOps(out.PkScript, false)
+	}
+	return n
+}
+
+// witnessSigOps counts the signature operations of a witness program: one
+// for P2WPKH, those of the witness script for P2WSH, none for other versions
+// (taproot has its own limits)
+func witnessSigOps(version byte, program []byte, witness [][]byte) int {
+	if version != 0 {
+		return 0
+	}
+	if len(program) == 20 {
+		return 1
+	}
+	if len(program) == 32 && len(witness) > 0 {
+		return CountSigOps(witness[len(witness)-1], true)
+	}
+	return 0
+}
+
+// CountWitnessSigOps counts the signature operations of the witness program
+// spent by an input, either directly or nested in P2SH
+func CountWitnessSigOps(scriptSig, scriptPubKey []byte, witness [][]byte, flags ScriptFlags) int {
+	if flags&SCRIPT_VERIFY_WITNESS == 0 {
+		return 0
+	}
+	if version, program, ok := IsWitnessProgram(scriptPubKey); ok {
+		return witnessSigOps(version, program, witness)
+	}
+	if IsPayToScriptHash(scriptPubKey) && IsPushOnly(scriptSig) {
+		var redeemScript []byte
+		for t := NewScriptTokenizer(scriptSig); t.Next(); {
+			redeemScript = t.Data()
+		}
+		if version, program, ok := IsWitnessProgram(redeemScript); ok {
+			return witnessSigOps(version, program, witness)
+		}
+	}
+	return 0
+}
+
+// TransactionSigOpCost returns the signature operation cost of tx (legacy
+// and P2SH operations count WITNESS_SCALE_FACTOR times). spent are the
+// outputs spent by its inputs.
+func TransactionSigOpCost(tx *Tx, spent []TxOut, flags ScriptFlags) int {
+	cost := LegacySigOpCount(tx) * WITNESS_SCALE_FACTOR
+	if tx.IsCoinBase() {
+		return cost
+	}
+	for i, in := range tx.TxIn {
+		if flags&SCRIPT_VERIFY_P2SH != 0 {
+			cost += P2SHSigOpCount(in.SignatureScript, spent[i].PkScript) * WITNESS_SCALE_FACTOR
+		}
+		cost += CountWitnessSigOps(in.SignatureScript, spent[i].PkScript, in.Witness, flags)
+	}
+	return cost
+}
+
+// GetBlockScriptFlags returns the script flags for validating the block of
+// node: P2SH, segwit and taproot are enforced for all blocks except the
+// exceptions, the other soft forks from their activation height on.
+func GetBlockScriptFlags(node *HeaderNode, params *ConsensusParams) ScriptFlags {
+	flags := SCRIPT_VERIFY_P2SH | SCRIPT_VERIFY_WITNESS | SCRIPT_VERIFY_TAPROOT
+	if exception, ok := params.ScriptFlagExceptions[node.Hash]; ok {
+		flags = exception
+	}
+	if node.Height >= params.BIP66Height {
+		flags |= SCRIPT_VERIFY_DERSIG
+	}
+	if node.Height >= params.BIP65Height {
+		flags |= SCRIPT_VERIFY_CHECKLOCKTIMEVERIFY
+	}
+	if node.Height >= params.CSVHeight {
+		flags |= SCRIPT_VERIFY_CHECKSEQUENCEVERIFY
+	}
+	if node.Height >= params.SegwitHeight {
+		flags |= SCRIPT_VERIFY_NULLDUMMY
+	}
+	return flags
+}
+
+// CheckSequenceLocks checks the BIP68 relative lock times of the inputs of
+// tx, which is included in the block of node. heights are the heights of
+// the blocks which created the spent outputs.
+func CheckSequenceLocks(tx *Tx, heights []int, node *HeaderNode) bool {
+	if tx.Version < 2 {
+		return true
+	}
+	minHeight, minTime := -1, int64(-1)
+	for i, in := range tx.TxIn {
+		if in.Sequence&SEQUENCE_LOCKTIME_DISABLE_FLAG != 0 {
+			continue
+		}
+		value := int64(in.Sequence & SEQUENCE_LOCKTIME_MASK)
+		if in.Sequence&SEQUENCE_LOCKTIME_TYPE_FLAG != 0 {
+			// The time is counted from the median time past of the
+			// block before the one with the spent output
+			height := heights[i] - 1
+			if height < 0 {
+				height = 0
+			}
+			coinTime := node.Ancestor(height).MedianTimePast().Unix()
+			if t := coinTime + value<<SEQUENCE_LOCKTIME_GRANULARITY - 1; t > minTime {
+				minTime = t
+			}
+		} else if h := heights[i] + int(value) - 1; h > minHeight {
+			minHeight = h
+		}
+	}
+	if minHeight >= node.Height {
+		return false
+	}
+	return node.Parent == nil || minTime < node.Parent.MedianTimePast().Unix()
+}
+
+// Block checks
+//=============
+
+// CheckBlock performs the context free checks of a block (as bitcoin core's
+// CheckBlock): proof of work, merkle root, size, a single coinbase at the
+// start, the transactions and the legacy signature operation limit. Errors
+// are returned as *RejectError.
+func CheckBlock(block *Block, params *ConsensusParams) error {
+	return rejectError(checkBlock(block, params))
+}
+
+func checkBlock(block *Block, params *ConsensusParams) error {
+	if err := CheckHeader(block.Header, params); err != nil {
+		return err
+	}
+	if err := block.CheckMerkleRoot(); err != nil {
+		return err
+	}
+	if len(block.Txs)*WITNESS_SCALE_FACTOR > MAX_BLOCK_WEIGHT || block.strippedSize()*WITNESS_SCALE_FACTOR > MAX_BLOCK_WEIGHT {
+		return fmt.Errorf("%w: size limits failed", ErrBlockLength)
+	}
+	if !block.Txs[0].IsCoinBase() {
+		return fmt.Errorf("%w: first tx is not coinbase", ErrCoinbaseMissing)
+	}
+	for i := 1; i < len(block.Txs); i++ {
+		if block.Txs[i].IsCoinBase() {
+			return fmt.Errorf("%w: more than one coinbase", ErrCoinbaseMultiple)
+		}
+	}
+	sigOps := 0
+	for i := range block.Txs {
+		tx := &block.Txs[i]
+		if err := CheckTransaction(tx); err != nil {
+			return fmt.Errorf("%w (tx %v)", err, tx.TxID().RPCString())
+		}
+		sigOps += LegacySigOpCount(tx)
+	}
+	if sigOps*WITNESS_SCALE_FACTOR > MAX_BLOCK_SIGOPS_COST {
+		return fmt.Errorf("%w: out-of-bounds SigOpCount", ErrBlockSigOps)
+	}
+	return nil
+}
+
+// ContextualCheckBlock checks a block against its predecessor prev (as
+// bitcoin core's ContextualCheckBlock): all transactions must be final, the
+// coinbase must start with the height (BIP34), the witness commitment must
+// match (BIP141) and the weight must be within the limit.
+func ContextualCheckBlock(block *Block, prev *HeaderNode, params *ConsensusParams) error {
+	return rejectError(contextualCheckBlock(block, prev, params))
+}
+
+func contextualCheckBlock(block *Block, prev *HeaderNode, params *ConsensusParams) error {
+	height := prev.Height + 1
+
+	// Since BIP113, the median time past is the lock time cutoff
+	lockTimeCutoff := block.Timestamp.Unix()
+	if height >= params.CSVHeight {
+		lockTimeCutoff = prev.MedianTimePast().Unix()
+	}
+	for i := range block.Txs {
+		if !IsFinalTx(&block.Txs[i], height, lockTimeCutoff) {
+			return fmt.Errorf("%w: non-final transaction %v", ErrTxNonFinal, block.Txs[i].TxID().RPCString())
+		}
+	}
+
+	if height >= params.BIP34Height {
+		expected := NewScriptBuilder().AddInt64(int64(height)).Script()
+		scriptSig := block.Txs[0].TxIn[0].SignatureScript
+		if len(scriptSig) < len(expected) || string(scriptSig[:len(expected)]) != string(expected) {
+			return fmt.Errorf("%w: block height mismatch in coinbase", ErrCoinbaseHeight)
+		}
+	}
+
+	if height >= params.SegwitHeight {
+		if err := block.CheckWitnessCommitment(); err != nil {
+			return err
+		}
+	} else {
+		for i := range block.Txs {
+			if block.Txs[i].HasWitness() {
+				return fmt.Errorf("%w: witness before segwit activation", ErrUnexpectedWitness)
+			}
+		}
+	}
+
+	if weight := block.Weight(); weight > MAX_BLOCK_WEIGHT {
+		return fmt.Errorf("%w: weight limit failed (%d)", ErrBlockWeight, weight)
+	}
+	return nil
+}
+
+// Connecting blocks
+//==================
+
+// Blocks 91842 and 91880 on mainnet contain coinbases which duplicate
+// earlier ones. They are the only violations of BIP30.
+var bip30Exceptions = map[int]Hash{
+	91842: mustParseHash("00000000000a4d0a398161ffc163c503763b1f4360639393e0e4c8e300e0caec"),
+	91880: mustParseHash("00000000000743f190a18c5577a3c2d2a1f610ae9601ac046a38084ccb7cd721"),
+}
+
+// BIP34 makes coinbases unique, which makes the BIP30 check unnecessary,
+// until this height where the coinbase heights of early blocks (which did
+// not follow BIP34) could repeat
+const BIP34_IMPLIES_BIP30_LIMIT = 1983702
+
+// scriptCheck is the verification of one input script
+type scriptCheck struct {
+	tx     *Tx
+	index  int
+	spent  TxOut
+	txData *PrecomputedTxData
+	flags  ScriptFlags
+}
+
+// scriptCheckError is a failed script check. It wraps the reject reason
+// and the error of the interpreter, so errors.Is finds both.
+type scriptCheckError struct {
+	reason error // ErrScriptVerifyFailed or ErrScriptVerifyNonMandatory
+	err    error
+	input  string // the failed input
+}
+
+func (e *scriptCheckError) Error() string {
+	return fmt.Sprintf("%v (%v): %s", e.reason, e.err, e.input)
+}
+
+func (e *scriptCheckError) Unwrap() error {
+	return e.reason
+}
+
+func (e *scriptCheckError) Is(target error) bool {
+	return errors.Is(e.err, target)
+}
+
+func (e *scriptCheckError) As(target interface{}) bool {
+	return errors.As(e.err, target)
+}
+
+func (c *scriptCheck) verify() error {
+	in := &c.tx.TxIn[c.index]
+	checker := &TxSignatureChecker{Tx: c.tx, Index: c.index, Amount: c.spent.Value, TxData: c.txData}
+	return VerifyScript(in.SignatureScript, c.spent.PkScript, in.Witness, c.flags, checker)
+}
+
+// runScriptChecks verifies the scripts on all CPUs and returns the first
+// failure found
+func runScriptChecks(checks []scriptCheck) error {
+	workers := runtime.NumCPU()
+	if workers > len(checks) {
+		workers = len(checks)
+	}
+	var next int64 = -1
+	var failed int32
+	var firstErr error
+	var once sync.Once
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for atomic.LoadInt32(&failed) == 0 {
+				i := atomic.AddInt64(&next, 1)
+				if i >= int64(len(checks)) {
+					return
+				}
+				c := &checks[i]
+				if err := c.verify(); err != nil {
+					once.Do(func() {
+						firstErr = &RejectError{
+							Code:   REJECT_INVALID,
+							Reason: fmt.Sprintf("%s (%v)", ErrScriptVerifyFailed, err),
+							Err:    &scriptCheckError{ErrScriptVerifyFailed, err, fmt.Sprintf("input %d of tx %v", c.index, c.tx.TxID().RPCString())},
+						}
+						atomic.StoreInt32(&failed, 1)
+					})
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return firstErr
+}
+
+// ConnectBlock validates the transactions of a block against the UTXO set
+// and applies them (as bitcoin core's ConnectBlock). node is the header
+// node of the block, which must follow the best block of utxo. It checks
+// BIP30, coinbase maturity, input and output values, BIP68 sequence locks,
+// the signature operation cost, the coinbase amount (subsidy and fees) and
+// all scripts, which are verified in parallel. The block should have
+// passed CheckBlock and ContextualCheckBlock. Errors are returned as
+// *RejectError, the UTXO set is only changed if the block is valid.
+func ConnectBlock(block *Block, node *HeaderNode, utxo *UtxoSet, params *ConsensusParams) (*BlockUndo, error) {
+	undo, err := connectBlock(block, node, utxo, params)
+	return undo, rejectError(err)
+}
+
+func connectBlock(block *Block, node *HeaderNode, utxo *UtxoSet, params *ConsensusParams) (*BlockUndo, error) {
+	// The undo data of the spending transactions is indexed by their
+	// position after the coinbase (the genesis block is not checked)
+	if node.Height > 0 {
+		if len(block.Txs) == 0 || !block.Txs[0].IsCoinBase() {
+			return nil, ErrCoinbaseMissing
+		}
+		for i := range block.Txs[1:] {
+			if block.Txs[1+i].IsCoinBase() {
+				return nil, ErrCoinbaseMultiple
+			}
+		}
+	}
+	changes, err := utxo.prepareConnect(block, node.Height)
+	if err != nil {
+		return nil, err
+	}
+	if node.Height == 0 {
+		return changes.undo, utxo.applyConnect(changes)
+	}
+
+	// BIP30: transactions may not overwrite unspent outputs
+	enforceBIP30 := node.Height < params.BIP34Height || node.Height >= BIP34_IMPLIES_BIP30_LIMIT
+	if hash, ok := bip30Exceptions[node.Height]; ok && hash == node.Hash {
+		enforceBIP30 = false
+	}
+	if enforceBIP30 {
+		for i := range block.Txs {
+			txid := block.Txs[i].TxID()
+			for j := range block.Txs[i].TxOut {
+				_, exists, err := utxo.Coin(OutPoint{txid, uint32(j)})
+				if err != nil {
+					return nil, err
+				}
+				if exists {
+					return nil, fmt.Errorf("%w: tried to overwrite transaction %v", ErrTxBIP30, txid.RPCString())
+				}
+			}
+		}
+	}
+
+	flags := GetBlockScriptFlags(node, params)
+	var checks []scriptCheck
+	var fees int64
+	sigOpCost := 0
+	for i := range block.Txs {
+		tx := &block.Txs[i]
+		if tx.IsCoinBase() {
+			sigOpCost += TransactionSigOpCost(tx, nil, flags)
+			continue
+		}
+		coins := changes.undo.Txs[i-1].Spent
+		spent := make([]TxOut, len(coins))
+		heights := make([]int, len(coins))
+		var valueIn int64
+		for j, coin := range coins {
+			if coin.CoinBase && node.Height-coin.Height < COINBASE_MATURITY {
+				return nil, fmt.Errorf("%w: tried to spend coinbase at depth %d", ErrPrematureSpend, node.Height-coin.Height)
+			}
+			valueIn += coin.Value
+			if !MoneyRange(coin.Value) || !MoneyRange(valueIn) {
+				return nil, ErrInputValuesRange
+			}
+			spent[j] = coin.TxOut
+			heights[j] = coin.Height
+		}
+		var valueOut int64
+		for _, out := range tx.TxOut {
+			valueOut += out.Value
+		}
+		if valueIn < valueOut {
+			return nil, fmt.Errorf("%w: value in (%d) < value out (%d) in tx %v", ErrInBelowOut, valueIn, valueOut, tx.TxID().RPCString())
+		}
+		fees += valueIn - valueOut
+		if !MoneyRange(fees) {
+			return nil, fmt.Errorf("%w: accumulated fee in the block out of range", ErrAccumulatedFeeRange)
+		}
+
+		if flags&SCRIPT_VERIFY_CHECKSEQUENCEVERIFY != 0 && !CheckSequenceLocks(tx, heights, node) {
+			return nil, fmt.Errorf("%w: contains a non-BIP68-final transaction %v", ErrTxNonFinal, tx.TxID().RPCString())
+		}
+
+		sigOpCost += TransactionSigOpCost(tx, spent, flags)
+		if sigOpCost > MAX_BLOCK_SIGOPS_COST {
+			return nil, fmt.Errorf("%w: too many sigops", ErrBlockSigOps)
+		}
+
+		txData := NewPrecomputedTxData(tx, spent)
+		for j := range tx.TxIn {
+			checks = append(checks, scriptCheck{tx: tx, index: j, spent: spent[j], txData: txData, flags: flags})
+		}
+	}
+	if sigOpCost > MAX_BLOCK_SIGOPS_COST {
+		return nil, fmt.Errorf("%w: too many sigops", ErrBlockSigOps)
+	}
+
+	var coinbaseOut int64
+	for _, out := range block.Txs[0].TxOut {
+		coinbaseOut += out.Value
+	}
+	if limit := fees + GetBlockSubsidy(node.Height, params); coinbaseOut > limit {
+		return nil, fmt.Errorf("%w: coinbase pays too much (actual=%d vs limit=%d)", ErrCoinbaseAmount, coinbaseOut, limit)
+	}
+
+	if err := runScriptChecks(checks); err != nil {
+		return nil, err
+	}
+	return changes.undo, utxo.applyConnect(changes)
+}
@@ -0,0 +1,337 @@
+package network
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetBlockSubsidy(t *testing.T) {
+	main := &MainNetParams.Consensus
+	tests := []struct {
+		height  int
+		subsidy int64
+	}{
+		{0, 50 * COIN}, {209999, 50 * COIN}, {210000, 25 * COIN}, {420000, 1250000000},
+		{630000, 625000000}, {840000, 312500000}, {32 * 210000, 1}, {33 * 210000, 0}, {64 * 210000, 0},
+	}
+	for _, test := range tests {
+		if subsidy := GetBlockSubsidy(test.height, main); subsidy != test.subsidy {
+			t.Errorf("Wrong subsidy %d at height %d", subsidy, test.height)
+		}
+	}
+	if subsidy := GetBlockSubsidy(150, &RegTestParams.Consensus); subsidy != 25*COIN {
+		t.Errorf("Wrong regtest subsidy %d", subsidy)
+	}
+}
+
+func TestCountSigOps(t *testing.T) {
+	key := "21" + "0279be667ef9dcbbac55a06295ce870b07029bfcdb2dce28d959f2815b16f81798"
+	multisig := h2b("52" + key + key + "52ae")
+	if n := CountSigOps(multisig, false); n != 20 {
+		t.Errorf("Wrong legacy count %d", n)
+	}
+	if n := CountSigOps(multisig, true); n != 2 {
+		t.Errorf("Wrong accurate count %d", n)
+	}
+	if n := CountSigOps(h2b("acadac4c"), false); n != 3 {
+		t.Errorf("Wrong count %d for truncated script", n)
+	}
+
+	p2sh := append([]byte{OP_HASH160, 20}, make([]byte, 20)...)
+	p2sh = append(p2sh, OP_EQUAL)
+	scriptSig := NewScriptBuilder().AddOp(OP_0).AddData(multisig).Script()
+	if n := P2SHSigOpCount(scriptSig, p2sh); n != 2 {
+		t.Errorf("Wrong P2SH count %d", n)
+	}
+	if n := P2SHSigOpCount(append(scriptSig, OP_NOP), p2sh); n != 0 {
+		t.Errorf("Wrong P2SH count %d for non push only scriptSig", n)
+	}
+
+	p2wsh := append([]byte{OP_0, 32}, make([]byte, 32)...)
+	if n := CountWitnessSigOps(nil, p2wsh, [][]byte{{}, multisig}, SCRIPT_VERIFY_WITNESS); n != 2 {
+		t.Errorf("Wrong P2WSH count %d", n)
+	}
+	p2wpkh := append([]byte{OP_0, 20}, make([]byte, 20)...)
+	nested := NewScriptBuilder().AddData(p2wpkh).Script()
+	if n := CountWitnessSigOps(nested, p2sh, [][]byte{{}, {}}, SCRIPT_VERIFY_WITNESS); n != 1 {
+		t.Errorf("Wrong nested P2WPKH count %d", n)
+	}
+	if n := CountWitnessSigOps(nested, p2sh, nil, SCRIPT_VERIFY_P2SH); n != 0 {
+		t.Errorf("Witness sigops counted without segwit")
+	}
+}
+
+// validationTestChain builds and connects regtest blocks
+type validationTestChain struct {
+	t      *testing.T
+	params *ConsensusParams
+	utxo   *UtxoSet
+	tip    *HeaderNode
+	blocks []*Block
+}
+
+func newValidationTestChain(t *testing.T, params *ConsensusParams) *validationTestChain {
+	genesis := RegTestParams.GenesisHeader
+	node := &HeaderNode{Header: genesis, Hash: genesis.Hash(), ChainWork: genesis.Work()}
+	c := &validationTestChain{t: t, params: params, utxo: NewUtxoSet(), tip: node}
+	block := &Block{Header: genesis, Txs: []Tx{{Version: 1}}}
+	if _, err := ConnectBlock(block, node, c.utxo, params); err != nil {
+		t.Fatalf("Can't connect genesis block: %v", err)
+	}
+	c.blocks = append(c.blocks, block)
+	return c
+}
+
+// coinbase returns a coinbase for the next block paying value to OP_TRUE
+func (c *validationTestChain) coinbase(value int64) Tx {
+	return Tx{
+		Version: 1,
+		TxIn: []TxIn{{
+			PreviousOutput:  OutPoint{Index: 0xffffffff},
+			SignatureScript: NewScriptBuilder().AddInt64(int64(c.tip.Height + 1)).AddOp(OP_0).Script(),
+			Sequence:        SEQUENCE_FINAL,
+		}},
+		TxOut: []TxOut{{Value: value, PkScript: []byte{OP_TRUE}}},
+	}
+}
+
+// newBlock mines a block on top of the tip with the given coinbase and
+// transactions, adding a witness commitment
+func (c *validationTestChain) newBlock(coinbase Tx, txs ...Tx) *Block {
+	block := &Block{
+		Header: Header{
+			Version:       4,
+			PrevBlockHash: c.tip.Hash,
+			Timestamp:     c.tip.Timestamp.Add(10 * time.Minute),
+			Bits:          c.tip.Bits,
+		},
+		Txs: append([]Tx{coinbase}, txs...),
+	}
+	block.Txs[0].TxIn[0].Witness = [][]byte{make([]byte, 32)}
+	commitment := WitnessCommitment(block.WitnessMerkleRoot(), make([]byte, 32))
+	block.Txs[0].TxOut = append(block.Txs[0].TxOut, TxOut{PkScript: append(append([]byte{}, witnessCommitmentHeader...), commitment[:]...)})
+	c.mine(block)
+	return block
+}
+
+func (c *validationTestChain) mine(block *Block) {
+	block.MerkleRootHash, _ = block.MerkleRoot()
+	for block.CheckProofOfWork() != nil {
+		block.Nonce++
+	}
+}
+
+// connect validates block and makes it the new tip if it is valid
+func (c *validationTestChain) connect(block *Block) error {
+	if err := CheckBlock(block, c.params); err != nil {
+		return err
+	}
+	if err := ContextualCheckBlock(block, c.tip, c.params); err != nil {
+		return err
+	}
+	node := &HeaderNode{Header: block.Header, Hash: block.Hash(), Height: c.tip.Height + 1, Parent: c.tip}
+	if _, err := ConnectBlock(block, node, c.utxo, c.params); err != nil {
+		return err
+	}
+	c.tip = node
+	c.blocks = append(c.blocks, block)
+	return nil
+}
+
+func (c *validationTestChain) mustConnect(block *Block) {
+	if err := c.connect(block); err != nil {
+		c.t.Fatalf("Can't connect block at height %d: %v", c.tip.Height+1, err)
+	}
+}
+
+// expectReject checks that block is rejected with reason and doesn't
+// change the UTXO set
+func (c *validationTestChain) expectReject(block *Block, reason string) {
+	c.t.Helper()
+	err := c.connect(block)
+	var rejectErr *RejectError
+	if !errors.As(err, &rejectErr) {
+		c.t.Errorf("Expected %s, got %v", reason, err)
+		return
+	}
+	if !strings.HasPrefix(rejectErr.Reason, reason) || rejectErr.Code != REJECT_INVALID {
+		c.t.Errorf("Expected %s, got %s (0x%02x): %v", reason, rejectErr.Reason, rejectErr.Code, err)
+	}
+	if hash, _ := c.utxo.BestBlock(); hash != c.tip.Hash {
+		c.t.Errorf("Rejected block changed the UTXO set")
+	}
+}
+
+// spendTestTx returns a transaction spending output index of tx to script
+func spendTestTx(tx *Tx, index int, value int64, script []byte) Tx {
+	return Tx{
+		Version: 2,
+		TxIn:    []TxIn{{PreviousOutput: OutPoint{tx.TxID(), uint32(index)}, Sequence: SEQUENCE_FINAL}},
+		TxOut:   []TxOut{{Value: value, PkScript: script}},
+	}
+}
+
+func TestConnectBlock(t *testing.T) {
+	params := &RegTestParams.Consensus
+	c := newValidationTestChain(t, params)
+	for i := 0; i < COINBASE_MATURITY+1; i++ {
+		c.mustConnect(c.newBlock(c.coinbase(50 * COIN)))
+	}
+	first := &c.blocks[1].Txs[0]
+
+	// Coinbases must mature
+	c.expectReject(c.newBlock(c.coinbase(50*COIN), spendTestTx(&c.blocks[3].Txs[0], 0, COIN, []byte{OP_TRUE})), "bad-txns-premature-spend-of-coinbase")
+	// The coinbase may claim the subsidy and the fees
+	spend := spendTestTx(first, 0, 49*COIN, []byte{OP_TRUE})
+	c.expectReject(c.newBlock(c.coinbase(51*COIN+1), spend), "bad-cb-amount")
+	c.expectReject(c.newBlock(c.coinbase(50*COIN), spendTestTx(first, 0, 51*COIN, []byte{OP_TRUE})), "bad-txns-in-belowout")
+	c.expectReject(c.newBlock(c.coinbase(50*COIN), spendTestTx(first, 1, COIN, []byte{OP_TRUE})), "bad-txns-inputs-missingorspent")
+	c.expectReject(c.newBlock(c.coinbase(50*COIN), spend, spend), "bad-txns-inputs-missingorspent")
+
+	// Pay to a P2WPKH output of a key
+	key, _ := PrivateKeyFromBytes(h2b("0000000000000000000000000000000000000000000000000000000000000001"))
+	keyHash := Hash160(key.SerializePubKey())
+	p2wpkh := append([]byte{OP_0, 20}, keyHash[:]...)
+	spend = spendTestTx(first, 0, 49*COIN, p2wpkh)
+	c.mustConnect(c.newBlock(c.coinbase(51*COIN), spend))
+
+	// A valid and an invalid signature
+	signed := spendTestTx(&spend, 0, 48*COIN, []byte{OP_TRUE})
+	scriptCode := append(append([]byte{OP_DUP, OP_HASH160, 20}, keyHash[:]...), OP_EQUALVERIFY, OP_CHECKSIG)
+	hash := SignatureHash(scriptCode, &signed, 0, SIGHASH_ALL, 49*COIN, SigVersionWitnessV0, nil)
+	sig := append(key.Sign(hash[:]).Serialize(), SIGHASH_ALL)
+	signed.TxIn[0].Witness = [][]byte{sig, key.SerializePubKey()}
+	bad := signed
+	bad.TxOut = []TxOut{{Value: 47 * COIN, PkScript: []byte{OP_TRUE}}}
+	c.expectReject(c.newBlock(c.coinbase(50*COIN), bad), "mandatory-script-verify-flag-failed")
+	c.mustConnect(c.newBlock(c.coinbase(50*COIN), signed))
+
+	// The coinbase must start with the height (BIP34)
+	coinbase := c.coinbase(50 * COIN)
+	coinbase.TxIn[0].SignatureScript = []byte{OP_0, OP_0}
+	c.expectReject(c.newBlock(coinbase), "bad-cb-height")
+
+	// Context free checks
+	block := c.newBlock(c.coinbase(50 * COIN))
+	block.Txs = append(block.Txs, c.coinbase(COIN))
+	c.mine(block)
+	c.expectReject(block, "bad-cb-multiple")
+	block = c.newBlock(c.coinbase(50*COIN), signed)
+	block.Txs = block.Txs[1:]
+	c.mine(block)
+	c.expectReject(block, "bad-cb-missing")
+	block = c.newBlock(c.coinbase(50 * COIN))
+	block.MerkleRootHash = Hash{}
+	for block.CheckProofOfWork() != nil {
+		block.Nonce++
+	}
+	c.expectReject(block, "bad-txnmrklroot")
+	// ConnectBlock doesn't rely on the context free checks of the coinbase
+	node := &HeaderNode{Height: c.tip.Height + 1, Parent: c.tip}
+	for _, test := range []struct {
+		txs []Tx
+		err error
+	}{
+		{nil, ErrCoinbaseMissing},
+		{[]Tx{signed}, ErrCoinbaseMissing},
+		{[]Tx{c.coinbase(50 * COIN), c.coinbase(COIN)}, ErrCoinbaseMultiple},
+	} {
+		block := &Block{Header: Header{PrevBlockHash: c.tip.Hash}, Txs: test.txs}
+		if _, err := ConnectBlock(block, node, c.utxo, c.params); !errors.Is(err, test.err) {
+			t.Errorf("Got %v, expected %v", err, test.err)
+		}
+	}
+
+	// Witness data without commitment
+	block = c.newBlock(c.coinbase(50 * COIN))
+	block.Txs[0].TxOut = block.Txs[0].TxOut[:1]
+	c.mine(block)
+	c.expectReject(block, "unexpected-witness")
+
+	// Too many signature operations
+	tx := spendTestTx(&c.blocks[2].Txs[0], 0, 49*COIN, []byte{OP_TRUE})
+	tx.TxOut[0].PkScript = make([]byte, MAX_BLOCK_SIGOPS_COST/WITNESS_SCALE_FACTOR/20+1)
+	for i := range tx.TxOut[0].PkScript {
+		tx.TxOut[0].PkScript[i] = OP_CHECKMULTISIG
+	}
+	c.expectReject(c.newBlock(c.coinbase(50*COIN), tx), "bad-blk-sigops")
+}
+
+func TestConnectBlockBIP30(t *testing.T) {
+	params := RegTestParams.Consensus
+	params.BIP34Height = 1000
+	c := newValidationTestChain(t, &params)
+	c.mustConnect(c.newBlock(c.coinbase(50 * COIN)))
+
+	// The same coinbase again (without BIP34 nothing prevents it)
+	coinbase := c.blocks[1].Txs[0]
+	coinbase.TxOut = coinbase.TxOut[:1]
+	block := c.newBlock(coinbase)
+	if block.Txs[0].TxID() != c.blocks[1].Txs[0].TxID() {
+		t.Fatalf("Coinbase differs")
+	}
+	c.expectReject(block, "bad-txns-BIP30")
+}
+
+func TestCheckSequenceLocks(t *testing.T) {
+	genesis := RegTestParams.GenesisHeader
+	nodes := []*HeaderNode{{Header: genesis, Hash: genesis.Hash()}}
+	for _, header := range mineHeaders(genesis, 20) {
+		parent := nodes[len(nodes)-1]
+		nodes = append(nodes, &HeaderNode{Header: header, Hash: header.Hash(), Height: parent.Height + 1, Parent: parent})
+	}
+	tip := nodes[20]
+	tx := Tx{Version: 2, TxIn: []TxIn{{}}}
+
+	tests := []struct {
+		sequence uint32
+		height   int
+		ok       bool
+	}{
+		{SEQUENCE_FINAL, 20, true},
+		{10, 10, true}, // the output may be spent in the 10th block after it
+		{10, 11, false},
+		{SEQUENCE_LOCKTIME_DISABLE_FLAG | 10, 11, true},
+		// 10 minutes per block, 1200 seconds are 3 units of 512 seconds
+		{SEQUENCE_LOCKTIME_TYPE_FLAG | 3, 10, true},
+		{SEQUENCE_LOCKTIME_TYPE_FLAG | 3, 19, false},
+	}
+	for _, test := range tests {
+		tx.TxIn[0].Sequence = test.sequence
+		if ok := CheckSequenceLocks(&tx, []int{test.height}, tip); ok != test.ok {
+			t.Errorf("Wrong result %v for sequence 0x%x and height %d", ok, test.sequence, test.height)
+		}
+	}
+	tx.Version = 1
+	tx.TxIn[0].Sequence = 10
+	if !CheckSequenceLocks(&tx, []int{20}, tip) {
+		t.Errorf("Sequence locks apply to version 1")
+	}
+}
+
+func TestRejectError(t *testing.T) {
+	err := NewRejectError(ErrTxVinEmpty)
+	if err.Code != REJECT_INVALID || err.Reason != "bad-txns-vin-empty" || !errors.Is(err, ErrTxVinEmpty) {
+		t.Errorf("Wrong reject error %+v", err)
+	}
+	wrapped := NewRejectError(ErrBadVersion)
+	if wrapped.Code != REJECT_OBSOLETE || NewRejectError(wrapped) != wrapped {
+		t.Errorf("Wrong reject error %+v", wrapped)
+	}
+	msg := err.RejectMessage("block", Hash{1})
+	if msg.Message != "block" || msg.CCode != REJECT_INVALID || msg.Reason != "bad-txns-vin-empty" || msg.Data[0] != 1 {
+		t.Errorf("Wrong reject message %+v", msg)
+	}
+
+	// Failed scripts keep the error of the interpreter
+	tx := Tx{Version: 1, TxIn: []TxIn{{Sequence: SEQUENCE_FINAL}}, TxOut: []TxOut{{Value: 1, PkScript: []byte{OP_TRUE}}}}
+	spent := []TxOut{{Value: 1, PkScript: []byte{OP_FALSE}}}
+	check := scriptCheck{tx: &tx, spent: spent[0], txData: NewPrecomputedTxData(&tx, spent)}
+	for _, err := range []error{runScriptChecks([]scriptCheck{check}), checkTxScripts(&tx, spent)} {
+		if !errors.Is(err, ErrScriptVerifyFailed) || !errors.Is(err, ErrEvalFalse) {
+			t.Errorf("Wrong script error %v", err)
+		}
+	}
+}